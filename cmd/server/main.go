@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/jwtly10/go-tunol/internal/auth/token"
 	"github.com/jwtly10/go-tunol/internal/db"
@@ -13,12 +18,19 @@ import (
 	"github.com/jwtly10/go-tunol/internal/web/auth"
 	"github.com/jwtly10/go-tunol/internal/web/dashboard"
 	_ "github.com/jwtly10/go-tunol/internal/web/dashboard"
+	"github.com/jwtly10/go-tunol/internal/web/subdomain"
+	"github.com/jwtly10/go-tunol/internal/web/usage"
 	"github.com/jwtly10/go-tunol/internal/web/user"
 
 	"github.com/jwtly10/go-tunol/internal/config"
 	"github.com/jwtly10/go-tunol/internal/server"
+	"github.com/jwtly10/go-tunol/internal/version"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// shutdownTimeout is how long in flight requests are given to complete when the server is stopped
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 	cfg, err := config.LoadConfig()
 	if err != nil {
@@ -27,6 +39,7 @@ func main() {
 	}
 
 	logger := cfg.Server.Logger
+	logger.Info("Starting tunol server", "version", version.Version, "commit", version.Commit)
 
 	d, err := db.Initialize(cfg.Database)
 	if err != nil {
@@ -39,30 +52,88 @@ func main() {
 	userRepo := user.NewUserRepository(d)
 	sessionService := auth.NewSessionService(d, logger)
 	tokenService := token.NewTokenService(d)
+	subdomainRepo := subdomain.NewSubdomainRepository(d)
+	usageRepo := usage.NewUsageRepository(d)
 
 	// Load templates
 	templates := template.Must(template.ParseGlob("templates/*.html"))
 
 	// Initialize handlers
 	authHandler := auth.NewAuthHandler(d, templates, tokenService, sessionService, userRepo, &cfg.Server, logger)
-	authMiddleware := auth.NewAuthMiddleware(sessionService, userRepo, logger)
-	dashboardHandler := dashboard.NewDashboardHandler(templates, tokenService, logger)
+	authMiddleware := auth.NewAuthMiddleware(sessionService, tokenService, userRepo, logger)
+	dashboardHandler := dashboard.NewDashboardHandler(templates, tokenService, subdomainRepo, usageRepo, logger)
 
 	// Initialize handlers
-	tunnelHandler := server.NewTunnelHandler(tokenService, templates, logger, &cfg.Server)
-	webHandler := server.NewWebHandler(templates, authMiddleware, dashboardHandler, authHandler, logger)
+	tunnelHandler := server.NewTunnelHandler(tokenService, subdomainRepo, usageRepo, templates, logger, &cfg.Server)
+	// Tunnels are shared with other instances through Redis, so requests reach tunnels held by any instance
+	if cfg.Server.RedisURL != "" {
+		registry, err := server.NewRedisRegistry(cfg.Server.RedisURL, cfg.Server.HeartbeatTimeout)
+		if err != nil {
+			log.Fatalf("Failed to connect to redis: %v", err)
+		}
+		tunnelHandler.SetRegistry(registry, cfg.Server.InstanceURL)
+		logger.Info("Sharing tunnels through redis", "instance", cfg.Server.InstanceURL)
+	}
+	webHandler := server.NewWebHandler(templates, authMiddleware, dashboardHandler, authHandler, tunnelHandler, d, logger)
+
+	// Expired sessions and old tokens are deleted in the background, until the server is stopped
+	janitorCtx, stopJanitor := context.WithCancel(context.Background())
+	defer stopJanitor()
+	go server.NewJanitor(sessionService, tokenService, &cfg.Server, logger).Run(janitorCtx)
+
+	tlsConfig, err := server.NewTLSConfig(&cfg.Server, tunnelHandler)
+	if err != nil {
+		log.Fatalf("Failed to configure tls: %v", err)
+	}
+	tunnelHandler.SetTLSConfig(tlsConfig)
 
 	// Initialize server
 	server := server.NewServer(tunnelHandler, webHandler, logger, &cfg.Server)
 
 	// Wrap with middleware
-	loggingHandler := middleware.WithLogging(server, logger)
+	loggingHandler := middleware.WithLogging(server, logger, server.IsTunnelRequest)
+
+	// Metrics are served on their own address, so they aren't exposed publicly with the tunnels
+	if cfg.Server.MetricsAddr != "" {
+		go func() {
+			metricsAddr := cfg.Server.MetricsListenAddr()
+			logger.Info(fmt.Sprintf("Metrics listening on %s", metricsAddr))
+			if err := http.ListenAndServe(metricsAddr, promhttp.Handler()); err != nil {
+				logger.Error("Metrics server error", "error", err)
+			}
+		}()
+	}
 
 	// Start server
-	port := ":" + cfg.Server.Port
-	logger.Info(fmt.Sprintf("Server listening on %s", port))
-	if err := http.ListenAndServe(port, loggingHandler); err != nil {
-		logger.Error("Server error", "error", err)
-		os.Exit(1)
+	addr := cfg.Server.ListenAddr()
+	httpServer := &http.Server{Addr: addr, Handler: loggingHandler, TLSConfig: tlsConfig}
+	go func() {
+		logger.Info(fmt.Sprintf("Server listening on %s", addr), "tls", tlsConfig != nil)
+		var err error
+		if tlsConfig != nil {
+			err = httpServer.ListenAndServeTLS("", "") // The certificates are provided by the tls config
+		} else {
+			err = httpServer.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Server error", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	<-sigChan
+
+	logger.Info("Shutting down server")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Drain the tunnels first, the http server has to keep running to deliver their responses
+	if err := tunnelHandler.Shutdown(ctx); err != nil {
+		logger.Error("Failed to drain tunnels", "error", err)
+	}
+	if err := httpServer.Shutdown(ctx); err != nil {
+		logger.Error("Failed to shutdown server", "error", err)
 	}
 }
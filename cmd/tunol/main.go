@@ -7,6 +7,8 @@ import (
 
 	"github.com/jwtly10/go-tunol/internal/auth/token"
 	"github.com/jwtly10/go-tunol/internal/cli"
+	"github.com/jwtly10/go-tunol/internal/config"
+	"github.com/jwtly10/go-tunol/internal/version"
 )
 
 // This is the main entry point for the CLI client application
@@ -15,10 +17,52 @@ import (
 const maxConcurrentTunnels = 5
 
 func main() {
-	cfg := cli.ParseFlags()
-	logger := cli.SetupLogger()
+	cfg, err := cli.ParseFlags()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if cfg.ShowVersion {
+		fmt.Println("tunol " + version.String())
+		return
+	}
+
+	logger := cli.SetupLogger(cfg)
 	app := cli.NewApp(cfg, logger)
 
+	if cfg.WhoAmI {
+		if err := app.WhoAmI(); err != nil {
+			fmt.Printf("Failed to fetch login details: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cfg.ShowConfig {
+		if err := app.ShowConfig(); err != nil {
+			fmt.Printf("Failed to show config: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cfg.Logout {
+		if err := app.Logout(); err != nil {
+			fmt.Printf("Logout failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cfg.BrowserLogin {
+		if err := app.BrowserLogin(); err != nil {
+			fmt.Printf("Login failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// cfg.Token is only set here if is the user has run the login command
 	if cfg.Token != "" {
 		// If the user has run the login command, we should run the Login flow
@@ -34,6 +78,34 @@ func main() {
 		os.Exit(1)
 	}
 
+	if cfg.Subdomain != "" && len(cfg.Ports) > 1 {
+		fmt.Println("Error: --subdomain can only be used when tunneling a single port")
+		os.Exit(1)
+	}
+
+	if err := validateLocalScheme(cfg.LocalScheme); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if err := validateProtocol(cfg.Protocol); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if err := validateBasicAuth(cfg); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if cfg.Check {
+		if err := app.Check(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	t, err := getAndValidateToken()
 	if err != nil {
 		fmt.Printf("Error: %v", err)
@@ -43,6 +115,11 @@ func main() {
 	// Now we have the token, we should set the app config to use it
 	app.Cfg.Token = t
 
+	// The check runs in the background, so a slow or unreachable server never holds up the tunnels
+	if !cfg.NoUpdateCheck {
+		go app.CheckForUpdate()
+	}
+
 	err = app.Start()
 	if err != nil {
 		fmt.Printf("Error starting tunnels: %v\n", err)
@@ -50,15 +127,52 @@ func main() {
 	}
 
 	waitForShutdown()
+	app.Shutdown()
+	app.Close()
 }
 
 func validatePorts(ports []int) error {
 	if len(ports) == 0 {
-		return fmt.Errorf("Usage:\n  tunol --port <port> [--port <port>...]\n  tunol --login <token>")
+		return fmt.Errorf("Usage:\n  tunol --port <port> [--port <port>...]\n  tunol (with tunnels declared in .tunol.yaml or ~/.tunol/config.yaml)\n  tunol start <name> [<name>...]\n  tunol login\n  tunol config\n  tunol --login <token>\n  tunol --logout\n  tunol --whoami")
 	}
 	if len(ports) > maxConcurrentTunnels {
 		return fmt.Errorf("Error: Maximum of %d ports can be tunneled at once", maxConcurrentTunnels)
 	}
+	// A second tunnel to the same port would only get a different url, and take up a slot
+	seen := make(map[int]bool, len(ports))
+	for _, port := range ports {
+		if seen[port] {
+			return fmt.Errorf("Error: Port %d is tunneled more than once, each port can only have one tunnel", port)
+		}
+		seen[port] = true
+	}
+	return nil
+}
+
+func validateLocalScheme(scheme string) error {
+	if scheme != "http" && scheme != "https" {
+		return fmt.Errorf("Error: Invalid local scheme %q, must be http or https", scheme)
+	}
+	return nil
+}
+
+func validateProtocol(protocol string) error {
+	if protocol != "http" && protocol != "tcp" {
+		return fmt.Errorf("Error: Invalid protocol %q, must be http or tcp", protocol)
+	}
+	return nil
+}
+
+func validateBasicAuth(cfg *config.ClientConfig) error {
+	if cfg.BasicAuth == "" {
+		return nil
+	}
+	if _, _, ok := cfg.BasicAuthCredentials(); !ok {
+		return fmt.Errorf("Error: Invalid basic auth credentials, must be in the form user:pass")
+	}
+	if cfg.Protocol == "tcp" {
+		return fmt.Errorf("Error: --basic-auth can only be used with http tunnels")
+	}
 	return nil
 }
 
@@ -74,7 +188,7 @@ func getAndValidateToken() (string, error) {
 	}
 
 	if token == "" {
-		return "", fmt.Errorf("not logged in. Please run 'tunol --login <token>' first")
+		return "", fmt.Errorf("not logged in. Please run 'tunol login' first")
 	}
 
 	return token, nil
@@ -0,0 +1,10 @@
+CREATE TABLE reserved_subdomains
+(
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id    INTEGER     NOT NULL,
+    subdomain  TEXT UNIQUE NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE INDEX idx_reserved_subdomains_user_id ON reserved_subdomains (user_id);
@@ -0,0 +1,15 @@
+CREATE TABLE tunnel_usage
+(
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id       INTEGER NOT NULL,
+    tunnel_id     TEXT    NOT NULL,
+    day           TEXT    NOT NULL,
+    request_count INTEGER NOT NULL DEFAULT 0,
+    error_count   INTEGER NOT NULL DEFAULT 0,
+    bytes_in      INTEGER NOT NULL DEFAULT 0,
+    bytes_out     INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY (user_id) REFERENCES users (id),
+    UNIQUE (user_id, tunnel_id, day)
+);
+
+CREATE INDEX idx_tunnel_usage_user_day ON tunnel_usage (user_id, day);
@@ -0,0 +1,22 @@
+-- Users can sign in with OAuth providers other than GitHub, so they are identified by the
+-- provider and their id with that provider. SQLite can't drop the NOT NULL on github_id, so
+-- the table is rebuilt, keeping user ids so existing tokens and sessions still resolve
+CREATE TABLE users_new
+(
+    id               INTEGER PRIMARY KEY AUTOINCREMENT,
+    provider         TEXT NOT NULL,
+    provider_user_id TEXT NOT NULL,
+    username         TEXT NOT NULL,
+    avatar_url       TEXT,
+    email            TEXT,
+    created_at       TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_login       TIMESTAMP,
+    UNIQUE (provider, provider_user_id)
+);
+
+INSERT INTO users_new (id, provider, provider_user_id, username, avatar_url, email, created_at, last_login)
+SELECT id, 'github', CAST(github_id AS TEXT), github_username, github_avatar_url, github_email, created_at, last_login
+FROM users;
+
+DROP TABLE users;
+ALTER TABLE users_new RENAME TO users;
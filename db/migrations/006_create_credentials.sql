@@ -0,0 +1,12 @@
+-- Local accounts sign in with an email and password instead of an OAuth provider
+CREATE TABLE credentials
+(
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id       INTEGER UNIQUE NOT NULL,
+    email         TEXT UNIQUE    NOT NULL,
+    password_hash TEXT           NOT NULL,
+    created_at    TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE INDEX idx_credentials_email ON credentials (email);
@@ -0,0 +1,77 @@
+-- The Postgres schema, matching the SQLite migrations in db/migrations up to 006_create_credentials.sql
+-- New migrations need adding to both, as the dialects differ
+CREATE TABLE users
+(
+    id               BIGSERIAL PRIMARY KEY,
+    provider         TEXT NOT NULL,
+    provider_user_id TEXT NOT NULL,
+    username         TEXT NOT NULL,
+    avatar_url       TEXT,
+    email            TEXT,
+    created_at       TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    last_login       TIMESTAMPTZ,
+    UNIQUE (provider, provider_user_id)
+);
+
+CREATE TABLE tokens
+(
+    id          BIGSERIAL PRIMARY KEY,
+    user_id     BIGINT      NOT NULL REFERENCES users (id),
+    token_hash  TEXT UNIQUE NOT NULL,
+    description TEXT,
+    last_used   TIMESTAMPTZ,
+    created_at  TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    expires_at  TIMESTAMPTZ NOT NULL,
+    revoked_at  TIMESTAMPTZ
+);
+
+CREATE INDEX idx_tokens_hash ON tokens (token_hash);
+CREATE INDEX idx_tokens_user ON tokens (user_id);
+
+CREATE TABLE sessions
+(
+    id         BIGSERIAL PRIMARY KEY,
+    user_id    BIGINT      NOT NULL REFERENCES users (id),
+    token      TEXT UNIQUE NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_sessions_token ON sessions (token);
+CREATE INDEX idx_sessions_user_id ON sessions (user_id);
+
+CREATE TABLE reserved_subdomains
+(
+    id         BIGSERIAL PRIMARY KEY,
+    user_id    BIGINT      NOT NULL REFERENCES users (id),
+    subdomain  TEXT UNIQUE NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_reserved_subdomains_user_id ON reserved_subdomains (user_id);
+
+CREATE TABLE tunnel_usage
+(
+    id            BIGSERIAL PRIMARY KEY,
+    user_id       BIGINT NOT NULL REFERENCES users (id),
+    tunnel_id     TEXT   NOT NULL,
+    day           TEXT   NOT NULL,
+    request_count BIGINT NOT NULL DEFAULT 0,
+    error_count   BIGINT NOT NULL DEFAULT 0,
+    bytes_in      BIGINT NOT NULL DEFAULT 0,
+    bytes_out     BIGINT NOT NULL DEFAULT 0,
+    UNIQUE (user_id, tunnel_id, day)
+);
+
+CREATE INDEX idx_tunnel_usage_user_day ON tunnel_usage (user_id, day);
+
+CREATE TABLE credentials
+(
+    id            BIGSERIAL PRIMARY KEY,
+    user_id       BIGINT UNIQUE NOT NULL REFERENCES users (id),
+    email         TEXT UNIQUE   NOT NULL,
+    password_hash TEXT          NOT NULL,
+    created_at    TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_credentials_email ON credentials (email);
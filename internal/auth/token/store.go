@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+
+	"github.com/jwtly10/go-tunol/internal/config"
 )
 
 type Store struct {
@@ -13,21 +15,11 @@ type Store struct {
 // NewTokenStore sets up the internal token store for the CLI
 // It will use TUNOL_CONFIG_DIR if set, otherwise defaults to ~/.tunol/
 func NewTokenStore() (*Store, error) {
-	if configPath := os.Getenv("TUNOL_CONFIG_DIR"); configPath != "" {
-		if err := os.MkdirAll(configPath, 0700); err != nil {
-			return nil, fmt.Errorf("failed to create config directory: %w", err)
-		}
-		return &Store{
-			configPath: filepath.Join(configPath, "token"),
-		}, nil
-	}
-
-	homeDir, err := os.UserHomeDir()
+	configDir, err := config.CLIConfigDir()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get home directory: %w", err)
+		return nil, err
 	}
 
-	configDir := filepath.Join(homeDir, ".tunol")
 	if err := os.MkdirAll(configDir, 0700); err != nil {
 		return nil, fmt.Errorf("failed to create config directory: %w", err)
 	}
@@ -37,6 +29,11 @@ func NewTokenStore() (*Store, error) {
 	}, nil
 }
 
+// Path returns the file the token is stored in
+func (s *Store) Path() string {
+	return s.configPath
+}
+
 func (s *Store) StoreToken(token string) error {
 	return os.WriteFile(s.configPath, []byte(token), 0600)
 }
@@ -51,3 +48,11 @@ func (s *Store) GetToken() (string, error) {
 	}
 	return string(data), nil
 }
+
+// DeleteToken removes the stored token, it is not an error if there is no token stored
+func (s *Store) DeleteToken() error {
+	if err := os.Remove(s.configPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete token file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package token
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenStoreDeleteToken(t *testing.T) {
+	t.Setenv("TUNOL_CONFIG_DIR", t.TempDir())
+
+	store, err := NewTokenStore()
+	require.NoError(t, err)
+
+	require.NoError(t, store.StoreToken("some-token"))
+	stored, err := store.GetToken()
+	require.NoError(t, err)
+	require.Equal(t, "some-token", stored)
+
+	require.NoError(t, store.DeleteToken())
+	stored, err = store.GetToken()
+	require.NoError(t, err)
+	require.Empty(t, stored)
+
+	// Deleting again is a no-op
+	require.NoError(t, store.DeleteToken())
+}
+
+func TestTokenStoreExpandsConfigDir(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	for _, dir := range []string{"~/tunol", "$HOME/tunol", "${HOME}/tunol"} {
+		t.Setenv("TUNOL_CONFIG_DIR", dir)
+
+		store, err := NewTokenStore()
+		require.NoError(t, err)
+		require.Equal(t, filepath.Join(home, "tunol", "token"), store.Path())
+		require.DirExists(t, filepath.Join(home, "tunol"))
+	}
+}
@@ -27,6 +27,9 @@ func (t *Token) IsExpired() bool {
 	return time.Now().After(t.ExpiresAt)
 }
 
+// ErrTokenNotFound is returned when a token does not exist, or belongs to another user
+var ErrTokenNotFound = errors.New("token not found")
+
 type Service struct {
 	db *db.Database
 }
@@ -49,28 +52,44 @@ func (s *Service) CreateToken(userId int64, description string, validity time.Du
 		ExpiresAt:   time.Now().Add(validity),
 	}
 
-	result, err := s.db.Exec(`
+	id, err := s.db.Insert(`
         INSERT INTO tokens (user_id, token_hash, description, created_at, expires_at)
         VALUES (?, ?, ?, ?, ?)
     `, token.UserId, token.Hash, token.Description, token.CreatedAt, token.ExpiresAt)
 	if err != nil {
 		return nil, err
 	}
+	token.ID = id
+
+	return token, nil
+}
 
-	id, err := result.LastInsertId()
+// RevokeToken revokes one of the users tokens, so it can no longer be used. Revoking an already
+// revoked token keeps the original revocation time
+func (s *Service) RevokeToken(id, userID int64) error {
+	result, err := s.db.Exec(`UPDATE tokens SET revoked_at = COALESCE(revoked_at, ?) WHERE id = ? AND user_id = ?`, time.Now(), id, userID)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	token.ID = id
 
-	// If we successfully created a token, we should revoke all other tokens for this user
-	// as the user can only have one at a time
-	_, err = s.db.Exec(`UPDATE tokens SET revoked_at = ? WHERE user_id = ? AND id != ?`, time.Now(), userId, id)
+	affected, err := result.RowsAffected()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if affected == 0 {
+		return ErrTokenNotFound
 	}
 
-	return token, nil
+	return nil
+}
+
+// PurgeRevoked deletes the tokens revoked or expired before the cutoff, returning how many were deleted
+func (s *Service) PurgeRevoked(before time.Time) (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM tokens WHERE revoked_at < ? OR expires_at < ?`, before, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
 }
 
 func (s *Service) ValidateToken(plainToken string) (bool, error) {
@@ -91,6 +110,8 @@ func (s *Service) ValidateToken(plainToken string) (bool, error) {
 		if errors.Is(err, sql.ErrNoRows) {
 			return false, fmt.Errorf("token does not exist")
 		}
+		// The token is zero valued, so it mustn't reach the expiry checks below
+		return false, fmt.Errorf("failed to find token: %w", err)
 	}
 
 	if token.RevokedAt != nil {
@@ -115,6 +136,31 @@ func (s *Service) ValidateToken(plainToken string) (bool, error) {
 	return true, nil
 }
 
+// FindByPlainToken returns the token matching the plain token, or nil if it does not exist
+func (s *Service) FindByPlainToken(plainToken string) (*Token, error) {
+	hash := utils.HashToken(plainToken)
+	var token Token
+	err := s.db.QueryRow(`SELECT
+    id, user_id, token_hash, description, last_used, created_at, expires_at, revoked_at
+	FROM tokens WHERE token_hash = ?`, hash).Scan(
+		&token.ID,
+		&token.UserId,
+		&token.Hash,
+		&token.Description,
+		&token.LastUsed,
+		&token.CreatedAt,
+		&token.ExpiresAt,
+		&token.RevokedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
 func (s *Service) ListUserTokens(userID int64) ([]Token, error) {
 	rows, err := s.db.Query(`
         SELECT id, user_id, token_hash, description, last_used, created_at, expires_at, revoked_at
@@ -18,11 +18,12 @@ func TestTokenGeneration(t *testing.T) {
 
 	// Create test user
 	user := &user.User{
-		ID:              0,
-		GithubID:        12345,
-		GithubUsername:  "testuser",
-		GithubAvatarURL: "https://github.com/avatar.jpg",
-		GithubEmail:     "test@example.com",
+		ID:             0,
+		Provider:       "github",
+		ProviderUserID: "12345",
+		Username:       "testuser",
+		AvatarURL:      "https://github.com/avatar.jpg",
+		Email:          "test@example.com",
 	}
 
 	user, err := userRepo.CreateUser(user)
@@ -56,8 +57,9 @@ func TestListUserTokens(t *testing.T) {
 
 	user := &user.User{
 		ID:             1,
-		GithubID:       12345,
-		GithubUsername: "testuser",
+		Provider:       "github",
+		ProviderUserID: "12345",
+		Username:       "testuser",
 	}
 
 	user, err := userRepo.CreateUser(user)
@@ -82,3 +84,107 @@ func TestListUserTokens(t *testing.T) {
 		require.False(t, to.IsExpired())
 	}
 }
+
+func TestMultipleActiveTokens(t *testing.T) {
+	db, cleanup := testutil.SetupTestDB(t)
+	defer cleanup()
+
+	tokenService := NewTokenService(db)
+	userRepo := user.NewUserRepository(db)
+
+	user, err := userRepo.CreateUser(&user.User{
+		Provider:       "github",
+		ProviderUserID: "12345",
+		Username:       "testuser",
+	})
+	require.NoError(t, err)
+
+	laptop, err := tokenService.CreateToken(user.ID, "Laptop", 24*time.Hour)
+	require.NoError(t, err)
+	ci, err := tokenService.CreateToken(user.ID, "CI", 24*time.Hour)
+	require.NoError(t, err)
+
+	// Creating a token shouldn't revoke the others
+	for _, plain := range []string{laptop.PlainToken, ci.PlainToken} {
+		valid, err := tokenService.ValidateToken(plain)
+		require.NoError(t, err)
+		require.True(t, valid)
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	db, cleanup := testutil.SetupTestDB(t)
+	defer cleanup()
+
+	tokenService := NewTokenService(db)
+	userRepo := user.NewUserRepository(db)
+
+	owner, err := userRepo.CreateUser(&user.User{Provider: "github", ProviderUserID: "1", Username: "owner"})
+	require.NoError(t, err)
+	other, err := userRepo.CreateUser(&user.User{Provider: "github", ProviderUserID: "2", Username: "other"})
+	require.NoError(t, err)
+
+	laptop, err := tokenService.CreateToken(owner.ID, "Laptop", 24*time.Hour)
+	require.NoError(t, err)
+	ci, err := tokenService.CreateToken(owner.ID, "CI", 24*time.Hour)
+	require.NoError(t, err)
+
+	// Other users can't revoke the token
+	require.ErrorIs(t, tokenService.RevokeToken(laptop.ID, other.ID), ErrTokenNotFound)
+	valid, err := tokenService.ValidateToken(laptop.PlainToken)
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	require.NoError(t, tokenService.RevokeToken(laptop.ID, owner.ID))
+	valid, err = tokenService.ValidateToken(laptop.PlainToken)
+	require.Error(t, err)
+	require.False(t, valid)
+
+	// Revoking one token leaves the others usable
+	valid, err = tokenService.ValidateToken(ci.PlainToken)
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// Revoking again is fine, but unknown tokens are not found
+	require.NoError(t, tokenService.RevokeToken(laptop.ID, owner.ID))
+	require.ErrorIs(t, tokenService.RevokeToken(12345, owner.ID), ErrTokenNotFound)
+}
+
+func TestValidateTokenFailures(t *testing.T) {
+	db, cleanup := testutil.SetupTestDB(t)
+	defer cleanup()
+
+	tokenService := NewTokenService(db)
+	userRepo := user.NewUserRepository(db)
+
+	owner, err := userRepo.CreateUser(&user.User{Provider: "github", ProviderUserID: "1", Username: "owner"})
+	require.NoError(t, err)
+
+	t.Run("revoked but unexpired token", func(t *testing.T) {
+		tok, err := tokenService.CreateToken(owner.ID, "Revoked", 24*time.Hour)
+		require.NoError(t, err)
+		require.NoError(t, tokenService.RevokeToken(tok.ID, owner.ID))
+
+		valid, err := tokenService.ValidateToken(tok.PlainToken)
+		require.ErrorContains(t, err, "revoked")
+		require.False(t, valid)
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		valid, err := tokenService.ValidateToken("not-a-real-token")
+		require.ErrorContains(t, err, "does not exist")
+		require.False(t, valid)
+	})
+
+	t.Run("database error", func(t *testing.T) {
+		tok, err := tokenService.CreateToken(owner.ID, "Laptop", 24*time.Hour)
+		require.NoError(t, err)
+
+		// Closing the database makes the lookup fail with something other than no rows
+		require.NoError(t, db.Close())
+
+		valid, err := tokenService.ValidateToken(tok.PlainToken)
+		require.ErrorContains(t, err, "failed to find token")
+		require.False(t, valid)
+	})
+}
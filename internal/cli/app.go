@@ -1,38 +1,108 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/jwtly10/go-tunol/internal/auth/token"
 	"github.com/jwtly10/go-tunol/internal/client"
 	"github.com/jwtly10/go-tunol/internal/config"
+	"github.com/jwtly10/go-tunol/internal/proto"
 )
 
 type App struct {
 	tunnels    map[string]*tunnelState
 	commonLogs []logEntry
+	requestLog *client.RequestLog // Full request/response pairs, for the inspector
 	Cfg        *config.ClientConfig
-	stats      stats
-	mu         sync.Mutex // Protect concurrent access to app state
+	stats      map[int]*stats // Keyed by the local port of the tunnel
+	mu         sync.Mutex     // Protect concurrent access to app state
 
+	out    io.Writer // Where the dashboard or JSON events are written
+	term   *terminal // Raw while the dashboard's keyboard controls are active
+	view   view      // What the dashboard is showing, changed with the keyboard controls
 	logger *slog.Logger
+
+	tokenExpiresAt time.Time            // When the token expires, zero if the server didn't say
+	updateNotice   string               // Set by CheckForUpdate if a newer CLI has been released
+	har            *harRecorder         // Records every request for --har, nil without it
+	manager        client.TunnelManager // Shared by every tunnel, nil until Start
 }
 
+// statsWindow is how far back the dashboard stats cover
+const statsWindow = 60 * time.Second
+
+// stats tracks the requests seen within the stats window
 type stats struct {
-	requestCount    int
-	errorCount      int
-	avgResponseTime int
+	samples []statSample // Oldest first
+}
+
+type statSample struct {
+	at       time.Time
+	duration int // In milliseconds
+	isError  bool
+}
+
+// record adds a request to the stats, evicting any that have fallen out of the window
+func (s *stats) record(at time.Time, duration int, isError bool) {
+	s.samples = append(s.samples, statSample{at: at, duration: duration, isError: isError})
+	s.evict(at)
+}
+
+// evict drops the requests older than the stats window
+func (s *stats) evict(now time.Time) {
+	cutoff := now.Add(-statsWindow)
+	i := 0
+	for i < len(s.samples) && s.samples[i].at.Before(cutoff) {
+		i++
+	}
+	s.samples = s.samples[i:]
+}
+
+// summary returns the request and error counts, and the average response time in milliseconds,
+// of the requests within the window as of now
+func (s *stats) summary(now time.Time) (requests, errors, avgResponseTime int) {
+	return summarise(now, s)
+}
+
+// summarise combines the summaries of several stats, e.g. to total up every tunnel
+func summarise(now time.Time, all ...*stats) (requests, errors, avgResponseTime int) {
+	var total int
+	for _, s := range all {
+		s.evict(now)
+		for _, sample := range s.samples {
+			total += sample.duration
+			if sample.isError {
+				errors++
+			}
+		}
+		requests += len(s.samples)
+	}
+
+	if requests > 0 {
+		avgResponseTime = total / requests
+	}
+	return requests, errors, avgResponseTime
 }
 
 type tunnelState struct {
 	tunnel   client.Tunnel
+	manager  client.TunnelManager
 	isActive bool
 	lastErr  error
 	uptime   time.Time
+
+	rateLimited int // Requests rejected by the servers rate limit, as last reported by the server
+
+	localErr string // Set while the local server isn't reachable, cleared once it responds
 }
 
 type logEntry struct {
@@ -44,6 +114,7 @@ type logEntry struct {
 	duration  int
 	error     string
 	isError   bool
+	requestID int // The id of the full request in the request log
 }
 
 type initError struct {
@@ -52,25 +123,44 @@ type initError struct {
 }
 
 func NewApp(cfg *config.ClientConfig, logger *slog.Logger) *App {
+	var har *harRecorder
+	if cfg.HARFile != "" {
+		har = newHARRecorder(cfg.HARFile)
+	}
 	return &App{
 		tunnels:    make(map[string]*tunnelState),
 		logger:     logger,
 		commonLogs: make([]logEntry, 0),
+		requestLog: client.NewRequestLog(inspectorLogSize),
+		stats:      make(map[int]*stats),
 		Cfg:        cfg,
+		out:        os.Stdout,
+		term:       &terminal{},
+		har:        har,
 	}
 }
 
+// inspectorLogSize is the number of requests kept for the inspector
+const inspectorLogSize = 100
+
 func (a *App) initTunnels() []initError {
 	var errs []initError
 
-	for _, port := range a.Cfg.Ports {
-		// Create client with event handler
-		c := client.NewTunnelManager(a.Cfg, a.logger, func(event client.Event) {
-			a.handleEvent(port, event)
-		})
+	// The tunnels share a manager, so they share a connection to the server if it supports it
+	c := client.NewTunnelManager(a.Cfg, a.logger, func(event client.Event) {
+		a.handleEvent(eventPort(event), event)
+	})
+	a.mu.Lock()
+	a.manager = c
+	a.mu.Unlock()
 
+	retries := startupRetries
+	for _, port := range a.Cfg.Ports {
 		tunnelID := fmt.Sprintf("tunnel_%d", port)
-		t, err := c.NewTunnel(port)
+		t, err := a.newTunnel(c, port, retries)
+		if errors.Is(err, client.ErrServerUnreachable) {
+			retries = 0 // The other tunnels won't reach it either, so don't keep the user waiting
+		}
 		if err != nil {
 			a.logger.Error("Error creating tunnel", "port", port, "error", err)
 			a.mu.Lock()
@@ -85,41 +175,276 @@ func (a *App) initTunnels() []initError {
 			continue
 		}
 
-		// At this point the tunnel should be active
+		// At this point the tunnel should be active. The state may already exist if the tunnel
+		// emitted an event while it was being created, e.g. the local server not being reachable
 		a.mu.Lock()
-		a.tunnels[tunnelID] = &tunnelState{
-			tunnel:   t,
-			isActive: true,
-			lastErr:  nil, // Ensure there no error if we get here
-			uptime:   time.Now(),
-		}
+		state := a.stateFor(port)
+		state.tunnel = t
+		state.manager = c
+		state.isActive = true
+		state.lastErr = nil // Ensure there no error if we get here
+		state.uptime = time.Now()
+		a.announceTunnel(port, t.URL())
 		a.mu.Unlock()
 	}
 
 	return errs
 }
 
+// startupRetries is how many times a tunnel is retried when the server can't be reached at startup,
+// or rejects it with an error it says may go away
+const startupRetries = 3
+
+// startupRetryBackoff is the wait before the first retry at startup, doubling after each
+const startupRetryBackoff = 500 * time.Millisecond
+
+// newTunnel creates the tunnel, retrying up to retries times if the server can't be reached, e.g. it's
+// restarting, or says the error is retryable. Other errors, such as an invalid token, aren't retried
+func (a *App) newTunnel(m client.TunnelManager, port int, retries int) (client.Tunnel, error) {
+	backoff := startupRetryBackoff
+	for attempt := 0; ; attempt++ {
+		t, err := m.NewTunnel(port)
+		unreachable := errors.Is(err, client.ErrServerUnreachable)
+		var serverErr *client.ServerError
+		if !unreachable && !(errors.As(err, &serverErr) && serverErr.Retryable) {
+			return t, err
+		}
+		if attempt >= retries {
+			if unreachable {
+				return nil, fmt.Errorf("%w, check --server or %s is set to a running tunol server", err, serverUrlEnv)
+			}
+			return nil, err
+		}
+
+		a.logger.Warn("Tunnel not created, retrying", "port", port, "attempt", attempt+1, "error", err)
+		if unreachable {
+			fmt.Fprintf(os.Stderr, "Can't reach tunol server at %s, retrying in %s...\n", a.Cfg.ServerURL, backoff)
+		} else {
+			fmt.Fprintf(os.Stderr, "Tunol server rejected the tunnel for port %d (%s), retrying in %s...\n", port, serverErr.Message, backoff)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// errorCode returns the code of the error the server rejected a tunnel with, "" if it wasn't the server
+func errorCode(err error) string {
+	var serverErr *client.ServerError
+	if errors.As(err, &serverErr) {
+		return serverErr.Code
+	}
+	return ""
+}
+
+// errorHint suggests what to do about an error the server sent with the code, "" if there's nothing to add
+func errorHint(code string) string {
+	switch code {
+	case proto.ErrorCodeInvalidToken:
+		return "Your token is no longer valid, run 'tunol login' to log in again"
+	case proto.ErrorCodeTunnelLimitExceeded:
+		return "Close one of your other tunnels, or tunnel fewer ports at once"
+	case proto.ErrorCodeSubdomainTaken:
+		return "Pick another --subdomain, or leave it out to get a random one"
+	case proto.ErrorCodeInvalidSubdomain:
+		return "Pick a different --subdomain, or leave it out to get a random one"
+	case proto.ErrorCodeShuttingDown:
+		return "The server is restarting, try again in a moment"
+	default:
+		return ""
+	}
+}
+
+// eventPort returns the local port of the tunnel an event is for, 0 if it isn't for a tunnel
+func eventPort(event client.Event) int {
+	switch payload := event.Payload.(type) {
+	case client.RequestEvent:
+		return payload.LocalPort
+	case client.ReconnectEvent:
+		return payload.LocalPort
+	case client.ShutdownEvent:
+		return payload.LocalPort
+	case client.TunnelClosedEvent:
+		return payload.LocalPort
+	case client.RateLimitedEvent:
+		return payload.LocalPort
+	case client.LocalUnreachableEvent:
+		return payload.LocalPort
+	default:
+		return 0
+	}
+}
+
+// announceTunnel prints the url of a newly created tunnel on its own line, so scripts can read it
+// before the dashboard takes over the screen. The caller must hold the lock
+func (a *App) announceTunnel(port int, url string) {
+	if a.Cfg.JSONOutput {
+		a.writeJSON(jsonEvent{Type: jsonEventTunnelCreated, Time: time.Now(), Port: port, URL: url})
+		return
+	}
+	fmt.Fprintln(a.out, url)
+}
+
+// stateFor returns the state of the tunnel for the port, creating it if needed. The caller must hold the lock
+func (a *App) stateFor(port int) *tunnelState {
+	tunnelID := fmt.Sprintf("tunnel_%d", port)
+	state, exists := a.tunnels[tunnelID]
+	if !exists {
+		state = &tunnelState{}
+		a.tunnels[tunnelID] = state
+	}
+	return state
+}
+
 func (a *App) Start() error {
-	if err := ValidateTokenOnServer(a.Cfg, a.logger); err != nil {
-		fmt.Printf("Error: Token is no longer valid. Please run 'tunol --login <token>' again. (Reason: %v)\n", err)
+	status, err := ValidateTokenOnServer(a.Cfg, a.logger)
+	if err != nil {
+		fmt.Printf("Error: Token is no longer valid. Please run 'tunol login' again. (Reason: %v)\n", err)
 		os.Exit(1)
 	}
+	a.tokenExpiresAt = status.ExpiresAt
+
+	if a.Cfg.InspectPort != 0 {
+		if err := a.startInspector(); err != nil {
+			fmt.Printf("Error starting inspector on port %d: %v\n", a.Cfg.InspectPort, err)
+			os.Exit(1)
+		}
+	}
+
+	// The empty file is written up front, so a path that can't be written fails now rather than on exit
+	if a.har != nil {
+		if _, err := a.har.save(); err != nil {
+			fmt.Printf("Error creating HAR file: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
 	if errs := a.initTunnels(); len(errs) != 0 {
+		if a.Cfg.JSONOutput {
+			a.mu.Lock()
+			for _, err := range errs {
+				a.writeJSON(jsonEvent{Type: string(client.EventTypeError), Time: time.Now(), Port: err.port, Error: err.err.Error(), Code: errorCode(err.err)})
+			}
+			a.mu.Unlock()
+			os.Exit(1)
+		}
+
 		fmt.Println("Error initializing tunnels:")
 		for _, err := range errs {
-			fmt.Printf("  Port %d: %v\n", err.port, err.err)
+			if name := a.Cfg.TunnelName(err.port); name != "" {
+				fmt.Printf("  Port %d (%s): %v\n", err.port, name, err.err)
+			} else {
+				fmt.Printf("  Port %d: %v\n", err.port, err.err)
+			}
+			if hint := errorHint(errorCode(err.err)); hint != "" {
+				fmt.Printf("    %s\n", hint)
+			}
 		}
 		os.Exit(1)
 	}
 
-	go a.startUI()
+	// The dashboard redraws the whole screen, so it's replaced by the JSON events or inspected requests (written as they happen)
+	if !a.Cfg.JSONOutput && !a.Cfg.PrintURLOnly && a.Cfg.Inspect == "" {
+		a.startKeyboard()
+		go a.startUI()
+	} else if warning := expiryWarning(a.tokenExpiresAt, time.Now()); warning != "" {
+		// Stdout is for the JSON events, url or requests, the dashboard shows the warning itself
+		fmt.Fprintln(os.Stderr, "Warning: "+warning)
+	}
 	return nil
 }
 
+// Shutdown closes every tunnel, telling the server so it removes them straight away rather than waiting
+// to notice the disconnect
+func (a *App) Shutdown() {
+	a.mu.Lock()
+	manager := a.manager
+	a.mu.Unlock()
+
+	if manager == nil {
+		return
+	}
+	if err := manager.Close(); err != nil {
+		a.logger.Warn("Failed to close tunnels", "error", err)
+	}
+}
+
+// Close restores the terminal if the dashboard changed it, and writes the HAR file if there is one. It must
+// be called before the CLI exits
+func (a *App) Close() {
+	a.term.restore()
+	a.saveHAR()
+}
+
+// saveHAR writes the requests recorded for --har to the HAR file
+func (a *App) saveHAR() {
+	if a.har == nil {
+		return
+	}
+	n, err := a.har.save()
+	if err != nil {
+		a.logger.Error("Failed to write HAR file", "path", a.Cfg.HARFile, "error", err)
+		fmt.Fprintf(os.Stderr, "Failed to write HAR file %s: %v\n", a.Cfg.HARFile, err)
+		return
+	}
+	a.logger.Info("Wrote HAR file", "path", a.Cfg.HARFile, "requests", n)
+}
+
+// exit closes the app and exits with the code, for when it can't carry on
+func (a *App) exit(code int) {
+	a.Close()
+	os.Exit(code)
+}
+
+// startInspector serves the request inspector on the configured address and port
+func (a *App) startInspector() error {
+	ln, err := net.Listen("tcp", a.inspectorAddr())
+	if err != nil {
+		return err
+	}
+
+	inspector := client.NewInspector(a.requestLog, a, a.logger)
+	go func() {
+		if err := http.Serve(ln, inspector); err != nil {
+			a.logger.Error("Inspector stopped", "error", err)
+		}
+	}()
+
+	a.logger.Info("Inspector started", "addr", a.inspectorAddr())
+
+	// The inspector shows every request and can replay them, so make sure exposing it was meant
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() {
+		fmt.Fprintf(os.Stderr, "Warning: the inspector is reachable from other machines on %s\n", ln.Addr())
+	}
+	return nil
+}
+
+// Replay re-sends a request captured by the inspector through the tunnel manager for its port
+func (a *App) Replay(localPort int, req proto.HTTPRequest) (*proto.HTTPResponse, error) {
+	// The manager emits an event for the replay, which locks the app state, so we
+	// can't hold the lock while replaying
+	a.mu.Lock()
+	state, exists := a.tunnels[fmt.Sprintf("tunnel_%d", localPort)]
+	a.mu.Unlock()
+
+	if !exists || state.manager == nil {
+		return nil, fmt.Errorf("no active tunnel for port %d", localPort)
+	}
+
+	return state.manager.Replay(localPort, req)
+}
+
+func (a *App) inspectorAddr() string {
+	host := a.Cfg.InspectHost
+	if host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(a.Cfg.InspectPort))
+}
+
 // Login logs the user in with the current application configuration
 func (a *App) Login() error {
-	if err := ValidateTokenOnServer(a.Cfg, a.logger); err != nil {
+	status, err := ValidateTokenOnServer(a.Cfg, a.logger)
+	if err != nil {
 		return fmt.Errorf("failed to validate token: %w", err)
 	}
 
@@ -134,5 +459,122 @@ func (a *App) Login() error {
 
 	a.logger.Info("Login successful")
 	fmt.Println("Login successful. You can now tunnel ports with 'tunol [--port <port>]'")
+	if !status.ExpiresAt.IsZero() {
+		fmt.Printf("Your token expires on %s\n", status.ExpiresAt.Local().Format("2 Jan 2006"))
+	}
+	return nil
+}
+
+// Logout removes the stored token, so the CLI can't be used on this machine until logging in again
+func (a *App) Logout() error {
+	store, err := token.NewTokenStore()
+	if err != nil {
+		return fmt.Errorf("failed to create token store: %w", err)
+	}
+
+	t, err := store.GetToken()
+	if err != nil {
+		return err
+	}
+	if t == "" {
+		fmt.Println("You are not logged in")
+		return nil
+	}
+
+	if err := store.DeleteToken(); err != nil {
+		return fmt.Errorf("failed to delete token: %w", err)
+	}
+
+	a.logger.Info("Logout successful")
+	fmt.Println("Logout successful. The stored token has been removed from this machine")
+	return nil
+}
+
+// ShowConfig prints where the CLI keeps its files and which server it uses, so users can find them.
+// The token itself is never printed
+func (a *App) ShowConfig() error {
+	configDir, err := config.CLIConfigDir()
+	if err != nil {
+		return err
+	}
+
+	store, err := token.NewTokenStore()
+	if err != nil {
+		return fmt.Errorf("failed to create token store: %w", err)
+	}
+	t, err := store.GetToken()
+	if err != nil {
+		return err
+	}
+
+	logFile, err := LogFilePath()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Config dir:  %s\n", configDir)
+	fmt.Printf("Server:      %s\n", a.Cfg.ServerURL)
+	if a.Cfg.ConfigFile != "" {
+		fmt.Printf("Config file: %s\n", a.Cfg.ConfigFile)
+	} else {
+		fmt.Println("Config file: none")
+	}
+	if t != "" {
+		fmt.Printf("Token:       stored in %s\n", store.Path())
+	} else {
+		fmt.Println("Token:       none, run 'tunol login' to log in")
+	}
+	fmt.Printf("Log file:    %s (%s)\n", logFile, fileSize(logFile))
+	return nil
+}
+
+// fileSize describes the size of the file at path, for ShowConfig
+func fileSize(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "not created yet"
+	}
+
+	switch n := info.Size(); {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%dB", n)
+	}
+}
+
+// WhoAmI prints who the stored token belongs to, and the server it's used with
+func (a *App) WhoAmI() error {
+	store, err := token.NewTokenStore()
+	if err != nil {
+		return fmt.Errorf("failed to create token store: %w", err)
+	}
+
+	t, err := store.GetToken()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Server:      %s\n", a.Cfg.ServerURL)
+	if t == "" {
+		fmt.Println("You are not logged in. Run 'tunol login' to log in")
+		return nil
+	}
+
+	a.Cfg.Token = t
+	profile, err := FetchProfile(a.Cfg, a.logger)
+	if err != nil {
+		return err
+	}
+
+	username := profile.Username
+	if username == "" { // Older servers only return the GitHub username
+		username = profile.GithubUsername
+	}
+	fmt.Printf("User:        %s\n", username)
+	fmt.Printf("Token:       %s\n", profile.TokenDescription)
+	fmt.Printf("Expires:     %s\n", profile.TokenExpiresAt.Local().Format(time.RFC1123))
 	return nil
 }
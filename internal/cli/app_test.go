@@ -0,0 +1,227 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/client"
+	"github.com/jwtly10/go-tunol/internal/config"
+	"github.com/jwtly10/go-tunol/internal/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsSummary(t *testing.T) {
+	var s stats
+	now := time.Now()
+
+	requests, errors, avg := s.summary(now)
+	require.Zero(t, requests)
+	require.Zero(t, errors)
+	require.Zero(t, avg)
+
+	s.record(now.Add(-2*time.Second), 100, false)
+	s.record(now.Add(-time.Second), 200, true)
+	s.record(now, 300, false)
+
+	requests, errors, avg = s.summary(now)
+	require.Equal(t, 3, requests)
+	require.Equal(t, 1, errors)
+	require.Equal(t, 200, avg, "Expected the average of all requests in the window")
+}
+
+func TestStatsWindow(t *testing.T) {
+	var s stats
+	now := time.Now()
+
+	s.record(now.Add(-2*statsWindow), 1000, true)
+	s.record(now.Add(-statsWindow-time.Second), 1000, false)
+	s.record(now.Add(-statsWindow/2), 100, false)
+
+	requests, errors, avg := s.summary(now)
+	require.Equal(t, 1, requests, "Expected requests older than the window to be evicted")
+	require.Zero(t, errors)
+	require.Equal(t, 100, avg)
+
+	// Once the window moves past every request, the stats are empty
+	requests, _, avg = s.summary(now.Add(statsWindow))
+	require.Zero(t, requests)
+	require.Zero(t, avg)
+}
+
+func TestSummariseAcrossTunnels(t *testing.T) {
+	now := time.Now()
+	web, api := &stats{}, &stats{}
+
+	web.record(now, 100, false)
+	web.record(now, 100, false)
+	api.record(now, 400, true)
+
+	requests, errors, avg := summarise(now, web, api)
+	require.Equal(t, 3, requests)
+	require.Equal(t, 1, errors)
+	require.Equal(t, 200, avg, "Expected the average to be weighted by each tunnels request count")
+
+	requests, errors, avg = api.summary(now)
+	require.Equal(t, 1, requests)
+	require.Equal(t, 1, errors)
+	require.Equal(t, 400, avg)
+}
+
+func TestFormatTimeLeft(t *testing.T) {
+	tests := []struct {
+		left time.Duration
+		want string
+	}{
+		{2 * time.Hour, "2h0m"},
+		{90*time.Minute + 20*time.Second, "1h30m"},
+		{4*time.Minute + 40*time.Second, "5m"},
+		{42*time.Second + 300*time.Millisecond, "42s"},
+		{-time.Second, "0s"},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.want, formatTimeLeft(tt.left), "formatTimeLeft(%s)", tt.left)
+	}
+}
+
+func TestFormatLimits(t *testing.T) {
+	tests := []struct {
+		limits proto.Limits
+		want   string
+	}{
+		{proto.Limits{}, ""},
+		{proto.Limits{MaxTunnels: 3}, "3 tunnels max"},
+		{proto.Limits{MaxBodyBytes: 10 << 20, TunnelIdleTimeoutMs: 600000}, "10MB max body • closed after 10m0s idle"},
+		{proto.Limits{MaxBodyBytes: 1500, TunnelMaxLifetimeMs: 7200000}, "1500B max body • 2h0m0s max lifetime"},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.want, formatLimits(tt.limits), "formatLimits(%+v)", tt.limits)
+	}
+}
+
+func TestInspectorAddr(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "", want: "localhost:4040"},
+		{host: "127.0.0.1", want: "127.0.0.1:4040"},
+		{host: "0.0.0.0", want: "0.0.0.0:4040"},
+		{host: "::1", want: "[::1]:4040"},
+	}
+
+	for _, tt := range tests {
+		a := &App{Cfg: &config.ClientConfig{InspectPort: 4040, InspectHost: tt.host}}
+		require.Equal(t, tt.want, a.inspectorAddr())
+	}
+}
+
+// unreachableManager fails to create tunnels as if the server were down, until it has failed enough times
+type unreachableManager struct {
+	client.TunnelManager
+	failures int
+	err      error // Returned once the failures are used up, nil to succeed
+	attempts int
+}
+
+func (m *unreachableManager) NewTunnel(localPort int) (client.Tunnel, error) {
+	m.attempts++
+	if m.attempts <= m.failures {
+		return nil, fmt.Errorf("%w at http://localhost:1: connection refused", client.ErrServerUnreachable)
+	}
+	return nil, m.err
+}
+
+func TestNewTunnelRetriesUnreachableServer(t *testing.T) {
+	a := NewApp(&config.ClientConfig{ServerURL: "http://localhost:1"}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	// The server coming back within the retries creates the tunnel
+	m := &unreachableManager{failures: 1}
+	_, err := a.newTunnel(m, 3000, startupRetries)
+	require.NoError(t, err)
+	require.Equal(t, 2, m.attempts)
+
+	// Other errors are returned straight away
+	rejected := errors.New("subdomain is already in use")
+	m = &unreachableManager{err: rejected}
+	_, err = a.newTunnel(m, 3000, startupRetries)
+	require.ErrorIs(t, err, rejected)
+	require.Equal(t, 1, m.attempts)
+
+	// Errors the server says are retryable are retried too, and returned as is once out of retries
+	retryable := &client.ServerError{Code: proto.ErrorCodeShuttingDown, Message: "server is shutting down", Retryable: true}
+	m = &unreachableManager{err: retryable}
+	_, err = a.newTunnel(m, 3000, 1)
+	require.ErrorIs(t, err, retryable)
+	require.Equal(t, 2, m.attempts)
+
+	fatal := &client.ServerError{Code: proto.ErrorCodeInvalidToken, Message: "invalid token"}
+	m = &unreachableManager{err: fatal}
+	_, err = a.newTunnel(m, 3000, startupRetries)
+	require.ErrorIs(t, err, fatal)
+	require.Equal(t, 1, m.attempts)
+
+	// Once out of retries the error says where to look
+	m = &unreachableManager{failures: 1}
+	_, err = a.newTunnel(m, 3000, 0)
+	require.ErrorIs(t, err, client.ErrServerUnreachable)
+	require.Contains(t, err.Error(), "TUNOL_SERVER_URL")
+	require.Equal(t, 1, m.attempts)
+}
+
+func TestMatchesPath(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		path     string
+		want     bool
+	}{
+		{[]string{"/api/*"}, "/api/users", true},
+		{[]string{"/api/*"}, "/api/users/1?expand=true", true},
+		{[]string{"/api/*"}, "/api", false},
+		{[]string{"/api/*"}, "/apis/users", false},
+		{[]string{"/health"}, "/health", true},
+		{[]string{"/health"}, "/health/live", true},
+		{[]string{"/health"}, "/healthz", false},
+		{[]string{"*.css", "/static/*.js"}, "/static/app.js", true},
+		{[]string{"/static/*.js"}, "/static/app.css", false},
+		{nil, "/anything", false},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.want, matchesPath(tt.patterns, tt.path), "matchesPath(%v, %q)", tt.patterns, tt.path)
+	}
+}
+
+func TestFilterPaths(t *testing.T) {
+	cfg := &config.ClientConfig{FilterPaths: []string{"/api/*"}, ExcludePaths: []string{"/api/health"}}
+	app := NewApp(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	app.stateFor(3000).localErr = "local server on port 3000 not reachable"
+	request := func(p string) {
+		app.handleEvent(3000, client.Event{Type: client.EventTypeRequest, Payload: client.RequestEvent{
+			Method:    "GET",
+			Path:      p,
+			Status:    200,
+			Timestamp: time.Now(),
+			LocalPort: 3000,
+		}})
+	}
+
+	request("/favicon.ico")
+	require.Empty(t, app.commonLogs)
+	require.Empty(t, app.stateFor(3000).localErr, "Expected a filtered request to still show the local server is reachable")
+
+	for _, p := range []string{"/api/users", "/api/health", "/api/orders?page=2"} {
+		request(p)
+	}
+
+	require.Len(t, app.commonLogs, 2)
+	require.Equal(t, "/api/users", app.commonLogs[0].path)
+	require.Equal(t, "/api/orders?page=2", app.commonLogs[1].path)
+	requests, _, _ := app.stats[3000].summary(time.Now())
+	require.Equal(t, 2, requests, "Expected filtered requests to be left out of the stats")
+}
@@ -1,36 +1,100 @@
 package cli
 
 import (
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/jwtly10/go-tunol/internal/config"
+	"github.com/jwtly10/go-tunol/internal/web/auth"
 )
 
-func ValidateTokenOnServer(cfg *config.ClientConfig, logger *slog.Logger) error {
+// ValidateTokenOnServer checks the configured token with the server, returning when it expires
+func ValidateTokenOnServer(cfg *config.ClientConfig, logger *slog.Logger) (*auth.TokenStatus, error) {
 	// Validate token format (should be two UUIDs joined with a hyphen)
 	// Expected format: UUID-UUID (where each UUID is 36 chars)
 	if len(cfg.Token) != 73 { // 36 + 1 + 36
-		return fmt.Errorf("invalid token format: incorrect length")
+		return nil, fmt.Errorf("invalid token format: incorrect length")
 	}
 
 	c := &http.Client{}
 	req, err := http.NewRequest("GET", cfg.ServerURL+"/auth/validate", nil)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 	req.Header.Set("Authorization", "Bearer "+cfg.Token)
 
 	resp, err := c.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to validate token: %w", err)
+		return nil, fmt.Errorf("failed to validate token: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("invalid token")
+		return nil, fmt.Errorf("invalid token")
 	}
 
-	return nil
+	// Older servers don't return a body, in which case the expiry is left unknown
+	status := &auth.TokenStatus{Valid: true}
+	if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+		logger.Debug("Server did not return token expiry", "error", err)
+	}
+
+	return status, nil
+}
+
+// tokenExpiryWarning is how close to expiring a token has to be before the CLI warns about it
+const tokenExpiryWarning = 7 * 24 * time.Hour
+
+// expiryWarning returns a warning if the token expires soon, or "" if it doesn't (or the expiry is unknown)
+func expiryWarning(expiresAt, now time.Time) string {
+	if expiresAt.IsZero() {
+		return ""
+	}
+
+	left := expiresAt.Sub(now)
+	if left > tokenExpiryWarning {
+		return ""
+	}
+
+	var in string
+	switch days, hours := int(left.Hours()/24), int(left.Hours()); {
+	case days > 1:
+		in = fmt.Sprintf("in %d days", days)
+	case hours > 1:
+		in = fmt.Sprintf("in %d hours", hours)
+	default:
+		in = "within the hour"
+	}
+	return fmt.Sprintf("Your token expires %s, run 'tunol login' to renew it", in)
+}
+
+// FetchProfile asks the server who owns the configured token
+func FetchProfile(cfg *config.ClientConfig, logger *slog.Logger) (*auth.Profile, error) {
+	c := &http.Client{}
+	req, err := http.NewRequest("GET", cfg.ServerURL+"/auth/whoami", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.Token)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		logger.Debug("whoami request failed", "status", resp.StatusCode)
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	var profile auth.Profile
+	if err := json.NewDecoder(resp.Body).Decode(&profile); err != nil {
+		return nil, fmt.Errorf("failed to decode profile: %w", err)
+	}
+
+	return &profile, nil
 }
@@ -0,0 +1,60 @@
+package cli
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/config"
+	"github.com/jwtly10/go-tunol/internal/web/auth"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateTokenOnServer(t *testing.T) {
+	expiresAt := time.Now().Add(72 * time.Hour).Truncate(time.Second)
+	plainToken := strings.Repeat("a", 36) + "-" + strings.Repeat("b", 36)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer " + plainToken:
+			json.NewEncoder(w).Encode(auth.TokenStatus{Valid: true, ExpiresAt: expiresAt})
+		default:
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := &config.ClientConfig{ServerURL: srv.URL, Token: plainToken}
+	status, err := ValidateTokenOnServer(cfg, slog.Default())
+	require.NoError(t, err)
+	require.True(t, status.ExpiresAt.Equal(expiresAt))
+
+	cfg.Token = strings.Repeat("c", 73)
+	_, err = ValidateTokenOnServer(cfg, slog.Default())
+	require.Error(t, err)
+}
+
+func TestValidateTokenOnOlderServer(t *testing.T) {
+	// Older servers respond to a valid token with an empty 200
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	cfg := &config.ClientConfig{ServerURL: srv.URL, Token: strings.Repeat("a", 73)}
+	status, err := ValidateTokenOnServer(cfg, slog.Default())
+	require.NoError(t, err)
+	require.True(t, status.ExpiresAt.IsZero(), "Expected the expiry to be unknown")
+}
+
+func TestExpiryWarning(t *testing.T) {
+	now := time.Now()
+
+	require.Empty(t, expiryWarning(time.Time{}, now), "Expected no warning when the expiry is unknown")
+	require.Empty(t, expiryWarning(now.Add(30*24*time.Hour), now))
+	require.Equal(t, "Your token expires in 3 days, run 'tunol login' to renew it", expiryWarning(now.Add(3*24*time.Hour+time.Minute), now))
+	require.Equal(t, "Your token expires in 5 hours, run 'tunol login' to renew it", expiryWarning(now.Add(5*time.Hour+time.Minute), now))
+	require.Equal(t, "Your token expires within the hour, run 'tunol login' to renew it", expiryWarning(now.Add(10*time.Minute), now))
+}
@@ -0,0 +1,112 @@
+package cli
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/auth/token"
+)
+
+// checkTimeout is how long `tunol --check` waits on the server, or a local port, before failing the check
+const checkTimeout = 5 * time.Second
+
+// checkResult is one line of the `tunol --check` checklist
+type checkResult struct {
+	name string
+	err  error // Nil if the check passed
+}
+
+// Check validates everything needed to start the tunnels without opening any, printing a checklist.
+// An error is returned if any check failed
+func (a *App) Check() error {
+	store, err := token.NewTokenStore()
+	if err != nil {
+		return fmt.Errorf("failed to create token store: %w", err)
+	}
+	t, err := store.GetToken()
+	if err != nil {
+		return err
+	}
+	a.Cfg.Token = t
+
+	results := a.runChecks()
+	failed := 0
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+			fmt.Printf("❌ %s: %v\n", r.name, r.err)
+			continue
+		}
+		fmt.Printf("✅ %s\n", r.name)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(results))
+	}
+	fmt.Println("Everything looks good, start the tunnels with the same flags without --check")
+	return nil
+}
+
+// runChecks checks the config, the server, the token and each local port in turn
+func (a *App) runChecks() []checkResult {
+	var results []checkResult
+
+	// The flags and config file have been parsed and validated by the time the checks run
+	configCheck := checkResult{name: "Config is valid"}
+	if a.Cfg.ConfigFile != "" {
+		configCheck.name = "Config file " + a.Cfg.ConfigFile + " is valid"
+	}
+	results = append(results, configCheck)
+
+	results = append(results, checkResult{
+		name: "Server " + a.Cfg.ServerURL + " is reachable",
+		err:  checkServer(a.Cfg.ServerURL),
+	})
+
+	tokenCheck := checkResult{name: "Token is valid"}
+	if a.Cfg.Token == "" {
+		tokenCheck.err = fmt.Errorf("not logged in, run 'tunol login' first")
+	} else if status, err := ValidateTokenOnServer(a.Cfg, a.logger); err != nil {
+		tokenCheck.err = err
+	} else if warning := expiryWarning(status.ExpiresAt, time.Now()); warning != "" {
+		tokenCheck.name += " (" + warning + ")"
+	}
+	results = append(results, tokenCheck)
+
+	for _, port := range a.Cfg.Ports {
+		addr := a.Cfg.ForTunnel(port).LocalAddr(port)
+		name := fmt.Sprintf("Local port %d is listening on %s", port, addr)
+		if n := a.Cfg.TunnelName(port); n != "" {
+			name = fmt.Sprintf("Local port %d (%s) is listening on %s", port, n, addr)
+		}
+		results = append(results, checkResult{name: name, err: checkLocalPort(addr)})
+	}
+
+	return results
+}
+
+// checkServer checks the server answers its health check
+func checkServer(serverURL string) error {
+	c := &http.Client{Timeout: checkTimeout}
+	resp, err := c.Get(serverURL + "/health")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+	return nil
+}
+
+// checkLocalPort checks something is listening on the local address
+func checkLocalPort(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, checkTimeout)
+	if err != nil {
+		return fmt.Errorf("nothing is listening, is the local server running?")
+	}
+	return conn.Close()
+}
@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jwtly10/go-tunol/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunChecks(t *testing.T) {
+	plainToken := strings.Repeat("a", 36) + "-" + strings.Repeat("b", 36)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/auth/validate" && r.Header.Get("Authorization") != "Bearer "+plainToken {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+
+	listening, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listening.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	cfg := &config.ClientConfig{
+		ServerURL: srv.URL,
+		Token:     plainToken,
+		LocalHost: "127.0.0.1",
+		Ports:     []int{listening.Addr().(*net.TCPAddr).Port, closedPort},
+	}
+	a := NewApp(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	failed := func(results []checkResult) []string {
+		var names []string
+		for _, r := range results {
+			if r.err != nil {
+				names = append(names, r.name)
+			}
+		}
+		return names
+	}
+
+	results := a.runChecks()
+	require.Len(t, results, 5)
+	require.Len(t, failed(results), 1)
+	require.Contains(t, failed(results)[0], "Local port")
+
+	cfg.Token = ""
+	require.Len(t, failed(a.runChecks()), 2)
+
+	cfg.Token = plainToken
+	cfg.ServerURL = "http://" + closed.Addr().String()
+	require.Len(t, failed(a.runChecks()), 3, "Expected the server and token checks to fail without a server")
+}
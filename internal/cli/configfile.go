@@ -0,0 +1,87 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/jwtly10/go-tunol/internal/config"
+	"gopkg.in/yaml.v3"
+)
+
+// localConfigFile is looked for in the working directory, before the config file in the config dir
+const localConfigFile = ".tunol.yaml"
+
+// fileConfig is the optional CLI config file, for declaring a repeatable set of tunnels
+//
+//	server: https://tunol.dev
+//	tunnels:
+//	  - name: web
+//	    port: 3000
+//	    subdomain: myapp
+//	    headers:
+//	      X-Api-Key: secret
+type fileConfig struct {
+	Server  string                `yaml:"server"`
+	Tunnels []config.TunnelConfig `yaml:"tunnels"`
+}
+
+// findConfigFile returns the path of the config file to use, or an empty path if there is none.
+// A .tunol.yaml in the working directory is used first, then config.yaml in the config dir, which
+// is TUNOL_CONFIG_DIR if set, otherwise ~/.tunol/
+func findConfigFile() (string, error) {
+	candidates := []string{localConfigFile}
+
+	if configDir, err := config.CLIConfigDir(); err == nil {
+		candidates = append(candidates, filepath.Join(configDir, "config.yaml"))
+	}
+
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("failed to check config file %s: %w", path, err)
+		}
+	}
+
+	return "", nil
+}
+
+// loadConfigFile reads and validates the config file at path
+func loadConfigFile(path string) (*fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var cfg fileConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true) // Catch typos rather than silently ignoring them
+	if err := decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	ports := make(map[int]bool)
+	names := make(map[string]bool)
+	for i, t := range cfg.Tunnels {
+		if t.Port < 1 || t.Port > 65535 {
+			return nil, fmt.Errorf("invalid config file %s: tunnel %d has invalid port %d", path, i+1, t.Port)
+		}
+		if ports[t.Port] {
+			return nil, fmt.Errorf("invalid config file %s: port %d is declared more than once", path, t.Port)
+		}
+		ports[t.Port] = true
+
+		if t.Name != "" {
+			if names[t.Name] {
+				return nil, fmt.Errorf("invalid config file %s: tunnel name %q is declared more than once", path, t.Name)
+			}
+			names[t.Name] = true
+		}
+	}
+
+	return &cfg, nil
+}
@@ -0,0 +1,171 @@
+package cli
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jwtly10/go-tunol/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfigFile(t, `
+server: https://tunol.example.com
+tunnels:
+  - name: web
+    port: 3000
+    subdomain: myapp
+  - name: api
+    port: 8080
+    local_host: 127.0.0.1
+    headers:
+      X-Api-Key: secret
+`)
+
+	cfg, err := loadConfigFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "https://tunol.example.com", cfg.Server)
+	require.Equal(t, []config.TunnelConfig{
+		{Name: "web", Port: 3000, Subdomain: "myapp"},
+		{Name: "api", Port: 8080, LocalHost: "127.0.0.1", Headers: map[string]string{"X-Api-Key": "secret"}},
+	}, cfg.Tunnels)
+}
+
+func TestLoadConfigFileInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{
+			name:    "test unknown field",
+			content: "tunnels:\n  - port: 3000\n    subdomian: typo\n",
+		},
+		{
+			name:    "test missing port",
+			content: "tunnels:\n  - name: web\n",
+		},
+		{
+			name:    "test duplicate port",
+			content: "tunnels:\n  - port: 3000\n  - port: 3000\n",
+		},
+		{
+			name:    "test duplicate name",
+			content: "tunnels:\n  - name: web\n    port: 3000\n  - name: web\n    port: 3001\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfigFile(writeConfigFile(t, tt.content))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestLoadConfigFileEmpty(t *testing.T) {
+	cfg, err := loadConfigFile(writeConfigFile(t, ""))
+	require.NoError(t, err)
+	require.Empty(t, cfg.Tunnels)
+}
+
+func TestResolveServerUrl(t *testing.T) {
+	t.Setenv(serverUrlEnv, "")
+	require.Equal(t, "https://flag.example.com", resolveServerUrl("https://flag.example.com", "https://file.example.com"))
+	require.Equal(t, "https://file.example.com", resolveServerUrl("", "https://file.example.com"))
+	require.Equal(t, defaultServerUrl, resolveServerUrl("", ""))
+
+	t.Setenv(serverUrlEnv, "https://env.example.com")
+	require.Equal(t, "https://env.example.com", resolveServerUrl("", "https://file.example.com"))
+}
+
+func TestResolveLogLevel(t *testing.T) {
+	t.Setenv(logLevelEnv, "")
+	level, err := resolveLogLevel("")
+	require.NoError(t, err)
+	require.Equal(t, slog.LevelInfo, level, "should default to info, not debug")
+
+	level, err = resolveLogLevel("warn")
+	require.NoError(t, err)
+	require.Equal(t, slog.LevelWarn, level)
+
+	t.Setenv(logLevelEnv, "DEBUG")
+	level, err = resolveLogLevel("")
+	require.NoError(t, err)
+	require.Equal(t, slog.LevelDebug, level)
+
+	level, err = resolveLogLevel("error")
+	require.NoError(t, err)
+	require.Equal(t, slog.LevelError, level, "the flag should win over the environment")
+
+	_, err = resolveLogLevel("verbose")
+	require.Error(t, err)
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    command
+		wantErr bool
+	}{
+		{name: "no command", args: nil},
+		{name: "single name", args: []string{"start", "web"}, want: command{name: "start", args: []string{"web"}}},
+		{name: "multiple names", args: []string{"start", "web", "api"}, want: command{name: "start", args: []string{"web", "api"}}},
+		{name: "flags after names", args: []string{"start", "web", "--verbose", "api"}, want: command{name: "start", args: []string{"web", "api"}}},
+		{name: "start without names", args: []string{"start"}, wantErr: true},
+		{name: "login", args: []string{"login", "--verbose"}, want: command{name: "login"}},
+		{name: "login with args", args: []string{"login", "some-token"}, wantErr: true},
+		{name: "config", args: []string{"config"}, want: command{name: "config"}},
+		{name: "config with args", args: []string{"config", "show"}, wantErr: true},
+		{name: "unknown command", args: []string{"web"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.Bool("verbose", false, "")
+			require.NoError(t, fs.Parse(tt.args))
+
+			cmd, err := parseCommand(fs)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, cmd)
+		})
+	}
+}
+
+func TestSelectTunnels(t *testing.T) {
+	tunnels := []config.TunnelConfig{
+		{Name: "web", Port: 3000},
+		{Name: "api", Port: 8080},
+		{Port: 9000},
+	}
+
+	selected, err := selectTunnels(tunnels, nil)
+	require.NoError(t, err)
+	require.Equal(t, tunnels, selected)
+
+	selected, err = selectTunnels(tunnels, []string{"api", "web", "api"})
+	require.NoError(t, err)
+	require.Equal(t, []config.TunnelConfig{{Name: "api", Port: 8080}, {Name: "web", Port: 3000}}, selected)
+
+	_, err = selectTunnels(tunnels, []string{"db"})
+	require.ErrorContains(t, err, "available tunnels are: web, api")
+
+	_, err = selectTunnels(nil, []string{"web"})
+	require.ErrorContains(t, err, "doesn't declare any named tunnels")
+}
@@ -3,8 +3,13 @@ package cli
 import (
 	"flag"
 	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
+	"path"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jwtly10/go-tunol/internal/config"
 )
@@ -16,6 +21,9 @@ const (
 	// Environment Variable for server URL
 	// Locally we use http://localhost:8001
 	serverUrlEnv = "TUNOL_SERVER_URL"
+
+	// Environment Variable for the level of the log file, when --log-level isn't passed
+	logLevelEnv = "TUNOL_LOG_LEVEL"
 )
 
 type portFlags []int
@@ -33,34 +41,371 @@ func (f *portFlags) Set(value string) error {
 	return nil
 }
 
-func ParseFlags() *config.ClientConfig {
+// stringFlags collects repeated string flags
+type stringFlags []string
+
+func (f *stringFlags) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringFlags) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// headerFlags collects repeated "Key: Value" flags into a header map
+type headerFlags map[string]string
+
+func (f headerFlags) String() string {
+	return fmt.Sprint(map[string]string(f))
+}
+
+func (f headerFlags) Set(value string) error {
+	key, val, found := strings.Cut(value, ":")
+	key = strings.TrimSpace(key)
+	if !found || key == "" || strings.ContainsAny(key, " \t") {
+		return fmt.Errorf("invalid header %q, must be in the form \"Key: Value\"", value)
+	}
+	f[http.CanonicalHeaderKey(key)] = strings.TrimSpace(val)
+	return nil
+}
+
+// inspectFlag is --inspect, which can be passed on its own, or as --inspect=headers or --inspect=body to
+// print more of each request
+type inspectFlag string
+
+func (f *inspectFlag) String() string {
+	return string(*f)
+}
+
+func (f *inspectFlag) Set(value string) error {
+	switch value {
+	case "true":
+		*f = inspectSummary
+	case "false":
+		*f = ""
+	case inspectSummary, inspectHeaders, inspectBody:
+		*f = inspectFlag(value)
+	default:
+		return fmt.Errorf("invalid inspect level %q, must be headers or body, or left out for one line each way", value)
+	}
+	return nil
+}
+
+// IsBoolFlag lets --inspect be passed without a level
+func (f *inspectFlag) IsBoolFlag() bool {
+	return true
+}
+
+// ParseFlags parses the CLI flags, merged with the config file if there is one. Flags win
+// over the config file
+func ParseFlags() (*config.ClientConfig, error) {
 	var (
-		ports      portFlags
-		loginToken string
-		serverUrl  string
+		configPath  string
+		localHost   string
+		ports       portFlags
+		loginToken  string
+		logout      bool
+		whoami      bool
+		showVersion bool
+		check       bool
+		serverUrl   string
+		localScheme string
+		insecure    bool
+		retries     int
+		subdomain   string
+		protocol    string
+		inspectPort int
+		inspectHost string
+		heartbeat   time.Duration
+		basicAuth   string
+		rateLimit   float64
+		rewriteHost string
+		headers     = headerFlags{}
+		passHeaders bool
+		allowHeader stringFlags
+		jsonOutput  bool
+		urlOnly     bool
+		inspect     inspectFlag
+		harFile     string
+		filterPath  stringFlags
+		excludePath stringFlags
+		logLevel    string
+		logMaxSize  int
+		logMaxFiles int
+		logRedact   stringFlags
+		noCapture   bool
+		verbatim    bool
+		rewriteLink bool
+		corsOrigin  stringFlags
+		corsMethod  stringFlags
+		corsHeader  stringFlags
+		corsCreds   bool
+		corsMaxAge  time.Duration
+		noUpdate    bool
 	)
 
 	flag.Var(&ports, "port", "Port to tunnel (can be specified multiple times)")
 	flag.StringVar(&loginToken, "login", "", "Login with the provided token")
+	flag.BoolVar(&logout, "logout", false, "Remove the stored token from this machine")
+	flag.BoolVar(&whoami, "whoami", false, "Show who you are logged in as, and which server you are using")
+	flag.BoolVar(&showVersion, "version", false, "Print the version of the CLI")
+	flag.BoolVar(&check, "check", false, "Check the token, server and local ports without starting the tunnels")
+	flag.BoolVar(&noUpdate, "no-update-check", false, "Don't check the server for a newer version of the CLI on startup")
 	flag.StringVar(&serverUrl, "server", "", "Server URL")
+	flag.StringVar(&configPath, "config", "", "Path to a config file declaring tunnels (defaults to ./.tunol.yaml, then ~/.tunol/config.yaml)")
+	flag.StringVar(&localHost, "local-host", "", "Host of the local server (defaults to localhost)")
+	flag.StringVar(&localScheme, "local-scheme", "http", "Scheme used to reach the local server (http or https)")
+	flag.Var(headers, "header", "Header to set on every request forwarded to the local server, as \"Key: Value\" (can be specified multiple times)")
+	flag.StringVar(&rewriteHost, "rewrite-host", "", "Host header to send to the local server, for apps that route on virtual hosts (e.g. myapp.local)")
+	flag.BoolVar(&passHeaders, "pass-all-headers", false, "Forward all headers to and from the local server, instead of only a known set (hop-by-hop headers are always dropped)")
+	flag.BoolVar(&verbatim, "verbatim", false, "Forward requests to the local server exactly as they were sent, with every header and the exact body, so webhook signatures validate. X-Forwarded-For and X-Real-Ip are still set to the real client")
+	flag.BoolVar(&rewriteLink, "rewrite-links", false, "Prefix root-relative links in html responses and redirects with the tunnel path, for apps behind a /local/<id> url")
+	flag.Var(&corsOrigin, "cors-origin", "Answer CORS preflights from this origin (or * for any) at the server, without forwarding them to the local server (can be specified multiple times)")
+	flag.Var(&corsMethod, "cors-method", "Method the preflights answered at the server allow, any if not set (can be specified multiple times)")
+	flag.Var(&corsHeader, "cors-header", "Request header the preflights answered at the server allow, any if not set (can be specified multiple times)")
+	flag.BoolVar(&corsCreds, "cors-credentials", false, "Allow credentials in the preflights answered at the server")
+	flag.DurationVar(&corsMaxAge, "cors-max-age", 0, "How long browsers may cache the preflights answered at the server (e.g. 10m)")
+	flag.Var(&allowHeader, "allow-header", "Extra header to forward to and from the local server (can be specified multiple times)")
+	flag.BoolVar(&insecure, "insecure", false, "Skip TLS verification of the local server (for self-signed certs)")
+	flag.StringVar(&subdomain, "subdomain", "", "Request a specific subdomain for the tunnel (only valid with a single --port)")
+	flag.StringVar(&protocol, "protocol", "http", "Type of tunnel to create (http or tcp)")
+	flag.StringVar(&basicAuth, "basic-auth", "", "Require visitors to sign in with these credentials (user:pass)")
+	flag.Float64Var(&rateLimit, "rate-limit", 0, "Max requests per second to the tunnel, extra requests are rejected (0 for no limit)")
+	flag.IntVar(&retries, "reconnect-retries", 5, "Max attempts to reconnect a tunnel if the connection to the server drops (0 to disable)")
+	flag.DurationVar(&heartbeat, "heartbeat", 30*time.Second, "How often to ping the server to keep idle tunnels alive (0 to disable)")
+	flag.IntVar(&inspectPort, "inspect-port", 0, "Serve a local request inspector on this port (e.g. 4040), it's off unless set")
+	flag.StringVar(&inspectHost, "inspect-host", "localhost", "Address the inspector listens on, anyone who can reach it can see and replay requests")
+	flag.BoolVar(&jsonOutput, "json", false, "Print one JSON line per event (tunnel created, requests, errors) instead of the dashboard, for scripting")
+	flag.BoolVar(&urlOnly, "print-url-only", false, "Print the url of each tunnel once it's created, without the dashboard")
+	flag.Var(&inspect, "inspect", "Print each request and response to the terminal instead of the dashboard, --inspect=headers or --inspect=body to include those too")
+	flag.Var(&filterPath, "filter-path", "Only show and record requests to paths matching this glob and below it, e.g. /api/* (can be specified multiple times, requests are still forwarded)")
+	flag.Var(&excludePath, "exclude-path", "Don't show or record requests to paths matching this glob and below it, e.g. /health (can be specified multiple times)")
+	flag.StringVar(&harFile, "har", "", "Record every request and response to this HAR file, for browser devtools or a proxy like Charles (kept in memory and written on exit)")
+	flag.BoolVar(&noCapture, "no-capture-bodies", false, "Don't keep request and response bodies in the dashboard and inspector, only their metadata")
+	flag.StringVar(&logLevel, "log-level", "", "Level of the log file in ~/.tunol/logs, one of debug, info, warn or error (defaults to info)")
+	flag.IntVar(&logMaxSize, "log-max-size", 10, "Size in MB the log file is rotated at (0 to never rotate)")
+	flag.IntVar(&logMaxFiles, "log-max-files", 3, "Number of rotated log files to keep")
+	flag.Var(&logRedact, "log-redact-header", "Extra header to redact from the log file, on top of Authorization, Cookie and the like (can be specified multiple times)")
 	flag.Parse()
 
+	cmd, err := parseCommand(flag.CommandLine)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	if cmd.name == "start" {
+		names = cmd.args
+	}
+
+	if len(corsOrigin) == 0 && (len(corsMethod) > 0 || len(corsHeader) > 0 || corsCreds || corsMaxAge > 0) {
+		return nil, fmt.Errorf("the --cors flags need at least one --cors-origin")
+	}
+
+	if inspect != "" && jsonOutput {
+		return nil, fmt.Errorf("--inspect can't be used with --json, which already prints every request")
+	}
+
+	for _, pattern := range append(append([]string{}, filterPath...), excludePath...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid path pattern %q: %w", pattern, err)
+		}
+	}
+
+	level, err := resolveLogLevel(logLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	configFile, file, err := resolveConfigFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tunnels are only taken from the config file when no ports are passed
+	if len(names) > 0 && len(ports) > 0 {
+		return nil, fmt.Errorf("named tunnels can't be started alongside --port")
+	}
+	if len(ports) == 0 {
+		selected, err := selectTunnels(file.Tunnels, names)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range selected {
+			ports = append(ports, t.Port)
+		}
+	}
+
 	return &config.ClientConfig{
-		Ports:     []int(ports),
-		Token:     loginToken,
-		ServerURL: resolveServerUrl(serverUrl),
+		Ports:               []int(ports),
+		Tunnels:             file.Tunnels,
+		Token:               loginToken,
+		BrowserLogin:        cmd.name == "login",
+		Logout:              logout,
+		WhoAmI:              whoami,
+		ShowVersion:         showVersion,
+		ShowConfig:          cmd.name == "config",
+		Check:               check,
+		NoUpdateCheck:       noUpdate,
+		ConfigFile:          configFile,
+		ServerURL:           resolveServerUrl(serverUrl, file.Server),
+		Protocol:            protocol,
+		BasicAuth:           basicAuth,
+		RateLimit:           rateLimit,
+		LocalScheme:         localScheme,
+		LocalHost:           localHost,
+		InsecureSkipVerify:  insecure,
+		Headers:             headers,
+		RewriteHost:         rewriteHost,
+		PassAllHeaders:      passHeaders,
+		AllowHeaders:        allowHeader,
+		Verbatim:            verbatim,
+		RewriteLinks:        rewriteLink,
+		CORSOrigins:         corsOrigin,
+		CORSMethods:         corsMethod,
+		CORSHeaders:         corsHeader,
+		CORSCredentials:     corsCreds,
+		CORSMaxAge:          corsMaxAge,
+		ReconnectMaxRetries: retries,
+		HeartbeatInterval:   heartbeat,
+		InspectPort:         inspectPort,
+		InspectHost:         inspectHost,
+		JSONOutput:          jsonOutput,
+		PrintURLOnly:        urlOnly,
+		Inspect:             string(inspect),
+		HARFile:             harFile,
+		FilterPaths:         filterPath,
+		ExcludePaths:        excludePath,
+		NoCaptureBodies:     noCapture,
+		LogLevel:            level,
+		LogMaxSize:          logMaxSize,
+		LogMaxFiles:         logMaxFiles,
+		LogRedactHeaders:    logRedact,
+	}, nil
+}
+
+// command is a subcommand given after the flags, e.g. `tunol start web api` or `tunol login`
+type command struct {
+	name string // Empty if no command was given
+	args []string
+}
+
+// parseCommand parses the command from the args left after the flags. Flags may also follow the
+// command, so those are parsed too
+func parseCommand(fs *flag.FlagSet) (command, error) {
+	original := fs.Args()
+	if len(original) == 0 {
+		return command{}, nil
+	}
+
+	cmd := command{name: original[0]}
+	args := original[1:]
+	for len(args) > 0 {
+		if strings.HasPrefix(args[0], "-") {
+			if err := fs.Parse(args); err != nil {
+				return command{}, err
+			}
+			args = fs.Args()
+			continue
+		}
+		cmd.args = append(cmd.args, args[0])
+		args = args[1:]
+	}
+
+	switch cmd.name {
+	case "start":
+		if len(cmd.args) == 0 {
+			return command{}, fmt.Errorf("usage: tunol start <name> [<name>...]")
+		}
+	case "login":
+		if len(cmd.args) > 0 {
+			return command{}, fmt.Errorf("usage: tunol login (to log in with a token, use 'tunol --login <token>')")
+		}
+	case "config":
+		if len(cmd.args) > 0 {
+			return command{}, fmt.Errorf("usage: tunol config")
+		}
+	default:
+		return command{}, fmt.Errorf("unknown command %q, did you mean 'tunol start %s'?", cmd.name, strings.Join(original, " "))
+	}
+	return cmd, nil
+}
+
+// selectTunnels returns the tunnels with the given names, in the order given, or all of them if no
+// names are given
+func selectTunnels(tunnels []config.TunnelConfig, names []string) ([]config.TunnelConfig, error) {
+	if len(names) == 0 {
+		return tunnels, nil
+	}
+
+	byName := make(map[string]config.TunnelConfig, len(tunnels))
+	var available []string
+	for _, t := range tunnels {
+		if t.Name != "" {
+			byName[t.Name] = t
+			available = append(available, t.Name)
+		}
+	}
+
+	selected := make([]config.TunnelConfig, 0, len(names))
+	seen := make(map[string]bool)
+	for _, name := range names {
+		t, exists := byName[name]
+		if !exists {
+			if len(available) == 0 {
+				return nil, fmt.Errorf("no tunnel named %q, the config file doesn't declare any named tunnels", name)
+			}
+			return nil, fmt.Errorf("no tunnel named %q in the config file, available tunnels are: %s", name, strings.Join(available, ", "))
+		}
+		if !seen[name] {
+			selected = append(selected, t)
+			seen[name] = true
+		}
+	}
+	return selected, nil
+}
+
+// resolveConfigFile loads the config file at path, or the default config file if path is empty, returning
+// the path it was loaded from. An empty config and path are returned if there is no default config file
+func resolveConfigFile(path string) (string, *fileConfig, error) {
+	if path == "" {
+		var err error
+		if path, err = findConfigFile(); err != nil {
+			return "", nil, err
+		}
+		if path == "" {
+			return "", &fileConfig{}, nil
+		}
 	}
+
+	file, err := loadConfigFile(path)
+	return path, file, err
 }
 
-func resolveServerUrl(serverUrl string) string {
+func resolveServerUrl(serverUrl, fileServerUrl string) string {
 	if serverUrl == "" {
 		// If the server URL is not provided via the flag, check the environment
 		serverUrl = os.Getenv(serverUrlEnv)
 		if serverUrl == "" {
-			// If the environment variable is stil not set, use the default
+			serverUrl = fileServerUrl
+		}
+		if serverUrl == "" {
+			// If the environment variable and config file still don't set it, use the default
 			serverUrl = defaultServerUrl
 		}
 	}
 
 	return serverUrl
 }
+
+// resolveLogLevel parses the --log-level flag, falling back to the environment and then info
+func resolveLogLevel(logLevel string) (slog.Level, error) {
+	if logLevel == "" {
+		logLevel = os.Getenv(logLevelEnv)
+	}
+	if logLevel == "" {
+		return slog.LevelInfo, nil
+	}
+	return config.ParseLogLevel(logLevel)
+}
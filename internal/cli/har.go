@@ -0,0 +1,249 @@
+package cli
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jwtly10/go-tunol/internal/client"
+	"github.com/jwtly10/go-tunol/internal/proto"
+	"github.com/jwtly10/go-tunol/internal/version"
+)
+
+// harRecorder keeps every request for the HAR file set VIA --har. HAR files are a single JSON document,
+// so the entries are kept in memory and the whole file is written again on save
+type harRecorder struct {
+	path string
+
+	mu      sync.Mutex
+	entries []harEntry
+}
+
+// The parts of the HAR 1.2 format tunol fills in, see http://www.softwareishard.com/blog/har-12-spec/
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"` // In milliseconds, the sum of the timings
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string       `json:"method"`
+	URL         string       `json:"url"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []harNameVal `json:"cookies"`
+	Headers     []harNameVal `json:"headers"`
+	QueryString []harNameVal `json:"queryString"`
+	PostData    *harPostData `json:"postData,omitempty"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int          `json:"status"`
+	StatusText  string       `json:"statusText"`
+	HTTPVersion string       `json:"httpVersion"`
+	Cookies     []harNameVal `json:"cookies"`
+	Headers     []harNameVal `json:"headers"`
+	Content     harContent   `json:"content"`
+	RedirectURL string       `json:"redirectURL"`
+	HeadersSize int          `json:"headersSize"`
+	BodySize    int          `json:"bodySize"`
+}
+
+type harNameVal struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size        int    `json:"size"`
+	Compression int    `json:"compression,omitempty"` // Bytes saved by the Content-Encoding
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	Encoding    string `json:"encoding,omitempty"` // base64 for binary bodies
+}
+
+// harTimings only has the wait filled in, the client doesnt see the public request being sent or received
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func newHARRecorder(path string) *harRecorder {
+	return &harRecorder{path: path}
+}
+
+// add records a request from its event
+func (h *harRecorder) add(e client.RequestEvent) {
+	entry := newHAREntry(e)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = append(h.entries, entry)
+}
+
+// save writes every request recorded so far to the HAR file, replacing what was there
+func (h *harRecorder) save() (int, error) {
+	h.mu.Lock()
+	entries := append([]harEntry{}, h.entries...)
+	h.mu.Unlock()
+
+	data, err := json.MarshalIndent(harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "tunol", Version: version.Version},
+		Entries: entries,
+	}}, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), os.WriteFile(h.path, data, 0644)
+}
+
+// newHAREntry converts a request event to its HAR entry. The url is the public one, as the request was sent
+func newHAREntry(e client.RequestEvent) harEntry {
+	ms := float64(e.Duration.Microseconds()) / 1000
+	entry := harEntry{
+		StartedDateTime: e.Timestamp.Format(time.RFC3339Nano),
+		Time:            ms,
+		Timings:         harTimings{Wait: ms},
+		Request: harRequest{
+			Method:      e.Method,
+			URL:         strings.TrimSuffix(e.TunnelID, "/") + e.Path,
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameVal{},
+			Headers:     []harNameVal{},
+			QueryString: harQuery(e.Path),
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Response: harResponse{
+			Status:      e.Status,
+			StatusText:  http.StatusText(e.Status),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameVal{},
+			Headers:     []harNameVal{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+	}
+
+	var comments []string
+	if e.Replayed {
+		comments = append(comments, "replayed from the inspector")
+	}
+	if e.BodiesOmitted {
+		comments = append(comments, "bodies not captured")
+	}
+	if e.LocalFailed && e.Error != "" {
+		comments = append(comments, strings.TrimSpace(e.Error))
+	}
+	entry.Comment = strings.Join(comments, ", ")
+
+	if req := e.Request; req != nil {
+		entry.Request.Headers = harHeaders(req.Headers)
+		if !e.BodiesOmitted {
+			entry.Request.BodySize = len(req.Body)
+			// Post data has no encoding for binary bodies, so only its size is recorded
+			if len(req.Body) > 0 && utf8.Valid(req.Body) {
+				entry.Request.PostData = &harPostData{MimeType: req.Headers["Content-Type"], Text: string(req.Body)}
+			}
+		}
+	}
+	if resp := e.Response; resp != nil {
+		entry.Response.Headers = harHeaders(resp.Headers)
+		entry.Response.RedirectURL = resp.Headers["Location"]
+		entry.Response.Content.MimeType = resp.Headers["Content-Type"]
+		if !e.BodiesOmitted {
+			entry.Response.BodySize = len(resp.Body)
+			entry.Response.Content = harResponseContent(resp)
+		}
+	}
+	return entry
+}
+
+// harResponseContent returns the body of a response as HAR content, which is the decoded body. Only gzip
+// is decoded, other encodings are kept as they were sent
+func harResponseContent(resp *proto.HTTPResponse) harContent {
+	content := harContent{Size: len(resp.Body), MimeType: resp.Headers["Content-Type"]}
+	body := resp.Body
+	if strings.EqualFold(resp.Headers["Content-Encoding"], proto.BodyEncodingGzip) {
+		if decoded, err := proto.DecompressBody(body, proto.BodyEncodingGzip, 0); err == nil {
+			body = decoded
+			content.Size = len(decoded)
+			content.Compression = len(decoded) - len(resp.Body)
+		}
+	}
+
+	if utf8.Valid(body) {
+		content.Text = string(body)
+	} else {
+		content.Text = base64.StdEncoding.EncodeToString(body)
+		content.Encoding = "base64"
+	}
+	return content
+}
+
+// harHeaders converts headers to HAR name value pairs, in a stable order
+func harHeaders(headers map[string]string) []harNameVal {
+	pairs := make([]harNameVal, 0, len(headers))
+	for k, v := range headers {
+		pairs = append(pairs, harNameVal{Name: k, Value: v})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Name < pairs[j].Name })
+	return pairs
+}
+
+// harQuery returns the query parameters of a request path
+func harQuery(path string) []harNameVal {
+	pairs := []harNameVal{}
+	_, rawQuery, found := strings.Cut(path, "?")
+	if !found {
+		return pairs
+	}
+	for _, part := range strings.Split(rawQuery, "&") {
+		if part == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(part, "=")
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		}
+		if v, err := url.QueryUnescape(value); err == nil {
+			value = v
+		}
+		pairs = append(pairs, harNameVal{Name: name, Value: value})
+	}
+	return pairs
+}
@@ -0,0 +1,90 @@
+package cli
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/client"
+	"github.com/jwtly10/go-tunol/internal/config"
+	"github.com/jwtly10/go-tunol/internal/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHARFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.har")
+	app := NewApp(&config.ClientConfig{HARFile: path}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte(`{"ok":true}`))
+	gz.Close()
+
+	started := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	app.handleEvent(3000, client.Event{Type: client.EventTypeRequest, Payload: client.RequestEvent{
+		TunnelID:  "https://abc.tunol.dev",
+		Method:    "POST",
+		Path:      "/api?q=a%20b&page=2",
+		Status:    201,
+		Duration:  1500 * time.Microsecond,
+		Timestamp: started,
+		LocalPort: 3000,
+		Request: &proto.HTTPRequest{
+			Method:  "POST",
+			Path:    "/api?q=a%20b&page=2",
+			Headers: map[string]string{"Content-Type": "application/json", "Accept": "*/*"},
+			Body:    []byte(`{"name":"tunol"}`),
+		},
+		Response: &proto.HTTPResponse{
+			StatusCode: 201,
+			Headers:    map[string]string{"Content-Type": "application/json", "Content-Encoding": "gzip"},
+			Body:       gzipped.Bytes(),
+		},
+	}})
+	app.handleEvent(3000, client.Event{Type: client.EventTypeRequest, Payload: client.RequestEvent{
+		TunnelID:  "https://abc.tunol.dev",
+		Method:    "GET",
+		Path:      "/logo.png",
+		Status:    200,
+		Timestamp: started,
+		LocalPort: 3000,
+		Request:   &proto.HTTPRequest{Method: "GET", Path: "/logo.png"},
+		Response: &proto.HTTPResponse{
+			StatusCode: 200,
+			Headers:    map[string]string{"Content-Type": "image/png"},
+			Body:       []byte{0x89, 'P', 'N', 'G', 0xff},
+		},
+	}})
+	app.Close()
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var har harFile
+	require.NoError(t, json.Unmarshal(data, &har))
+	require.Equal(t, "1.2", har.Log.Version)
+	require.Equal(t, "tunol", har.Log.Creator.Name)
+	require.Len(t, har.Log.Entries, 2)
+
+	post := har.Log.Entries[0]
+	require.Equal(t, started.Format(time.RFC3339Nano), post.StartedDateTime)
+	require.Equal(t, 1.5, post.Time)
+	require.Equal(t, "https://abc.tunol.dev/api?q=a%20b&page=2", post.Request.URL)
+	require.Equal(t, []harNameVal{{Name: "q", Value: "a b"}, {Name: "page", Value: "2"}}, post.Request.QueryString)
+	require.Equal(t, []harNameVal{{Name: "Accept", Value: "*/*"}, {Name: "Content-Type", Value: "application/json"}}, post.Request.Headers)
+	require.Equal(t, `{"name":"tunol"}`, post.Request.PostData.Text)
+	require.Equal(t, "Created", post.Response.StatusText)
+	require.Equal(t, `{"ok":true}`, post.Response.Content.Text, "Expected the gzipped body to be decoded")
+	require.Equal(t, len(`{"ok":true}`), post.Response.Content.Size)
+	require.Equal(t, gzipped.Len(), post.Response.BodySize)
+
+	png := har.Log.Entries[1]
+	require.Equal(t, "base64", png.Response.Content.Encoding)
+	require.Equal(t, "iVBOR/8=", png.Response.Content.Text)
+	require.Nil(t, png.Request.PostData)
+}
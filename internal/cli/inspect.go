@@ -0,0 +1,77 @@
+package cli
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jwtly10/go-tunol/internal/client"
+)
+
+// The levels of --inspect, each prints everything the one before it does
+const (
+	inspectSummary = "summary" // --inspect on its own, the method, path, status and timing of each request
+	inspectHeaders = "headers" // Their headers too
+	inspectBody    = "body"    // Their headers and bodies
+)
+
+// writeInspect prints a request to the apps output in the style of curl -v, with > for the request and
+// < for the response. The caller must hold the lock, so requests from concurrent events don't interleave
+func (a *App) writeInspect(e client.RequestEvent) {
+	if e.ConnectionFailed {
+		return // Not a request, the CLI is shutting down
+	}
+
+	var b strings.Builder
+	info := fmt.Sprintf("* %s [:%d] %s", e.Timestamp.Format("15:04:05"), e.LocalPort, e.TunnelID)
+	if e.Replayed {
+		info += " (replayed)"
+	}
+	b.WriteString(info + "\n")
+
+	path := e.Path
+	if path == "" {
+		path = "/"
+	}
+	b.WriteString(fmt.Sprintf("> %s %s\n", e.Method, path))
+	if req := e.Request; req != nil {
+		a.writeInspectParts(&b, ">", req.Headers, req.Body, e.BodiesOmitted)
+	}
+
+	b.WriteString(fmt.Sprintf("< %d %s %dms\n", e.Status, http.StatusText(e.Status), e.Duration.Milliseconds()))
+	if resp := e.Response; resp != nil {
+		a.writeInspectParts(&b, "<", resp.Headers, resp.Body, e.BodiesOmitted)
+	}
+	if e.LocalFailed && e.Error != "" {
+		b.WriteString(fmt.Sprintf("* %s\n", strings.TrimSpace(e.Error)))
+	}
+
+	b.WriteString("\n")
+	fmt.Fprint(a.out, b.String())
+}
+
+// writeInspectParts writes the headers and body of a request or response, as far as the inspect level asks.
+// Each line is marked with the direction, as curl does
+func (a *App) writeInspectParts(b *strings.Builder, marker string, headers map[string]string, body []byte, omitted bool) {
+	if a.Cfg.Inspect == inspectSummary {
+		return
+	}
+
+	for _, line := range strings.Split(strings.TrimSuffix(formatHeaders(headers), "\n"), "\n") {
+		if line != "" {
+			b.WriteString(marker + " " + line + "\n")
+		}
+	}
+	if a.Cfg.Inspect != inspectBody {
+		return
+	}
+
+	formatted := strings.Trim(formatBody(body, omitted), "\n")
+	if formatted == "" {
+		return
+	}
+	b.WriteString(marker + "\n")
+	for _, line := range strings.Split(formatted, "\n") {
+		b.WriteString(marker + " " + line + "\n")
+	}
+}
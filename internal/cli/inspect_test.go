@@ -0,0 +1,98 @@
+package cli
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/client"
+	"github.com/jwtly10/go-tunol/internal/config"
+	"github.com/jwtly10/go-tunol/internal/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspectOutput(t *testing.T) {
+	event := client.RequestEvent{
+		TunnelID:  "https://abc.tunol.dev",
+		Method:    "POST",
+		Path:      "/api",
+		Status:    201,
+		Duration:  42 * time.Millisecond,
+		Timestamp: time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC),
+		LocalPort: 3000,
+		Request: &proto.HTTPRequest{
+			Method:  "POST",
+			Path:    "/api",
+			Headers: map[string]string{"Content-Type": "application/json", "Accept": "*/*"},
+			Body:    []byte(`{"name":"tunol"}`),
+		},
+		Response: &proto.HTTPResponse{
+			StatusCode: 201,
+			Headers:    map[string]string{"Content-Type": "text/plain"},
+			Body:       []byte("created\nid 1"),
+		},
+	}
+
+	tests := []struct {
+		level string
+		want  string
+	}{
+		{
+			level: inspectSummary,
+			want: "* 15:04:05 [:3000] https://abc.tunol.dev\n" +
+				"> POST /api\n" +
+				"< 201 Created 42ms\n\n",
+		},
+		{
+			level: inspectHeaders,
+			want: "* 15:04:05 [:3000] https://abc.tunol.dev\n" +
+				"> POST /api\n" +
+				"> Accept: */*\n" +
+				"> Content-Type: application/json\n" +
+				"< 201 Created 42ms\n" +
+				"< Content-Type: text/plain\n\n",
+		},
+		{
+			level: inspectBody,
+			want: "* 15:04:05 [:3000] https://abc.tunol.dev\n" +
+				"> POST /api\n" +
+				"> Accept: */*\n" +
+				"> Content-Type: application/json\n" +
+				">\n" +
+				`> {"name":"tunol"}` + "\n" +
+				"< 201 Created 42ms\n" +
+				"< Content-Type: text/plain\n" +
+				"<\n" +
+				"< created\n" +
+				"< id 1\n\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			var out bytes.Buffer
+			app := NewApp(&config.ClientConfig{Inspect: tt.level}, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+			app.out = &out
+
+			app.handleEvent(3000, client.Event{Type: client.EventTypeRequest, Payload: event})
+			require.Equal(t, tt.want, out.String())
+		})
+	}
+
+	// Requests the local server didn't answer say why
+	var out bytes.Buffer
+	app := NewApp(&config.ClientConfig{Inspect: inspectSummary}, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	app.out = &out
+	app.handleEvent(3000, client.Event{Type: client.EventTypeRequest, Payload: client.RequestEvent{
+		TunnelID:    "https://abc.tunol.dev",
+		Method:      "GET",
+		Status:      502,
+		Timestamp:   event.Timestamp,
+		LocalPort:   3000,
+		Error:       "Failed to reach local server",
+		LocalFailed: true,
+	}})
+	require.Equal(t, "* 15:04:05 [:3000] https://abc.tunol.dev\n> GET /\n< 502 Bad Gateway 0ms\n* Failed to reach local server\n\n", out.String())
+}
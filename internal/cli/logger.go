@@ -5,54 +5,48 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
-	"strings"
-)
 
-// SetupLogger sets up the internal logger for the CLI tool
-// It will use TUNOL_CONFIG_DIR if set, otherwise defaults to ~/.tunol/
-func SetupLogger() *slog.Logger {
-	var logsDir string
+	"github.com/jwtly10/go-tunol/internal/config"
+	"github.com/jwtly10/go-tunol/internal/utils"
+	"github.com/jwtly10/go-tunol/internal/version"
+)
 
-	// Get and check the actual HOME value
-	homeDir, err := os.UserHomeDir()
+// LogFilePath returns the path of the CLI log file, in the logs dir of the config dir
+func LogFilePath() (string, error) {
+	configDir, err := config.CLIConfigDir()
 	if err != nil {
-		fmt.Printf("Error getting home directory: %v\n", err)
-		os.Exit(1)
+		return "", err
 	}
+	return filepath.Join(configDir, "logs", "tunol-cli.log"), nil
+}
 
-	if configPath := os.Getenv("TUNOL_CONFIG_DIR"); configPath != "" {
-		// If the path starts with $HOME, manually replace it
-		fmt.Println("Config path before: ", configPath)
-		if strings.HasPrefix(configPath, "$HOME") {
-			configPath = strings.Replace(configPath, "$HOME", homeDir, 1)
-		}
-		fmt.Println("Config path after: ", configPath)
-		logsDir = filepath.Join(configPath, "logs")
-	} else {
-		logsDir = filepath.Join(homeDir, ".tunol", "logs")
+// SetupLogger sets up the internal logger for the CLI tool, at the configured level and rotation
+// It will use TUNOL_CONFIG_DIR if set, otherwise defaults to ~/.tunol/
+func SetupLogger(cfg *config.ClientConfig) *slog.Logger {
+	logFile, err := LogFilePath()
+	if err != nil {
+		fmt.Printf("Error finding log file: %v\n", err)
+		os.Exit(1)
 	}
 
-	fmt.Printf("Final logs directory path: %s\n", logsDir)
-
-	if err := os.MkdirAll(logsDir, 0755); err != nil {
+	if err := os.MkdirAll(filepath.Dir(logFile), 0755); err != nil {
 		fmt.Printf("Error creating logs directory: %v\n", err)
 		os.Exit(1)
 	}
 
-	logFile := filepath.Join(logsDir, "tunol-cli.log")
-	f, err := os.OpenFile(logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	f, err := openRotatingFile(logFile, int64(cfg.LogMaxSize)*1024*1024, cfg.LogMaxFiles)
 	if err != nil {
 		fmt.Printf("Error opening log file: %v\n", err)
 		os.Exit(1)
 	}
 
 	opts := &slog.HandlerOptions{
-		Level: slog.LevelDebug,
+		Level:       cfg.LogLevel,
+		ReplaceAttr: utils.NewHeaderRedactor(cfg.LogRedactHeaders).ReplaceAttr,
 	}
 	handler := slog.NewTextHandler(f, opts)
 	logger := slog.New(handler)
 
-	// TODO: Don't hardcode the version, we should have a way to bump the version properly
-	logger.Info("tunol CLI started", "version", "0.1.0")
+	logger.Info("tunol CLI started", "version", version.Version, "commit", version.Commit)
 	return logger
 }
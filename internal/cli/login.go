@@ -0,0 +1,97 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// browserLoginTimeout is how long `tunol login` waits for the browser to hand back a token
+const browserLoginTimeout = 5 * time.Minute
+
+// BrowserLogin logs the user in by authorising the CLI in their browser. The server hands the
+// token back to a short lived listener on this machine, and it's then stored as with --login
+func (a *App) BrowserLogin() error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("failed to start login listener: %w", err)
+	}
+
+	state := uuid.New().String()
+	callback, tokens := newLoginCallback(state)
+	srv := &http.Server{Handler: callback}
+	go srv.Serve(ln)
+	defer srv.Shutdown(context.Background())
+
+	hostname, _ := os.Hostname()
+	loginURL := fmt.Sprintf("%s/auth/cli?%s", a.Cfg.ServerURL, url.Values{
+		"port":  {fmt.Sprint(ln.Addr().(*net.TCPAddr).Port)},
+		"state": {state},
+		"name":  {hostname},
+	}.Encode())
+
+	fmt.Println("Opening your browser to log in, if it doesn't open visit:")
+	fmt.Printf("  %s\n", loginURL)
+	if err := openBrowser(loginURL); err != nil {
+		a.logger.Warn("Failed to open browser", "error", err)
+	}
+
+	select {
+	case t := <-tokens:
+		a.Cfg.Token = t
+	case <-time.After(browserLoginTimeout):
+		return fmt.Errorf("timed out waiting for the browser login")
+	}
+
+	return a.Login()
+}
+
+// newLoginCallback handles the browser being redirected back with a token, sending the token on the
+// channel if the state matches the one the CLI asked for
+func newLoginCallback(state string) (http.Handler, <-chan string) {
+	tokens := make(chan string, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /callback", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("state") != state {
+			http.Error(w, "Invalid login state, please run 'tunol login' again", http.StatusBadRequest)
+			return
+		}
+
+		t := r.URL.Query().Get("token")
+		if t == "" {
+			http.Error(w, "Missing token, please run 'tunol login' again", http.StatusBadRequest)
+			return
+		}
+
+		select {
+		case tokens <- t:
+		default: // Already logged in, e.g. the page was refreshed
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, "<p>The tunol CLI is logged in, you can close this tab.</p>")
+	})
+
+	return mux, tokens
+}
+
+// openBrowser opens the url in the users default browser
+func openBrowser(url string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("open", url).Start()
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
+	default:
+		return exec.Command("xdg-open", url).Start()
+	}
+}
@@ -0,0 +1,32 @@
+package cli
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginCallback(t *testing.T) {
+	callback, tokens := newLoginCallback("expected-state")
+
+	rec := httptest.NewRecorder()
+	callback.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/callback?token=abc&state=forged", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code, "Expected a token for another login to be rejected")
+	require.Empty(t, tokens)
+
+	rec = httptest.NewRecorder()
+	callback.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/callback?state=expected-state", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	callback.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/callback?token=abc&state=expected-state", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "abc", <-tokens)
+
+	// A refresh of the page after logging in shouldn't block
+	rec = httptest.NewRecorder()
+	callback.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/callback?token=abc&state=expected-state", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+}
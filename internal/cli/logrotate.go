@@ -0,0 +1,95 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingFile is a log file that's rotated once it grows past maxSize bytes, keeping up to maxFiles
+// old logs alongside it, from path.1 (the newest) to path.N. A maxSize of 0 never rotates
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	// The file may have been left over the limit, e.g. by a version of the CLI that didn't rotate
+	if r.maxSize > 0 && r.size >= r.maxSize {
+		if err := r.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts each old log up one, dropping the oldest, and starts a new file. The file is closed
+// first, as open files can't be renamed on Windows
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+
+	if r.maxFiles > 0 {
+		os.Remove(r.backupPath(r.maxFiles))
+		for i := r.maxFiles - 1; i >= 1; i-- {
+			os.Rename(r.backupPath(i), r.backupPath(i+1)) // Not every backup exists yet
+		}
+		if err := os.Rename(r.path, r.backupPath(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+
+	return r.open()
+}
+
+func (r *rotatingFile) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", r.path, n)
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
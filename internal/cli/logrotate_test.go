@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunol-cli.log")
+	f, err := openRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := f.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, "fourth\n", readLog(t, path))
+	require.Equal(t, "third\n", readLog(t, path+".1"))
+	require.Equal(t, "second\n", readLog(t, path+".2"))
+	require.NoFileExists(t, path+".3", "only maxFiles old logs should be kept")
+}
+
+func TestRotatingFileOversizedWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunol-cli.log")
+	f, err := openRotatingFile(path, 4, 1)
+	require.NoError(t, err)
+	defer f.Close()
+
+	// A line longer than the limit is still written whole, into its own file
+	_, err = f.Write([]byte("a long line\n"))
+	require.NoError(t, err)
+	require.Equal(t, "a long line\n", readLog(t, path))
+	require.NoFileExists(t, path+".1")
+}
+
+func TestRotatingFileRotatesOnStartup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunol-cli.log")
+	require.NoError(t, os.WriteFile(path, []byte(strings.Repeat("x", 20)), 0600))
+
+	f, err := openRotatingFile(path, 10, 1)
+	require.NoError(t, err)
+	defer f.Close()
+
+	require.Empty(t, readLog(t, path))
+	require.Equal(t, strings.Repeat("x", 20), readLog(t, path+".1"))
+}
+
+func TestRotatingFileWithoutBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunol-cli.log")
+	f, err := openRotatingFile(path, 10, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n"} {
+		_, err := f.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, "second\n", readLog(t, path))
+	require.NoFileExists(t, path+".1")
+}
+
+func TestRotatingFileDisabled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunol-cli.log")
+	f, err := openRotatingFile(path, 0, 2)
+	require.NoError(t, err)
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n"} {
+		_, err := f.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, "first\nsecond\n", readLog(t, path))
+}
@@ -0,0 +1,173 @@
+package cli
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gookit/color"
+)
+
+type viewMode int
+
+const (
+	viewDashboard viewMode = iota
+	viewLog                // Every request in the log, scrolled with the selection
+	viewDetail             // The headers and body of the selected request
+)
+
+// logPageSize is the number of requests shown at once in the log view
+const logPageSize = 20
+
+// maxDetailBody is the most of a body shown when a request is expanded
+const maxDetailBody = 4096
+
+// view is what the dashboard is showing, and the request selected in the log
+type view struct {
+	mode     viewMode
+	selected int      // Index of the selected request, counting back from the newest
+	detail   logEntry // The request being shown in the detail view
+}
+
+// logAdded keeps the selection on the same request when a new one is logged, as the log view
+// lists the newest first
+func (v *view) logAdded(logs int) {
+	if v.mode == viewDashboard {
+		return
+	}
+	if logs > 1 {
+		v.selected++
+	}
+	if v.selected >= logs {
+		v.selected = logs - 1
+	}
+}
+
+// handleKey moves between the dashboard views. The caller must hold the lock
+func (a *App) handleKey(k key) {
+	switch a.view.mode {
+	case viewDashboard:
+		if k == keyLog || k == keyUp || k == keyDown {
+			a.view.mode = viewLog
+			a.view.selected = 0
+		}
+	case viewLog:
+		switch k {
+		case keyUp:
+			if a.view.selected > 0 {
+				a.view.selected--
+			}
+		case keyDown:
+			if a.view.selected < len(a.commonLogs)-1 {
+				a.view.selected++
+			}
+		case keyEnter:
+			if len(a.commonLogs) > 0 {
+				a.view.detail = a.commonLogs[len(a.commonLogs)-1-a.view.selected]
+				a.view.mode = viewDetail
+			}
+		case keyBack, keyLog:
+			a.view.mode = viewDashboard
+		}
+	case viewDetail:
+		if k == keyBack || k == keyEnter {
+			a.view.mode = viewLog
+		}
+	}
+}
+
+// renderLog renders every request in the log, newest first, scrolled so the selection is visible
+func (a *App) renderLog() string {
+	var b strings.Builder
+
+	b.WriteString(color.Bold.Sprintf(" go-tunol requests (%d, newest first)%34s\n", len(a.commonLogs), time.Now().Format("15:04:05")))
+	b.WriteString("══════════════════════════════════════════════════════\n")
+
+	if len(a.commonLogs) == 0 {
+		b.WriteString("   No requests yet\n")
+	}
+
+	offset := 0
+	if a.view.selected >= logPageSize {
+		offset = a.view.selected - logPageSize + 1
+	}
+	for i := offset; i < len(a.commonLogs) && i < offset+logPageSize; i++ {
+		line := formatLogLine(a.commonLogs[len(a.commonLogs)-1-i])
+		if i == a.view.selected {
+			b.WriteString(color.Bold.Sprint(" > ") + line + "\n")
+		} else {
+			b.WriteString("   " + line + "\n")
+		}
+	}
+
+	b.WriteString("\n↑/↓ select • enter expand • esc back • q quit\n")
+	return b.String()
+}
+
+// renderDetail renders the selected request in full, from the request log
+func (a *App) renderDetail() string {
+	var b strings.Builder
+	log := a.view.detail
+
+	b.WriteString(color.Bold.Sprintf(" %s\n", formatLogLine(log)))
+	b.WriteString("══════════════════════════════════════════════════════\n")
+	b.WriteString(fmt.Sprintf("   %s\n", log.timestamp.Format("15:04:05")))
+	if log.error != "" {
+		b.WriteString(color.Red.Sprintf("   Error: %s\n", strings.TrimSpace(log.error)))
+	}
+
+	captured, ok := a.requestLog.Get(log.requestID)
+	if !ok {
+		b.WriteString("\n   The full request is no longer in the log\n")
+	}
+	if req := captured.Request; req != nil {
+		b.WriteString(color.Bold.Sprint("\nREQUEST\n"))
+		b.WriteString(fmt.Sprintf("%s %s\n", req.Method, req.Path))
+		b.WriteString(formatHeaders(req.Headers))
+		b.WriteString(formatBody(req.Body, captured.BodiesOmitted))
+	}
+	if resp := captured.Response; resp != nil {
+		b.WriteString(color.Bold.Sprint("\nRESPONSE\n"))
+		b.WriteString(fmt.Sprintf("%d\n", resp.StatusCode))
+		b.WriteString(formatHeaders(resp.Headers))
+		b.WriteString(formatBody(resp.Body, captured.BodiesOmitted))
+	}
+
+	b.WriteString("\nesc back • q quit\n")
+	return b.String()
+}
+
+// formatHeaders renders headers one per line, in a stable order
+func formatHeaders(headers map[string]string) string {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k + ": " + headers[k] + "\n")
+	}
+	return b.String()
+}
+
+// formatBody renders a body after its headers, summarising binary content and truncating large bodies.
+// Omitted is set when the tunnel doesn't capture bodies, so an empty body isn't mistaken for one
+func formatBody(body []byte, omitted bool) string {
+	if omitted {
+		return "\n(body not captured)\n"
+	}
+	if len(body) == 0 {
+		return ""
+	}
+	if !utf8.Valid(body) {
+		return fmt.Sprintf("\n<%d bytes of binary data>\n", len(body))
+	}
+	if len(body) > maxDetailBody {
+		return fmt.Sprintf("\n%s\n... (%d more bytes)\n", body[:maxDetailBody], len(body)-maxDetailBody)
+	}
+	return "\n" + string(body) + "\n"
+}
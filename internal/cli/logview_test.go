@@ -0,0 +1,119 @@
+package cli
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/client"
+	"github.com/jwtly10/go-tunol/internal/config"
+	"github.com/jwtly10/go-tunol/internal/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestApp(t *testing.T) *App {
+	t.Helper()
+
+	app := NewApp(&config.ClientConfig{Ports: []int{3000}}, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	app.out = &bytes.Buffer{}
+	return app
+}
+
+func logTestRequest(app *App, path string) {
+	app.handleEvent(3000, client.Event{
+		Type: client.EventTypeRequest,
+		Payload: client.RequestEvent{
+			Method:    "GET",
+			Path:      path,
+			Status:    200,
+			Timestamp: time.Now(),
+			LocalPort: 3000,
+			Request: &proto.HTTPRequest{
+				Method:  "GET",
+				Path:    path,
+				Headers: map[string]string{"Accept": "application/json"},
+			},
+			Response: &proto.HTTPResponse{
+				StatusCode: 200,
+				Headers:    map[string]string{"Content-Type": "application/json"},
+				Body:       []byte(`{"path":"` + path + `"}`),
+			},
+		},
+	})
+}
+
+func TestParseKey(t *testing.T) {
+	tests := map[string]key{
+		"\x1b[A": keyUp,
+		"k":      keyUp,
+		"\x1b[B": keyDown,
+		"j":      keyDown,
+		"\r":     keyEnter,
+		"\x1b":   keyBack,
+		"b":      keyBack,
+		"l":      keyLog,
+		"q":      keyQuit,
+		"\x03":   keyQuit,
+		"x":      keyNone,
+	}
+
+	for input, want := range tests {
+		require.Equal(t, want, parseKey([]byte(input)), "Unexpected key for %q", input)
+	}
+}
+
+func TestLogViewNavigation(t *testing.T) {
+	app := newTestApp(t)
+	logTestRequest(app, "/first")
+	logTestRequest(app, "/second")
+	logTestRequest(app, "/third")
+
+	app.handleKey(keyLog)
+	require.Equal(t, viewLog, app.view.mode)
+	require.Contains(t, app.render(), "/first", "Expected the log view to list every request")
+
+	// The newest request is selected first, moving down goes back in time
+	app.handleKey(keyDown)
+	app.handleKey(keyDown)
+	app.handleKey(keyDown)
+	require.Equal(t, 2, app.view.selected, "Expected the selection to stop at the oldest request")
+
+	app.handleKey(keyUp)
+	app.handleKey(keyEnter)
+	require.Equal(t, viewDetail, app.view.mode)
+	require.Equal(t, "/second", app.view.detail.path)
+
+	detail := app.render()
+	require.Contains(t, detail, "Accept: application/json")
+	require.Contains(t, detail, "Content-Type: application/json")
+	require.Contains(t, detail, `{"path":"/second"}`)
+
+	app.handleKey(keyBack)
+	require.Equal(t, viewLog, app.view.mode)
+	app.handleKey(keyBack)
+	require.Equal(t, viewDashboard, app.view.mode)
+}
+
+func TestLogViewKeepsSelection(t *testing.T) {
+	app := newTestApp(t)
+	logTestRequest(app, "/first")
+	logTestRequest(app, "/second")
+
+	app.handleKey(keyLog)
+	app.handleKey(keyDown)
+
+	// New requests are listed first, so the selection has to move to stay on the same request
+	logTestRequest(app, "/third")
+	app.handleKey(keyEnter)
+	require.Equal(t, "/first", app.view.detail.path)
+}
+
+func TestFormatBody(t *testing.T) {
+	require.Empty(t, formatBody(nil, false))
+	require.Equal(t, "\nhello\n", formatBody([]byte("hello"), false))
+	require.Equal(t, "\n(body not captured)\n", formatBody(nil, true))
+	require.Contains(t, formatBody([]byte{0xff, 0xfe}, false), "2 bytes of binary data")
+	require.Contains(t, formatBody(bytes.Repeat([]byte("a"), maxDetailBody+10), false), "10 more bytes")
+}
@@ -0,0 +1,84 @@
+package cli
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/client"
+)
+
+// jsonEvent is a line of output in --json mode, one is written per tunnel or request event
+type jsonEvent struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Name       string    `json:"name,omitempty"` // The name of the tunnel in the config file, if it has one
+	Port       int       `json:"port,omitempty"`
+	URL        string    `json:"url,omitempty"`
+	Method     string    `json:"method,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	Status     int       `json:"status,omitempty"`
+	DurationMs int64     `json:"duration_ms,omitempty"`
+	Replayed   bool      `json:"replayed,omitempty"`
+	Rejected   int       `json:"rejected,omitempty"` // Total requests rejected by the rate limit
+	Message    string    `json:"message,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Code       string    `json:"code,omitempty"`      // Why the server sent an error, one of the proto error codes
+	Retryable  bool      `json:"retryable,omitempty"` // Set if the server says the error may go away on its own
+}
+
+// jsonEventTunnelCreated is written for each tunnel once it is registered with the server
+const jsonEventTunnelCreated = "tunnel_created"
+
+// writeJSON writes the event as a single line to the apps output. The caller must hold the lock,
+// so lines from concurrent events don't interleave
+func (a *App) writeJSON(e jsonEvent) {
+	if e.Port != 0 {
+		e.Name = a.Cfg.TunnelName(e.Port)
+	}
+	if err := json.NewEncoder(a.out).Encode(e); err != nil {
+		a.logger.Error("Failed to write JSON event", "error", err)
+	}
+}
+
+// writeJSONEvent converts an event from a tunnel manager to its JSON output
+func (a *App) writeJSONEvent(port int, event client.Event) {
+	e := jsonEvent{Type: string(event.Type), Port: port, Time: time.Now()}
+
+	switch p := event.Payload.(type) {
+	case client.RequestEvent:
+		e.URL = p.TunnelID
+		e.Method = p.Method
+		e.Path = p.Path
+		e.Status = p.Status
+		e.DurationMs = p.Duration.Milliseconds()
+		e.Replayed = p.Replayed
+		e.Error = p.Error
+		e.Time = p.Timestamp
+	case client.ReconnectEvent:
+		e.URL = p.TunnelID
+		e.Message = "reconnected, previous url was " + p.PreviousURL
+		e.Time = p.Timestamp
+	case client.ShutdownEvent:
+		e.URL = p.TunnelID
+		e.Message = p.Message
+		e.Time = p.Timestamp
+	case client.TunnelClosedEvent:
+		e.URL = p.TunnelID
+		e.Message = p.Message
+		e.Time = p.Timestamp
+	case client.RateLimitedEvent:
+		e.URL = p.TunnelID
+		e.Rejected = p.Rejected
+		e.Time = p.Timestamp
+	case client.LocalUnreachableEvent:
+		e.URL = p.TunnelID
+		e.Message = p.Message
+		e.Time = p.Timestamp
+	case client.ErrorEvent:
+		e.Error = p.Error
+		e.Code = p.Code
+		e.Retryable = p.Retryable
+	}
+
+	a.writeJSON(e)
+}
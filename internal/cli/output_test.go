@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/client"
+	"github.com/jwtly10/go-tunol/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONOutput(t *testing.T) {
+	cfg := &config.ClientConfig{
+		JSONOutput: true,
+		Tunnels:    []config.TunnelConfig{{Name: "web", Port: 3000}},
+	}
+	var out bytes.Buffer
+	app := NewApp(cfg, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	app.out = &out
+
+	app.handleEvent(3000, client.Event{
+		Type: client.EventTypeRequest,
+		Payload: client.RequestEvent{
+			TunnelID:  "https://abc.tunol.dev",
+			Method:    "POST",
+			Path:      "/api",
+			Status:    201,
+			Duration:  42 * time.Millisecond,
+			Timestamp: time.Now(),
+			LocalPort: 3000,
+		},
+	})
+	app.handleEvent(8080, client.Event{
+		Type: client.EventTypeLocalUnreachable,
+		Payload: client.LocalUnreachableEvent{
+			TunnelID:  "https://def.tunol.dev",
+			LocalPort: 8080,
+			Message:   "local server on port 8080 not reachable, is it running?",
+			Timestamp: time.Now(),
+		},
+	})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2, "Expected one JSON line per event")
+
+	var request jsonEvent
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &request))
+	require.Equal(t, "request", request.Type)
+	require.Equal(t, "web", request.Name)
+	require.Equal(t, 3000, request.Port)
+	require.Equal(t, "https://abc.tunol.dev", request.URL)
+	require.Equal(t, "POST", request.Method)
+	require.Equal(t, "/api", request.Path)
+	require.Equal(t, 201, request.Status)
+	require.Equal(t, int64(42), request.DurationMs)
+
+	var unreachable jsonEvent
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &unreachable))
+	require.Equal(t, "local_unreachable", unreachable.Type)
+	require.Empty(t, unreachable.Name)
+	require.Equal(t, 8080, unreachable.Port)
+	require.Contains(t, unreachable.Message, "not reachable")
+}
+
+func TestAnnounceTunnel(t *testing.T) {
+	var out bytes.Buffer
+	app := NewApp(&config.ClientConfig{}, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	app.out = &out
+
+	app.announceTunnel(3000, "https://abc.tunol.dev")
+	app.announceTunnel(8080, "https://def.tunol.dev")
+	require.Equal(t, "https://abc.tunol.dev\nhttps://def.tunol.dev\n", out.String(), "Expected each url on its own line")
+
+	out.Reset()
+	app.Cfg.JSONOutput = true
+	app.announceTunnel(3000, "https://abc.tunol.dev")
+
+	var created jsonEvent
+	require.NoError(t, json.Unmarshal(out.Bytes(), &created))
+	require.Equal(t, "tunnel_created", created.Type)
+	require.Equal(t, 3000, created.Port)
+	require.Equal(t, "https://abc.tunol.dev", created.URL)
+}
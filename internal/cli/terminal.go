@@ -0,0 +1,85 @@
+package cli
+
+import (
+	"os"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// key is a keypress the dashboard responds to
+type key int
+
+const (
+	keyNone key = iota
+	keyUp
+	keyDown
+	keyEnter
+	keyBack
+	keyLog
+	keyQuit
+)
+
+// parseKey maps the bytes read from the terminal for a single keypress to a key
+func parseKey(b []byte) key {
+	switch string(b) {
+	case "\x1b[A", "k":
+		return keyUp
+	case "\x1b[B", "j":
+		return keyDown
+	case "\r", "\n":
+		return keyEnter
+	case "\x1b", "b", "\x7f":
+		return keyBack
+	case "l":
+		return keyLog
+	case "q", "\x03": // Ctrl+C doesn't raise a signal in raw mode, so it's read as a key
+		return keyQuit
+	}
+	return keyNone
+}
+
+// terminal tracks whether stdin has been put in raw mode for keyboard controls, so it can always
+// be restored before the CLI exits
+type terminal struct {
+	fd    int
+	state *term.State // The state before raw mode, nil if the terminal isn't raw
+
+	mu sync.Mutex
+}
+
+// makeRaw puts the terminal in raw mode, returning false if stdin isn't a terminal
+func (t *terminal) makeRaw() (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.fd = int(os.Stdin.Fd())
+	if !term.IsTerminal(t.fd) {
+		return false, nil
+	}
+
+	state, err := term.MakeRaw(t.fd)
+	if err != nil {
+		return false, err
+	}
+	t.state = state
+	return true, nil
+}
+
+func (t *terminal) isRaw() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state != nil
+}
+
+// restore returns the terminal to how it was before raw mode, it's safe to call more than once
+func (t *terminal) restore() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.state == nil {
+		return
+	}
+	_ = term.Restore(t.fd, t.state)
+	t.state = nil
+}
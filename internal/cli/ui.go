@@ -1,8 +1,10 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path"
 	"sort"
 	"strconv"
 	"strings"
@@ -10,19 +12,80 @@ import (
 
 	"github.com/gookit/color"
 	"github.com/jwtly10/go-tunol/internal/client"
+	"github.com/jwtly10/go-tunol/internal/proto"
 )
 
 func (a *App) handleEvent(port int, event client.Event) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
+	// Requests filtered out with --filter-path or --exclude-path were still forwarded, they're only kept out
+	// of the output. Any of them answering still means the local server is reachable
+	if req, ok := event.Payload.(client.RequestEvent); ok && !req.ConnectionFailed && !a.showsPath(req.Path) {
+		if state, exists := a.tunnels[fmt.Sprintf("tunnel_%d", port)]; exists && !req.LocalFailed {
+			state.localErr = ""
+		}
+		return
+	}
+
+	if a.Cfg.JSONOutput {
+		a.writeJSONEvent(port, event)
+	}
+	if req, ok := event.Payload.(client.RequestEvent); ok && a.Cfg.Inspect != "" {
+		a.writeInspect(req)
+	}
+
 	switch event.Type {
 	case client.EventTypeError:
-		// If the connection has failed due to auth, log for user and kill CLI
-		// TODO: I guess the only time this would happen is it the tunnel has already been created and THEN the token expires....
-		// TODO: Handle in future, for now just log and close
-		fmt.Printf("There was an error during the tunnel session: %v\n", event.Payload.(client.ErrorEvent).Error)
-		os.Exit(1)
+		// Errors the server says may go away on their own are left to the tunnel manager, which reconnects
+		// the tunnels if they drop. Anything else, such as the token expiring, needs the user so the CLI exits
+		errEvent := event.Payload.(client.ErrorEvent)
+		if errEvent.Retryable {
+			a.logger.Warn("Tunol server sent an error", "port", port, "code", errEvent.Code, "error", errEvent.Error)
+			return
+		}
+		if !a.Cfg.JSONOutput {
+			fmt.Printf("There was an error during the tunnel session: %v\n", errEvent.Error)
+			if hint := errorHint(errEvent.Code); hint != "" {
+				fmt.Println(hint)
+			}
+		}
+		a.exit(1)
+	case client.EventTypeReconnect:
+		// The tunnel dropped but the manager recovered it, the state already references the
+		// same tunnel (with its new url), so we just need to reset the uptime
+		reconnect := event.Payload.(client.ReconnectEvent)
+		a.logger.Info("Tunnel reconnected", "port", port, "previousUrl", reconnect.PreviousURL, "url", reconnect.TunnelID)
+		if state, exists := a.tunnels[fmt.Sprintf("tunnel_%d", port)]; exists {
+			state.isActive = true
+			state.lastErr = nil
+			state.uptime = reconnect.Timestamp
+		}
+	case client.EventTypeShutdown:
+		// The server is restarting, the manager reconnects the tunnel once it's back
+		shutdown := event.Payload.(client.ShutdownEvent)
+		a.logger.Info("Tunol server is shutting down", "port", port, "message", shutdown.Message)
+		if state, exists := a.tunnels[fmt.Sprintf("tunnel_%d", port)]; exists {
+			state.isActive = false
+			state.lastErr = fmt.Errorf("%s, reconnecting", shutdown.Message)
+		}
+	case client.EventTypeTunnelClosed:
+		// The server won't have the tunnel back, so it's left closed rather than reconnected
+		closed := event.Payload.(client.TunnelClosedEvent)
+		a.logger.Info("Tunnel closed by server", "port", port, "reason", closed.Reason, "message", closed.Message)
+		if state, exists := a.tunnels[fmt.Sprintf("tunnel_%d", port)]; exists {
+			state.isActive = false
+			state.lastErr = errors.New(closed.Message)
+		}
+	case client.EventTypeRateLimited:
+		limited := event.Payload.(client.RateLimitedEvent)
+		if state, exists := a.tunnels[fmt.Sprintf("tunnel_%d", port)]; exists {
+			state.rateLimited = limited.Rejected
+		}
+	case client.EventTypeLocalUnreachable:
+		unreachable := event.Payload.(client.LocalUnreachableEvent)
+		a.logger.Warn("Local server not reachable", "port", port)
+		a.stateFor(port).localErr = unreachable.Message
 	case client.EventTypeRequest:
 		// If the connection has failed (but not due to auth, some other http issue), log for user and kill CLI
 		if event.Payload.(client.RequestEvent).ConnectionFailed {
@@ -41,24 +104,38 @@ func (a *App) handleEvent(port int, event client.Event) {
 			}
 
 			// The event contains an error message, so we log it
-			if event.Payload.(client.RequestEvent).Error != "" {
+			if event.Payload.(client.RequestEvent).Error != "" && !a.Cfg.JSONOutput {
 				fmt.Println("Shutting down due to error:", event.Payload.(client.RequestEvent).Error)
 			}
 
-			os.Exit(1)
+			a.exit(1)
 		}
 
 		// Else we handle the request event
+		captured := a.requestLog.Record(event.Payload.(client.RequestEvent))
+		if a.har != nil {
+			a.har.add(event.Payload.(client.RequestEvent))
+		}
 
-		// Update stats
-		a.stats.requestCount++
-		if event.Payload.(client.RequestEvent).Status >= 500 || event.Payload.(client.RequestEvent).Error != "" {
-			a.stats.errorCount++
+		// A response from the local server means it's reachable again
+		if !event.Payload.(client.RequestEvent).LocalFailed {
+			if state, exists := a.tunnels[fmt.Sprintf("tunnel_%d", port)]; exists {
+				state.localErr = ""
+			}
 		}
 
-		// Update average response time
+		// Replays from the inspector are only for debugging, so keep them out of the stats
+		if event.Payload.(client.RequestEvent).Replayed {
+			return
+		}
+
+		// Update stats
 		duration := int(event.Payload.(client.RequestEvent).Duration.Milliseconds())
-		a.stats.avgResponseTime = (a.stats.avgResponseTime*a.stats.requestCount + duration) / (a.stats.requestCount + 1)
+		isError := event.Payload.(client.RequestEvent).Status >= 500 || event.Payload.(client.RequestEvent).Error != ""
+		if _, exists := a.stats[port]; !exists {
+			a.stats[port] = &stats{}
+		}
+		a.stats[port].record(time.Now(), duration, isError)
 
 		// Add log entry
 		a.commonLogs = append(a.commonLogs, logEntry{
@@ -69,22 +146,72 @@ func (a *App) handleEvent(port int, event client.Event) {
 			status:    event.Payload.(client.RequestEvent).Status,
 			duration:  duration,
 			error:     event.Payload.(client.RequestEvent).Error,
-			isError:   event.Payload.(client.RequestEvent).Status >= 500 || event.Payload.(client.RequestEvent).Error != "",
+			isError:   isError,
+			requestID: captured.ID,
 		})
 
 		// Keep only last 100 logs
 		if len(a.commonLogs) > 100 {
 			a.commonLogs = a.commonLogs[1:]
 		}
+		a.view.logAdded(len(a.commonLogs))
+	}
+}
+
+// showsPath reports whether requests to the path are shown, going by --filter-path and --exclude-path
+func (a *App) showsPath(p string) bool {
+	if len(a.Cfg.FilterPaths) > 0 && !matchesPath(a.Cfg.FilterPaths, p) {
+		return false
+	}
+	return !matchesPath(a.Cfg.ExcludePaths, p)
+}
+
+// matchesPath reports whether the path, without its query, matches any of the glob patterns. A pattern also
+// matches everything below the paths it matches, so /api/* matches /api/users/1 and /health matches /health/live
+func matchesPath(patterns []string, p string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+
+	p, _, _ = strings.Cut(p, "?")
+	p = path.Clean("/" + p)
+	for {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+		if p == "/" {
+			return false
+		}
+		p = path.Dir(p)
 	}
 }
 
+// render renders the current view of the dashboard. The caller must hold the lock
 func (a *App) render() string {
+	switch a.view.mode {
+	case viewLog:
+		return a.renderLog()
+	case viewDetail:
+		return a.renderDetail()
+	default:
+		return a.renderDashboard()
+	}
+}
+
+func (a *App) renderDashboard() string {
 	var b strings.Builder
 
 	// Header
 	b.WriteString(color.Bold.Sprintf(" go-tunol dashboard%51s\n", time.Now().Format("15:04:05")))
 	b.WriteString("══════════════════════════════════════════════════════\n")
+	if warning := expiryWarning(a.tokenExpiresAt, time.Now()); warning != "" {
+		b.WriteString(color.Yellow.Sprintf("⚠️  %s\n\n", warning))
+	}
+	if a.updateNotice != "" {
+		b.WriteString(color.Cyan.Sprintf("⬆️  %s\n\n", a.updateNotice))
+	}
 
 	// Tunnels Section
 	b.WriteString(color.Bold.Sprint("📡 TUNNELS\n"))
@@ -98,37 +225,117 @@ func (a *App) render() string {
 	for _, id := range tunnelIDs {
 		state := a.tunnels[id]
 		if state.isActive {
-			uptime := time.Since(state.uptime).Round(time.Second)
-			tunnelLine := fmt.Sprintf("   %s ➔ %s (⬆️ %s)",
+			// The servers timestamp is preferred, so the uptime matches when the tunnel expires
+			started := state.uptime
+			if created := state.tunnel.Created(); !created.IsZero() {
+				started = created
+			}
+			uptime := time.Since(started).Round(time.Second)
+			var name string
+			if n := a.Cfg.TunnelName(state.tunnel.LocalPort()); n != "" {
+				name = color.Bold.Sprint(n) + ": "
+			}
+			tunnelLine := fmt.Sprintf("   %s%s ➔ %s (⬆️ %s)",
+				name,
 				state.tunnel.URL(),
-				"localhost:"+strconv.Itoa(state.tunnel.LocalPort()),
+				a.Cfg.ForTunnel(state.tunnel.LocalPort()).LocalAddr(state.tunnel.LocalPort()),
 				uptime)
+			if limit := state.tunnel.RateLimit(); limit > 0 {
+				tunnelLine += fmt.Sprintf(" • %g req/s limit", limit)
+			}
+			if expiresAt := state.tunnel.ExpiresAt(); !expiresAt.IsZero() {
+				left := time.Until(expiresAt)
+				expiry := fmt.Sprintf(" • ⏳ %s left", formatTimeLeft(left))
+				if left < tunnelExpiryWarning {
+					expiry = color.Yellow.Sprint(expiry)
+				}
+				tunnelLine += expiry
+			}
 			b.WriteString(tunnelLine + "\n")
+			if state.localErr != "" {
+				b.WriteString(color.Yellow.Sprintf("   ⚠️  %s\n", state.localErr))
+			}
 		} else {
+			// The tunnel has no url yet, so the port is what tells the user which one failed
+			label := id
+			if port, err := strconv.Atoi(strings.TrimPrefix(id, "tunnel_")); err == nil {
+				label = fmt.Sprintf("port %d", port)
+				if n := a.Cfg.TunnelName(port); n != "" {
+					label = fmt.Sprintf("%s, port %d", n, port)
+				}
+			}
 			errLine := fmt.Sprintf("   [%s] ➔ (❌ %s)",
-				id,
+				label,
 				state.lastErr)
 			b.WriteString(errLine + "\n")
 		}
 	}
+	if info := a.serverInfo(); info != nil {
+		serverLine := "   Server " + info.Version
+		if limits := formatLimits(info.Limits); limits != "" {
+			serverLine += " • " + limits
+		}
+		b.WriteString(serverLine + "\n")
+	}
 	b.WriteString("\n")
 
-	// Admin Tool Section
-	// b.WriteString(color.Bold.Sprint("🔗 ADMIN TOOL\n"))
-	// b.WriteString(color.Green.Sprint("   http://localhost:9000 (coming soon)\n\n")) // TODO: Implement this
+	// Inspector Section
+	if a.Cfg.InspectPort != 0 {
+		b.WriteString(color.Bold.Sprint("🔗 INSPECTOR\n"))
+		b.WriteString(color.Green.Sprintf("   http://%s\n\n", a.inspectorAddr()))
+	}
 
 	// Stats Section
-	b.WriteString(color.Bold.Sprint("📊 STATS (last 60s)\n"))
+	b.WriteString(color.Bold.Sprintf("📊 STATS (last %ds)\n", int(statsWindow.Seconds())))
+	now := time.Now()
+	var all []*stats
+	for _, s := range a.stats {
+		all = append(all, s)
+	}
+	requests, errors, avgResponseTime := summarise(now, all...)
 	var successRate float64
-	if a.stats.requestCount > 0 {
-		successRate = 100.0 * float64(a.stats.requestCount-a.stats.errorCount) / float64(a.stats.requestCount)
+	if requests > 0 {
+		successRate = 100.0 * float64(requests-errors) / float64(requests)
 	}
 	statsLine := fmt.Sprintf("   %d requests • %d errors • %.1f%% success rate",
-		a.stats.requestCount,
-		a.stats.errorCount,
+		requests,
+		errors,
 		successRate)
 	b.WriteString(statsLine + "\n")
-	b.WriteString(fmt.Sprintf("   Average response time: %dms\n\n", a.stats.avgResponseTime))
+	b.WriteString(fmt.Sprintf("   Average response time: %dms\n", avgResponseTime))
+
+	// Break the stats down by tunnel, so it's clear which service is erroring
+	if len(a.Cfg.Ports) > 1 {
+		for _, port := range a.Cfg.Ports {
+			state, exists := a.tunnels[fmt.Sprintf("tunnel_%d", port)]
+			if !exists || !state.isActive {
+				continue
+			}
+
+			var requests, errors, avgResponseTime int
+			if s, exists := a.stats[port]; exists {
+				requests, errors, avgResponseTime = s.summary(now)
+			}
+
+			label := fmt.Sprintf(":%d", port)
+			if n := a.Cfg.TunnelName(port); n != "" {
+				label = fmt.Sprintf("%s (:%d)", n, port)
+			}
+			b.WriteString(fmt.Sprintf("   %s • %d requests • %d errors • %dms avg\n",
+				label,
+				requests,
+				errors,
+				avgResponseTime))
+		}
+	}
+	var rateLimited int
+	for _, state := range a.tunnels {
+		rateLimited += state.rateLimited
+	}
+	if rateLimited > 0 {
+		b.WriteString(color.Yellow.Sprintf("   %d requests rejected by the rate limit\n", rateLimited))
+	}
+	b.WriteString("\n")
 
 	// Traffic Section
 	b.WriteString(color.Bold.Sprint("LIVE TRAFFIC (newest first)\n"))
@@ -140,42 +347,39 @@ func (a *App) render() string {
 		start = 6
 	}
 	for i := len(a.commonLogs) - 1; i >= len(a.commonLogs)-start && i >= 0; i-- {
-		log := a.commonLogs[i]
-		statusSymbol := color.Green.Sprint("✓")
-
-		// Update status symbol depending on req
-		if log.isError {
-			statusSymbol = color.Red.Sprint("✗")
-		} else if log.status >= 400 {
-			statusSymbol = color.Yellow.Sprint("!")
-		}
+		// Errors aren't shown inline, as the raw body error msg can span lines. The full error
+		// is shown when the request is expanded from the log view
+		b.WriteString("   " + formatLogLine(a.commonLogs[i]) + "\n")
+	}
 
-		// If path is empty, set it to root
-		if log.path == "" {
-			log.path = "/"
-		}
+	// Footer
+	b.WriteString("\nPress l to browse requests • q or Ctrl+C to quit\n")
+	return b.String()
+}
 
-		logLine := fmt.Sprintf("   [:%d] %d %s    %s    %dms %s",
-			log.port,
-			log.status,
-			log.method,
-			log.path,
-			log.duration,
-			statusSymbol)
+// formatLogLine renders a request as a single line for the traffic and log views
+func formatLogLine(log logEntry) string {
+	statusSymbol := color.Green.Sprint("✓")
 
-		// TODO: There is an issue with setting the raw body error msg
-		// Theres an additional \n being rendered, for now will just remove
-		//if log.isError && log.error != "" {
-		//	logLine = fmt.Sprintf("%s ERROR: %s", logLine, log.error)
-		//}
+	// Update status symbol depending on req
+	if log.isError {
+		statusSymbol = color.Red.Sprint("✗")
+	} else if log.status >= 400 {
+		statusSymbol = color.Yellow.Sprint("!")
+	}
 
-		b.WriteString(logLine)
-		b.Write([]byte("\n"))
+	// If path is empty, set it to root
+	if log.path == "" {
+		log.path = "/"
 	}
 
-	// Footer
-	b.WriteString("\nPress Ctrl+C to quit\n")
-	return b.String()
+	return fmt.Sprintf("[:%d] %d %s    %s    %dms %s",
+		log.port,
+		log.status,
+		log.method,
+		log.path,
+		log.duration,
+		statusSymbol)
 }
 
 func (a *App) startUI() {
@@ -185,13 +389,126 @@ func (a *App) startUI() {
 	for {
 		select {
 		case <-ticker.C:
-			clearScreen()
-			fmt.Print(a.render())
+			// Rendering evicts old stats, and reads state the tunnel events update
+			a.mu.Lock()
+			a.draw(a.render())
+			a.mu.Unlock()
+		}
+	}
+}
+
+// startKeyboard enables the dashboard's keyboard controls, by putting the terminal in raw mode and
+// handling keypresses in the background. It's a no-op when stdin isn't a terminal
+func (a *App) startKeyboard() {
+	raw, err := a.term.makeRaw()
+	if err != nil {
+		a.logger.Warn("Failed to enable keyboard controls", "error", err)
+		return
+	}
+	if !raw {
+		return
+	}
+
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				return
+			}
 
+			k := parseKey(buf[:n])
+			if k == keyQuit {
+				a.quit()
+				return
+			}
+
+			// Redraw straight away, rather than waiting for the next tick
+			a.mu.Lock()
+			a.handleKey(k)
+			a.draw(a.render())
+			a.mu.Unlock()
 		}
+	}()
+}
+
+// quit shuts the CLI down as if it was interrupted, since Ctrl+C is read as a key in raw mode
+func (a *App) quit() {
+	a.Close()
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil || p.Signal(os.Interrupt) != nil {
+		os.Exit(0)
+	}
+}
+
+// draw replaces the screen with the rendered view. The caller must hold the lock, so draws don't interleave
+func (a *App) draw(screen string) {
+	// Raw mode stops the terminal translating newlines, so the cursor has to be returned explicitly
+	if a.term.isRaw() {
+		screen = strings.ReplaceAll(screen, "\n", "\r\n")
 	}
+	clearScreen()
+	fmt.Fprint(a.out, screen)
 }
 
 func clearScreen() {
 	fmt.Print("\033[H\033[2J")
 }
+
+// tunnelExpiryWarning is how long before a tunnel expires its time left is highlighted
+const tunnelExpiryWarning = 5 * time.Minute
+
+// formatTimeLeft renders the time until a tunnel expires, to the minute until the last one
+// serverInfo returns what the server said about itself to any of the connected tunnels, nil if it didn't.
+// The caller must hold the lock
+func (a *App) serverInfo() *proto.HelloAck {
+	for _, state := range a.tunnels {
+		if state.manager == nil {
+			continue
+		}
+		if info := state.manager.ServerInfo(); info != nil {
+			return info
+		}
+	}
+	return nil
+}
+
+// formatLimits describes the limits the server enforces, leaving out the ones it doesn't
+func formatLimits(l proto.Limits) string {
+	var parts []string
+	if l.MaxTunnels > 0 {
+		parts = append(parts, fmt.Sprintf("%d tunnels max", l.MaxTunnels))
+	}
+	if l.MaxBodyBytes > 0 {
+		parts = append(parts, fmt.Sprintf("%s max body", formatSize(l.MaxBodyBytes)))
+	}
+	if l.TunnelIdleTimeoutMs > 0 {
+		parts = append(parts, fmt.Sprintf("closed after %s idle", time.Duration(l.TunnelIdleTimeoutMs)*time.Millisecond))
+	}
+	if l.TunnelMaxLifetimeMs > 0 {
+		parts = append(parts, fmt.Sprintf("%s max lifetime", time.Duration(l.TunnelMaxLifetimeMs)*time.Millisecond))
+	}
+	return strings.Join(parts, " • ")
+}
+
+// formatSize formats a number of bytes in the largest unit it's a whole number of
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return fmt.Sprintf("%dMB", n>>20)
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return fmt.Sprintf("%dKB", n>>10)
+	default:
+		return fmt.Sprintf("%dB", n)
+	}
+}
+
+func formatTimeLeft(left time.Duration) string {
+	if left <= 0 {
+		return "0s"
+	}
+	if left < time.Minute {
+		return left.Round(time.Second).String()
+	}
+	return strings.TrimSuffix(left.Round(time.Minute).String(), "0s")
+}
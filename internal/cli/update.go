@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/version"
+)
+
+// updateCheckTimeout is how long the update check waits on the server before giving up
+const updateCheckTimeout = 5 * time.Second
+
+// CheckForUpdate asks the server for the latest CLI release, noting it for the dashboard if it's newer
+// than this one. It's only a convenience, so it's meant to be run in the background and fails quietly
+func (a *App) CheckForUpdate() {
+	latest, err := latestVersion(a.Cfg.ServerURL)
+	if err != nil {
+		a.logger.Debug("Failed to check for a newer version", "error", err)
+		return
+	}
+
+	notice := updateNotice(latest, version.Version)
+	if notice == "" {
+		return
+	}
+	a.logger.Info("A newer version of the CLI is available", "latest", latest, "version", version.Version)
+
+	a.mu.Lock()
+	a.updateNotice = notice
+	a.mu.Unlock()
+
+	// Stdout is for the JSON events, url or requests, the dashboard shows the notice itself
+	if a.Cfg.JSONOutput || a.Cfg.PrintURLOnly || a.Cfg.Inspect != "" {
+		fmt.Fprintln(os.Stderr, "Notice: "+notice)
+	}
+}
+
+// latestVersion returns the latest CLI release according to the server. Servers from before it was
+// reported only return their own version, which is released alongside the CLI
+func latestVersion(serverURL string) (string, error) {
+	c := &http.Client{Timeout: updateCheckTimeout}
+	resp, err := c.Get(serverURL + "/version")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("version check returned %s", resp.Status)
+	}
+
+	var body struct {
+		Version          string `json:"version"`
+		LatestCLIVersion string `json:"latest_cli_version"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.LatestCLIVersion == "" {
+		return body.Version, nil
+	}
+	return body.LatestCLIVersion, nil
+}
+
+// updateNotice returns the one line notice shown if the latest release is newer than the current
+// version, or "" if it isn't. Dev builds are never told to update
+func updateNotice(latest, current string) string {
+	if !version.Newer(latest, current) {
+		return ""
+	}
+	return fmt.Sprintf("tunol %s is available, you are running %s", latest, current)
+}
@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jwtly10/go-tunol/internal/config"
+	"github.com/jwtly10/go-tunol/internal/version"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckForUpdate(t *testing.T) {
+	defer func(v string) { version.Version = v }(version.Version)
+	version.Version = "v1.2.0"
+
+	body := `{"version":"v1.4.0","commit":"abc1234","latest_cli_version":"v1.3.0"}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/version" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	newApp := func() *App {
+		return NewApp(&config.ClientConfig{ServerURL: srv.URL}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+
+	a := newApp()
+	a.CheckForUpdate()
+	require.Equal(t, "tunol v1.3.0 is available, you are running v1.2.0", a.updateNotice)
+
+	// Servers from before the latest CLI was reported only have their own version
+	body = `{"version":"v1.4.0","commit":"abc1234"}`
+	a = newApp()
+	a.CheckForUpdate()
+	require.Contains(t, a.updateNotice, "v1.4.0")
+
+	version.Version = "v1.4.0"
+	a = newApp()
+	a.CheckForUpdate()
+	require.Empty(t, a.updateNotice, "Expected no notice when up to date")
+
+	version.Version = "dev"
+	a = newApp()
+	a.CheckForUpdate()
+	require.Empty(t, a.updateNotice, "Expected dev builds never to be told to update")
+
+	srv.Close()
+	version.Version = "v1.2.0"
+	a = newApp()
+	a.CheckForUpdate()
+	require.Empty(t, a.updateNotice, "Expected an unreachable server to be ignored")
+}
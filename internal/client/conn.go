@@ -0,0 +1,379 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/proto"
+	"github.com/jwtly10/go-tunol/internal/version"
+	"golang.org/x/net/websocket"
+)
+
+// errTunnelClosed is returned when a tunnel is closed while it's being registered
+var errTunnelClosed = errors.New("tunnel was closed")
+
+// ErrServerUnreachable is returned when the websocket to the tunol server can't be opened, e.g. the server is
+// down or the url is wrong, rather than the server rejecting the tunnel
+var ErrServerUnreachable = errors.New("can't reach tunol server")
+
+// ServerError is an error the server rejected a tunnel with. The code tells why, so callers can act
+// on it without matching the message
+type ServerError struct {
+	Code      string // One of the proto error codes, empty from servers that predate them
+	Message   string
+	Retryable bool // Set if the server says trying again later may succeed
+}
+
+func (e *ServerError) Error() string {
+	return e.Message
+}
+
+// connection is a websocket to the tunol server. When the server supports it every tunnel of the
+// manager shares one connection, otherwise each tunnel has its own
+type connection struct {
+	ws *websocket.Conn
+
+	mu        sync.Mutex
+	tunnels   map[string]*tunnel // Keyed by the servers id for the tunnel
+	multiplex bool               // Set once the server says the connection can carry several tunnels
+	features  []string           // The optional features the server said it supports in its hello ack
+	pending   *pendingTunnel     // The tunnel request waiting on the server, they're answered in order
+	closed    bool               // Set once the connection is closed, after which it carries no new tunnels
+
+	done chan struct{} // Closed once the connection is no longer read from
+
+	bodies *proto.PendingBodies // Bodies sent as binary frames, waiting on the request they come before. Only used by readMessages
+}
+
+// pendingTunnel is a tunnel request waiting on the servers response
+type pendingTunnel struct {
+	tunnel *tunnel
+	result chan error // Receives nil once the tunnel is switched over to the connection
+}
+
+// dial connects to the tunol server and says hello. Nothing is read from the connection until
+// readMessages is started, so the answer to the first tunnel request can't be missed
+func (c *manager) dial() (*connection, error) {
+	// Create a manual ws config so we can add auth to handshake
+	wsConfig, err := c.cfg.NewWebSocketConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create websocket config: %w", err)
+	}
+
+	if c.cfg.Token != "" {
+		wsConfig.Header.Set("Authorization", "Bearer "+c.cfg.Token)
+	}
+	wsConfig.Header.Set(version.Header, version.Version)
+	wsConfig.Header.Set(proto.ProtocolHeader, strconv.Itoa(proto.ProtocolVersion))
+
+	ws, err := websocket.DialConfig(wsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("%w at %s: %v", ErrServerUnreachable, c.cfg.ServerURL, err)
+	}
+
+	// The ack isn't waited for, servers that predate the hello ignore it and only send the tunnel response
+	hello, _ := proto.NewMessage(proto.MessageTypeHello, proto.Hello{ // Always marshals
+		Version:         version.Version,
+		ProtocolVersion: proto.ProtocolVersion,
+		OS:              runtime.GOOS + "/" + runtime.GOARCH,
+		Capabilities: []string{
+			proto.FeatureTCP, proto.FeatureStreaming, proto.FeatureWebSocket, proto.FeatureMultiplex,
+			proto.FeatureCompression, proto.FeatureBinaryBodies,
+		},
+	})
+	if err := websocket.JSON.Send(ws, hello); err != nil {
+		ws.Close()
+		return nil, fmt.Errorf("failed to send hello: %w", err)
+	}
+
+	return &connection{
+		ws:      ws,
+		tunnels: make(map[string]*tunnel),
+		done:    make(chan struct{}),
+		bodies:  proto.NewPendingBodies(proto.PendingBodyMaxAge, proto.PendingBodyMaxBytes),
+	}, nil
+}
+
+// readMessages reads from the connection until it's closed, handing each message to the tunnel it's for
+func (c *manager) readMessages(cn *connection) {
+	for {
+		var received proto.Received
+		if err := proto.MessageCodec.Receive(cn.ws, &received); err != nil {
+			c.connectionLost(cn, err)
+			return
+		}
+		if received.Body != nil {
+			cn.bodies.Put(received.Body.RequestId, received.Body.Body)
+			continue
+		}
+
+		c.handleMessage(cn, received.Message)
+	}
+}
+
+// connectionLost recovers the tunnels of a connection that stopped being readable, unless they
+// were closed on purpose
+func (c *manager) connectionLost(cn *connection, err error) {
+	close(cn.done)
+
+	cn.mu.Lock()
+	cn.closed = true
+	pending := cn.pending
+	cn.pending = nil
+	tunnels := make([]*tunnel, 0, len(cn.tunnels))
+	for id, t := range cn.tunnels {
+		tunnels = append(tunnels, t)
+		delete(cn.tunnels, id)
+	}
+	cn.mu.Unlock()
+	cn.ws.Close()
+
+	if pending != nil {
+		pending.result <- fmt.Errorf("failed to receive tunnel response: %w", err)
+	}
+
+	c.mu.Lock()
+	if c.conn == cn {
+		c.conn = nil
+	}
+	c.mu.Unlock()
+
+	for _, t := range tunnels {
+		if t.isClosed() {
+			continue // The tunnel was closed on purpose, nothing to recover
+		}
+
+		c.logger.Error("failed to receive websocket message", "url", t.URL(), "error", err)
+		go c.recover(t, err)
+	}
+}
+
+// heartbeat pings the server on an interval until the connection is closed. The pings keep idle tunnels
+// from being dropped by proxies in between, and let the server know the client is still alive
+func (c *manager) heartbeat(cn *connection) {
+	ticker := time.NewTicker(c.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// A failed ping means the connection dropped, which readMessages will notice and recover
+			if err := websocket.JSON.Send(cn.ws, proto.Message{Type: proto.MessageTypePing}); err != nil {
+				c.logger.Debug("failed to send heartbeat ping", "error", err)
+			}
+		case <-cn.done:
+			return
+		}
+	}
+}
+
+// multiplexed reports whether the server said the connection can carry more tunnels
+func (cn *connection) multiplexed() bool {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	return cn.multiplex && !cn.closed
+}
+
+// setFeatures records what the server supports from its hello ack
+func (cn *connection) setFeatures(features []string) {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	cn.multiplex = slices.Contains(features, proto.FeatureMultiplex)
+	cn.features = features
+}
+
+// supports reports whether the server said it supports an optional feature
+func (cn *connection) supports(feature string) bool {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	return slices.Contains(cn.features, feature)
+}
+
+// takeBody returns the body sent as a binary frame before the request with the id
+func (cn *connection) takeBody(requestID string) []byte {
+	return cn.bodies.Take(requestID)
+}
+
+// expect registers the tunnel as waiting on the next tunnel response, returning nil if the
+// connection has been closed in the meantime
+func (cn *connection) expect(t *tunnel) chan error {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+
+	if cn.closed {
+		return nil
+	}
+	cn.pending = &pendingTunnel{tunnel: t, result: make(chan error, 1)}
+	return cn.pending.result
+}
+
+// takePending returns the tunnel request waiting on the server, if any
+func (cn *connection) takePending() *pendingTunnel {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+
+	pending := cn.pending
+	cn.pending = nil
+	return pending
+}
+
+// tunnel returns the tunnel a message is for. Servers that don't multiplex don't tag their messages,
+// but then the connection only carries one tunnel
+func (cn *connection) tunnel(id string) *tunnel {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+
+	if t, exists := cn.tunnels[id]; exists {
+		return t
+	}
+	if !cn.multiplex && len(cn.tunnels) == 1 {
+		for _, t := range cn.tunnels {
+			return t
+		}
+	}
+	return nil
+}
+
+// all returns every tunnel on the connection
+func (cn *connection) all() []*tunnel {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+
+	tunnels := make([]*tunnel, 0, len(cn.tunnels))
+	for _, t := range cn.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	return tunnels
+}
+
+func (cn *connection) add(id string, t *tunnel) {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	cn.tunnels[id] = t
+}
+
+// forget stops routing messages to a tunnel the server has already closed
+func (cn *connection) forget(id string) {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	delete(cn.tunnels, id)
+}
+
+// remove closes a tunnel on the connection. The server is told to close it, even when the connection is
+// about to be closed too, so it doesn't wait to notice the disconnect. The connection is closed once no
+// tunnels are left on it
+func (cn *connection) remove(id string) error {
+	cn.mu.Lock()
+	_, open := cn.tunnels[id]
+	delete(cn.tunnels, id)
+	closed := cn.closed
+	cn.mu.Unlock()
+
+	var err error
+	if open && !closed {
+		err = websocket.JSON.Send(cn.ws, proto.Message{Type: proto.MessageTypeTunnelClose, TunnelID: id})
+	}
+	cn.closeIfUnused()
+	return err
+}
+
+// closeIfUnused closes the connection if it carries no tunnels, and none are being registered on it
+func (cn *connection) closeIfUnused() {
+	cn.mu.Lock()
+	if cn.closed || len(cn.tunnels) > 0 || cn.pending != nil {
+		cn.mu.Unlock()
+		return
+	}
+	cn.closed = true
+	cn.mu.Unlock()
+
+	cn.ws.Close()
+}
+
+// handleMessage handles a message from the server, about either the connection or one of its tunnels
+func (c *manager) handleMessage(cn *connection, msg proto.Message) {
+	switch msg.Type {
+	case proto.MessageTypeHelloAck:
+		if info := c.setServerInfo(msg); info != nil {
+			cn.setFeatures(info.Features)
+		}
+
+	case proto.MessageTypeTunnelResp:
+		c.handleTunnelResponse(cn, msg)
+
+	case proto.MessageTypeError:
+		c.logger.Error("received error message", "error", string(msg.Payload))
+		payload, err := msg.AsError()
+		if err != nil {
+			c.logger.Error("failed to unmarshal error message", "error", err)
+			return
+		}
+		errMsg := ErrorEvent{Code: payload.Code, Error: payload.Message, Retryable: payload.Retryable}
+
+		// Errors are only sent in answer to tunnel requests, or when the connection is rejected
+		if pending := cn.takePending(); pending != nil {
+			cn.closeIfUnused()
+			pending.result <- fmt.Errorf("failed to create tunnel: %w", &ServerError{Code: errMsg.Code, Message: errMsg.Error, Retryable: errMsg.Retryable})
+			return
+		}
+
+		if c.events != nil {
+			c.events(Event{
+				Type:    EventTypeError,
+				Payload: errMsg,
+			})
+		}
+
+	case proto.MessageTypeServerShutdown:
+		for _, t := range cn.all() {
+			c.handleServerShutdown(t, msg)
+		}
+
+	case proto.MessageTypePong:
+		c.logger.Debug("received pong message")
+
+	case proto.MessageTypePing:
+		c.logger.Debug("received ping message")
+		if err := websocket.JSON.Send(cn.ws, proto.Message{Type: proto.MessageTypePong}); err != nil {
+			c.logger.Error("failed to send websocket message", "error", err)
+		}
+
+	default:
+		t := cn.tunnel(msg.TunnelID)
+		if t == nil {
+			c.logger.Warn("received message for unknown tunnel", "type", msg.Type, "tunnelId", msg.TunnelID)
+			return
+		}
+		c.handleTunnelMessage(cn, t, msg)
+	}
+}
+
+// handleTunnelResponse switches the tunnel waiting on the response over to the connection
+func (c *manager) handleTunnelResponse(cn *connection, msg proto.Message) {
+	pending := cn.takePending()
+	if pending == nil {
+		c.logger.Warn("received tunnel response without a tunnel request")
+		return
+	}
+
+	resp, err := msg.AsTunnelResponse()
+	if err != nil {
+		cn.closeIfUnused()
+		pending.result <- fmt.Errorf("could not unmarshal payload: %w", err)
+		return
+	}
+
+	// The tunnel is added before anything else is read, so no requests for it are missed
+	cn.add(resp.ID, pending.tunnel)
+	if !pending.tunnel.setConn(cn, &resp) {
+		cn.remove(resp.ID)
+		pending.result <- errTunnelClosed
+		return
+	}
+	pending.result <- nil
+}
@@ -1,12 +1,33 @@
 package client
 
-import "time"
+import (
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/proto"
+)
 
 type EventType string
 
 const (
-	EventTypeRequest EventType = "request"
-	EventTypeError   EventType = "error"
+	EventTypeRequest          EventType = "request"
+	EventTypeError            EventType = "error"
+	EventTypeReconnect        EventType = "reconnect"
+	EventTypeShutdown         EventType = "shutdown"
+	EventTypeRateLimited      EventType = "rate_limited"
+	EventTypeLocalUnreachable EventType = "local_unreachable"
+	EventTypeTunnelClosed     EventType = "tunnel_closed"
+
+	// With LifecycleEvents set in the config, every tunnel returned by NewTunnel gets an open event, and a close
+	// event when it's closed for good, whoever closed it. As the handler is called from Close it mustn't hold a
+	// lock Close is called under
+	EventTypeTunnelOpen  EventType = "tunnel_open"
+	EventTypeTunnelClose EventType = "tunnel_close"
+)
+
+// Reasons a tunnel is closed, on top of the proto.TunnelClosed reasons for the server closing it
+const (
+	CloseReasonClosed         = "closed"          // Closed VIA Close, or the Close of its manager
+	CloseReasonConnectionLost = "connection_lost" // The connection to the server dropped and couldn't be recovered
 )
 
 type RequestEvent struct {
@@ -17,13 +38,94 @@ type RequestEvent struct {
 	Duration  time.Duration
 	Error     string
 	Timestamp time.Time
+	LocalPort int
+
+	// Request and Response are the full forwarded request and the local servers response
+	Request  *proto.HTTPRequest
+	Response *proto.HTTPResponse
+
+	// Replayed is set to true if the request was replayed from the inspector, rather
+	// than received through the tunnel
+	Replayed bool
+
+	// BodiesOmitted is set to true if the tunnel doesn't capture bodies, in which case Request and
+	// Response only hold the metadata of the request
+	BodiesOmitted bool
 
 	// ConnectionFailed is set to true if the manager lost connection to the server
 	ConnectionFailed bool
+
+	// LocalFailed is set to true if the local server couldn't be reached or read, in which
+	// case Response is the error response sent in its place
+	LocalFailed bool
+}
+
+// TunnelOpenEvent is emitted when a tunnel has been registered with the server by NewTunnel
+type TunnelOpenEvent struct {
+	TunnelID  string
+	LocalPort int
+	Timestamp time.Time
+}
+
+// TunnelCloseEvent is emitted once a tunnel is closed and won't be reconnected
+type TunnelCloseEvent struct {
+	TunnelID  string
+	LocalPort int
+	Reason    string // One of the close reasons, or the proto.TunnelClosed reason if the server closed it
+	Message   string
+	Timestamp time.Time
+}
+
+// ReconnectEvent is emitted when a dropped tunnel has been re-registered with the server
+type ReconnectEvent struct {
+	TunnelID    string // The URL of the tunnel after reconnecting
+	PreviousURL string // The URL of the tunnel before the connection dropped
+	Attempt     int
+	LocalPort   int
+	Timestamp   time.Time
+}
+
+// ShutdownEvent is emitted when the server announces it is shutting down. The tunnel is
+// reconnected once the server closes the connection
+type ShutdownEvent struct {
+	TunnelID  string
+	LocalPort int
+	Message   string
+	Timestamp time.Time
+}
+
+// TunnelClosedEvent is emitted when the server closes the tunnel, e.g. after it's been idle for too long.
+// The tunnel isn't reconnected
+type TunnelClosedEvent struct {
+	TunnelID  string
+	LocalPort int
+	Reason    string // One of the proto.TunnelClosed reasons
+	Message   string
+	Timestamp time.Time
+}
+
+// RateLimitedEvent is emitted when the server rejects requests to the tunnel over its rate limit
+type RateLimitedEvent struct {
+	TunnelID  string
+	LocalPort int
+	Rejected  int // The total number of requests rejected since the tunnel was registered
+	Timestamp time.Time
+}
+
+// LocalUnreachableEvent is emitted when nothing is listening on the local port of a tunnel,
+// either when the tunnel is created or when a request can't be forwarded
+type LocalUnreachableEvent struct {
+	TunnelID  string
+	LocalPort int
+	Message   string
+	Timestamp time.Time
 }
 
+// ErrorEvent is emitted when the server sends an error that isn't the answer to a tunnel request
 type ErrorEvent struct {
-	Error string `json:"error"`
+	Error     string `json:"error"`
+	Code      string `json:"code"`      // One of the proto error codes, empty if the server didn't send one
+	Retryable bool   `json:"retryable"` // Set if the server says trying again later may succeed
 }
 
 type Event struct {
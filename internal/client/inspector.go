@@ -0,0 +1,294 @@
+package client
+
+import (
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jwtly10/go-tunol/internal/proto"
+)
+
+// CapturedRequest is a forwarded request and its response, as recorded by the RequestLog
+type CapturedRequest struct {
+	ID         int                 `json:"id"`
+	TunnelURL  string              `json:"tunnel_url"`
+	LocalPort  int                 `json:"local_port"`
+	Method     string              `json:"method"`
+	Path       string              `json:"path"`
+	Status     int                 `json:"status"`
+	DurationMs int64               `json:"duration_ms"`
+	Error      string              `json:"error,omitempty"`
+	Replayed   bool                `json:"replayed,omitempty"`
+	Timestamp  time.Time           `json:"timestamp"`
+	Request    *proto.HTTPRequest  `json:"request,omitempty"`
+	Response   *proto.HTTPResponse `json:"response,omitempty"`
+
+	BodiesOmitted bool `json:"bodies_omitted,omitempty"` // The tunnel doesn't capture bodies, only metadata was recorded
+}
+
+// RequestLog is a fixed size ring buffer of the most recently forwarded requests
+type RequestLog struct {
+	entries []CapturedRequest
+	next    int // The index the next entry will be written to
+	count   int
+	lastID  int
+
+	mu sync.Mutex
+}
+
+func NewRequestLog(size int) *RequestLog {
+	return &RequestLog{
+		entries: make([]CapturedRequest, size),
+	}
+}
+
+// Record stores a request event, overwriting the oldest entry once the log is full
+func (l *RequestLog) Record(e RequestEvent) CapturedRequest {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lastID++
+	captured := CapturedRequest{
+		ID:         l.lastID,
+		TunnelURL:  e.TunnelID,
+		LocalPort:  e.LocalPort,
+		Method:     e.Method,
+		Path:       e.Path,
+		Status:     e.Status,
+		DurationMs: e.Duration.Milliseconds(),
+		Error:      e.Error,
+		Replayed:   e.Replayed,
+		Timestamp:  e.Timestamp,
+		Request:    e.Request,
+		Response:   e.Response,
+
+		BodiesOmitted: e.BodiesOmitted,
+	}
+
+	l.entries[l.next] = captured
+	l.next = (l.next + 1) % len(l.entries)
+	if l.count < len(l.entries) {
+		l.count++
+	}
+
+	return captured
+}
+
+// List returns all recorded requests, newest first
+func (l *RequestLog) List() []CapturedRequest {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	list := make([]CapturedRequest, 0, l.count)
+	for i := 1; i <= l.count; i++ {
+		idx := (l.next - i + len(l.entries)) % len(l.entries)
+		list = append(list, l.entries[idx])
+	}
+	return list
+}
+
+// Get returns the recorded request with the given id, if it is still in the log
+func (l *RequestLog) Get(id int) (CapturedRequest, bool) {
+	for _, c := range l.List() {
+		if c.ID == id {
+			return c, true
+		}
+	}
+	return CapturedRequest{}, false
+}
+
+// Replayer re-sends a captured request to the local server on localPort
+type Replayer interface {
+	Replay(localPort int, req proto.HTTPRequest) (*proto.HTTPResponse, error)
+}
+
+// Inspector serves a local web UI and JSON API for browsing requests in a RequestLog
+type Inspector struct {
+	log      *RequestLog
+	replayer Replayer // May be nil, in which case replaying is unavailable
+	mux      *http.ServeMux
+	logger   *slog.Logger
+}
+
+func NewInspector(log *RequestLog, replayer Replayer, logger *slog.Logger) *Inspector {
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+	}
+
+	i := &Inspector{
+		log:      log,
+		replayer: replayer,
+		mux:      http.NewServeMux(),
+		logger:   logger,
+	}
+
+	i.mux.HandleFunc("GET /{$}", i.handleIndex)
+	i.mux.HandleFunc("GET /api/requests", i.handleListRequests)
+	i.mux.HandleFunc("GET /api/requests/{id}", i.handleGetRequest)
+	i.mux.HandleFunc("POST /replay/{id}", i.handleReplay)
+
+	return i
+}
+
+func (i *Inspector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	i.mux.ServeHTTP(w, r)
+}
+
+func (i *Inspector) handleIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := inspectorTemplate.Execute(w, i.log.List()); err != nil {
+		i.logger.Error("failed to render inspector", "error", err)
+	}
+}
+
+func (i *Inspector) handleListRequests(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(i.log.List())
+}
+
+func (i *Inspector) handleGetRequest(w http.ResponseWriter, r *http.Request) {
+	captured, ok := i.capturedFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(captured)
+}
+
+// handleReplay re-sends a captured request to the local server and returns the new response
+func (i *Inspector) handleReplay(w http.ResponseWriter, r *http.Request) {
+	if i.replayer == nil {
+		http.Error(w, "Replaying is not available", http.StatusNotImplemented)
+		return
+	}
+
+	captured, ok := i.capturedFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if captured.Request == nil || captured.BodiesOmitted {
+		http.Error(w, "Request was not captured in full", http.StatusUnprocessableEntity)
+		return
+	}
+
+	resp, err := i.replayer.Replay(captured.LocalPort, *captured.Request)
+	if err != nil {
+		i.logger.Error("failed to replay request", "id", captured.ID, "error", err)
+		http.Error(w, "Failed to replay request: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// capturedFromPath looks up the captured request for the id in the path, writing an
+// error response if it cannot be found
+func (i *Inspector) capturedFromPath(w http.ResponseWriter, r *http.Request) (CapturedRequest, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid request id", http.StatusBadRequest)
+		return CapturedRequest{}, false
+	}
+
+	captured, ok := i.log.Get(id)
+	if !ok {
+		http.Error(w, "Request not found", http.StatusNotFound)
+		return CapturedRequest{}, false
+	}
+
+	return captured, true
+}
+
+// displayBody renders a body for the inspector UI, summarising binary content
+func displayBody(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	if !utf8.Valid(body) {
+		return "<" + strconv.Itoa(len(body)) + " bytes of binary data>"
+	}
+	return string(body)
+}
+
+// displayHeaders renders headers one per line, in a stable order
+func displayHeaders(headers map[string]string) string {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k + ": " + headers[k] + "\n")
+	}
+	return b.String()
+}
+
+var inspectorTemplate = template.Must(template.New("inspector").Funcs(template.FuncMap{
+	"body":    displayBody,
+	"headers": displayHeaders,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>tunol inspector</title>
+    <style>
+        body { font-family: -apple-system, BlinkMacSystemFont, sans-serif; margin: 2rem; color: #1f2937; }
+        summary { cursor: pointer; padding: 0.5rem; font-family: monospace; }
+        details { border-bottom: 1px solid #e5e7eb; }
+        pre { background: #f9fafb; padding: 0.75rem; overflow-x: auto; white-space: pre-wrap; }
+        .error { color: #dc2626; }
+        .muted { color: #6b7280; }
+    </style>
+</head>
+<body>
+<h1>tunol inspector</h1>
+<p class="muted">{{len .}} recent requests, newest first. <a href="/">Refresh</a> &middot; <a href="/api/requests">JSON</a></p>
+{{range .}}
+{{$omitted := .BodiesOmitted}}
+<details>
+    <summary>
+        <span class="muted">{{.Timestamp.Format "15:04:05"}}</span>
+        [:{{.LocalPort}}] <span {{if or (ge .Status 500) .Error}}class="error"{{end}}>{{.Status}}</span>
+        {{.Method}} {{if .Path}}{{.Path}}{{else}}/{{end}} <span class="muted">{{.DurationMs}}ms{{if .Replayed}} (replay){{end}}</span>
+    </summary>
+    {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+    {{if and .Request (not .BodiesOmitted)}}<button onclick="replay({{.ID}})">Replay</button>{{end}}
+    {{with .Request}}
+    <h4>Request</h4>
+    <pre>{{.Method}} {{.Path}}
+{{headers .Headers}}
+{{if $omitted}}<span class="muted">(body not captured)</span>{{else}}{{body .Body}}{{end}}</pre>
+    {{end}}
+    {{with .Response}}
+    <h4>Response</h4>
+    <pre>{{.StatusCode}}
+{{headers .Headers}}
+{{if $omitted}}<span class="muted">(body not captured)</span>{{else}}{{body .Body}}{{end}}</pre>
+    {{end}}
+</details>
+{{end}}
+<script>
+    async function replay(id) {
+        const resp = await fetch('/replay/' + id, { method: 'POST' });
+        if (!resp.ok) {
+            alert(await resp.text());
+            return;
+        }
+        location.reload();
+    }
+</script>
+</body>
+</html>`))
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestLogKeepsMostRecent(t *testing.T) {
+	l := NewRequestLog(3)
+	for i := 0; i < 5; i++ {
+		l.Record(RequestEvent{Method: "GET", Path: "/", Status: 200, Timestamp: time.Now()})
+	}
+
+	list := l.List()
+	require.Len(t, list, 3)
+	require.Equal(t, []int{5, 4, 3}, []int{list[0].ID, list[1].ID, list[2].ID})
+
+	_, ok := l.Get(1)
+	require.False(t, ok, "oldest request should have been evicted")
+
+	_, ok = l.Get(4)
+	require.True(t, ok)
+}
+
+func TestInspectorAPI(t *testing.T) {
+	l := NewRequestLog(10)
+	l.Record(RequestEvent{
+		TunnelID: "http://abc.localhost",
+		Method:   "POST",
+		Path:     "/hook",
+		Status:   201,
+		Request: &proto.HTTPRequest{
+			Method: "POST",
+			Path:   "/hook",
+			Body:   []byte(`{"ok":true}`),
+		},
+		Response: &proto.HTTPResponse{
+			StatusCode: 201,
+			Body:       []byte("created"),
+		},
+	})
+
+	ts := httptest.NewServer(NewInspector(l, nil, nil))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/requests")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var list []CapturedRequest
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	require.Len(t, list, 1)
+	require.Equal(t, "/hook", list[0].Path)
+	require.Equal(t, []byte("created"), list[0].Response.Body)
+
+	resp, err = http.Get(ts.URL + "/api/requests/999")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = http.Get(ts.URL + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+}
+
+type fakeReplayer struct {
+	port int
+	req  proto.HTTPRequest
+}
+
+func (f *fakeReplayer) Replay(localPort int, req proto.HTTPRequest) (*proto.HTTPResponse, error) {
+	f.port = localPort
+	f.req = req
+	return &proto.HTTPResponse{StatusCode: 200, Body: []byte("replayed")}, nil
+}
+
+func TestInspectorReplay(t *testing.T) {
+	l := NewRequestLog(10)
+	captured := l.Record(RequestEvent{
+		LocalPort: 3001,
+		Method:    "POST",
+		Path:      "/hook",
+		Request:   &proto.HTTPRequest{Method: "POST", Path: "/hook"},
+	})
+	partial := l.Record(RequestEvent{LocalPort: 3001, Method: "GET", Path: "/"})
+	omitted := l.Record(RequestEvent{
+		LocalPort:     3001,
+		Method:        "POST",
+		Path:          "/hook",
+		Request:       &proto.HTTPRequest{Method: "POST", Path: "/hook"},
+		BodiesOmitted: true,
+	})
+
+	replayer := &fakeReplayer{}
+	ts := httptest.NewServer(NewInspector(l, replayer, nil))
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/replay/"+strconv.Itoa(captured.ID), "", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 3001, replayer.port)
+	require.Equal(t, "/hook", replayer.req.Path)
+
+	var replayResp proto.HTTPResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&replayResp))
+	require.Equal(t, []byte("replayed"), replayResp.Body)
+
+	resp, err = http.Post(ts.URL+"/replay/"+strconv.Itoa(partial.ID), "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	// Replaying without the body would send a different request
+	resp, err = http.Post(ts.URL+"/replay/"+strconv.Itoa(omitted.ID), "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+}
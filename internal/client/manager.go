@@ -2,10 +2,13 @@ package client
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"strings"
@@ -14,15 +17,34 @@ import (
 
 	"github.com/jwtly10/go-tunol/internal/config"
 	"github.com/jwtly10/go-tunol/internal/proto"
+	"github.com/jwtly10/go-tunol/internal/utils"
 
 	"golang.org/x/net/websocket"
 )
 
+// errResponseTooLarge is returned when a local response is over the servers body size limit
+var errResponseTooLarge = errors.New("response too large")
+
+// errLocalTimeout cancels a request the local server didn't answer before the server would give up on it
+var errLocalTimeout = errors.New("local server timed out")
+
+// localTimeoutMargin is how long before the server times out a request the client gives up on the local
+// server, so its timeout response still reaches the server
+const localTimeoutMargin = time.Second
+
 type TunnelManager interface {
 	// NewTunnel creates a new tunnel and returns it
 	NewTunnel(localPort int) (Tunnel, error)
 	// Tunnels returns all active tunnels
 	Tunnels() []Tunnel
+	// Replay re-sends a captured request to the local server of the tunnel on localPort
+	Replay(localPort int, req proto.HTTPRequest) (*proto.HTTPResponse, error)
+	// ServerInfo returns what the server said about itself when the last tunnel connected, nil for
+	// servers that don't answer the hello
+	ServerInfo() *proto.HelloAck
+	// CloseTunnel closes the tunnel with the public url, telling the server to remove it, while the
+	// other tunnels carry on
+	CloseTunnel(url string) error
 	// Close cleans up and closes all active tunnels
 	Close() error
 }
@@ -32,6 +54,14 @@ type Tunnel interface {
 	URL() string
 	// LocalPort returns the local port of the tunnel
 	LocalPort() int
+	// ID returns the servers id for the tunnel, empty if the server didn't say
+	ID() string
+	// Created returns when the server registered the tunnel, zero if the server didn't say
+	Created() time.Time
+	// RateLimit returns the requests per second limit the server enforces on the tunnel, 0 if unlimited
+	RateLimit() float64
+	// ExpiresAt returns when the server closes the tunnel however much it's used, zero if it doesn't expire
+	ExpiresAt() time.Time
 	// Close closes the specific tunnel instance
 	Close() error
 }
@@ -39,8 +69,12 @@ type Tunnel interface {
 type EventHandler func(event Event)
 
 type manager struct {
-	tunnels map[string]Tunnel
-	events  EventHandler
+	tunnels    map[string]Tunnel
+	events     EventHandler
+	httpClient *http.Client // Client used to forward requests to the local server
+	serverInfo *proto.HelloAck
+	conn       *connection // The connection new tunnels share, if the server supports it
+	regMu      sync.Mutex  // Only one tunnel request can be waiting on the server at a time
 
 	mu     sync.Mutex
 	cfg    *config.ClientConfig
@@ -49,313 +83,843 @@ type manager struct {
 
 type tunnel struct {
 	url       string
+	id        string    // The servers id for the tunnel
+	created   time.Time // When the server registered the tunnel, reset on reconnect
 	localPort int
-	wsConn    *websocket.Conn
+	rateLimit float64       // The requests per second limit enforced by the server, 0 if unlimited
+	maxBody   int64         // The largest response body the server accepts, 0 if unlimited
+	timeout   time.Duration // How long the server waits for the response to a request, 0 if it didn't say
+	noBodies  bool          // Bodies are left out of request events, only their metadata is recorded
+	expiresAt time.Time     // When the server closes the tunnel, zero if it doesn't expire
+	cn        *connection
+	tcpConns  map[string]*tcpConn        // Local connections of a tcp tunnel, keyed by connection id
+	streams   map[string]func()          // Cancels streaming responses in progress, keyed by request id
+	proxiedWS map[string]*websocket.Conn // Local websocket passthrough connections, keyed by connection id
+
+	cfg     *config.ClientConfig // The config of the manager, with any settings for the tunnels port applied
+	manager *manager             // The manager the tunnel belongs to, which shares its connection with other tunnels
+
+	mu        sync.Mutex    // Protects url and cn, which change on reconnect, and the connection maps
+	done      chan struct{} // Closed when the tunnel is closed on purpose
+	closeOnce sync.Once
 }
 
+const (
+	initialReconnectBackoff = 1 * time.Second
+	maxReconnectBackoff     = 30 * time.Second
+)
+
 func NewTunnelManager(cfg *config.ClientConfig, logger *slog.Logger, events EventHandler) TunnelManager {
 	if logger == nil {
 		logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
 	}
 	return &manager{
-		tunnels: make(map[string]Tunnel),
-		events:  events,
+		tunnels:    make(map[string]Tunnel),
+		events:     events,
+		httpClient: newLocalHTTPClient(cfg),
 
 		cfg:    cfg,
 		logger: logger,
 	}
 }
 
+// newLocalHTTPClient creates the client used to forward requests to the local server
+func newLocalHTTPClient(cfg *config.ClientConfig) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// The transport would otherwise ask for gzip when the public client didn't, changing the request. The
+	// response goes through the tunnel uncompressed either way
+	transport.DisableCompression = true
+	if cfg.InsecureSkipVerify {
+		// Local dev servers often use self-signed certs, so allow opting out of verification
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse // Don't follow redirects
+		},
+	}
+}
+
 func (c *manager) NewTunnel(localPort int) (Tunnel, error) {
 	c.logger.Info("creating new tunnel", "localPort", localPort)
 
-	headers := make(http.Header)
-	if c.cfg.Token != "" {
-		headers.Set("Authorization", "Bearer "+c.cfg.Token)
+	// Each tunnel gets its own config, so tunnels from the config file can be set up differently
+	cfg := c.cfg.ForTunnel(localPort)
+	t := &tunnel{
+		localPort: localPort,
+		cfg:       cfg,
+		manager:   c,
+		noBodies:  cfg.NoCaptureBodies,
+		tcpConns:  make(map[string]*tcpConn),
+		streams:   make(map[string]func()),
+		proxiedWS: make(map[string]*websocket.Conn),
+		done:      make(chan struct{}),
 	}
 
-	// Create a manual ws config so we can add auth to handshake
-	wsConfig, err := c.cfg.NewWebSocketConfig()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create websocket config: %w", err)
+	if err := c.register(t); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.tunnels[t.URL()] = t
+	c.mu.Unlock()
+
+	// Only once the tunnel is registered, so the handler can look it up or close it
+	c.emitLifecycleEvent(Event{
+		Type:    EventTypeTunnelOpen,
+		Payload: TunnelOpenEvent{TunnelID: t.URL(), LocalPort: localPort, Timestamp: time.Now()},
+	})
+
+	// Warn, but don't fail, if the local server hasn't been started yet
+	if err := c.checkLocal(t); err != nil {
+		c.localUnreachable(t, err)
 	}
 
-	if c.cfg.Token != "" {
-		wsConfig.Header.Set("Authorization", "Bearer "+c.cfg.Token)
+	return t, nil
+}
+
+// setServerInfo stores the servers answer to the hello, returning it
+func (c *manager) setServerInfo(msg proto.Message) *proto.HelloAck {
+	ack, err := msg.AsHelloAck()
+	if err != nil {
+		c.logger.Warn("could not unmarshal hello ack", "error", err)
+		return nil
 	}
 
-	ws, err := websocket.DialConfig(wsConfig)
+	c.logger.Debug("server hello", "version", ack.Version, "protocol", ack.ProtocolVersion, "features", ack.Features)
+	c.mu.Lock()
+	c.serverInfo = &ack
+	c.mu.Unlock()
+	return &ack
+}
+
+func (c *manager) ServerInfo() *proto.HelloAck {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.serverInfo
+}
+
+// register requests a tunnel for the local port of t from the tunol server, switching t over to
+// the connection once the server answers. The connection of the other tunnels is reused if the
+// server supports it, otherwise a new one is dialed
+func (c *manager) register(t *tunnel) error {
+	req, err := proto.NewMessage(proto.MessageTypeTunnelReq, tunnelRequest(t.cfg, t.localPort))
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to tunol server: %w", err)
+		return fmt.Errorf("failed to marshal tunnel request: %w", err)
 	}
 
+	// The server answers tunnel requests in order without saying which request it's answering,
+	// so only one can be waiting at a time
+	c.regMu.Lock()
+	defer c.regMu.Unlock()
+
+	c.mu.Lock()
+	cn := c.conn
+	c.mu.Unlock()
+
+	var result chan error
+	if cn != nil && cn.multiplexed() {
+		result = cn.expect(t)
+	}
+	if result == nil {
+		cn, err = c.dial()
+		if err != nil {
+			return err
+		}
+		result = cn.expect(t)
+
+		c.mu.Lock()
+		c.conn = cn
+		c.mu.Unlock()
+
+		go c.readMessages(cn)
+		if c.cfg.HeartbeatInterval > 0 {
+			go c.heartbeat(cn)
+		}
+	}
+
+	// The server may have already rejected the connection after the hello, e.g. for a bad token, so
+	// a failed send is left for the response, which is then the error or the connection dropping
+	if err := websocket.JSON.Send(cn.ws, req); err != nil {
+		c.logger.Debug("failed to send tunnel request", "localPort", t.localPort, "error", err)
+	}
+
+	return <-result
+}
+
+// tunnelRequest builds the request for a tunnel to the local port from its config
+func tunnelRequest(cfg *config.ClientConfig, localPort int) proto.TunnelRequest {
 	req := proto.TunnelRequest{
 		LocalPort: localPort,
+		Subdomain: cfg.Subdomain,
+		Protocol:  cfg.Protocol,
+	}
+	req.RequestsPerSecond = cfg.RateLimit
+	req.PassAllHeaders = cfg.PassAllHeaders
+	req.AllowHeaders = cfg.AllowHeaders
+	req.Verbatim = cfg.Verbatim
+	req.CaptureBodies = !cfg.NoCaptureBodies
+	if len(cfg.CORSOrigins) > 0 {
+		req.CORS = &proto.CORSPolicy{
+			AllowOrigins:     cfg.CORSOrigins,
+			AllowMethods:     cfg.CORSMethods,
+			AllowHeaders:     cfg.CORSHeaders,
+			AllowCredentials: cfg.CORSCredentials,
+			MaxAgeSeconds:    int(cfg.CORSMaxAge.Seconds()),
+		}
+	}
+	if user, pass, ok := cfg.BasicAuthCredentials(); ok {
+		req.BasicAuthUser = user
+		req.BasicAuthPassHash = utils.HashToken(pass)
+	}
+	return req
+}
+
+// recover reconnects a tunnel whose connection dropped, closing it if it can't be recovered
+func (c *manager) recover(t *tunnel, err error) {
+	reconnectErr := c.reconnect(t)
+	if reconnectErr == nil || t.isClosed() {
+		return
 	}
 
-	if err := websocket.JSON.Send(ws, proto.Message{
-		Type:    proto.MessageTypeTunnelReq,
-		Payload: req,
-	}); err != nil {
-		return nil, fmt.Errorf("failed to send tunnel request: %w", err)
+	msg := "TunnelManager lost connection to server: " + err.Error()
+	var serverErr *ServerError
+	if errors.As(reconnectErr, &serverErr) {
+		msg += ", and the server rejected reconnecting: " + serverErr.Message
 	}
 
-	// Now wait for response of tunnel init
-	var resp proto.Message
-	if err := websocket.JSON.Receive(ws, &resp); err != nil {
-		return nil, fmt.Errorf("failed to receive tunnel response: %w", err)
+	if c.events != nil {
+		c.events(Event{
+			Type: EventTypeRequest,
+			Payload: RequestEvent{
+				TunnelID:         t.URL(),
+				Error:            msg,
+				Timestamp:        time.Now(),
+				LocalPort:        t.localPort,
+				ConnectionFailed: true,
+			},
+		})
 	}
-	// This should either be a success with tunnel details, or an error
-	// In case of an error we end here
-	switch resp.Type {
-	case proto.MessageTypeTunnelResp:
-		break
-	case proto.MessageTypeError:
-		var eEvent ErrorEvent
-		b, err := json.Marshal(resp.Payload)
+
+	t.closeWith(CloseReasonConnectionLost, msg)
+}
+
+// reconnect attempts to re-register a tunnel whose connection dropped, backing off
+// exponentially between attempts. It returns why if the tunnel could not be recovered, errors the server
+// says won't go away aren't retried
+func (c *manager) reconnect(t *tunnel) error {
+	// The server drops the public side of any streamed connections with the websocket
+	t.closeTCPConns()
+	t.closeProxiedWS()
+
+	backoff := initialReconnectBackoff
+	for attempt := 1; attempt <= c.cfg.ReconnectMaxRetries; attempt++ {
+		c.logger.Info("attempting to reconnect tunnel", "url", t.URL(), "attempt", attempt, "backoff", backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-t.done:
+			return errTunnelClosed // Tunnel was closed while we were waiting
+		}
+
+		previousURL := t.URL()
+		if err := c.register(t); err != nil {
+			if errors.Is(err, errTunnelClosed) {
+				return err
+			}
+			// Servers that predate the codes don't say, so their errors are still retried
+			var serverErr *ServerError
+			if errors.As(err, &serverErr) && serverErr.Code != "" && !serverErr.Retryable {
+				c.logger.Error("server rejected reconnecting tunnel", "url", previousURL, "attempt", attempt, "code", serverErr.Code, "error", err)
+				return err
+			}
+			c.logger.Error("failed to reconnect tunnel", "url", previousURL, "attempt", attempt, "error", err)
+			backoff = min(backoff*2, maxReconnectBackoff)
+			continue
+		}
+
+		url := t.URL()
+		c.mu.Lock()
+		delete(c.tunnels, previousURL)
+		c.tunnels[url] = t
+		c.mu.Unlock()
+
+		c.logger.Info("tunnel reconnected", "previousUrl", previousURL, "url", url, "attempt", attempt)
+
+		if c.events != nil {
+			c.events(Event{
+				Type: EventTypeReconnect,
+				Payload: ReconnectEvent{
+					TunnelID:    url,
+					PreviousURL: previousURL,
+					Attempt:     attempt,
+					LocalPort:   t.localPort,
+					Timestamp:   time.Now(),
+				},
+			})
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("gave up reconnecting after %d attempts", c.cfg.ReconnectMaxRetries)
+}
+
+// handleTunnelMessage handles a message from the server for one of the tunnels on the connection
+func (c *manager) handleTunnelMessage(cn *connection, t *tunnel, msg proto.Message) {
+	switch msg.Type {
+	case proto.MessageTypeRateLimited:
+		c.handleRateLimited(t, msg)
+
+	case proto.MessageTypeTunnelClosed:
+		// The server has already closed the tunnel, and closes the connection if it was the only one
+		// on it, which mustn't be mistaken for it dropping
+		cn.forget(t.ID())
+		closed := c.handleTunnelClosed(t, msg)
+		t.closeWith(closed.Reason, closed.Message)
+
+	case proto.MessageTypeHTTPRequest:
+		startTime := time.Now()
+		// Parse the proxied request from messages
+		httpReq, err := msg.AsHTTPRequest()
 		if err != nil {
-			return nil, fmt.Errorf("could not marshal error payload: %w", err)
+			c.logger.Error("failed to unmarshal HTTP request", "error", err)
+			return
+		}
+		// Logged parsed, never as the raw payload, so the redactor masks credentials in the headers
+		c.logger.Debug("received HTTP request", "requestId", httpReq.RequestId, "method", httpReq.Method, "path", httpReq.Path, "headers", httpReq.Headers)
+		// Taken either way, as nothing else can claim a body once its request has arrived
+		if body := cn.takeBody(httpReq.RequestId); httpReq.BodyFrame {
+			httpReq.Body, httpReq.BodyFrame = body, false
 		}
-		if err := json.Unmarshal(b, &eEvent); err != nil {
-			return nil, fmt.Errorf("could not unmarshal error payload: %w", err)
+		if httpReq.Body, err = proto.DecompressBody(httpReq.Body, httpReq.BodyEncoding, t.requestBodyLimit()); err != nil {
+			c.logger.Error("failed to decompress HTTP request", "requestId", httpReq.RequestId, "error", err)
+			c.failRequest(t, httpReq, startTime, http.StatusBadGateway, "Failed to read request from tunnel")
+			return
 		}
+		httpReq.BodyEncoding = ""
+		c.logger.Debug("3. client received from websocket", "headers", httpReq.Headers)
+
+		// Forward the generated request to local host
+		go c.forwardRequest(t, httpReq, startTime)
+
+	case proto.MessageTypeHTTPStreamClose:
+		c.handleHTTPStreamClose(t, msg)
+
+	case proto.MessageTypeTCPData:
+		c.handleTCPData(t, msg)
 
-		return nil, fmt.Errorf("failed to create tunnel: %s", eEvent.Error)
+	case proto.MessageTypeTCPClose:
+		c.handleTCPClose(t, msg)
+
+	case proto.MessageTypeWSOpen:
+		c.handleWSOpen(t, msg)
+
+	case proto.MessageTypeWSFrame:
+		c.handleWSFrame(t, msg)
+
+	case proto.MessageTypeWSClose:
+		c.handleWSClose(t, msg)
+
+	default:
+		c.logger.Warn("unknown message type", "type", msg.Type)
 	}
+}
 
-	b, err := json.Marshal(resp.Payload)
+// handleServerShutdown surfaces the servers shutdown notice. The connection is deliberately left open
+// so in flight requests can still be answered, the server closes it once they have drained, at
+// which point the tunnel is reconnected as normal
+func (c *manager) handleServerShutdown(t *tunnel, msg proto.Message) {
+	shutdown, err := msg.AsServerShutdown()
 	if err != nil {
-		return nil, fmt.Errorf("could not marshal payload: %w", err)
+		c.logger.Error("failed to unmarshal server shutdown", "error", err)
+		return
 	}
 
-	var tunnelResp proto.TunnelResponse
-	if err := json.Unmarshal(b, &tunnelResp); err != nil {
-		return nil, fmt.Errorf("could not unmarshal payload: %w", err)
+	c.logger.Info("server is shutting down", "url", t.URL(), "message", shutdown.Message)
+
+	if c.events != nil {
+		c.events(Event{
+			Type: EventTypeShutdown,
+			Payload: ShutdownEvent{
+				TunnelID:  t.URL(),
+				LocalPort: t.localPort,
+				Message:   shutdown.Message,
+				Timestamp: time.Now(),
+			},
+		})
 	}
+}
 
-	t := &tunnel{
-		url:       tunnelResp.URL,
-		localPort: localPort,
-		wsConn:    ws,
+// handleTunnelClosed surfaces why the server closed the tunnel, returning the reason it gave
+func (c *manager) handleTunnelClosed(t *tunnel, msg proto.Message) proto.TunnelClosed {
+	closed, err := msg.AsTunnelClosed()
+	if err != nil {
+		c.logger.Error("failed to unmarshal tunnel closed message", "error", err)
+		return proto.TunnelClosed{Message: "tunnel closed by server"}
+	}
+
+	c.logger.Info("server closed tunnel", "url", t.URL(), "reason", closed.Reason, "message", closed.Message)
+
+	if c.events != nil {
+		c.events(Event{
+			Type: EventTypeTunnelClosed,
+			Payload: TunnelClosedEvent{
+				TunnelID:  t.URL(),
+				LocalPort: t.localPort,
+				Reason:    closed.Reason,
+				Message:   closed.Message,
+				Timestamp: time.Now(),
+			},
+		})
+	}
+	return closed
+}
+
+// handleRateLimited surfaces that the server is rejecting requests to the tunnel over its rate limit
+func (c *manager) handleRateLimited(t *tunnel, msg proto.Message) {
+	limited, err := msg.AsRateLimited()
+	if err != nil {
+		c.logger.Error("failed to unmarshal rate limited message", "error", err)
+		return
+	}
+
+	c.logger.Debug("tunnel is being rate limited", "url", t.URL(), "rejected", limited.Rejected)
+
+	if c.events != nil {
+		c.events(Event{
+			Type: EventTypeRateLimited,
+			Payload: RateLimitedEvent{
+				TunnelID:  t.URL(),
+				LocalPort: t.localPort,
+				Rejected:  limited.Rejected,
+				Timestamp: time.Now(),
+			},
+		})
+	}
+}
+
+// forwardRequest forwards a proxied request to the local server, sends the response
+// back over the tunnel and emits the request event
+func (c *manager) forwardRequest(t *tunnel, httpReq proto.HTTPRequest, startTime time.Time) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	// A hung local server is given up on, rather than holding on to the request forever
+	timeout := t.localTimeout()
+	timer := time.AfterFunc(timeout, func() { cancel(errLocalTimeout) })
+	defer timer.Stop()
+
+	resp, err := c.doLocalRequest(ctx, t, httpReq)
+	if errors.Is(context.Cause(ctx), errLocalTimeout) {
+		c.logger.Warn("local server didn't respond in time", "path", httpReq.Path, "timeout", timeout)
+		c.failRequest(t, httpReq, startTime, http.StatusGatewayTimeout, "Local server timed out")
+		return
+	}
+	if err != nil {
+		// Answer straight away, rather than leave the server waiting until it times out
+		c.logger.Error("failed to forward request to local server", "error", err)
+		if isDialError(err) {
+			c.localUnreachable(t, err)
+		}
+		c.failRequest(t, httpReq, startTime, http.StatusBadGateway, "Failed to reach local server")
+		return
+	}
+
+	// Event streams never finish, so their body is sent on as it is written. Only the headers have
+	// to arrive in time
+	if isEventStream(resp) {
+		timer.Stop()
+		c.streamResponse(t, httpReq, resp, startTime, func() { cancel(nil) })
+		return
+	}
+
+	httpResp, err := c.readLocalResponse(httpReq, resp, t.maxBodyBytes())
+	if errors.Is(context.Cause(ctx), errLocalTimeout) {
+		c.logger.Warn("local server didn't finish the response in time", "path", httpReq.Path, "timeout", timeout)
+		c.failRequest(t, httpReq, startTime, http.StatusGatewayTimeout, "Local server timed out")
+		return
+	}
+	if errors.Is(err, errResponseTooLarge) {
+		c.logger.Warn("local response is too large to send through the tunnel", "path", httpReq.Path, "error", err)
+		httpResp = localErrorResponse(httpReq, http.StatusBadGateway, "Response too large")
+	} else if err != nil {
+		c.logger.Error("failed to read response from local server", "error", err)
+		c.failRequest(t, httpReq, startTime, http.StatusBadGateway, "Failed to read local response")
+		return
+	}
+
+	if t.cfg.RewriteLinks {
+		rewriteLinks(httpResp, t.basePath())
+	}
+
+	if err := c.sendHTTPResponse(t, httpReq, httpResp, startTime); err != nil {
+		return
+	}
+
+	c.emitRequestEvent(t, httpReq, httpResp, startTime, false)
+}
+
+// localCheckTimeout is how long to wait when checking the local server is listening
+const localCheckTimeout = time.Second
+
+// checkLocal dials the local port of the tunnel to check something is listening on it
+func (c *manager) checkLocal(t *tunnel) error {
+	conn, err := net.DialTimeout("tcp", t.cfg.LocalAddr(t.localPort), localCheckTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// isDialError reports whether a local request failed because the local server couldn't be connected to
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// localUnreachable emits the event for a tunnel whose local server isn't listening
+func (c *manager) localUnreachable(t *tunnel, err error) {
+	c.logger.Warn("local server is not reachable", "localPort", t.localPort, "error", err)
+
+	if c.events != nil {
+		c.events(Event{
+			Type: EventTypeLocalUnreachable,
+			Payload: LocalUnreachableEvent{
+				TunnelID:  t.URL(),
+				LocalPort: t.localPort,
+				Message:   fmt.Sprintf("local server on port %d not reachable, is it running?", t.localPort),
+				Timestamp: time.Now(),
+			},
+		})
 	}
+}
+
+// failRequest answers a request the local server couldn't with the error status, and emits its event
+// so the failure still shows up in the dashboard
+func (c *manager) failRequest(t *tunnel, httpReq proto.HTTPRequest, startTime time.Time, statusCode int, message string) {
+	httpResp := localErrorResponse(httpReq, statusCode, message)
+	c.sendHTTPResponse(t, httpReq, httpResp, startTime)
+
+	if c.events != nil {
+		event := newRequestEvent(t, httpReq, httpResp, startTime, false)
+		event.LocalFailed = true
+		c.events(Event{Type: EventTypeRequest, Payload: event})
+	}
+}
 
+// sendHTTPResponse sends the response to a proxied request back over the tunnel, with how long it took
+// since the request was received on startTime
+func (c *manager) sendHTTPResponse(t *tunnel, httpReq proto.HTTPRequest, httpResp *proto.HTTPResponse, startTime time.Time) error {
+	// Only the copy sent is changed, the response in the request event is left as it was. Bodies the
+	// local server already compressed won't get any smaller
+	wireResp := *httpResp
+	wireResp.RequestSentAt, wireResp.LocalDuration = httpReq.SentAt, time.Since(startTime)
+	if t.serverSupports(proto.FeatureCompression) && httpResp.Headers["Content-Encoding"] == "" {
+		wireResp.Body, wireResp.BodyEncoding = proto.CompressBody(httpResp.Body)
+	}
+	if len(wireResp.Body) > 0 && t.serverSupports(proto.FeatureBinaryBodies) {
+		if err := t.sendBody(wireResp.RequestId, wireResp.Body); err != nil {
+			c.logger.Error("failed to send HTTP response body", "requestId", httpResp.RequestId, "error", err)
+			return err
+		}
+		wireResp.Body, wireResp.BodyFrame = nil, true
+	}
+
+	err := t.send(proto.MessageTypeHTTPResponse, &wireResp)
+	if err != nil {
+		c.logger.Error("failed to send HTTP response", "requestId", httpResp.RequestId, "error", err)
+	}
+	return err
+}
+
+// localErrorResponse builds the response sent in place of one the local server couldn't provide
+func localErrorResponse(httpReq proto.HTTPRequest, statusCode int, message string) *proto.HTTPResponse {
+	return &proto.HTTPResponse{
+		StatusCode: statusCode,
+		Headers:    map[string]string{"Content-Type": "text/plain; charset=utf-8"},
+		Body:       []byte(message),
+		RequestId:  httpReq.RequestId,
+	}
+}
+
+// Replay re-sends a previously captured request to the local server of the tunnel on
+// localPort. The response is returned to the caller rather than sent over the tunnel
+func (c *manager) Replay(localPort int, httpReq proto.HTTPRequest) (*proto.HTTPResponse, error) {
+	var t *tunnel
 	c.mu.Lock()
-	c.tunnels[tunnelResp.URL] = t
+	for _, candidate := range c.tunnels {
+		if candidate.LocalPort() == localPort {
+			t = candidate.(*tunnel)
+			break
+		}
+	}
 	c.mu.Unlock()
 
-	// Now we have created the tunnel we should start a goroutine to listen for messages
-	go c.handleMessages(t)
+	if t == nil {
+		return nil, fmt.Errorf("no tunnel for local port %d", localPort)
+	}
 
-	return t, nil
+	c.logger.Info("replaying request", "localPort", localPort, "method", httpReq.Method, "path", httpReq.Path)
+
+	startTime := time.Now()
+	httpResp, err := c.forwardLocal(t, httpReq)
+	if err != nil {
+		return nil, err
+	}
+
+	c.emitRequestEvent(t, httpReq, httpResp, startTime, true)
+	return httpResp, nil
 }
 
-func (c *manager) handleMessages(t *tunnel) {
-	// Clean up tunnel on exit
-	defer func() {
-		c.mu.Lock()
-		// Close ws
-		t.Close()
-		delete(c.tunnels, t.url)
-		c.mu.Unlock()
-	}()
-
-	for {
-		var msg proto.Message
-		if err := websocket.JSON.Receive(t.wsConn, &msg); err != nil {
-			if c.events != nil {
-				c.events(Event{
-					Payload: RequestEvent{
-						TunnelID:         t.url,
-						Error:            "TunnelManager lost connection to server: " + err.Error(),
-						Timestamp:        time.Now(),
-						ConnectionFailed: true,
-					},
-				})
+// forwardLocal makes the request against the local server of the tunnel and returns its response. It's given
+// up on after the same timeout as forwarded requests, so a hung local server doesn't hang the caller
+func (c *manager) forwardLocal(t *tunnel, httpReq proto.HTTPRequest) (*proto.HTTPResponse, error) {
+	timeout := t.localTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp, err := c.doLocalRequest(ctx, t, httpReq)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("local server didn't respond within %s", timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Replays are returned to the caller rather than sent through the tunnel, so aren't limited
+	return c.readLocalResponse(httpReq, resp, 0)
+}
+
+// doLocalRequest sends the request to the local server of the tunnel, leaving the response body for the caller to read
+func (c *manager) doLocalRequest(ctx context.Context, t *tunnel, httpReq proto.HTTPRequest) (*http.Response, error) {
+	cfg := t.cfg
+	localURL := cfg.LocalURL(t.localPort, httpReq.Path)
+	// Build the request and headers
+	req, err := http.NewRequestWithContext(ctx, httpReq.Method, localURL, bytes.NewReader(httpReq.Body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+
+	c.logger.Debug("headers set when originally forwarding request to local", "headers", httpReq.Headers)
+
+	// Here we need to carefully clean headers to avoid issues with conflicting headers
+	// between cloudflare and any third party services
+
+	isWebSocketUpgrade := strings.EqualFold(httpReq.Headers["Upgrade"], "websocket") &&
+		strings.EqualFold(httpReq.Headers["Connection"], "upgrade")
+
+		// Base headers that are always kept
+	var headersToKeep = map[string]bool{
+		"host":              true,
+		"user-agent":        true,
+		"accept":            true,
+		"accept-encoding":   true,
+		"accept-language":   true,
+		"content-type":      true,
+		"content-encoding":  true, // Bodies are forwarded still encoded, so the local server has to be told how
+		"cookie":            true,
+		"x-forwarded-for":   true,
+		"x-forwarded-proto": true,
+		"x-real-ip":         true,
+		"forwarded":         true,
+		"authorization":     true,
+
+		// Conditional and range requests, so caching and partial downloads work through the tunnel
+		"if-none-match":       true,
+		"if-modified-since":   true,
+		"if-match":            true,
+		"if-unmodified-since": true,
+		"if-range":            true,
+		"range":               true,
+
+		// CORS, so browser apps can call a tunneled api
+		"origin":                                 true,
+		"access-control-request-method":          true,
+		"access-control-request-headers":         true,
+		"access-control-request-private-network": true,
+	}
+
+	// Add WebSocket specific headers if needed
+	if isWebSocketUpgrade {
+		headersToKeep["connection"] = true
+		headersToKeep["upgrade"] = true
+		headersToKeep["sec-websocket-key"] = true
+		headersToKeep["sec-websocket-version"] = true
+		headersToKeep["sec-websocket-protocol"] = true
+		headersToKeep["sec-websocket-extensions"] = true
+	}
+
+	for _, h := range cfg.AllowHeaders {
+		headersToKeep[strings.ToLower(h)] = true
+	}
+
+	if cfg.Verbatim {
+		// Nothing is cleaned, every value is sent as the public client sent it. Servers that predate
+		// verbatim tunnels only send the first value of each header
+		for k, v := range httpReq.Headers {
+			req.Header[k] = []string{v}
+		}
+		for k, v := range httpReq.HeaderValues {
+			req.Header[k] = v
+		}
+	} else {
+		cleaned := make(map[string]string)
+		for k, v := range httpReq.Headers {
+			headerLower := strings.ToLower(k)
+			if headersToKeep[headerLower] || (cfg.PassAllHeaders && !utils.IsHopByHopHeader(k)) {
+				cleaned[k] = v
 			}
+		}
 
-			c.logger.Error("failed to receive websocket message", "error", err)
-			return // This will trigger our deferred cleanup
+		c.logger.Debug("headers after cleaning", "headers", cleaned)
+
+		for k, v := range cleaned {
+			req.Header.Set(k, v)
 		}
 
-		switch msg.Type {
-		case proto.MessageTypeError:
-			c.logger.Error("received error message", "error", msg.Payload)
-			var errMsg ErrorEvent
-			b, err := json.Marshal(msg.Payload)
-			if err != nil {
-				c.logger.Error("failed to marshal error message", "error", err)
-				continue
-			}
-			if err := json.Unmarshal(b, &errMsg); err != nil {
-				c.logger.Error("failed to unmarshal error message", "error", err)
-				continue
-			}
+		// The /local/<id> path of the tunnel is stripped, so apps are told it to build their links with
+		if prefix := t.basePath(); prefix != "" {
+			req.Header.Set(prefixHeader, prefix)
+		}
+	}
 
-			if c.events != nil {
-				c.events(Event{
-					Type:    EventTypeError,
-					Payload: errMsg,
-				})
-			}
+	// Trailers are only sent with a chunked body, which needs an unknown length
+	if len(httpReq.Trailers) > 0 {
+		req.Trailer = make(http.Header, len(httpReq.Trailers))
+		for k, v := range httpReq.Trailers {
+			req.Trailer.Set(k, v)
+		}
+		req.ContentLength = -1
+	}
 
-		case proto.MessageTypeHTTPRequest:
-			c.logger.Debug("received HTTP request", "request", msg.Payload)
-			startTime := time.Now()
-			// Parse the proxied request from messages
-			var httpReq proto.HTTPRequest
-			b, err := json.Marshal(msg.Payload)
-			if err != nil {
-				c.logger.Error("failed to marshal HTTP request", "error", err)
-				continue
-			}
-			if err := json.Unmarshal(b, &httpReq); err != nil {
-				c.logger.Error("failed to unmarshal HTTP request", "error", err)
-				continue
-			}
-			c.logger.Info("3. client received from websocket", "headers", httpReq.Headers)
-
-			// Forward the generated request to local host
-			go func() {
-				localURL := fmt.Sprintf("http://localhost:%d%s", t.localPort, httpReq.Path)
-				// Build the request and headers
-				req, err := http.NewRequest(httpReq.Method, localURL, bytes.NewReader(httpReq.Body))
-				if err != nil {
-					c.logger.Error("failed to create HTTP request", "error", err)
-					return
-				}
-
-				c.logger.Info("headers set when originally forwarding request to local", "headers", httpReq.Headers)
-
-				// Here we need to carefully clean headers to avoid issues with conflicting headers
-				// between cloudflare and any third party services
-
-				isWebSocketUpgrade := strings.EqualFold(httpReq.Headers["Upgrade"], "websocket") &&
-					strings.EqualFold(httpReq.Headers["Connection"], "upgrade")
-
-					// Base headers that are always kept
-				var headersToKeep = map[string]bool{
-					"host":              true,
-					"user-agent":        true,
-					"accept":            true,
-					"accept-encoding":   true,
-					"accept-language":   true,
-					"content-type":      true,
-					"cookie":            true,
-					"x-forwarded-for":   true,
-					"x-forwarded-proto": true,
-					"x-real-ip":         true,
-					"authorization":     true,
-				}
-
-				// Add WebSocket specific headers if needed
-				if isWebSocketUpgrade {
-					headersToKeep["connection"] = true
-					headersToKeep["upgrade"] = true
-					headersToKeep["sec-websocket-key"] = true
-					headersToKeep["sec-websocket-version"] = true
-					headersToKeep["sec-websocket-protocol"] = true
-					headersToKeep["sec-websocket-extensions"] = true
-				}
-
-				cleaned := make(map[string]string)
-				for k, v := range httpReq.Headers {
-					headerLower := strings.ToLower(k)
-					if headersToKeep[headerLower] {
-						cleaned[k] = v
-					}
-				}
-
-				c.logger.Info("headers after cleaning", "headers", cleaned)
-
-				for k, v := range cleaned {
-					req.Header.Set(k, v)
-				}
-
-				c.logger.Info("4. making local request", "headers", cleaned)
-
-				client := &http.Client{
-					CheckRedirect: func(req *http.Request, via []*http.Request) error {
-						return http.ErrUseLastResponse // Don't follow redirects
-					},
-				}
-
-				resp, err := client.Do(req)
-				if err != nil {
-					c.logger.Error("failed to make HTTP request", "error", err)
-					return
-				}
-
-				// Read the response body
-				body, err := io.ReadAll(resp.Body)
-				if err != nil {
-					c.logger.Error("failed to read response body", "error", err)
-					return
-				}
-
-				headers := make(map[string]string)
-				for k, v := range resp.Header {
-					headers[k] = v[0]
-				}
-
-				if resp.StatusCode >= 300 && resp.StatusCode < 400 {
-					location := resp.Header["Location"]
-					c.logger.Info("redirect detected",
-						"status_code", resp.StatusCode,
-						"location", location,
-						"original_path", httpReq.Path,
-						"request_id", httpReq.RequestId)
-				}
-
-				c.logger.Info("5. local request response", "headers", headers)
-
-				wsResp := proto.Message{
-					Type: proto.MessageTypeHTTPResponse,
-					Payload: proto.HTTPResponse{
-						StatusCode: resp.StatusCode,
-						Headers:    headers,
-						Body:       body,
-						RequestId:  httpReq.RequestId,
-					},
-				}
-
-				if err := websocket.JSON.Send(t.wsConn, wsResp); err != nil {
-					c.logger.Error("failed to send HTTP response", "error", err)
-					return
-				}
-
-				// Set the error message as 30 chars of the body, if status not OK
-				var errMsg string
-				if resp.StatusCode > 400 { // Some error status
-					errMsg = string(body[:30])
-					if len(body) > 30 {
-						errMsg += "..."
-					}
-				}
-
-				// Emit the event to be handled by the manager impl
-				if c.events != nil {
-					c.events(Event{
-						Type: EventTypeRequest,
-						Payload: RequestEvent{
-							TunnelID:  t.url,
-							Method:    httpReq.Method,
-							Path:      httpReq.Path,
-							Status:    resp.StatusCode,
-							Duration:  time.Since(startTime),
-							Error:     errMsg,
-							Timestamp: startTime,
-						},
-					})
-				}
-			}()
-
-		case proto.MessageTypePing:
-			c.logger.Debug("received ping message")
-			if err := websocket.JSON.Send(t.wsConn, proto.Message{Type: proto.MessageTypePong}); err != nil {
-				c.logger.Error("failed to send websocket message", "error", err)
-				return
-			}
+	// Without a rewrite the local server sees its own address as the host, as the http client
+	// sends the host of the request url rather than any Host header
+	if cfg.RewriteHost != "" {
+		req.Host = cfg.RewriteHost
+	}
+
+	// Headers set VIA --header are added after cleaning, as the user explicitly asked for them
+	for k, v := range cfg.Headers {
+		if strings.EqualFold(k, "host") {
+			// The http client ignores a Host header, the request host must be set instead
+			req.Host = v
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+
+	c.logger.Debug("4. making local request", "headers", req.Header)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make HTTP request: %w", err)
+	}
+
+	return resp, nil
+}
+
+// readLocalResponse reads a response from the local server into its proto form, returning
+// errResponseTooLarge if the body is over maxBytes (0 for no limit)
+func (c *manager) readLocalResponse(httpReq proto.HTTPRequest, resp *http.Response, maxBytes int64) (*proto.HTTPResponse, error) {
+	defer resp.Body.Close()
+
+	// Read the response body, up to one byte over the limit so we can tell it was exceeded
+	var reader io.Reader = resp.Body
+	if maxBytes > 0 {
+		if resp.ContentLength > maxBytes {
+			return nil, fmt.Errorf("%w: %d bytes is over the %d byte limit", errResponseTooLarge, resp.ContentLength, maxBytes)
 		}
+		reader = io.LimitReader(resp.Body, maxBytes+1)
+	}
+
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if maxBytes > 0 && int64(len(body)) > maxBytes {
+		return nil, fmt.Errorf("%w: over the %d byte limit", errResponseTooLarge, maxBytes)
+	}
+
+	headers := responseHeaders(resp)
+
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		location := resp.Header["Location"]
+		c.logger.Debug("redirect detected",
+			"status_code", resp.StatusCode,
+			"location", location,
+			"original_path", httpReq.Path,
+			"request_id", httpReq.RequestId)
+	}
+
+	c.logger.Debug("5. local request response", "headers", headers)
+
+	return &proto.HTTPResponse{
+		StatusCode: resp.StatusCode,
+		Headers:    headers,
+		Body:       body,
+		RequestId:  httpReq.RequestId,
+		Trailers:   responseTrailers(resp),
+	}, nil
+}
+
+// emitLifecycleEvent emits a tunnel open or close event, if the config asks for them
+func (c *manager) emitLifecycleEvent(event Event) {
+	if c.cfg.LifecycleEvents && c.events != nil {
+		c.events(event)
+	}
+}
+
+// emitRequestEvent emits the event for a request forwarded to the local server
+func (c *manager) emitRequestEvent(t *tunnel, httpReq proto.HTTPRequest, httpResp *proto.HTTPResponse, startTime time.Time, replayed bool) {
+	if c.events == nil {
+		return
+	}
+
+	// Emit the event to be handled by the manager impl
+	c.events(Event{
+		Type:    EventTypeRequest,
+		Payload: newRequestEvent(t, httpReq, httpResp, startTime, replayed),
+	})
+}
+
+// newRequestEvent builds the event for a request forwarded to the local server
+func newRequestEvent(t *tunnel, httpReq proto.HTTPRequest, httpResp *proto.HTTPResponse, startTime time.Time, replayed bool) RequestEvent {
+	// Set the error message as 30 chars of the body, if status not OK
+	var errMsg string
+	if httpResp.StatusCode > 400 { // Some error status
+		errMsg = string(httpResp.Body[:min(len(httpResp.Body), 30)])
+		if len(httpResp.Body) > 30 {
+			errMsg += "..."
+		}
+	}
+
+	// The response has already been sent on, so the bodies can be dropped from the copies kept for the event
+	if t.noBodies {
+		resp := *httpResp
+		resp.Body = nil
+		httpResp = &resp
+		httpReq.Body = nil
+		if errMsg != "" {
+			errMsg = http.StatusText(httpResp.StatusCode)
+		}
+	}
+
+	return RequestEvent{
+		TunnelID:  t.URL(),
+		Method:    httpReq.Method,
+		Path:      httpReq.Path,
+		Status:    httpResp.StatusCode,
+		Duration:  time.Since(startTime),
+		Error:     errMsg,
+		Timestamp: startTime,
+		LocalPort: t.localPort,
+		Request:   &httpReq,
+		Response:  httpResp,
+		Replayed:  replayed,
+
+		BodiesOmitted: t.noBodies,
 	}
 }
 
@@ -371,12 +935,23 @@ func (c *manager) Tunnels() []Tunnel {
 	return tunnels
 }
 
-func (c *manager) Close() error {
+func (c *manager) CloseTunnel(url string) error {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	t, exists := c.tunnels[url]
+	c.mu.Unlock()
+
+	if !exists {
+		return fmt.Errorf("no tunnel with url %s", url)
+	}
+	return t.Close()
+}
+
+func (c *manager) Close() error {
+	// Closing a tunnel removes it from the manager, so they can't be closed under the lock
+	tunnels := c.Tunnels()
 
 	var lastErr error
-	for _, t := range c.tunnels {
+	for _, t := range tunnels {
 		if err := t.Close(); err != nil {
 			lastErr = err
 		}
@@ -385,7 +960,21 @@ func (c *manager) Close() error {
 	return lastErr
 }
 
+// forget removes a closed tunnel from the manager
+func (c *manager) forget(t *tunnel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for url, candidate := range c.tunnels {
+		if candidate == Tunnel(t) {
+			delete(c.tunnels, url)
+		}
+	}
+}
+
 func (c *tunnel) URL() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.url
 }
 
@@ -393,10 +982,163 @@ func (c *tunnel) LocalPort() int {
 	return c.localPort
 }
 
+func (c *tunnel) ID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.id
+}
+
+func (c *tunnel) Created() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.created
+}
+
+func (c *tunnel) RateLimit() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rateLimit
+}
+
+func (c *tunnel) ExpiresAt() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.expiresAt
+}
+
+// localTimeout returns how long to wait for the local server to answer a request, shortly before the
+// server gives up on it. Older servers don't say, but all of them wait for the default
+func (c *tunnel) localTimeout() time.Duration {
+	c.mu.Lock()
+	timeout := c.timeout
+	c.mu.Unlock()
+
+	if timeout <= 0 {
+		timeout = config.DefaultRequestTimeout
+	}
+	if timeout > 2*localTimeoutMargin {
+		timeout -= localTimeoutMargin
+	}
+	return timeout
+}
+
+// maxBodyBytes returns the largest response body the server accepts, 0 if unlimited
+func (c *tunnel) maxBodyBytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.maxBody
+}
+
+// requestBodyLimit returns the largest request body to decompress, the same limit the server puts on it.
+// Servers without one still get the default, so a gzip bomb can't take all the clients memory
+func (c *tunnel) requestBodyLimit() int64 {
+	if maxBytes := c.maxBodyBytes(); maxBytes > 0 {
+		return maxBytes
+	}
+	return config.DefaultMaxBodyBytes
+}
+
 func (c *tunnel) Close() error {
-	if c.wsConn != nil {
-		return c.wsConn.Close()
+	return c.closeWith(CloseReasonClosed, "tunnel closed")
+}
+
+// closeWith closes the tunnel, telling the event handler why the first time it's closed
+func (c *tunnel) closeWith(reason, message string) error {
+	first := false
+	c.closeOnce.Do(func() {
+		close(c.done)
+		first = true
+	})
+	c.closeTCPConns()
+	c.closeProxiedWS()
+	c.manager.forget(c)
+
+	c.mu.Lock()
+	cn, id := c.cn, c.id
+	c.mu.Unlock()
+
+	var err error
+	if cn != nil {
+		err = cn.remove(id)
+	}
+
+	if first {
+		c.manager.emitLifecycleEvent(Event{
+			Type: EventTypeTunnelClose,
+			Payload: TunnelCloseEvent{
+				TunnelID:  c.URL(),
+				LocalPort: c.localPort,
+				Reason:    reason,
+				Message:   message,
+				Timestamp: time.Now(),
+			},
+		})
 	}
+	return err
+}
+
+// conn returns the current websocket connection of the tunnel
+func (c *tunnel) conn() *websocket.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cn.ws
+}
 
-	return nil
+// serverSupports reports whether the server the tunnel is connected to supports an optional feature
+func (c *tunnel) serverSupports(feature string) bool {
+	c.mu.Lock()
+	cn := c.cn
+	c.mu.Unlock()
+	return cn.supports(feature)
+}
+
+// sendBody sends a response body as a binary frame, ahead of the response it belongs to
+func (c *tunnel) sendBody(requestID string, body []byte) error {
+	return proto.MessageCodec.Send(c.conn(), &proto.BodyFrame{RequestId: requestID, Body: body})
+}
+
+// send sends a message for the tunnel to the server, tagged with the tunnel id as the
+// connection may carry several tunnels
+func (c *tunnel) send(msgType proto.MessageType, payload interface{}) error {
+	c.mu.Lock()
+	ws, id := c.cn.ws, c.id
+	c.mu.Unlock()
+
+	msg, err := proto.NewMessage(msgType, payload)
+	if err != nil {
+		return err
+	}
+	msg.TunnelID = id
+	return websocket.JSON.Send(ws, msg)
+}
+
+// setConn switches the tunnel over to a connection with the registration details, when it's
+// created and after a reconnect. If the tunnel was closed in the meantime false is returned
+func (c *tunnel) setConn(cn *connection, resp *proto.TunnelResponse) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.isClosed() {
+		return false
+	}
+
+	c.cn = cn
+	c.url = resp.URL
+	c.id = resp.ID
+	c.created = resp.Created
+	c.rateLimit = resp.RequestsPerSecond
+	c.maxBody = resp.MaxBodyBytes
+	c.timeout = time.Duration(resp.RequestTimeoutMs) * time.Millisecond
+	c.expiresAt = resp.ExpiresAt
+	return true
+}
+
+// isClosed reports whether the tunnel has been closed on purpose
+func (c *tunnel) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
 }
@@ -1,25 +1,41 @@
 package client
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"html/template"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/jwtly10/go-tunol/internal/auth/token"
 	"github.com/jwtly10/go-tunol/internal/config"
+	"github.com/jwtly10/go-tunol/internal/proto"
 	"github.com/jwtly10/go-tunol/internal/server"
 	testutil "github.com/jwtly10/go-tunol/internal/testutils"
 	"github.com/jwtly10/go-tunol/internal/utils"
+	"github.com/jwtly10/go-tunol/internal/version"
 	"github.com/jwtly10/go-tunol/internal/web/user"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
 )
 
 func setupUnitTestEnv(t *testing.T) (*config.ServerConfig, *config.ClientConfig) {
@@ -52,11 +68,12 @@ func TestCanCreateTunnels(t *testing.T) {
 
 	// Create test user
 	user := &user.User{
-		ID:              0,
-		GithubID:        12345,
-		GithubUsername:  "testuser",
-		GithubAvatarURL: "https://github.com/avatar.jpg",
-		GithubEmail:     "test@example.com",
+		ID:             0,
+		Provider:       "github",
+		ProviderUserID: "12345",
+		Username:       "testuser",
+		AvatarURL:      "https://github.com/avatar.jpg",
+		Email:          "test@example.com",
 	}
 
 	user, err := userRepo.CreateUser(user)
@@ -71,7 +88,7 @@ func TestCanCreateTunnels(t *testing.T) {
 
 	// Set up test
 	tmpl := template.Must(template.New("test").Parse("test"))
-	tunnelHandler := server.NewTunnelHandler(tokenService, tmpl, logger, sCfg)
+	tunnelHandler := server.NewTunnelHandler(tokenService, nil, nil, tmpl, logger, sCfg)
 	ts := httptest.NewServer(tunnelHandler.HandleWS())
 	defer ts.Close()
 	// update the manager config to point to test server
@@ -102,6 +119,13 @@ func TestCanCreateTunnels(t *testing.T) {
 	if tunnel1.URL() == tunnel2.URL() {
 		t.Error("tunnel URLs should be unique")
 	}
+	// The server assigns the id and creation time
+	if tunnel1.ID() == "" || !strings.Contains(tunnel1.URL(), tunnel1.ID()) {
+		t.Errorf("expected the tunnel id to be part of its url, got id %q and url %q", tunnel1.ID(), tunnel1.URL())
+	}
+	if time.Since(tunnel1.Created()) > time.Minute {
+		t.Errorf("expected the tunnel to have just been created, got %v", tunnel1.Created())
+	}
 }
 
 // TestHandleIncomingRequests tests that the manager can handle incoming requests
@@ -120,11 +144,12 @@ func TestHandleIncomingRequests(t *testing.T) {
 
 	// Create test user
 	user := &user.User{
-		ID:              0,
-		GithubID:        12345,
-		GithubUsername:  "testuser",
-		GithubAvatarURL: "https://github.com/avatar.jpg",
-		GithubEmail:     "test@example.com",
+		ID:             0,
+		Provider:       "github",
+		ProviderUserID: "12345",
+		Username:       "testuser",
+		AvatarURL:      "https://github.com/avatar.jpg",
+		Email:          "test@example.com",
 	}
 
 	user, err := userRepo.CreateUser(user)
@@ -138,7 +163,7 @@ func TestHandleIncomingRequests(t *testing.T) {
 	c.Token = token.PlainToken
 
 	tmpl := template.Must(template.New("test").Parse("test"))
-	tunnelHandler := server.NewTunnelHandler(tokenService, tmpl, logger, s)
+	tunnelHandler := server.NewTunnelHandler(tokenService, nil, nil, tmpl, logger, s)
 	// Create test HTTP server with ws support
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("Upgrade") == "websocket" {
@@ -225,11 +250,12 @@ func TestClientAuthentication(t *testing.T) {
 
 	// Create test user
 	user := &user.User{
-		ID:              0,
-		GithubID:        12345,
-		GithubUsername:  "testuser",
-		GithubAvatarURL: "https://github.com/avatar.jpg",
-		GithubEmail:     "test@example.com",
+		ID:             0,
+		Provider:       "github",
+		ProviderUserID: "12345",
+		Username:       "testuser",
+		AvatarURL:      "https://github.com/avatar.jpg",
+		Email:          "test@example.com",
 	}
 
 	user, err := userRepo.CreateUser(user)
@@ -248,7 +274,7 @@ func TestClientAuthentication(t *testing.T) {
 			c.Token = tc.token
 
 			tmpl := template.Must(template.New("test").Parse("test"))
-			tunnelHandler := server.NewTunnelHandler(tokenService, tmpl, logger, s)
+			tunnelHandler := server.NewTunnelHandler(tokenService, nil, nil, tmpl, logger, s)
 			ts := httptest.NewServer(tunnelHandler.HandleWS())
 			defer ts.Close()
 
@@ -341,11 +367,12 @@ func TestClientRequestEvents(t *testing.T) {
 
 	// Create test user
 	user := &user.User{
-		ID:              0,
-		GithubID:        12345,
-		GithubUsername:  "testuser",
-		GithubAvatarURL: "https://github.com/avatar.jpg",
-		GithubEmail:     "test@example.com",
+		ID:             0,
+		Provider:       "github",
+		ProviderUserID: "12345",
+		Username:       "testuser",
+		AvatarURL:      "https://github.com/avatar.jpg",
+		Email:          "test@example.com",
 	}
 
 	user, err := userRepo.CreateUser(user)
@@ -361,7 +388,7 @@ func TestClientRequestEvents(t *testing.T) {
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
 			tmpl := template.Must(template.New("test").Parse("test"))
-			tunnelHandler := server.NewTunnelHandler(tokenService, tmpl, logger, s)
+			tunnelHandler := server.NewTunnelHandler(tokenService, nil, nil, tmpl, logger, s)
 			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				if r.Header.Get("Upgrade") == "websocket" {
 					tunnelHandler.HandleWS().ServeHTTP(w, r)
@@ -443,3 +470,2152 @@ func TestClientRequestEvents(t *testing.T) {
 		})
 	}
 }
+
+// setupTestTunnelServer starts a tunol server backed by a test db, and returns
+// client config with a valid token pointing at it
+func setupTestTunnelServer(t *testing.T) (*config.ServerConfig, *config.ClientConfig, *server.TunnelHandler) {
+	t.Helper()
+
+	s, c := setupUnitTestEnv(t)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	db, cleanup := testutil.SetupTestDB(t)
+	t.Cleanup(cleanup)
+
+	tokenService := token.NewTokenService(db)
+	userRepo := user.NewUserRepository(db)
+
+	u, err := userRepo.CreateUser(&user.User{
+		Provider:       "github",
+		ProviderUserID: "12345",
+		Username:       "testuser",
+	})
+	require.NoError(t, err)
+
+	tok, err := tokenService.CreateToken(u.ID, "Test token", 24*time.Hour)
+	require.NoError(t, err)
+	c.Token = tok.PlainToken
+
+	tmpl := template.Must(template.New("test").Parse("test"))
+	tunnelHandler := server.NewTunnelHandler(tokenService, nil, nil, tmpl, logger, s)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/tunnel" && r.Header.Get("Upgrade") == "websocket" {
+			tunnelHandler.HandleWS().ServeHTTP(w, r)
+		} else {
+			tunnelHandler.ServeHTTP(w, r)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	tsURL, _ := url.Parse(ts.URL)
+	s.BaseURL = tsURL.Scheme + "://" + tsURL.Hostname()
+	s.Port = tsURL.Port()
+	c.ServerURL = ts.URL
+
+	return s, c, tunnelHandler
+}
+
+// TestHandleIncomingHTTPSRequests tests that the manager can forward requests to a local https server
+func TestHandleIncomingHTTPSRequests(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	// httptest TLS servers use a self-signed cert, so we must skip verification
+	localServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello from https local"))
+	}))
+	defer localServer.Close()
+
+	c.LocalScheme = "https"
+	c.InsecureSkipVerify = true
+
+	client := NewTunnelManager(c, logger, nil)
+	defer client.Close()
+
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	tunnel, err := client.NewTunnel(port)
+	require.NoError(t, err)
+
+	resp, err := http.Get(tunnel.URL() + "/")
+	require.NoError(t, err)
+
+	body, _ := io.ReadAll(resp.Body)
+	require.Equal(t, "hello from https local", string(body))
+}
+
+// TestTunnelReconnect tests that a tunnel whose connection drops is transparently re-registered
+func TestTunnelReconnect(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	c.ReconnectMaxRetries = 3
+
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello from local"))
+	}))
+	defer localServer.Close()
+
+	eventChan := make(chan Event, 10)
+	client := NewTunnelManager(c, logger, func(event Event) {
+		eventChan <- event
+	})
+	defer client.Close()
+
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	tun, err := client.NewTunnel(port)
+	require.NoError(t, err)
+	originalURL := tun.URL()
+
+	// Simulate the connection dropping, without closing the tunnel itself
+	tun.(*tunnel).conn().Close()
+
+	select {
+	case event := <-eventChan:
+		require.Equal(t, EventTypeReconnect, event.Type)
+		reconnect := event.Payload.(ReconnectEvent)
+		require.Equal(t, originalURL, reconnect.PreviousURL)
+		require.Equal(t, tun.URL(), reconnect.TunnelID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for reconnect event")
+	}
+
+	require.Len(t, client.Tunnels(), 1)
+
+	resp, err := http.Get(tun.URL() + "/")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	require.Equal(t, "hello from local", string(body))
+}
+
+// TestMultiplexedTunnels tests that tunnels of the same manager share one connection to the server,
+// which carries the requests of each to the right local server
+func TestMultiplexedTunnels(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	c.ReconnectMaxRetries = 3
+
+	ports := make([]int, 2)
+	for i, body := range []string{"hello from one", "hello from two"} {
+		localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+		defer localServer.Close()
+		localURL, _ := url.Parse(localServer.URL)
+		ports[i], _ = strconv.Atoi(localURL.Port())
+	}
+
+	reconnects := make(chan ReconnectEvent, 10)
+	client := NewTunnelManager(c, logger, func(event Event) {
+		if event.Type == EventTypeReconnect {
+			reconnects <- event.Payload.(ReconnectEvent)
+		}
+	})
+	defer client.Close()
+
+	one, err := client.NewTunnel(ports[0])
+	require.NoError(t, err)
+	two, err := client.NewTunnel(ports[1])
+	require.NoError(t, err)
+	require.Same(t, one.(*tunnel).conn(), two.(*tunnel).conn())
+
+	get := func(tunnelURL string) (int, string) {
+		resp, err := http.Get(tunnelURL + "/")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	_, body := get(one.URL())
+	require.Equal(t, "hello from one", body)
+	_, body = get(two.URL())
+	require.Equal(t, "hello from two", body)
+
+	// Both tunnels are recovered on a new shared connection when it drops
+	one.(*tunnel).conn().Close()
+	recovered := make(map[int]bool)
+	for len(recovered) < 2 {
+		select {
+		case reconnect := <-reconnects:
+			recovered[reconnect.LocalPort] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the tunnels to reconnect")
+		}
+	}
+	require.True(t, recovered[ports[0]] && recovered[ports[1]])
+	require.Same(t, one.(*tunnel).conn(), two.(*tunnel).conn())
+
+	// Closing one tunnel leaves the other open on the connection
+	require.NoError(t, one.Close())
+	require.Eventually(t, func() bool {
+		status, _ := get(one.URL())
+		return status != http.StatusOK
+	}, 2*time.Second, 20*time.Millisecond)
+
+	_, body = get(two.URL())
+	require.Equal(t, "hello from two", body)
+	require.Len(t, client.Tunnels(), 1)
+}
+
+// TestCloseTunnel tests that a single tunnel can be closed by its url while the others carry on
+func TestCloseTunnel(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("still here"))
+	}))
+	defer localServer.Close()
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	client := NewTunnelManager(c, logger, nil)
+	defer client.Close()
+
+	dropped, err := client.NewTunnel(port)
+	require.NoError(t, err)
+	kept, err := client.NewTunnel(port)
+	require.NoError(t, err)
+
+	require.NoError(t, client.CloseTunnel(dropped.URL()))
+	require.Error(t, client.CloseTunnel(dropped.URL()))
+	require.Len(t, client.Tunnels(), 1)
+	require.Equal(t, kept.URL(), client.Tunnels()[0].URL())
+
+	// The server removes the closed tunnel as soon as it reads the close
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(dropped.URL() + "/")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusNotFound
+	}, time.Second, 10*time.Millisecond)
+
+	resp, err := http.Get(kept.URL() + "/")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, "still here", string(body))
+}
+
+// TestSeparateConnectionsWithoutMultiplex tests that each tunnel gets its own connection to servers that
+// don't support sharing one, and that their untagged messages still reach the tunnel
+func TestSeparateConnectionsWithoutMultiplex(t *testing.T) {
+	_, c := setupUnitTestEnv(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello from local"))
+	}))
+	defer localServer.Close()
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	var mu sync.Mutex
+	connections := 0
+	responses := make(chan proto.HTTPResponse, 2)
+	ts := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		mu.Lock()
+		connections++
+		n := connections
+		mu.Unlock()
+
+		for {
+			var msg proto.Message
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			switch msg.Type {
+			case proto.MessageTypeTunnelReq:
+				websocket.JSON.Send(ws, proto.Message{
+					Type:    proto.MessageTypeTunnelResp,
+					Payload: testutil.Payload(t, proto.TunnelResponse{URL: fmt.Sprintf("http://localhost/local/tunnel%d", n)}),
+				})
+				websocket.JSON.Send(ws, proto.Message{
+					Type:    proto.MessageTypeHTTPRequest,
+					Payload: testutil.Payload(t, proto.HTTPRequest{Method: "GET", Path: "/", RequestId: fmt.Sprint(n)}),
+				})
+			case proto.MessageTypeHTTPResponse:
+				var resp proto.HTTPResponse
+				b, _ := json.Marshal(msg.Payload)
+				json.Unmarshal(b, &resp)
+				responses <- resp
+			}
+		}
+	}))
+	defer ts.Close()
+	c.ServerURL = ts.URL
+
+	client := NewTunnelManager(c, logger, nil)
+	defer client.Close()
+
+	one, err := client.NewTunnel(port)
+	require.NoError(t, err)
+	two, err := client.NewTunnel(port)
+	require.NoError(t, err)
+	require.NotSame(t, one.(*tunnel).conn(), two.(*tunnel).conn())
+
+	mu.Lock()
+	require.Equal(t, 2, connections)
+	mu.Unlock()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case resp := <-responses:
+			require.Equal(t, "hello from local", string(resp.Body))
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the untagged request to be answered")
+		}
+	}
+}
+
+// TestReplayRequest tests that a captured request can be replayed against the local server
+// TestReplayTimeout tests that replaying a request to a hung local server gives up after the tunnels
+// timeout, rather than hanging whoever asked for the replay
+func TestReplayTimeout(t *testing.T) {
+	s, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s.RequestTimeout = 500 * time.Millisecond
+
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer localServer.Close()
+
+	client := NewTunnelManager(c, logger, nil)
+	defer client.Close()
+
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+	_, err := client.NewTunnel(port)
+	require.NoError(t, err)
+
+	replayed := make(chan error, 1)
+	go func() {
+		_, err := client.Replay(port, proto.HTTPRequest{Method: http.MethodGet, Path: "/hung"})
+		replayed <- err
+	}()
+
+	select {
+	case err := <-replayed:
+		require.ErrorContains(t, err, "didn't respond within 500ms")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the replay to give up")
+	}
+}
+
+func TestReplayRequest(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	var received []string
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, string(body))
+		w.Write([]byte("handled"))
+	}))
+	defer localServer.Close()
+
+	eventChan := make(chan Event, 10)
+	client := NewTunnelManager(c, logger, func(event Event) {
+		eventChan <- event
+	})
+	defer client.Close()
+
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	tunnel, err := client.NewTunnel(port)
+	require.NoError(t, err)
+
+	resp, err := http.Post(tunnel.URL()+"/webhook", "application/json", strings.NewReader(`{"event":"push"}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	var original RequestEvent
+	select {
+	case event := <-eventChan:
+		original = event.Payload.(RequestEvent)
+		require.False(t, original.Replayed)
+		require.NotNil(t, original.Request)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for request event")
+	}
+
+	replayResp, err := client.Replay(port, *original.Request)
+	require.NoError(t, err)
+	require.Equal(t, "handled", string(replayResp.Body))
+
+	select {
+	case event := <-eventChan:
+		replayed := event.Payload.(RequestEvent)
+		require.True(t, replayed.Replayed)
+		require.Equal(t, "/webhook", replayed.Path)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for replay event")
+	}
+
+	require.Equal(t, []string{`{"event":"push"}`, `{"event":"push"}`}, received)
+
+	_, err = client.Replay(port+1, *original.Request)
+	require.Error(t, err, "should not replay to a port without a tunnel")
+}
+
+// TestTCPTunnel tests that raw tcp connections are piped through a tcp tunnel to the local server
+func TestTCPTunnel(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	c.Protocol = proto.ProtocolTCP
+
+	// A local server that greets first (like ssh) and then echoes
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("hello\n"))
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	client := NewTunnelManager(c, logger, nil)
+	defer client.Close()
+
+	tunnel, err := client.NewTunnel(ln.Addr().(*net.TCPAddr).Port)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(tunnel.URL(), "tcp://"), "unexpected url %s", tunnel.URL())
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(tunnel.URL(), "tcp://"))
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	greeting, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "hello\n", greeting)
+
+	_, err = conn.Write([]byte("ping\n"))
+	require.NoError(t, err)
+	echo, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "ping\n", echo)
+}
+
+// TestTCPTunnelSlowLocalServer tests that a local server not reading its connection doesnt hold up the
+// other tunnels sharing the websocket
+func TestTCPTunnelSlowLocalServer(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	c.Protocol = proto.ProtocolTCP
+
+	// Accepts connections but never reads them
+	slowLn, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer slowLn.Close()
+	go func() {
+		for {
+			conn, err := slowLn.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	echoLn, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer echoLn.Close()
+	go func() {
+		for {
+			conn, err := echoLn.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	client := NewTunnelManager(c, logger, nil)
+	defer client.Close()
+
+	slow, err := client.NewTunnel(slowLn.Addr().(*net.TCPAddr).Port)
+	require.NoError(t, err)
+	echo, err := client.NewTunnel(echoLn.Addr().(*net.TCPAddr).Port)
+	require.NoError(t, err)
+
+	// More than the socket buffers of the slow connection hold
+	slowConn, err := net.Dial("tcp", strings.TrimPrefix(slow.URL(), "tcp://"))
+	require.NoError(t, err)
+	defer slowConn.Close()
+	go slowConn.Write(make([]byte, 16<<20))
+
+	echoConn, err := net.Dial("tcp", strings.TrimPrefix(echo.URL(), "tcp://"))
+	require.NoError(t, err)
+	defer echoConn.Close()
+	echoConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = echoConn.Write([]byte("ping\n"))
+	require.NoError(t, err)
+	reply, err := bufio.NewReader(echoConn).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "ping\n", reply)
+}
+
+// TestWebSocketPassthrough tests that a public websocket connection is streamed to a local websocket server
+func TestWebSocketPassthrough(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	localServer := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		if ws.Request().URL.Path != "/live" {
+			return
+		}
+		// Echo messages back, keeping text and binary frames as they are
+		for {
+			var frame proto.WSFrame
+			if err := proto.FrameCodec.Receive(ws, &frame); err != nil {
+				return
+			}
+			if err := proto.FrameCodec.Send(ws, &frame); err != nil {
+				return
+			}
+		}
+	}))
+	defer localServer.Close()
+
+	client := NewTunnelManager(c, logger, nil)
+	defer client.Close()
+
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	tunnel, err := client.NewTunnel(port)
+	require.NoError(t, err)
+
+	publicURL := strings.Replace(tunnel.URL(), "http://", "ws://", 1) + "/live"
+	ws, err := websocket.Dial(publicURL, "", "http://localhost")
+	require.NoError(t, err)
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+
+	require.NoError(t, websocket.Message.Send(ws, "reload"))
+	var text string
+	require.NoError(t, websocket.Message.Receive(ws, &text))
+	require.Equal(t, "reload", text)
+
+	require.NoError(t, proto.FrameCodec.Send(ws, &proto.WSFrame{Binary: true, Data: []byte{0x01, 0x02}}))
+	var frame proto.WSFrame
+	require.NoError(t, proto.FrameCodec.Receive(ws, &frame))
+	require.True(t, frame.Binary)
+	require.Equal(t, []byte{0x01, 0x02}, frame.Data)
+}
+
+// TestStreamEventStreamResponse tests that server-sent events reach the caller before the local handler completes
+func TestStreamEventStreamResponse(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	release := make(chan struct{})
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+
+		// Hold the response open until the caller has seen the first event
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+		w.Write([]byte("data: second\n\n"))
+	}))
+	defer localServer.Close()
+	defer close(release)
+
+	eventChan := make(chan Event, 10)
+	client := NewTunnelManager(c, logger, func(event Event) {
+		eventChan <- event
+	})
+	defer client.Close()
+
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	tunnel, err := client.NewTunnel(port)
+	require.NoError(t, err)
+
+	resp, err := http.Get(tunnel.URL() + "/events")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "data: first\n", line)
+
+	select {
+	case <-eventChan:
+		t.Fatal("request should not complete before the local handler returns")
+	default:
+	}
+
+	release <- struct{}{}
+
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, "\ndata: second\n\n", string(rest))
+
+	select {
+	case event := <-eventChan:
+		require.Equal(t, "/events", event.Payload.(RequestEvent).Path)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for request event")
+	}
+}
+
+// TestServerShutdownEvent tests that the servers shutdown notice is surfaced as an event
+func TestServerShutdownEvent(t *testing.T) {
+	_, c, th := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	eventChan := make(chan Event, 10)
+	client := NewTunnelManager(c, logger, func(event Event) {
+		eventChan <- event
+	})
+	defer client.Close()
+
+	// Something must be listening locally, or creating the tunnel emits an unreachable event
+	localServer := httptest.NewServer(http.NotFoundHandler())
+	defer localServer.Close()
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	tun, err := client.NewTunnel(port)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, th.Shutdown(ctx))
+
+	select {
+	case event := <-eventChan:
+		require.Equal(t, EventTypeShutdown, event.Type)
+		shutdown := event.Payload.(ShutdownEvent)
+		require.Equal(t, tun.URL(), shutdown.TunnelID)
+		require.NotEmpty(t, shutdown.Message)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for shutdown event")
+	}
+}
+
+// TestTunnelClosedEvent tests that a tunnel closed by the server is surfaced as an event, and isn't reconnected
+func TestTunnelClosedEvent(t *testing.T) {
+	_, c := setupUnitTestEnv(t)
+	c.ReconnectMaxRetries = 3
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	connections := make(chan struct{}, 10)
+	ts := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		connections <- struct{}{}
+		var msg proto.Message
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			return
+		}
+		websocket.JSON.Send(ws, proto.Message{
+			Type:    proto.MessageTypeTunnelResp,
+			Payload: testutil.Payload(t, proto.TunnelResponse{URL: "http://localhost/local/closed"}),
+		})
+		websocket.JSON.Send(ws, proto.Message{
+			Type:    proto.MessageTypeTunnelClosed,
+			Payload: testutil.Payload(t, proto.TunnelClosed{Reason: proto.TunnelClosedIdle, Message: "tunnel closed due to inactivity"}),
+		})
+	}))
+	defer ts.Close()
+	c.ServerURL = ts.URL
+
+	eventChan := make(chan Event, 10)
+	client := NewTunnelManager(c, logger, func(event Event) {
+		eventChan <- event
+	})
+	defer client.Close()
+
+	_, err := client.NewTunnel(8080)
+	require.NoError(t, err)
+	<-connections
+
+	// Nothing listens on the local port, so skip past the unreachable event
+	for {
+		select {
+		case event := <-eventChan:
+			if event.Type == EventTypeLocalUnreachable {
+				continue
+			}
+			require.Equal(t, EventTypeTunnelClosed, event.Type)
+			closed := event.Payload.(TunnelClosedEvent)
+			require.Equal(t, proto.TunnelClosedIdle, closed.Reason)
+			require.Equal(t, "tunnel closed due to inactivity", closed.Message)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for tunnel closed event")
+		}
+		break
+	}
+
+	select {
+	case <-connections:
+		t.Fatal("closed tunnel was reconnected")
+	case <-time.After(initialReconnectBackoff + 500*time.Millisecond):
+	}
+}
+
+// TestCloseDeregistersTunnel tests that closing the manager tells the server to close each tunnel,
+// rather than leaving it to notice the disconnect
+func TestCloseDeregistersTunnel(t *testing.T) {
+	_, c := setupUnitTestEnv(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	closed := make(chan string, 1)
+	ts := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		for {
+			var msg proto.Message
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			switch msg.Type {
+			case proto.MessageTypeTunnelReq:
+				websocket.JSON.Send(ws, proto.Message{
+					Type:    proto.MessageTypeTunnelResp,
+					Payload: testutil.Payload(t, proto.TunnelResponse{URL: "http://localhost/local/closing", ID: "closing"}),
+				})
+			case proto.MessageTypeTunnelClose:
+				closed <- msg.TunnelID
+			}
+		}
+	}))
+	defer ts.Close()
+	c.ServerURL = ts.URL
+
+	client := NewTunnelManager(c, logger, nil)
+	_, err := client.NewTunnel(8080)
+	require.NoError(t, err)
+
+	require.NoError(t, client.Close())
+	select {
+	case id := <-closed:
+		require.Equal(t, "closing", id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server was not told the tunnel closed")
+	}
+	require.Empty(t, client.Tunnels())
+}
+
+// TestSendsVersion tests that the client sends its version and protocol version in the websocket handshake
+func TestSendsVersion(t *testing.T) {
+	_, c := setupUnitTestEnv(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	versions := make(chan string, 1)
+	ts := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		versions <- ws.Request().Header.Get(version.Header) + " " + ws.Request().Header.Get(proto.ProtocolHeader)
+		var msg proto.Message
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			return
+		}
+		websocket.JSON.Send(ws, proto.Message{
+			Type:    proto.MessageTypeTunnelResp,
+			Payload: testutil.Payload(t, proto.TunnelResponse{URL: "http://localhost/local/versioned"}),
+		})
+		websocket.JSON.Receive(ws, &msg)
+	}))
+	defer ts.Close()
+	c.ServerURL = ts.URL
+
+	client := NewTunnelManager(c, logger, nil)
+	defer client.Close()
+
+	_, err := client.NewTunnel(8080)
+	require.NoError(t, err)
+	require.Equal(t, version.Version+" "+strconv.Itoa(proto.ProtocolVersion), <-versions)
+}
+
+// TestServerInfo tests that the client says hello to the server and keeps its answer, while servers that
+// don't answer the hello can still be used
+func TestServerInfo(t *testing.T) {
+	t.Run("server answers hello", func(t *testing.T) {
+		s, c, _ := setupTestTunnelServer(t)
+		s.MaxBodyBytes = 1 << 20
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+		client := NewTunnelManager(c, logger, nil)
+		defer client.Close()
+
+		_, err := client.NewTunnel(8080)
+		require.NoError(t, err)
+
+		info := client.ServerInfo()
+		require.NotNil(t, info)
+		require.Equal(t, proto.ProtocolVersion, info.ProtocolVersion)
+		require.Contains(t, info.Features, proto.FeatureStreaming)
+		require.Equal(t, int64(1<<20), info.Limits.MaxBodyBytes)
+	})
+
+	t.Run("server predates hello", func(t *testing.T) {
+		_, c := setupUnitTestEnv(t)
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+		hellos := make(chan proto.Hello, 1)
+		ts := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+			for {
+				var msg proto.Message
+				if err := websocket.JSON.Receive(ws, &msg); err != nil {
+					return
+				}
+				switch msg.Type {
+				case proto.MessageTypeHello:
+					var hello proto.Hello
+					b, _ := json.Marshal(msg.Payload)
+					json.Unmarshal(b, &hello)
+					hellos <- hello
+				case proto.MessageTypeTunnelReq:
+					websocket.JSON.Send(ws, proto.Message{
+						Type:    proto.MessageTypeTunnelResp,
+						Payload: testutil.Payload(t, proto.TunnelResponse{URL: "http://localhost/local/old"}),
+					})
+				}
+			}
+		}))
+		defer ts.Close()
+		c.ServerURL = ts.URL
+
+		client := NewTunnelManager(c, logger, nil)
+		defer client.Close()
+
+		tunnel, err := client.NewTunnel(8080)
+		require.NoError(t, err)
+		require.Equal(t, "http://localhost/local/old", tunnel.URL())
+		require.Nil(t, client.ServerInfo())
+
+		hello := <-hellos
+		require.Equal(t, version.Version, hello.Version)
+		require.Equal(t, proto.ProtocolVersion, hello.ProtocolVersion)
+		require.Equal(t, runtime.GOOS+"/"+runtime.GOARCH, hello.OS)
+	})
+}
+
+// TestHeartbeatPings tests that the client pings the server on the heartbeat interval
+func TestHeartbeatPings(t *testing.T) {
+	_, c := setupUnitTestEnv(t)
+	c.HeartbeatInterval = 20 * time.Millisecond
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	pings := make(chan struct{}, 10)
+	ts := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		var msg proto.Message
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			return
+		}
+		websocket.JSON.Send(ws, proto.Message{
+			Type:    proto.MessageTypeTunnelResp,
+			Payload: testutil.Payload(t, proto.TunnelResponse{URL: "http://localhost/local/heartbeat"}),
+		})
+
+		for {
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			if msg.Type == proto.MessageTypePing {
+				select {
+				case pings <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}))
+	defer ts.Close()
+	c.ServerURL = ts.URL
+
+	client := NewTunnelManager(c, logger, nil)
+	defer client.Close()
+
+	_, err := client.NewTunnel(8080)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-pings:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for heartbeat ping")
+		}
+	}
+}
+
+// TestRateLimitedEvent tests that requests rejected by the tunnels rate limit are surfaced as events
+func TestRateLimitedEvent(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	c.RateLimit = 1
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello from local"))
+	}))
+	defer localServer.Close()
+
+	eventChan := make(chan Event, 10)
+	client := NewTunnelManager(c, logger, func(event Event) {
+		if event.Type == EventTypeRateLimited {
+			eventChan <- event
+		}
+	})
+	defer client.Close()
+
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	tun, err := client.NewTunnel(port)
+	require.NoError(t, err)
+	require.Equal(t, float64(1), tun.RateLimit())
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(tun.URL() + "/")
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	select {
+	case event := <-eventChan:
+		limited := event.Payload.(RateLimitedEvent)
+		require.Equal(t, tun.URL(), limited.TunnelID)
+		require.Equal(t, 1, limited.Rejected)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for rate limited event")
+	}
+}
+
+// TestInjectedHeaders tests that headers from the client config are set on forwarded requests,
+// even those the header cleaning would otherwise drop
+func TestInjectedHeaders(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	c.Headers = map[string]string{
+		"Host":      "myapp.local",
+		"X-Api-Key": "secret",
+		"Accept":    "application/json",
+	}
+
+	received := make(chan *http.Request, 1)
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+		w.Write([]byte("ok"))
+	}))
+	defer localServer.Close()
+
+	client := NewTunnelManager(c, logger, nil)
+	defer client.Close()
+
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	tunnel, err := client.NewTunnel(port)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, tunnel.URL()+"/", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("X-Dropped", "value")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	select {
+	case r := <-received:
+		require.Equal(t, "myapp.local", r.Host)
+		require.Equal(t, "secret", r.Header.Get("X-Api-Key"))
+		require.Equal(t, "application/json", r.Header.Get("Accept"), "injected headers should override incoming ones")
+		require.Empty(t, r.Header.Get("X-Dropped"), "incoming headers should still be cleaned")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for local request")
+	}
+}
+
+// TestRewriteHost tests that the forwarded request uses the configured host
+func TestRewriteHost(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	c.RewriteHost = "myapp.local"
+
+	received := make(chan string, 1)
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Host
+		w.Write([]byte("ok"))
+	}))
+	defer localServer.Close()
+
+	client := NewTunnelManager(c, logger, nil)
+	defer client.Close()
+
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	tunnel, err := client.NewTunnel(port)
+	require.NoError(t, err)
+
+	resp, err := http.Get(tunnel.URL() + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	select {
+	case host := <-received:
+		require.Equal(t, "myapp.local", host)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for local request")
+	}
+}
+
+// TestChunkedRequestWithTrailers tests that a chunked request body is reassembled before reaching
+// the local server, and that request and response trailers are carried through the tunnel
+func TestChunkedRequestWithTrailers(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	type received struct {
+		body    string
+		trailer string
+	}
+	receivedChan := make(chan received, 1)
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		receivedChan <- received{body: string(body), trailer: r.Trailer.Get("X-Checksum")}
+
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte("ok"))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	defer localServer.Close()
+
+	client := NewTunnelManager(c, logger, nil)
+	defer client.Close()
+
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	tunnel, err := client.NewTunnel(port)
+	require.NoError(t, err)
+
+	// A reader of unknown length makes the http client send the body chunked
+	body := io.MultiReader(strings.NewReader("first chunk,"), strings.NewReader("second chunk"))
+	req, err := http.NewRequest(http.MethodPost, tunnel.URL()+"/upload", body)
+	require.NoError(t, err)
+	req.Trailer = http.Header{"X-Checksum": {"abc123"}}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "ok", string(respBody))
+	require.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+
+	select {
+	case r := <-receivedChan:
+		require.Equal(t, "first chunk,second chunk", r.body)
+		require.Equal(t, "abc123", r.trailer)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for local request")
+	}
+}
+
+// TestResponseTooLarge tests that a local response over the servers body limit is replaced by an
+// error response, and surfaced as an error event
+func TestResponseTooLarge(t *testing.T) {
+	s, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	s.MaxBodyBytes = 16
+
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("a", 32)))
+	}))
+	defer localServer.Close()
+
+	eventChan := make(chan Event, 10)
+	client := NewTunnelManager(c, logger, func(event Event) {
+		eventChan <- event
+	})
+	defer client.Close()
+
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	tunnel, err := client.NewTunnel(port)
+	require.NoError(t, err)
+
+	resp, err := http.Get(tunnel.URL() + "/large")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	require.Equal(t, "Response too large", string(body))
+
+	select {
+	case event := <-eventChan:
+		require.Equal(t, EventTypeRequest, event.Type)
+		reqEvent := event.Payload.(RequestEvent)
+		require.Equal(t, http.StatusBadGateway, reqEvent.Status)
+		require.Equal(t, "Response too large", reqEvent.Error)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for request event")
+	}
+}
+
+// TestLocalServerTimeout tests that a hung local server is given up on before the server times out,
+// so the request is answered with the clients timeout and the local request is cancelled
+func TestLocalServerTimeout(t *testing.T) {
+	s, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	s.RequestTimeout = 2500 * time.Millisecond
+
+	cancelled := make(chan struct{})
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer localServer.Close()
+
+	eventChan := make(chan Event, 10)
+	client := NewTunnelManager(c, logger, func(event Event) {
+		eventChan <- event
+	})
+	defer client.Close()
+
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	tunnel, err := client.NewTunnel(port)
+	require.NoError(t, err)
+
+	start := time.Now()
+	resp, err := http.Get(tunnel.URL() + "/slow")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	require.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	require.Equal(t, "Local server timed out", string(body), "the client should answer before the server times out")
+	require.Less(t, time.Since(start), s.RequestTimeout)
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("local request was never cancelled")
+	}
+
+	select {
+	case event := <-eventChan:
+		require.Equal(t, EventTypeRequest, event.Type)
+		require.Equal(t, http.StatusGatewayTimeout, event.Payload.(RequestEvent).Status)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for request event")
+	}
+}
+
+// TestNoCaptureBodies tests that request events only hold the metadata of requests when bodies
+// aren't captured, while the bodies are still forwarded in full
+func TestNoCaptureBodies(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	c.NoCaptureBodies = true
+
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Echo", "yes")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("rejected: " + string(body)))
+	}))
+	defer localServer.Close()
+
+	eventChan := make(chan Event, 10)
+	client := NewTunnelManager(c, logger, func(event Event) {
+		eventChan <- event
+	})
+	defer client.Close()
+
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	tunnel, err := client.NewTunnel(port)
+	require.NoError(t, err)
+
+	resp, err := http.Post(tunnel.URL()+"/login", "text/plain", strings.NewReader("password=secret"))
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.Equal(t, "rejected: password=secret", string(body))
+
+	select {
+	case event := <-eventChan:
+		e := event.Payload.(RequestEvent)
+		require.True(t, e.BodiesOmitted)
+		require.Equal(t, "/login", e.Request.Path)
+		require.Empty(t, e.Request.Body)
+		require.Equal(t, "yes", e.Response.Headers["X-Echo"])
+		require.Empty(t, e.Response.Body)
+		require.Equal(t, "Forbidden", e.Error, "the error shouldn't leak the body either")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for request event")
+	}
+}
+
+// TestLocalServerDown tests that a request the local server can't answer gets a fast 502,
+// instead of the server waiting for a response until it times out
+func TestLocalServerDown(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	// Take a free port, then close the server so nothing is listening on it
+	localServer := httptest.NewServer(http.NotFoundHandler())
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+	localServer.Close()
+
+	client := NewTunnelManager(c, logger, nil)
+	defer client.Close()
+
+	tunnel, err := client.NewTunnel(port)
+	require.NoError(t, err)
+
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	resp, err := httpClient.Get(tunnel.URL() + "/")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	require.Equal(t, "Failed to reach local server", string(body))
+}
+
+// TestLocalServerDownEvent tests that a request the local server can't answer still emits an error event
+func TestLocalServerDownEvent(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	localServer := httptest.NewServer(http.NotFoundHandler())
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+	localServer.Close()
+
+	eventChan := make(chan Event, 10)
+	client := NewTunnelManager(c, logger, func(event Event) {
+		eventChan <- event
+	})
+	defer client.Close()
+
+	tunnel, err := client.NewTunnel(port)
+	require.NoError(t, err, "the tunnel should still be created when nothing is listening locally")
+
+	// Creating the tunnel warns that nothing is listening
+	select {
+	case event := <-eventChan:
+		require.Equal(t, EventTypeLocalUnreachable, event.Type)
+		unreachable := event.Payload.(LocalUnreachableEvent)
+		require.Equal(t, port, unreachable.LocalPort)
+		require.Contains(t, unreachable.Message, fmt.Sprintf("port %d not reachable", port))
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for local unreachable event")
+	}
+
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	resp, err := httpClient.Get(tunnel.URL() + "/down")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// As does each request that can't be forwarded, before its request event
+	select {
+	case event := <-eventChan:
+		require.Equal(t, EventTypeLocalUnreachable, event.Type)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for local unreachable event")
+	}
+
+	select {
+	case event := <-eventChan:
+		require.Equal(t, EventTypeRequest, event.Type)
+		reqEvent := event.Payload.(RequestEvent)
+		require.Equal(t, http.StatusBadGateway, reqEvent.Status)
+		require.Equal(t, "/down", reqEvent.Path)
+		require.Equal(t, "Failed to reach local server", reqEvent.Error)
+		require.Equal(t, port, reqEvent.LocalPort)
+		require.True(t, reqEvent.LocalFailed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for request event")
+	}
+}
+
+// TestHeaderForwardingOptions tests that headers outside the default allowlist are only forwarded,
+// in both directions, when allowed or when all headers are passed through
+func TestHeaderForwardingOptions(t *testing.T) {
+	tests := []struct {
+		name           string
+		passAllHeaders bool
+		allowHeaders   []string
+		wantVersion    bool // X-Api-Version is forwarded both ways
+		wantOther      bool // X-Other is forwarded both ways
+	}{
+		{
+			name: "test default allowlist",
+		},
+		{
+			name:         "test allowed header",
+			allowHeaders: []string{"x-api-version"},
+			wantVersion:  true,
+		},
+		{
+			name:           "test pass all headers",
+			passAllHeaders: true,
+			wantVersion:    true,
+			wantOther:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, c, _ := setupTestTunnelServer(t)
+			logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+			c.PassAllHeaders = tt.passAllHeaders
+			c.AllowHeaders = tt.allowHeaders
+
+			received := make(chan http.Header, 1)
+			localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received <- r.Header
+				w.Header().Set("X-Api-Version", "2")
+				w.Header().Set("X-Other", "value")
+				w.Write([]byte("ok"))
+			}))
+			defer localServer.Close()
+
+			client := NewTunnelManager(c, logger, nil)
+			defer client.Close()
+
+			localURL, _ := url.Parse(localServer.URL)
+			port, _ := strconv.Atoi(localURL.Port())
+
+			tunnel, err := client.NewTunnel(port)
+			require.NoError(t, err)
+
+			req, err := http.NewRequest(http.MethodGet, tunnel.URL()+"/", nil)
+			require.NoError(t, err)
+			req.Header.Set("X-Api-Version", "1")
+			req.Header.Set("X-Other", "value")
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			var localHeaders http.Header
+			select {
+			case localHeaders = <-received:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for local request")
+			}
+
+			require.Equal(t, tt.wantVersion, localHeaders.Get("X-Api-Version") == "1")
+			require.Equal(t, tt.wantOther, localHeaders.Get("X-Other") == "value")
+			require.Equal(t, tt.wantVersion, resp.Header.Get("X-Api-Version") == "2")
+			require.Equal(t, tt.wantOther, resp.Header.Get("X-Other") == "value")
+		})
+	}
+}
+
+// TestCORSPreflight tests that a CORS preflight through the tunnel reaches the local server with
+// its request headers, and returns the local servers CORS headers intact
+func TestCORSPreflight(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions || r.Header.Get("Origin") != "https://app.example.com" ||
+			r.Header.Get("Access-Control-Request-Method") != http.MethodPut ||
+			r.Header.Get("Access-Control-Request-Headers") != "content-type,x-api-key" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+		w.Header().Set("Access-Control-Allow-Methods", "GET, PUT")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Api-Key")
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Set("Access-Control-Max-Age", "600")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer localServer.Close()
+
+	client := NewTunnelManager(c, logger, nil)
+	defer client.Close()
+
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	tunnel, err := client.NewTunnel(port)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodOptions, tunnel.URL()+"/api/items", nil)
+	require.NoError(t, err)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPut)
+	req.Header.Set("Access-Control-Request-Headers", "content-type,x-api-key")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.Equal(t, http.StatusNoContent, resp.StatusCode, "the preflight headers should reach the local server")
+	require.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "GET, PUT", resp.Header.Get("Access-Control-Allow-Methods"))
+	require.Equal(t, "Content-Type, X-Api-Key", resp.Header.Get("Access-Control-Allow-Headers"))
+	require.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Credentials"))
+	require.Equal(t, "600", resp.Header.Get("Access-Control-Max-Age"))
+}
+
+// TestHeadRequest tests that a HEAD request gets the headers the local server would send for a GET,
+// including its Content-Length, without a body
+func TestHeadRequest(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	methods := make(chan string, 1)
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods <- r.Method
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "42")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Method != http.MethodHead {
+			w.Write([]byte(strings.Repeat("x", 42)))
+		}
+	}))
+	defer localServer.Close()
+
+	client := NewTunnelManager(c, logger, nil)
+	defer client.Close()
+
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	tunnel, err := client.NewTunnel(port)
+	require.NoError(t, err)
+
+	resp, err := http.Head(tunnel.URL() + "/file")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.MethodHead, <-methods)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, int64(42), resp.ContentLength)
+	require.Equal(t, "42", resp.Header.Get("Content-Length"))
+	require.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	require.Equal(t, `"v1"`, resp.Header.Get("ETag"))
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Empty(t, body)
+}
+
+// TestConditionalRequests tests that conditional and range headers reach the local server, so it
+// can answer with a 304 Not Modified or a partial response
+func TestConditionalRequests(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	modified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "file.txt", modified, strings.NewReader("hello world"))
+	}))
+	defer localServer.Close()
+
+	client := NewTunnelManager(c, logger, nil)
+	defer client.Close()
+
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	tunnel, err := client.NewTunnel(port)
+	require.NoError(t, err)
+
+	get := func(headers map[string]string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, tunnel.URL()+"/file.txt", nil)
+		require.NoError(t, err)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	resp, body := get(nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "hello world", body)
+
+	resp, body = get(map[string]string{"If-None-Match": `"v1"`})
+	require.Equal(t, http.StatusNotModified, resp.StatusCode)
+	require.Equal(t, `"v1"`, resp.Header.Get("ETag"))
+	require.Empty(t, body)
+
+	resp, body = get(map[string]string{"If-Modified-Since": modified.Format(http.TimeFormat)})
+	require.Equal(t, http.StatusNotModified, resp.StatusCode)
+	require.Empty(t, body)
+
+	resp, _ = get(map[string]string{"If-Match": `"v2"`})
+	require.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	resp, body = get(map[string]string{"Range": "bytes=0-4"})
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	require.Equal(t, "bytes 0-4/11", resp.Header.Get("Content-Range"))
+	require.Equal(t, "hello", body)
+}
+
+// TestServerUnreachable tests that failing to reach the server is told apart from the server rejecting the tunnel
+func TestServerUnreachable(t *testing.T) {
+	_, c := setupUnitTestEnv(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	c.ServerURL = "http://" + ln.Addr().String()
+	ln.Close()
+
+	client := NewTunnelManager(c, logger, nil)
+	_, err = client.NewTunnel(8080)
+	require.ErrorIs(t, err, ErrServerUnreachable)
+	require.Contains(t, err.Error(), c.ServerURL)
+}
+
+// TestServerErrorCode tests that the code the server rejects a tunnel with is kept on the error
+func TestServerErrorCode(t *testing.T) {
+	_, c := setupUnitTestEnv(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	ts := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		for {
+			var msg proto.Message
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			if msg.Type == proto.MessageTypeTunnelReq {
+				websocket.JSON.Send(ws, proto.Message{
+					Type: proto.MessageTypeError,
+					Payload: testutil.Payload(t, proto.ErrorPayload{
+						Message: "you can only have 1 tunnels open",
+						Code:    proto.ErrorCodeTunnelLimitExceeded,
+					}),
+				})
+			}
+		}
+	}))
+	defer ts.Close()
+	c.ServerURL = ts.URL
+
+	client := NewTunnelManager(c, logger, nil)
+	defer client.Close()
+
+	_, err := client.NewTunnel(8080)
+	var serverErr *ServerError
+	require.ErrorAs(t, err, &serverErr)
+	require.Equal(t, proto.ErrorCodeTunnelLimitExceeded, serverErr.Code)
+	require.Contains(t, err.Error(), "you can only have 1 tunnels open")
+	require.NotErrorIs(t, err, ErrServerUnreachable)
+}
+
+// TestReconnectStopsOnFatalError tests that a tunnel isn't reconnected again once the server says the error won't go away
+func TestReconnectStopsOnFatalError(t *testing.T) {
+	_, c := setupUnitTestEnv(t)
+	c.ReconnectMaxRetries = 3
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	connections := make(chan struct{}, 10)
+	first := true
+	ts := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		connections <- struct{}{}
+		var msg proto.Message
+		for msg.Type != proto.MessageTypeTunnelReq {
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+		}
+
+		// Accept the tunnel then drop the connection, and reject it when it reconnects
+		if first {
+			first = false
+			websocket.JSON.Send(ws, proto.Message{
+				Type:    proto.MessageTypeTunnelResp,
+				Payload: testutil.Payload(t, proto.TunnelResponse{URL: "http://localhost/local/fatal"}),
+			})
+			return
+		}
+		websocket.JSON.Send(ws, proto.Message{
+			Type:    proto.MessageTypeError,
+			Payload: testutil.Payload(t, proto.ErrorPayload{Code: proto.ErrorCodeInvalidToken, Message: "invalid token: token expired"}),
+		})
+		var ignored proto.Message
+		websocket.JSON.Receive(ws, &ignored)
+	}))
+	defer ts.Close()
+	c.ServerURL = ts.URL
+
+	eventChan := make(chan Event, 10)
+	client := NewTunnelManager(c, logger, func(event Event) {
+		eventChan <- event
+	})
+	defer client.Close()
+
+	_, err := client.NewTunnel(8080)
+	require.NoError(t, err)
+
+	for {
+		select {
+		case event := <-eventChan:
+			req, ok := event.Payload.(RequestEvent)
+			if !ok || !req.ConnectionFailed {
+				continue
+			}
+			require.Contains(t, req.Error, "invalid token: token expired")
+		case <-time.After(initialReconnectBackoff + 5*time.Second):
+			t.Fatal("timeout waiting for the tunnel to give up reconnecting")
+		}
+		break
+	}
+
+	require.Len(t, connections, 2, "Expected a single reconnect attempt")
+}
+
+// TestVerbatimRequests tests that a verbatim tunnel forwards the request byte for byte, so a signature
+// computed over it, as webhook senders do, validates on the local server
+func TestVerbatimRequests(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	c.Verbatim = true
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	secret := []byte("whsec_test")
+	sign := func(method, uri string, body []byte) string {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(method + " " + uri + "\n"))
+		mac.Write(body)
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	type received struct {
+		uri     string
+		headers http.Header
+		valid   bool
+	}
+	requests := make(chan received, 1)
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		want := sign(r.Method, r.RequestURI, body)
+		requests <- received{
+			uri:     r.RequestURI,
+			headers: r.Header,
+			valid:   hmac.Equal([]byte(want), []byte(r.Header.Get("X-Signature"))),
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer localServer.Close()
+
+	client := NewTunnelManager(c, logger, nil)
+	defer client.Close()
+
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	tunnel, err := client.NewTunnel(port)
+	require.NoError(t, err)
+
+	// A gzipped body, which must reach the local server still compressed, and not as valid utf-8
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	gz.Write([]byte(`{"type":"payment_intent.succeeded","amount":2000,"note":"caf\u00e9  "}`))
+	gz.Close()
+	body.Write([]byte{0x00, 0xff, 0xfe})
+
+	uri := "/hooks/a%2Fb?x=1&y=%3D&empty="
+	req, err := http.NewRequest(http.MethodPost, tunnel.URL()+uri, bytes.NewReader(body.Bytes()))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("X-Signature", sign(http.MethodPost, uri, body.Bytes()))
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	req.Header["X-Multi"] = []string{"one", "two"}
+	req.Header.Set("X-Custom-Delivery", "abc123")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	got := <-requests
+	require.True(t, got.valid, "Expected the signature to validate on the local server")
+	require.Equal(t, uri, got.uri)
+	require.Equal(t, "gzip", got.headers.Get("Content-Encoding"))
+	require.Equal(t, []string{"one", "two"}, got.headers["X-Multi"])
+	require.Equal(t, "abc123", got.headers.Get("X-Custom-Delivery"))
+	require.Equal(t, "127.0.0.1", got.headers.Get("X-Forwarded-For"), "Expected the spoofed client address to be replaced")
+	require.Equal(t, "127.0.0.1", got.headers.Get("X-Real-Ip"))
+	require.Empty(t, got.headers.Get("Forwarded"))
+}
+
+// TestCompressedBodies tests that large bodies make the round trip through a server that compresses them
+// and sends them as binary frames, and that the request event has them as the local server saw them
+func TestCompressedBodies(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	body := strings.Repeat(`{"id":1,"name":"a compressible json body"},`, 200)
+
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Write(bytes.ToUpper(b))
+	}))
+	defer localServer.Close()
+
+	events := make(chan RequestEvent, 10)
+	client := NewTunnelManager(c, logger, func(event Event) {
+		if req, ok := event.Payload.(RequestEvent); ok {
+			events <- req
+		}
+	})
+	defer client.Close()
+
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+	tun, err := client.NewTunnel(port)
+	require.NoError(t, err)
+	require.Contains(t, client.ServerInfo().Features, proto.FeatureCompression)
+	require.True(t, tun.(*tunnel).serverSupports(proto.FeatureCompression))
+	require.True(t, tun.(*tunnel).serverSupports(proto.FeatureBinaryBodies))
+
+	resp, err := http.Post(tun.URL()+"/", "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, strings.ToUpper(body), string(got))
+
+	event := <-events
+	require.Equal(t, body, string(event.Request.Body))
+	require.Equal(t, strings.ToUpper(body), string(event.Response.Body))
+	require.Empty(t, event.Request.BodyEncoding)
+	require.Empty(t, event.Response.BodyEncoding)
+}
+
+func TestResponseTiming(t *testing.T) {
+	_, c := setupUnitTestEnv(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer localServer.Close()
+
+	responses := make(chan proto.HTTPResponse, 1)
+	ts := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		var msg proto.Message
+		for msg.Type != proto.MessageTypeTunnelReq {
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+		}
+		websocket.JSON.Send(ws, proto.Message{
+			Type:    proto.MessageTypeTunnelResp,
+			Payload: testutil.Payload(t, proto.TunnelResponse{URL: "http://localhost/local/timing"}),
+		})
+		websocket.JSON.Send(ws, proto.Message{
+			Type:    proto.MessageTypeHTTPRequest,
+			Payload: testutil.Payload(t, proto.HTTPRequest{Method: "GET", Path: "/", RequestId: "req-1", SentAt: 12345}),
+		})
+
+		for {
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			if msg.Type == proto.MessageTypeHTTPResponse {
+				resp, err := msg.AsHTTPResponse()
+				require.NoError(t, err)
+				responses <- resp
+			}
+		}
+	}))
+	defer ts.Close()
+	c.ServerURL = ts.URL
+
+	client := NewTunnelManager(c, logger, nil)
+	defer client.Close()
+
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+	_, err := client.NewTunnel(port)
+	require.NoError(t, err)
+
+	select {
+	case resp := <-responses:
+		require.Equal(t, "slow", string(resp.Body))
+		require.Equal(t, int64(12345), resp.RequestSentAt, "Expected the servers timestamp to be returned")
+		require.GreaterOrEqual(t, resp.LocalDuration, 50*time.Millisecond)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the response")
+	}
+}
+
+// TestRequestBodyDecompressLimit tests that a compressed request body is only decompressed up to the
+// servers body limit, so a small gzip bomb is answered with an error and never reaches the local server
+func TestRequestBodyDecompressLimit(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Expected the request not to be forwarded")
+	}))
+	defer localServer.Close()
+
+	body, encoding := proto.CompressBody([]byte(strings.Repeat("a", 4096)))
+	require.Equal(t, proto.BodyEncodingGzip, encoding)
+
+	responses := make(chan proto.HTTPResponse, 1)
+	ts := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		var msg proto.Message
+		for msg.Type != proto.MessageTypeTunnelReq {
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+		}
+		websocket.JSON.Send(ws, proto.Message{
+			Type:    proto.MessageTypeTunnelResp,
+			Payload: testutil.Payload(t, proto.TunnelResponse{URL: "http://localhost/local/bomb", MaxBodyBytes: 1024}),
+		})
+		websocket.JSON.Send(ws, proto.Message{
+			Type:    proto.MessageTypeHTTPRequest,
+			Payload: testutil.Payload(t, proto.HTTPRequest{Method: "POST", Path: "/", RequestId: "req-1", Body: body, BodyEncoding: encoding}),
+		})
+
+		for {
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			if msg.Type == proto.MessageTypeHTTPResponse {
+				resp, err := msg.AsHTTPResponse()
+				require.NoError(t, err)
+				responses <- resp
+			}
+		}
+	}))
+	defer ts.Close()
+	c.ServerURL = ts.URL
+
+	client := NewTunnelManager(c, logger, nil)
+	defer client.Close()
+
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+	_, err := client.NewTunnel(port)
+	require.NoError(t, err)
+
+	select {
+	case resp := <-responses:
+		require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the response")
+	}
+}
+
+// TestRewriteLinks tests that the local server is told the path of a /local/<id> tunnel, and that with
+// --rewrite-links its root-relative links and redirects are prefixed with it
+func TestRewriteLinks(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	c.RewriteLinks = true
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	prefixes := make(chan string, 2)
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefixes <- r.Header.Get("X-Forwarded-Prefix")
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, `<a href="/about">About</a><img src='/logo.png'><a href="//cdn.example.com/x">CDN</a>`+
+			`<a href="https://example.com/">Out</a><form action=/login></form><a href="%s/done">Done</a>`, r.Header.Get("X-Forwarded-Prefix"))
+	}))
+	defer localServer.Close()
+
+	client := NewTunnelManager(c, logger, nil)
+	defer client.Close()
+
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	tun, err := client.NewTunnel(port)
+	require.NoError(t, err)
+	tunnelURL, _ := url.Parse(tun.URL())
+	prefix := tunnelURL.Path
+	require.True(t, strings.HasPrefix(prefix, "/local/"), "Expected a local mode tunnel")
+
+	resp, err := http.Get(tun.URL() + "/")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, prefix, <-prefixes)
+	require.Equal(t, `<a href="`+prefix+`/about">About</a><img src='`+prefix+`/logo.png'><a href="//cdn.example.com/x">CDN</a>`+
+		`<a href="https://example.com/">Out</a><form action=`+prefix+`/login></form><a href="`+prefix+`/done">Done</a>`, string(body))
+	require.Equal(t, strconv.Itoa(len(body)), resp.Header.Get("Content-Length"))
+
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err = noRedirects.Get(tun.URL() + "/old")
+	require.NoError(t, err)
+	resp.Body.Close()
+	<-prefixes
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	require.Equal(t, prefix+"/new", resp.Header.Get("Location"))
+}
+
+// TestEncodedRequestBodies tests that a compressed request body reaches the local server as it was sent,
+// along with its Content-Encoding, so the local server can decode it
+func TestEncodedRequestBodies(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	payload := `{"event":"order.created","id":42}`
+
+	type received struct {
+		encoding string
+		body     string
+	}
+	requests := make(chan received, 1)
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+		switch r.Header.Get("Content-Encoding") {
+		case "gzip":
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = gz
+		case "deflate":
+			body = flate.NewReader(r.Body)
+		}
+		b, _ := io.ReadAll(body)
+		requests <- received{encoding: r.Header.Get("Content-Encoding"), body: string(b)}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer localServer.Close()
+
+	client := NewTunnelManager(c, logger, nil)
+	defer client.Close()
+
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	tun, err := client.NewTunnel(port)
+	require.NoError(t, err)
+
+	encoders := map[string]func(io.Writer) io.WriteCloser{
+		"gzip":    func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"deflate": func(w io.Writer) io.WriteCloser { fw, _ := flate.NewWriter(w, flate.DefaultCompression); return fw },
+	}
+	for encoding, encoder := range encoders {
+		t.Run(encoding, func(t *testing.T) {
+			var body bytes.Buffer
+			w := encoder(&body)
+			w.Write([]byte(payload))
+			w.Close()
+
+			req, err := http.NewRequest(http.MethodPost, tun.URL()+"/hooks", &body)
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Content-Encoding", encoding)
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+			got := <-requests
+			require.Equal(t, encoding, got.encoding)
+			require.Equal(t, payload, got.body)
+		})
+	}
+}
+
+func TestTunnelRequestCORS(t *testing.T) {
+	require.Nil(t, tunnelRequest(&config.ClientConfig{}, 3000).CORS, "Expected preflights to be forwarded without --cors-origin")
+
+	req := tunnelRequest(&config.ClientConfig{
+		CORSOrigins:     []string{"https://app.example.com"},
+		CORSMethods:     []string{"GET"},
+		CORSCredentials: true,
+		CORSMaxAge:      10 * time.Minute,
+	}, 3000)
+	require.Equal(t, &proto.CORSPolicy{
+		AllowOrigins:     []string{"https://app.example.com"},
+		AllowMethods:     []string{"GET"},
+		AllowCredentials: true,
+		MaxAgeSeconds:    600,
+	}, req.CORS)
+}
+
+// TestTunnelLifecycleEvents tests that each tunnel gets an open event, and one close event with the reason
+// for however it was closed
+func TestTunnelLifecycleEvents(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	c.LifecycleEvents = true
+
+	events := make(chan Event, 10)
+	var client TunnelManager
+	registered := make(chan bool, 1)
+	client = NewTunnelManager(c, logger, func(event Event) {
+		if event.Type != EventTypeTunnelOpen && event.Type != EventTypeTunnelClose {
+			return
+		}
+		if event.Type == EventTypeTunnelOpen {
+			// The tunnel can already be found when its open event is handled
+			found := false
+			for _, t := range client.Tunnels() {
+				found = found || t.URL() == event.Payload.(TunnelOpenEvent).TunnelID
+			}
+			registered <- found
+		}
+		events <- event
+	})
+	defer client.Close()
+
+	tun, err := client.NewTunnel(9000)
+	require.NoError(t, err)
+
+	event := <-events
+	require.Equal(t, EventTypeTunnelOpen, event.Type)
+	opened := event.Payload.(TunnelOpenEvent)
+	require.Equal(t, tun.URL(), opened.TunnelID)
+	require.Equal(t, 9000, opened.LocalPort)
+	require.True(t, <-registered, "Expected the tunnel to be registered before its open event")
+
+	require.NoError(t, tun.Close())
+	tun.Close()
+	event = <-events
+	require.Equal(t, EventTypeTunnelClose, event.Type)
+	closed := event.Payload.(TunnelCloseEvent)
+	require.Equal(t, tun.URL(), closed.TunnelID)
+	require.Equal(t, CloseReasonClosed, closed.Reason)
+	require.Empty(t, events, "Expected a single close event")
+
+	// Tunnels the server closes have its reason
+	ts := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		var msg proto.Message
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			return
+		}
+		websocket.JSON.Send(ws, proto.Message{
+			Type:    proto.MessageTypeTunnelResp,
+			Payload: testutil.Payload(t, proto.TunnelResponse{URL: "http://localhost/local/expiring"}),
+		})
+		websocket.JSON.Send(ws, proto.Message{
+			Type:    proto.MessageTypeTunnelClosed,
+			Payload: testutil.Payload(t, proto.TunnelClosed{Reason: proto.TunnelClosedExpired, Message: "tunnel reached its max lifetime"}),
+		})
+		websocket.JSON.Receive(ws, &msg)
+	}))
+	defer ts.Close()
+	c.ServerURL = ts.URL
+
+	_, err = client.NewTunnel(9001)
+	require.NoError(t, err)
+	var closedByServer TunnelCloseEvent
+	require.Eventually(t, func() bool {
+		select {
+		case event := <-events:
+			if event.Type == EventTypeTunnelClose {
+				closedByServer = event.Payload.(TunnelCloseEvent)
+				return true
+			}
+		default:
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "http://localhost/local/expiring", closedByServer.TunnelID)
+	require.Equal(t, proto.TunnelClosedExpired, closedByServer.Reason)
+	require.Equal(t, "tunnel reached its max lifetime", closedByServer.Message)
+}
+
+// lockedBuffer collects log output written from the managers goroutines
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestRequestLogRedacted tests that credentials in proxied requests are masked in the debug logs
+func TestRequestLogRedacted(t *testing.T) {
+	_, c, _ := setupTestTunnelServer(t)
+	var logs lockedBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{
+		Level:       slog.LevelDebug,
+		ReplaceAttr: utils.NewHeaderRedactor(nil).ReplaceAttr,
+	}))
+
+	localServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer localServer.Close()
+
+	client := NewTunnelManager(c, logger, nil)
+	defer client.Close()
+
+	localURL, _ := url.Parse(localServer.URL)
+	port, _ := strconv.Atoi(localURL.Port())
+
+	tunnel, err := client.NewTunnel(port)
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, tunnel.URL()+"/private", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret-token")
+	req.Header.Set("Cookie", "session=secret-session")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), "received HTTP request")
+	}, 5*time.Second, 10*time.Millisecond)
+	out := logs.String()
+	require.Contains(t, out, "/private")
+	require.NotContains(t, out, "secret-")
+}
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"github.com/jwtly10/go-tunol/internal/proto"
+	"golang.org/x/net/websocket"
+)
+
+// passthroughHeaders are the headers of the public websocket handshake that are passed on to the local server
+var passthroughHeaders = map[string]bool{
+	"authorization":     true,
+	"cookie":            true,
+	"user-agent":        true,
+	"x-forwarded-for":   true,
+	"x-forwarded-proto": true,
+	"x-real-ip":         true,
+	"forwarded":         true,
+}
+
+// handleWSOpen opens a websocket connection to the local server for a public connection
+// accepted by the server, and starts streaming its messages back over the tunnel
+func (c *manager) handleWSOpen(t *tunnel, msg proto.Message) {
+	open, err := msg.AsWSOpen()
+	if err != nil {
+		c.logger.Error("failed to unmarshal websocket open", "error", err)
+		return
+	}
+
+	conn, err := c.dialLocalWebSocket(t, open)
+	if err != nil {
+		c.logger.Error("failed to connect to local websocket", "localPort", t.localPort, "path", open.Path, "error", err)
+		c.sendWSClose(t, open.ConnID)
+		return
+	}
+
+	c.logger.Info("opened local websocket connection", "localPort", t.localPort, "path", open.Path, "connId", open.ConnID)
+	t.addProxiedWS(open.ConnID, conn)
+	go c.pipeWebSocket(t, open.ConnID, conn)
+}
+
+// dialLocalWebSocket dials the local server of the tunnel with the relevant headers of the public handshake
+func (c *manager) dialLocalWebSocket(t *tunnel, open proto.WSOpen) (*websocket.Conn, error) {
+	origin := ""
+	for k, v := range open.Headers {
+		if strings.EqualFold(k, "Origin") {
+			origin = v
+		}
+	}
+	if origin == "" {
+		origin = t.cfg.LocalURL(t.localPort, "")
+	}
+
+	wsConfig, err := websocket.NewConfig(t.cfg.LocalWebSocketURL(t.localPort, open.Path), origin)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range open.Headers {
+		headerLower := strings.ToLower(k)
+		if passthroughHeaders[headerLower] {
+			wsConfig.Header.Set(k, v)
+		}
+		if headerLower == "sec-websocket-protocol" {
+			for _, p := range strings.Split(v, ",") {
+				wsConfig.Protocol = append(wsConfig.Protocol, strings.TrimSpace(p))
+			}
+		}
+	}
+
+	if c.cfg.InsecureSkipVerify {
+		wsConfig.TlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return websocket.DialConfig(wsConfig)
+}
+
+// handleWSFrame writes a frame from the server to the local websocket connection it belongs to
+func (c *manager) handleWSFrame(t *tunnel, msg proto.Message) {
+	frame, err := msg.AsWSFrame()
+	if err != nil {
+		c.logger.Error("failed to unmarshal websocket frame", "error", err)
+		return
+	}
+
+	conn, exists := t.proxiedWSConn(frame.ConnID)
+	if !exists {
+		c.logger.Warn("received websocket frame for unknown connection", "connId", frame.ConnID)
+		return
+	}
+
+	if err := proto.FrameCodec.Send(conn, &frame); err != nil {
+		c.logger.Error("failed to write to local websocket", "connId", frame.ConnID, "error", err)
+		if t.removeProxiedWS(frame.ConnID) {
+			c.sendWSClose(t, frame.ConnID)
+		}
+	}
+}
+
+// handleWSClose closes a local websocket connection after the public side closed
+func (c *manager) handleWSClose(t *tunnel, msg proto.Message) {
+	closed, err := msg.AsWSClose()
+	if err != nil {
+		c.logger.Error("failed to unmarshal websocket close", "error", err)
+		return
+	}
+
+	t.removeProxiedWS(closed.ConnID)
+}
+
+// pipeWebSocket forwards messages from a local websocket connection back over the tunnel
+func (c *manager) pipeWebSocket(t *tunnel, connID string, conn *websocket.Conn) {
+	for {
+		var frame proto.WSFrame
+		if err := proto.FrameCodec.Receive(conn, &frame); err != nil {
+			break
+		}
+
+		frame.ConnID = connID
+		if err := t.send(proto.MessageTypeWSFrame, frame); err != nil {
+			c.logger.Error("failed to send websocket frame", "connId", connID, "error", err)
+			break
+		}
+	}
+
+	// Only tell the server if we closed first, otherwise it already knows
+	if t.removeProxiedWS(connID) {
+		c.sendWSClose(t, connID)
+	}
+}
+
+func (c *manager) sendWSClose(t *tunnel, connID string) {
+	if err := t.send(proto.MessageTypeWSClose, proto.WSClose{ConnID: connID}); err != nil {
+		c.logger.Error("failed to send websocket close", "connId", connID, "error", err)
+	}
+}
+
+func (c *tunnel) proxiedWSConn(connID string) (*websocket.Conn, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conn, exists := c.proxiedWS[connID]
+	return conn, exists
+}
+
+func (c *tunnel) addProxiedWS(connID string, conn *websocket.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.proxiedWS[connID] = conn
+}
+
+// removeProxiedWS closes and forgets a local websocket connection, reporting whether it was still open
+func (c *tunnel) removeProxiedWS(connID string) bool {
+	c.mu.Lock()
+	conn, exists := c.proxiedWS[connID]
+	delete(c.proxiedWS, connID)
+	c.mu.Unlock()
+
+	if exists {
+		conn.Close()
+	}
+	return exists
+}
+
+// closeProxiedWS closes all local websocket connections of the tunnel
+func (c *tunnel) closeProxiedWS() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for connID, conn := range c.proxiedWS {
+		conn.Close()
+		delete(c.proxiedWS, connID)
+	}
+}
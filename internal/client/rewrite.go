@@ -0,0 +1,88 @@
+package client
+
+import (
+	"bytes"
+	"mime"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jwtly10/go-tunol/internal/proto"
+)
+
+// prefixHeader tells the local server the path its tunnel is served under, e.g. /local/<id>, which is stripped
+// from the requests it gets
+const prefixHeader = "X-Forwarded-Prefix"
+
+// linkAttr matches the html attributes holding a link, up to the leading slash of a root-relative value
+var linkAttr = regexp.MustCompile(`(?i)\s(?:href|src|action|formaction|poster)\s*=\s*["']?/`)
+
+// basePath returns the path of the tunnels public url, empty when the tunnel is at the root of its host
+func (c *tunnel) basePath() string {
+	u, err := url.Parse(c.URL())
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(u.Path, "/")
+}
+
+// rewriteLinks prefixes the root-relative links of a response with the base path of its tunnel, so they
+// still lead through the tunnel. Only redirects and the link attributes of uncompressed html are rewritten,
+// links built by scripts or in css are left as they are
+func rewriteLinks(resp *proto.HTTPResponse, prefix string) {
+	if prefix == "" {
+		return
+	}
+
+	if location := resp.Headers["Location"]; needsPrefix(location, prefix) {
+		resp.Headers["Location"] = prefix + location
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Headers["Content-Type"])
+	if mediaType != "text/html" {
+		return
+	}
+	if encoding := resp.Headers["Content-Encoding"]; encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return // Decoding and encoding again isnt worth it for a dev convenience
+	}
+
+	body := prefixLinks(resp.Body, prefix)
+	if len(body) == len(resp.Body) {
+		return
+	}
+	resp.Body = body
+	if _, ok := resp.Headers["Content-Length"]; ok {
+		resp.Headers["Content-Length"] = strconv.Itoa(len(body))
+	}
+}
+
+// prefixLinks returns the html with the prefix added to each root-relative link that doesnt already have it
+func prefixLinks(body []byte, prefix string) []byte {
+	var out bytes.Buffer
+	last := 0
+	for _, m := range linkAttr.FindAllIndex(body, -1) {
+		slash := m[1] - 1
+		if !needsPrefix(string(body[slash:min(slash+len(prefix)+1, len(body))]), prefix) {
+			continue
+		}
+		out.Write(body[last:slash])
+		out.WriteString(prefix)
+		last = slash
+	}
+	if last == 0 {
+		return body
+	}
+	out.Write(body[last:])
+	return out.Bytes()
+}
+
+// needsPrefix reports whether a link is root-relative and not already under the prefix, e.g. from an app
+// that reads X-Forwarded-Prefix. Protocol relative links (//host/path) lead elsewhere and are left alone
+func needsPrefix(link, prefix string) bool {
+	if !strings.HasPrefix(link, "/") || strings.HasPrefix(link, "//") {
+		return false
+	}
+	rest, found := strings.CutPrefix(link, prefix)
+	return !found || (rest != "" && !strings.ContainsAny(rest[:1], `/?#"' `))
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/proto"
+)
+
+// streamReadBufferSize is the max number of bytes sent in a single body chunk
+const streamReadBufferSize = 32 * 1024
+
+// isEventStream reports whether a local response is a server-sent event stream. The response to a HEAD
+// has no body to stream, only the headers of one
+func isEventStream(resp *http.Response) bool {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return false
+	}
+	return strings.HasPrefix(strings.ToLower(resp.Header.Get("Content-Type")), "text/event-stream")
+}
+
+// responseHeaders flattens the headers of a local response into their proto form
+func responseHeaders(resp *http.Response) map[string]string {
+	headers := make(map[string]string)
+	for k, v := range resp.Header {
+		headers[k] = v[0]
+	}
+	return headers
+}
+
+// responseTrailers flattens the trailers of a local response, they are only set once the body has been read
+func responseTrailers(resp *http.Response) map[string]string {
+	if len(resp.Trailer) == 0 {
+		return nil
+	}
+	trailers := make(map[string]string, len(resp.Trailer))
+	for k, v := range resp.Trailer {
+		if len(v) > 0 {
+			trailers[k] = v[0]
+		}
+	}
+	return trailers
+}
+
+// streamResponse sends the head of a local response and then each chunk of its body as soon as
+// it is read, until the body ends or the server tells us the public caller has gone away
+func (c *manager) streamResponse(t *tunnel, httpReq proto.HTTPRequest, resp *http.Response, startTime time.Time, cancel func()) {
+	defer resp.Body.Close()
+
+	t.addStream(httpReq.RequestId, cancel)
+	defer t.removeStream(httpReq.RequestId)
+
+	httpResp := &proto.HTTPResponse{
+		StatusCode: resp.StatusCode,
+		Headers:    responseHeaders(resp),
+		RequestId:  httpReq.RequestId,
+		Streaming:  true,
+
+		RequestSentAt: httpReq.SentAt,
+		LocalDuration: time.Since(startTime),
+	}
+
+	if err := t.send(proto.MessageTypeHTTPResponse, httpResp); err != nil {
+		c.logger.Error("failed to send HTTP response", "error", err)
+		return
+	}
+
+	c.logger.Info("streaming local response", "requestId", httpReq.RequestId, "path", httpReq.Path)
+
+	buf := make([]byte, streamReadBufferSize)
+	for {
+		n, err := resp.Body.Read(buf)
+		chunk := proto.HTTPBodyChunk{
+			RequestId: httpReq.RequestId,
+			Data:      buf[:n],
+			Final:     err != nil,
+		}
+		if chunk.Final {
+			chunk.Trailers = responseTrailers(resp)
+		}
+
+		if n > 0 || chunk.Final {
+			if sendErr := t.send(proto.MessageTypeHTTPBodyChunk, chunk); sendErr != nil {
+				c.logger.Error("failed to send body chunk", "requestId", httpReq.RequestId, "error", sendErr)
+				return
+			}
+		}
+
+		if chunk.Final {
+			break
+		}
+	}
+
+	c.emitRequestEvent(t, httpReq, httpResp, startTime, false)
+}
+
+// handleHTTPStreamClose stops a streaming response after the public caller has gone away
+func (c *manager) handleHTTPStreamClose(t *tunnel, msg proto.Message) {
+	closed, err := msg.AsHTTPStreamClose()
+	if err != nil {
+		c.logger.Error("failed to unmarshal stream close", "error", err)
+		return
+	}
+
+	if cancel, exists := t.removeStream(closed.RequestId); exists {
+		c.logger.Info("public caller closed streaming response", "requestId", closed.RequestId)
+		cancel()
+	}
+}
+
+func (c *tunnel) addStream(requestID string, cancel func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.streams[requestID] = cancel
+}
+
+func (c *tunnel) removeStream(requestID string) (func(), bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cancel, exists := c.streams[requestID]
+	delete(c.streams, requestID)
+	return cancel, exists
+}
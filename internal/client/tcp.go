@@ -0,0 +1,172 @@
+package client
+
+import (
+	"net"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/proto"
+	"github.com/jwtly10/go-tunol/internal/utils"
+)
+
+const (
+	// tcpReadBufferSize is the max number of bytes sent in a single tcp data frame
+	tcpReadBufferSize = 32 * 1024
+	// tcpDialTimeout is how long connecting to the local server can take
+	tcpDialTimeout = 10 * time.Second
+	// tcpWriteQueueSize is how many frames can wait on a local connection before it's closed for not keeping
+	// up, and tcpWriteTimeout how long writing one can take
+	tcpWriteQueueSize = 64
+	tcpWriteTimeout   = 30 * time.Second
+)
+
+// tcpConn is a local connection of a tcp tunnel. The websocket is shared by every tunnel of the manager, so
+// the connection is dialed and written to from its own goroutine, never from the read loop
+type tcpConn struct {
+	conn   net.Conn // Nil while the local server is being dialed
+	writes *utils.WriteQueue[[]byte]
+}
+
+// handleTCPData queues a frame from the server for the local connection it belongs to,
+// dialing the local server if this is the first frame for the connection
+func (c *manager) handleTCPData(t *tunnel, msg proto.Message) {
+	data, err := msg.AsTCPData()
+	if err != nil {
+		c.logger.Error("failed to unmarshal tcp data", "error", err)
+		return
+	}
+
+	tc, exists := t.tcpConn(data.ConnID)
+	if !exists {
+		tc = &tcpConn{writes: utils.NewWriteQueue(tcpWriteQueueSize, tcpWriteTimeout)}
+		t.addTCPConn(data.ConnID, tc)
+		go c.serveTCPConn(t, data.ConnID, tc)
+	}
+
+	if len(data.Data) == 0 {
+		return
+	}
+
+	if !tc.writes.Queue(data.Data) {
+		c.logger.Warn("local tcp connection can't keep up, closing it", "connId", data.ConnID)
+		if t.removeTCPConn(data.ConnID) {
+			c.sendTCPClose(t, data.ConnID)
+		}
+	}
+}
+
+// serveTCPConn dials the local server for a new connection, then writes the frames queued for it until
+// either side closes
+func (c *manager) serveTCPConn(t *tunnel, connID string, tc *tcpConn) {
+	conn, err := net.DialTimeout("tcp", t.cfg.LocalAddr(t.localPort), tcpDialTimeout)
+	if err != nil {
+		c.logger.Error("failed to connect to local server", "localPort", t.localPort, "error", err)
+		if t.removeTCPConn(connID) {
+			c.sendTCPClose(t, connID)
+		}
+		return
+	}
+
+	c.logger.Info("opened local tcp connection", "localPort", t.localPort, "connId", connID)
+	// The server may have closed the connection while dialing, its frames are still written below
+	if t.setTCPConn(connID, conn) {
+		go c.pipeTCP(t, connID, conn)
+	}
+
+	if err := tc.writes.Run(conn); err != nil {
+		c.logger.Error("failed to write to local tcp connection", "connId", connID, "error", err)
+		if t.removeTCPConn(connID) {
+			c.sendTCPClose(t, connID)
+		}
+	}
+}
+
+// handleTCPClose closes a local connection after the public side closed
+func (c *manager) handleTCPClose(t *tunnel, msg proto.Message) {
+	closed, err := msg.AsTCPClose()
+	if err != nil {
+		c.logger.Error("failed to unmarshal tcp close", "error", err)
+		return
+	}
+
+	t.removeTCPConn(closed.ConnID)
+}
+
+// pipeTCP frames bytes read from a local connection back over the tunnel
+func (c *manager) pipeTCP(t *tunnel, connID string, conn net.Conn) {
+	buf := make([]byte, tcpReadBufferSize)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if err := t.send(proto.MessageTypeTCPData, proto.TCPData{ConnID: connID, Data: buf[:n]}); err != nil {
+				c.logger.Error("failed to send tcp data", "connId", connID, "error", err)
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// Only tell the server if we closed first, otherwise it already knows
+	if t.removeTCPConn(connID) {
+		c.sendTCPClose(t, connID)
+	}
+}
+
+func (c *manager) sendTCPClose(t *tunnel, connID string) {
+	if err := t.send(proto.MessageTypeTCPClose, proto.TCPClose{ConnID: connID}); err != nil {
+		c.logger.Error("failed to send tcp close", "connId", connID, "error", err)
+	}
+}
+
+func (c *tunnel) tcpConn(connID string) (*tcpConn, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tc, exists := c.tcpConns[connID]
+	return tc, exists
+}
+
+func (c *tunnel) addTCPConn(connID string, tc *tcpConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tcpConns[connID] = tc
+}
+
+// setTCPConn sets the local connection once dialed, reporting false if it was closed in the meantime
+func (c *tunnel) setTCPConn(connID string, conn net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tc, exists := c.tcpConns[connID]
+	if exists {
+		tc.conn = conn
+	}
+	return exists
+}
+
+// removeTCPConn forgets a local connection, which is closed once the frames queued for it are written.
+// It reports whether the connection was still open
+func (c *tunnel) removeTCPConn(connID string) bool {
+	c.mu.Lock()
+	tc, exists := c.tcpConns[connID]
+	delete(c.tcpConns, connID)
+	c.mu.Unlock()
+
+	if exists {
+		tc.writes.Close()
+	}
+	return exists
+}
+
+// closeTCPConns closes all local connections of the tunnel straight away
+func (c *tunnel) closeTCPConns() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for connID, tc := range c.tcpConns {
+		tc.writes.Close()
+		if tc.conn != nil {
+			tc.conn.Close()
+		}
+		delete(c.tcpConns, connID)
+	}
+}
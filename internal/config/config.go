@@ -3,11 +3,18 @@ package config
 import (
 	"fmt"
 	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/jwtly10/go-tunol/internal/utils"
 	"golang.org/x/net/websocket"
 )
 
@@ -20,12 +27,59 @@ type ServerConfig struct {
 	BaseURL string `env:"SERVER_URL" required:"true"`
 	Port    string `env:"SERVER_PORT"`
 
-	UseSubdomains bool `env:"USE_SUBDOMAINS" default:"false"`
+	BindAddr string `env:"BIND_ADDRESS"` // The interface to listen on, e.g. 127.0.0.1 behind a reverse proxy. Empty listens on all interfaces
+
+	// Proxies in front of the server (e.g. Cloudflare) as IPs or CIDRs. Their forwarding headers are
+	// trusted to find the real client IP passed to local servers, anyone else's are ignored
+	TrustedProxies []string `env:"TRUSTED_PROXIES"`
+
+	// Optional, serves HTTPS directly rather than behind a proxy terminating TLS. Either a certificate
+	// (ideally a wildcard one, to cover tunnel subdomains) or certificates from Let's Encrypt
+	TLSCertFile     string `env:"TLS_CERT_FILE"`
+	TLSKeyFile      string `env:"TLS_KEY_FILE"`
+	TLSAutocert     bool   `env:"TLS_AUTOCERT" default:"false"`     // Fetch certificates for the SERVER_URL domain and reserved subdomains as they're requested
+	TLSAutocertDir  string `env:"TLS_AUTOCERT_DIR" default:"certs"` // Where fetched certificates are cached between restarts
+	TLSAutocertMail string `env:"TLS_AUTOCERT_EMAIL"`               // Optional contact for Let's Encrypt expiry notices
+
+	UseSubdomains bool   `env:"USE_SUBDOMAINS" default:"false"`
+	BaseDomain    string `env:"BASE_DOMAIN"` // The domain tunnels are subdomains of, e.g. tunol.dev. Defaults to the SERVER_URL host
+
+	// Without subdomains, gives each http tunnel its own port serving it at the root, as well as /local/<id>
+	TunnelPorts bool `env:"TUNNEL_PORTS" default:"false"`
+
+	MetricsAddr string `env:"METRICS_ADDR"` // Address to serve prometheus metrics on, e.g. :9090. Disabled if empty, see MetricsListenAddr
+
+	HeartbeatInterval time.Duration `env:"HEARTBEAT_INTERVAL" default:"30s"` // How often tunnels are checked for activity
+	HeartbeatTimeout  time.Duration `env:"HEARTBEAT_TIMEOUT" default:"90s"`  // How long a tunnel can go without activity before it's closed
+
+	MaxTunnelsPerUser int `env:"MAX_TUNNELS_PER_USER" default:"0"` // How many tunnels each user can have open at once, 0 is unlimited
+
+	TunnelIdleTimeout time.Duration `env:"TUNNEL_IDLE_TIMEOUT" default:"0"` // How long a tunnel can go without a request before it's closed, 0 never closes idle tunnels
+	TunnelMaxLifetime time.Duration `env:"TUNNEL_MAX_LIFETIME" default:"0"` // How long a tunnel is open for regardless of use, 0 never expires tunnels
+
+	RateLimit float64 `env:"RATE_LIMIT" default:"0"` // Max requests per second to each tunnel, 0 is unlimited
+
+	MaxBodyBytes int64 `env:"MAX_BODY_BYTES" default:"10485760"` // Max size of proxied request and response bodies, 0 is unlimited
+
+	MaxInFlight int `env:"MAX_INFLIGHT_REQUESTS" default:"0"` // Max requests each tunnel can have waiting on its client at once, 0 is unlimited
+
+	RequestTimeout time.Duration `env:"REQUEST_TIMEOUT" default:"30s"` // How long to wait for a client to answer a proxied request
+
+	PurgeInterval  time.Duration `env:"PURGE_INTERVAL" default:"1h"`    // How often expired sessions and old tokens are deleted, 0 disables purging
+	TokenRetention time.Duration `env:"TOKEN_RETENTION" default:"720h"` // How long revoked and expired tokens are kept (and listed in the dashboard) before being deleted
+
+	// Optional, lets instances behind a load balancer share tunnels by recording which instance
+	// holds each tunnel in Redis, and forwarding requests to it
+	RedisURL    string `env:"REDIS_URL"`    // e.g. redis://localhost:6379/0
+	InstanceURL string `env:"INSTANCE_URL"` // The url other instances reach this one on, e.g. http://10.0.0.2:8001
+
+	LatestCLIVersion string `env:"LATEST_CLI_VERSION"` // The CLI release users are told to update to, defaults to the version of the server
 
 	Auth AuthConfig
 
-	logLevel string `env:"LOG_LEVEL" default:"info"`
-	Logger   *slog.Logger
+	logLevel         string   `env:"LOG_LEVEL" default:"info"`
+	LogRedactHeaders []string `env:"LOG_REDACT_HEADERS"` // Headers to redact from logs, on top of Authorization, Cookie and the like
+	Logger           *slog.Logger
 }
 
 // ClientConfig will be set by the CLI app
@@ -33,15 +87,185 @@ type ClientConfig struct {
 	Ports     []int  // The ports the client is tunneling
 	ServerURL string // The server URL to connect to when handling tunnels
 	Token     string // The auth token set VIA --login
+	Logout    bool   // Set VIA --logout to clear the stored token
+	WhoAmI    bool   // Set VIA --whoami to show who the stored token belongs to
+	Subdomain string // Optional subdomain to request instead of a randomly generated one
+	Protocol  string // The type of tunnel to create, http or tcp
+	BasicAuth string // Optional user:pass credentials visitors must supply to use the tunnel
+
+	BrowserLogin bool // Set VIA 'tunol login' to log in through the browser instead of pasting a token
+	ShowVersion  bool // Set VIA --version to print the version of the CLI
+	ShowConfig   bool // Set VIA 'tunol config' to print where the CLI keeps its token, logs and config
+	Check        bool // Set VIA --check to check everything needed to start the tunnels, without starting them
+
+	NoUpdateCheck bool // Set VIA --no-update-check to not ask the server whether a newer CLI has been released
+
+	LocalScheme        string // The scheme used to reach the local server, http or https
+	LocalHost          string // The host of the local server, defaults to localhost
+	InsecureSkipVerify bool   // Skip TLS verification when tunneling to a local https server
+
+	Headers     map[string]string // Headers set on every request forwarded to the local server, overriding incoming ones
+	RewriteHost string            // Optional Host to send to the local server, for apps that route on virtual hosts
+
+	// By default only a known set of headers are forwarded in either direction
+	PassAllHeaders bool     // Forward all headers except hop-by-hop ones
+	AllowHeaders   []string // Extra headers to forward on top of the default set
+
+	// Verbatim forwards requests exactly as the public client sent them, with every header and no forwarding
+	// headers added, so signatures over them validate. X-Forwarded-For and X-Real-Ip are still replaced with
+	// the real client, and Forwarded dropped. Headers set VIA --header and --rewrite-host still apply
+	Verbatim bool
+
+	// RewriteLinks prefixes root-relative links in html responses, and redirects, with the path of the tunnel
+	// url, for apps behind a /local/<id> tunnel that don't read X-Forwarded-Prefix. Set VIA --rewrite-links
+	RewriteLinks bool
+
+	// CORS preflights from the origins are answered by the server without reaching the local server, so its own
+	// CORS handling is bypassed. Set VIA --cors-origin and the other --cors flags, no origins forwards them all
+	CORSOrigins     []string
+	CORSMethods     []string // Empty allows any method
+	CORSHeaders     []string // Empty allows any request headers
+	CORSCredentials bool
+	CORSMaxAge      time.Duration
+
+	// LifecycleEvents has the tunnel manager emit an open and close event for each tunnel, for programs embedding
+	// the client. The CLI doesnt set it, as it follows its tunnels through NewTunnel and the other events
+	LifecycleEvents bool
+
+	ReconnectMaxRetries int           // Max attempts to re-establish a dropped tunnel, 0 disables reconnection
+	HeartbeatInterval   time.Duration // How often to ping the server to keep idle tunnels alive, 0 disables pings
+
+	RateLimit float64 // Optional max requests per second to the tunnel, 0 is unlimited
+
+	InspectPort int    // Port to serve the local request inspector on, 0 disables it
+	InspectHost string // Address the inspector listens on, localhost unless it's wanted from other machines
+
+	JSONOutput   bool // Set VIA --json to print events as JSON lines instead of rendering the dashboard
+	PrintURLOnly bool // Set VIA --print-url-only to print the tunnel urls without rendering the dashboard
+
+	// Inspect is set VIA --inspect to print each request to stdout instead of rendering the dashboard. It's summary
+	// for the method, path, status and timing, or headers or body to print those as well
+	Inspect string
+
+	// Requests to paths matching FilterPaths, if any are set, and not ExcludePaths are shown and recorded. The
+	// rest are still forwarded. Set VIA --filter-path and --exclude-path, as globs matching the path and below it
+	FilterPaths  []string
+	ExcludePaths []string
+
+	HARFile string // Set VIA --har to record every request and response to a HAR file, written when the CLI exits
+
+	NoCaptureBodies bool // Set VIA --no-capture-bodies to keep bodies out of the dashboard and inspector, only recording metadata
+
+	LogLevel    slog.Level // The level of the CLI log file, set VIA --log-level or TUNOL_LOG_LEVEL
+	LogMaxSize  int        // Size in MB the log file is rotated at, 0 never rotates it
+	LogMaxFiles int        // Number of rotated log files to keep
+
+	LogRedactHeaders []string // Headers to redact from the log file, on top of Authorization, Cookie and the like
+
+	Tunnels    []TunnelConfig // Tunnels declared in the CLI config file, applied to their port by ForTunnel
+	ConfigFile string         // The path of the CLI config file, empty if there isn't one
+}
+
+// TunnelConfig declares a tunnel in the CLI config file, its fields override the client config for that tunnel
+type TunnelConfig struct {
+	Name      string            `yaml:"name"`
+	Port      int               `yaml:"port"`
+	LocalHost string            `yaml:"local_host"`
+	Subdomain string            `yaml:"subdomain"`
+	Headers   map[string]string `yaml:"headers"`
+
+	NoCaptureBodies bool `yaml:"no_capture_bodies"`
+	Verbatim        bool `yaml:"verbatim"`
+	RewriteLinks    bool `yaml:"rewrite_links"`
 }
 
+// Heartbeat defaults, used when the server config doesn't set them
+const (
+	DefaultHeartbeatInterval = 30 * time.Second
+	DefaultHeartbeatTimeout  = 90 * time.Second
+)
+
+// Purge defaults, used when the server config doesn't set them
+const (
+	DefaultPurgeInterval  = time.Hour
+	DefaultTokenRetention = 30 * 24 * time.Hour
+)
+
+// DefaultMaxBodyBytes is the max size of a proxied body, used when the server config doesn't set it
+const DefaultMaxBodyBytes = 10 << 20
+
+// DefaultRequestTimeout is how long to wait for the response to a proxied request, used when the
+// server config doesn't set it
+const DefaultRequestTimeout = 30 * time.Second
+
 type DatabaseConfig struct {
-	Path string `env:"DB_PATH" required:"true"`
+	Driver string `env:"DB_DRIVER" default:"sqlite3"` // sqlite3, or postgres to share the database between server instances
+	Path   string `env:"DB_PATH" required:"true"`     // The SQLite database file
+	URL    string `env:"DATABASE_URL"`                // The Postgres connection string, required when the driver is postgres
 }
 
 type AuthConfig struct {
 	GithubClientId     string `env:"GITHUB_CLIENT_ID" required:"true"`
 	GithubClientSecret string `env:"GITHUB_CLIENT_SECRET" required:"true"`
+
+	PasswordLogin bool `env:"PASSWORD_LOGIN"` // Allow signing in with an email and password
+	// Allow anyone to register a local account when PasswordLogin is set. Emails aren't verified, so this
+	// is its own setting rather than checked against AllowedGithubUsers, which anyone could claim to be
+	PasswordRegister bool `env:"PASSWORD_REGISTER"`
+
+	// Optional, signing in with Google is only offered when set
+	GoogleClientId     string `env:"GOOGLE_CLIENT_ID"`
+	GoogleClientSecret string `env:"GOOGLE_CLIENT_SECRET"`
+
+	AllowedGithubUsers []string `env:"ALLOWED_GITHUB_USERS"` // Empty allows any user to sign in, Google users are matched by email
+}
+
+// logLevels are the levels LOG_LEVEL and the CLI --log-level accept
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// ParseLogLevel parses a log level name, one of debug, info, warn or error
+func ParseLogLevel(level string) (slog.Level, error) {
+	l, ok := logLevels[strings.ToLower(level)]
+	if !ok {
+		return 0, fmt.Errorf("invalid log level: %s", level)
+	}
+	return l, nil
+}
+
+// CLIConfigDir returns the dir the CLI keeps its token, logs and config file in, which is
+// TUNOL_CONFIG_DIR if set, otherwise ~/.tunol/. The dir isn't created
+func CLIConfigDir() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+
+	if configDir := os.Getenv("TUNOL_CONFIG_DIR"); configDir != "" {
+		return expandHome(configDir, homeDir), nil
+	}
+
+	return filepath.Join(homeDir, ".tunol"), nil
+}
+
+// expandHome replaces a leading ~, $HOME or ${HOME} in the path with the home dir. The env var may be
+// set somewhere the shell doesn't expand it, e.g. a systemd unit or a quoted .env value
+func expandHome(path, homeDir string) string {
+	for _, prefix := range []string{"~", "$HOME", "${HOME}"} {
+		rest, ok := strings.CutPrefix(path, prefix)
+		if !ok {
+			continue
+		}
+		// ~user and $HOMEDIR aren't the home dir
+		if rest == "" || rest[0] == '/' || rest[0] == filepath.Separator {
+			return homeDir + rest
+		}
+	}
+	return path
 }
 
 func LoadConfig() (*Config, error) {
@@ -49,30 +273,131 @@ func LoadConfig() (*Config, error) {
 	// We ignore the error as the .env file is optional
 	_ = godotenv.Load()
 
-	allowedLogLevels := map[string]slog.Level{
-		"debug": slog.LevelDebug,
-		"info":  slog.LevelInfo,
-		"warn":  slog.LevelWarn,
-		"error": slog.LevelError,
-	}
-
 	cfg := &Config{}
 
 	// Server configuration
 	baseURL := getOrDefault("SERVER_URL", "http://localhost")
 	port := getOrDefault("SERVER_PORT", "8001")
-	logLevel := getOrDefault("LOG_LEVEL", "info")
-	if _, ok := allowedLogLevels[logLevel]; !ok {
-		return nil, fmt.Errorf("invalid log level: %s", logLevel)
+	bindAddr := os.Getenv("BIND_ADDRESS")
+	logLevelName := getOrDefault("LOG_LEVEL", "info")
+	logLevel, err := ParseLogLevel(logLevelName)
+	if err != nil {
+		return nil, err
 	}
+	redactHeaders := splitList(os.Getenv("LOG_REDACT_HEADERS"))
 	useSubdomains := getOrDefault("USE_SUBDOMAINS", "false") == "true"
+	tunnelPorts := getOrDefault("TUNNEL_PORTS", "false") == "true"
+	if useSubdomains && tunnelPorts {
+		return nil, fmt.Errorf("TUNNEL_PORTS can't be used with USE_SUBDOMAINS")
+	}
+	metricsAddr := getOrDefault("METRICS_ADDR", "")
+	heartbeatInterval, err := time.ParseDuration(getOrDefault("HEARTBEAT_INTERVAL", DefaultHeartbeatInterval.String()))
+	if err != nil || heartbeatInterval <= 0 {
+		return nil, fmt.Errorf("invalid heartbeat interval: %s", os.Getenv("HEARTBEAT_INTERVAL"))
+	}
+	heartbeatTimeout, err := time.ParseDuration(getOrDefault("HEARTBEAT_TIMEOUT", DefaultHeartbeatTimeout.String()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid heartbeat timeout: %s", os.Getenv("HEARTBEAT_TIMEOUT"))
+	}
+	if heartbeatTimeout <= heartbeatInterval {
+		return nil, fmt.Errorf("heartbeat timeout %s must be longer than the interval %s", heartbeatTimeout, heartbeatInterval)
+	}
+
+	maxTunnelsPerUser, err := strconv.Atoi(getOrDefault("MAX_TUNNELS_PER_USER", "0"))
+	if err != nil || maxTunnelsPerUser < 0 {
+		return nil, fmt.Errorf("invalid max tunnels per user: %s", os.Getenv("MAX_TUNNELS_PER_USER"))
+	}
+
+	tunnelIdleTimeout, err := time.ParseDuration(getOrDefault("TUNNEL_IDLE_TIMEOUT", "0"))
+	if err != nil || tunnelIdleTimeout < 0 {
+		return nil, fmt.Errorf("invalid tunnel idle timeout: %s", os.Getenv("TUNNEL_IDLE_TIMEOUT"))
+	}
+	tunnelMaxLifetime, err := time.ParseDuration(getOrDefault("TUNNEL_MAX_LIFETIME", "0"))
+	if err != nil || tunnelMaxLifetime < 0 {
+		return nil, fmt.Errorf("invalid tunnel max lifetime: %s", os.Getenv("TUNNEL_MAX_LIFETIME"))
+	}
+
+	rateLimit, err := strconv.ParseFloat(getOrDefault("RATE_LIMIT", "0"), 64)
+	if err != nil || rateLimit < 0 {
+		return nil, fmt.Errorf("invalid rate limit: %s", os.Getenv("RATE_LIMIT"))
+	}
+
+	maxBodyBytes, err := strconv.ParseInt(getOrDefault("MAX_BODY_BYTES", strconv.Itoa(DefaultMaxBodyBytes)), 10, 64)
+	if err != nil || maxBodyBytes < 0 {
+		return nil, fmt.Errorf("invalid max body bytes: %s", os.Getenv("MAX_BODY_BYTES"))
+	}
+
+	maxInFlight, err := strconv.Atoi(getOrDefault("MAX_INFLIGHT_REQUESTS", "0"))
+	if err != nil || maxInFlight < 0 {
+		return nil, fmt.Errorf("invalid max in flight requests: %s", os.Getenv("MAX_INFLIGHT_REQUESTS"))
+	}
+
+	requestTimeout, err := time.ParseDuration(getOrDefault("REQUEST_TIMEOUT", DefaultRequestTimeout.String()))
+	if err != nil || requestTimeout <= 0 {
+		return nil, fmt.Errorf("invalid request timeout: %s", os.Getenv("REQUEST_TIMEOUT"))
+	}
+
+	purgeInterval, err := time.ParseDuration(getOrDefault("PURGE_INTERVAL", DefaultPurgeInterval.String()))
+	if err != nil || purgeInterval < 0 {
+		return nil, fmt.Errorf("invalid purge interval: %s", os.Getenv("PURGE_INTERVAL"))
+	}
+	tokenRetention, err := time.ParseDuration(getOrDefault("TOKEN_RETENTION", DefaultTokenRetention.String()))
+	if err != nil || tokenRetention < 0 {
+		return nil, fmt.Errorf("invalid token retention: %s", os.Getenv("TOKEN_RETENTION"))
+	}
+
+	redisURL := os.Getenv("REDIS_URL")
+	instanceURL := os.Getenv("INSTANCE_URL")
+	if redisURL != "" && instanceURL == "" {
+		return nil, fmt.Errorf("INSTANCE_URL is required when REDIS_URL is set")
+	}
+
+	trustedProxies := splitList(os.Getenv("TRUSTED_PROXIES"))
+	if _, err := parseTrustedProxies(trustedProxies); err != nil {
+		return nil, err
+	}
+
+	tlsCertFile := os.Getenv("TLS_CERT_FILE")
+	tlsKeyFile := os.Getenv("TLS_KEY_FILE")
+	tlsAutocert := getOrDefault("TLS_AUTOCERT", "false") == "true"
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if tlsAutocert && tlsCertFile != "" {
+		return nil, fmt.Errorf("TLS_AUTOCERT can't be used with TLS_CERT_FILE")
+	}
 
 	cfg.Server = ServerConfig{
-		BaseURL:       baseURL,
-		Port:          port,
-		UseSubdomains: useSubdomains,
-		logLevel:      logLevel,
-		Logger:        setupLogger(allowedLogLevels[logLevel]),
+		BaseURL:           baseURL,
+		Port:              port,
+		BindAddr:          bindAddr,
+		TrustedProxies:    trustedProxies,
+		TLSCertFile:       tlsCertFile,
+		TLSKeyFile:        tlsKeyFile,
+		TLSAutocert:       tlsAutocert,
+		TLSAutocertDir:    getOrDefault("TLS_AUTOCERT_DIR", "certs"),
+		TLSAutocertMail:   os.Getenv("TLS_AUTOCERT_EMAIL"),
+		UseSubdomains:     useSubdomains,
+		BaseDomain:        os.Getenv("BASE_DOMAIN"),
+		TunnelPorts:       tunnelPorts,
+		MetricsAddr:       metricsAddr,
+		HeartbeatInterval: heartbeatInterval,
+		HeartbeatTimeout:  heartbeatTimeout,
+		MaxTunnelsPerUser: maxTunnelsPerUser,
+		TunnelIdleTimeout: tunnelIdleTimeout,
+		TunnelMaxLifetime: tunnelMaxLifetime,
+		RateLimit:         rateLimit,
+		MaxBodyBytes:      maxBodyBytes,
+		MaxInFlight:       maxInFlight,
+		RequestTimeout:    requestTimeout,
+		PurgeInterval:     purgeInterval,
+		TokenRetention:    tokenRetention,
+		RedisURL:          redisURL,
+		InstanceURL:       instanceURL,
+		LatestCLIVersion:  os.Getenv("LATEST_CLI_VERSION"),
+		logLevel:          logLevelName,
+		LogRedactHeaders:  redactHeaders,
+		Logger:            setupLogger(logLevel, utils.NewHeaderRedactor(redactHeaders)),
 	}
 
 	// Auth configuration
@@ -88,12 +413,30 @@ func LoadConfig() (*Config, error) {
 	cfg.Server.Auth = AuthConfig{
 		GithubClientId:     githubClientId,
 		GithubClientSecret: githubClientSecret,
+		PasswordLogin:      getOrDefault("PASSWORD_LOGIN", "false") == "true",
+		PasswordRegister:   getOrDefault("PASSWORD_REGISTER", "false") == "true",
+		GoogleClientId:     os.Getenv("GOOGLE_CLIENT_ID"),
+		GoogleClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
+		AllowedGithubUsers: splitList(os.Getenv("ALLOWED_GITHUB_USERS")),
 	}
 
 	// Database configuration
+	dbDriver := getOrDefault("DB_DRIVER", "sqlite3")
 	dbPath := getOrDefault("DB_PATH", "tunol")
+	dbURL := os.Getenv("DATABASE_URL")
+	switch dbDriver {
+	case "sqlite3":
+	case "postgres":
+		if dbURL == "" {
+			return nil, fmt.Errorf("DATABASE_URL is required when DB_DRIVER is postgres")
+		}
+	default:
+		return nil, fmt.Errorf("invalid database driver: %s", dbDriver)
+	}
 	cfg.Database = DatabaseConfig{
-		Path: dbPath,
+		Driver: dbDriver,
+		Path:   dbPath,
+		URL:    dbURL,
 	}
 
 	return cfg, nil
@@ -101,8 +444,8 @@ func LoadConfig() (*Config, error) {
 
 // Utility methods
 
-// setupLogger creates a new logger for the server application
-func setupLogger(l slog.Level) *slog.Logger {
+// setupLogger creates a new logger for the server application, redacting sensitive headers from its logs
+func setupLogger(l slog.Level, redactor *utils.HeaderRedactor) *slog.Logger {
 	opts := &slog.HandlerOptions{
 		AddSource: true,
 		Level:     l,
@@ -110,8 +453,9 @@ func setupLogger(l slog.Level) *slog.Logger {
 			if a.Key == slog.SourceKey {
 				source := a.Value.Any().(*slog.Source)
 				a.Value = slog.StringValue(source.File + ":" + strconv.Itoa(source.Line))
+				return a
 			}
-			return a
+			return redactor.ReplaceAttr(groups, a)
 		},
 	}
 
@@ -128,6 +472,48 @@ func (c *ServerConfig) HTTPURL() string {
 	return fmt.Sprintf("%s:%s", baseURL, c.Port)
 }
 
+// TLSEnabled reports whether the server serves HTTPS itself
+func (c *ServerConfig) TLSEnabled() bool {
+	return c.TLSCertFile != "" || c.TLSAutocert
+}
+
+// TrustedProxyPrefixes returns the trusted proxies as address ranges, a single IP being a range of one
+func (c *ServerConfig) TrustedProxyPrefixes() []netip.Prefix {
+	prefixes, _ := parseTrustedProxies(c.TrustedProxies) // Validated when the config is loaded
+	return prefixes
+}
+
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, p := range proxies {
+		if addr, err := netip.ParseAddr(p); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q, must be an IP or CIDR", p)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// ListenAddr returns the address the server listens on
+func (c *ServerConfig) ListenAddr() string {
+	return net.JoinHostPort(c.BindAddr, c.Port)
+}
+
+// MetricsListenAddr returns the address metrics are served on. An address without a host, e.g. :9090,
+// listens on the bind address like the server does, rather than on all interfaces
+func (c *ServerConfig) MetricsListenAddr() string {
+	host, port, err := net.SplitHostPort(c.MetricsAddr)
+	if err != nil || host != "" {
+		return c.MetricsAddr
+	}
+	return net.JoinHostPort(c.BindAddr, port)
+}
+
 // SubdomainURL converts the server's base URL to a subdomainURL based on the id
 // using the custom logic for local development and production
 func (c *ServerConfig) SubdomainURL(id string) string {
@@ -146,10 +532,80 @@ func (c *ServerConfig) SubdomainURL(id string) string {
 	}
 
 	// Using subdomain-based routing for production
+	if c.BaseDomain != "" {
+		return fmt.Sprintf("https://%s.%s", id, c.Domain())
+	}
 	baseURL := strings.TrimPrefix(strings.TrimPrefix(c.BaseURL, "https://"), "http://")
 	return fmt.Sprintf("https://%s.%s", id, baseURL)
 }
 
+// Domain returns the domain tunnel subdomains are under, the base domain if set or else the server host
+func (c *ServerConfig) Domain() string {
+	if c.BaseDomain != "" {
+		return normaliseHost(c.BaseDomain)
+	}
+	if u, err := url.Parse(c.BaseURL); err == nil {
+		return normaliseHost(u.Hostname())
+	}
+	return ""
+}
+
+// SubdomainTunnelID returns the tunnel id of a request host, which is a single label in front of the
+// domain, e.g. abc123.tunol.dev. The domain itself, the server host, www and IP hosts aren't tunnels
+func (c *ServerConfig) SubdomainTunnelID(host string) (string, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = normaliseHost(host)
+	if host == "" || net.ParseIP(host) != nil {
+		return "", false
+	}
+
+	// The server can be on its own subdomain of the base domain, e.g. api.tunol.dev
+	if u, err := url.Parse(c.BaseURL); err == nil && normaliseHost(u.Hostname()) == host {
+		return "", false
+	}
+
+	domain := c.Domain()
+	if domain == "" {
+		return "", false
+	}
+	id, ok := strings.CutSuffix(host, "."+domain)
+	if !ok || id == "" || id == "www" || strings.Contains(id, ".") {
+		return "", false
+	}
+	return id, true
+}
+
+// normaliseHost lowercases the host and strips IPv6 brackets and the trailing dot of a fully qualified name
+func normaliseHost(host string) string {
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	return strings.ToLower(host)
+}
+
+// TCPURL returns the public address of a tcp tunnel listening on the given port
+func (c *ServerConfig) TCPURL(port int) string {
+	host := c.BaseURL
+	if u, err := url.Parse(c.BaseURL); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+	return fmt.Sprintf("tcp://%s:%d", host, port)
+}
+
+// PortURL returns the public URL of an http tunnel with its own port on the server. The port is served
+// directly rather than through any proxy in front of the server, so it's only https when the server serves TLS
+func (c *ServerConfig) PortURL(port int) string {
+	host := c.BaseURL
+	if u, err := url.Parse(c.BaseURL); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+	scheme := "http://"
+	if c.TLSEnabled() {
+		scheme = "https://"
+	}
+	return scheme + net.JoinHostPort(host, strconv.Itoa(port))
+}
+
 // WebSocketURL returns the WebSocket URL (ws:// or wss://) of the server for the client to connect to
 func (c *ClientConfig) WebSocketURL() string {
 	wsURL := strings.TrimSuffix(c.ServerURL, "/")
@@ -158,6 +614,103 @@ func (c *ClientConfig) WebSocketURL() string {
 	return wsURL + "/tunnel"
 }
 
+// LocalAddr returns the host:port address of the local server for the given port
+func (c *ClientConfig) LocalAddr(port int) string {
+	host := c.LocalHost
+	if host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// LocalURL returns the URL of the local server for the given port and path
+func (c *ClientConfig) LocalURL(port int, path string) string {
+	scheme := c.LocalScheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, c.LocalAddr(port), path)
+}
+
+// LocalWebSocketURL returns the websocket URL of the local server for the given port and path
+func (c *ClientConfig) LocalWebSocketURL(port int, path string) string {
+	scheme := "ws"
+	if c.LocalScheme == "https" {
+		scheme = "wss"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, c.LocalAddr(port), path)
+}
+
+// TunnelName returns the name of the tunnel on the given port from the config file, if it has one
+func (c *ClientConfig) TunnelName(port int) string {
+	for _, t := range c.Tunnels {
+		if t.Port == port {
+			return t.Name
+		}
+	}
+	return ""
+}
+
+// ForTunnel returns the config for the tunnel on the given port, with the overrides of its tunnel
+// config applied. Values set on the client config come from flags, so they win over the tunnel config
+func (c *ClientConfig) ForTunnel(port int) *ClientConfig {
+	cfg := *c
+	for _, t := range c.Tunnels {
+		if t.Port != port {
+			continue
+		}
+
+		if cfg.LocalHost == "" {
+			cfg.LocalHost = t.LocalHost
+		}
+		if cfg.Subdomain == "" {
+			cfg.Subdomain = t.Subdomain
+		}
+		if t.NoCaptureBodies {
+			cfg.NoCaptureBodies = true
+		}
+		if t.Verbatim {
+			cfg.Verbatim = true
+		}
+		if t.RewriteLinks {
+			cfg.RewriteLinks = true
+		}
+		if len(t.Headers) > 0 {
+			cfg.Headers = make(map[string]string, len(t.Headers)+len(c.Headers))
+			for k, v := range t.Headers {
+				cfg.Headers[http.CanonicalHeaderKey(k)] = v
+			}
+			for k, v := range c.Headers {
+				cfg.Headers[k] = v
+			}
+		}
+		break
+	}
+	return &cfg
+}
+
+// AllowsUser reports whether the GitHub user may sign in, GitHub usernames are case insensitive
+func (c AuthConfig) AllowsUser(username string) bool {
+	if len(c.AllowedGithubUsers) == 0 {
+		return true
+	}
+	for _, u := range c.AllowedGithubUsers {
+		if strings.EqualFold(u, username) {
+			return true
+		}
+	}
+	return false
+}
+
+// BasicAuthCredentials splits the user:pass basic auth credentials, ok is false if they are not set or malformed
+func (c *ClientConfig) BasicAuthCredentials() (user, pass string, ok bool) {
+	user, pass, found := strings.Cut(c.BasicAuth, ":")
+	if !found || user == "" || pass == "" {
+		return "", "", false
+	}
+	return user, pass, true
+}
+
 // NewWebSocketConfig creates a websocket.Config for CLI usage
 func (c *ClientConfig) NewWebSocketConfig() (*websocket.Config, error) {
 	// For CLI clients, we can use a simple static origin
@@ -173,6 +726,17 @@ func getOrDefault(key, def string) string {
 	return def
 }
 
+// splitList parses a comma separated list, ignoring whitespace and empty entries
+func splitList(v string) []string {
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
 // getOrError returns the value of the environment variable with the given key
 // or an error if the variable is not set
 func getOrError(key string) (string, error) {
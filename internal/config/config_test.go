@@ -1,6 +1,10 @@
 package config
 
-import "testing"
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
 
 func TestServerConfigHTTPURL(t *testing.T) {
 	tests := []struct {
@@ -40,6 +44,7 @@ func TestServerConfigSubdomainURL(t *testing.T) {
 	tests := []struct {
 		name          string
 		baseUrl       string
+		baseDomain    string
 		useSubdomains bool
 		port          string
 		id            string
@@ -69,6 +74,14 @@ func TestServerConfigSubdomainURL(t *testing.T) {
 			id:            "abc123",
 			wantURL:       "https://abc123.tunol.dev",
 		},
+		{
+			name:          "test production subdomain of base domain",
+			baseUrl:       "https://api.tunol.dev",
+			baseDomain:    "tunol.dev",
+			useSubdomains: true,
+			id:            "abc123",
+			wantURL:       "https://abc123.tunol.dev",
+		},
 		{
 			name:          "test production subdomain",
 			baseUrl:       "https://tunol.dev",
@@ -84,6 +97,7 @@ func TestServerConfigSubdomainURL(t *testing.T) {
 			serverConfig := ServerConfig{
 				BaseURL:       tt.baseUrl,
 				Port:          tt.port,
+				BaseDomain:    tt.baseDomain,
 				UseSubdomains: tt.useSubdomains,
 			}
 			if got := serverConfig.SubdomainURL(tt.id); got != tt.wantURL {
@@ -93,6 +107,124 @@ func TestServerConfigSubdomainURL(t *testing.T) {
 	}
 }
 
+func TestServerConfigSubdomainTunnelID(t *testing.T) {
+	tests := []struct {
+		name       string
+		baseUrl    string
+		baseDomain string
+		host       string
+		wantID     string
+		wantOK     bool
+	}{
+		{
+			name:    "test tunnel subdomain",
+			baseUrl: "https://tunol.dev",
+			host:    "abc123.tunol.dev",
+			wantID:  "abc123",
+			wantOK:  true,
+		},
+		{
+			name:    "test tunnel subdomain with port and different case",
+			baseUrl: "http://localhost",
+			host:    "ABC123.localhost:8001",
+			wantID:  "abc123",
+			wantOK:  true,
+		},
+		{
+			name:    "test fully qualified tunnel subdomain",
+			baseUrl: "https://tunol.dev",
+			host:    "abc123.tunol.dev.",
+			wantID:  "abc123",
+			wantOK:  true,
+		},
+		{
+			name:    "test two label apex domain",
+			baseUrl: "https://tunol.dev",
+			host:    "tunol.dev",
+		},
+		{
+			name:    "test apex of domain under a multi label suffix",
+			baseUrl: "https://tunol.co.uk",
+			host:    "tunol.co.uk",
+		},
+		{
+			name:    "test subdomain of domain under a multi label suffix",
+			baseUrl: "https://tunol.co.uk",
+			host:    "abc123.tunol.co.uk",
+			wantID:  "abc123",
+			wantOK:  true,
+		},
+		{
+			name:    "test www",
+			baseUrl: "https://tunol.dev",
+			host:    "www.tunol.dev",
+		},
+		{
+			name:       "test www of custom domain",
+			baseUrl:    "https://www.example.com",
+			baseDomain: "example.com",
+			host:       "www.example.com",
+		},
+		{
+			name:       "test server host under base domain",
+			baseUrl:    "https://api.tunol.dev",
+			baseDomain: "tunol.dev",
+			host:       "api.tunol.dev",
+		},
+		{
+			name:       "test tunnel under base domain",
+			baseUrl:    "https://api.tunol.dev",
+			baseDomain: "tunol.dev",
+			host:       "abc123.tunol.dev",
+			wantID:     "abc123",
+			wantOK:     true,
+		},
+		{
+			name:    "test nested subdomain",
+			baseUrl: "https://tunol.dev",
+			host:    "a.abc123.tunol.dev",
+		},
+		{
+			name:    "test other domain",
+			baseUrl: "https://tunol.dev",
+			host:    "abc123.example.com",
+		},
+		{
+			name:    "test domain with the base domain as a suffix",
+			baseUrl: "https://tunol.dev",
+			host:    "eviltunol.dev",
+		},
+		{
+			name:    "test ipv4 host",
+			baseUrl: "http://10.0.0.1",
+			host:    "10.0.0.1:8001",
+		},
+		{
+			name:    "test ipv4 host looking like a subdomain",
+			baseUrl: "http://0.1",
+			host:    "10.0.0.1",
+		},
+		{
+			name:    "test ipv6 host",
+			baseUrl: "http://[::1]",
+			host:    "[::1]:8001",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConfig := ServerConfig{
+				BaseURL:    tt.baseUrl,
+				BaseDomain: tt.baseDomain,
+			}
+			id, ok := serverConfig.SubdomainTunnelID(tt.host)
+			if id != tt.wantID || ok != tt.wantOK {
+				t.Errorf("SubdomainTunnelID(%q) = %q, %v, want %q, %v", tt.host, id, ok, tt.wantID, tt.wantOK)
+			}
+		})
+	}
+}
+
 func TestClientConfigWebSocketURL(t *testing.T) {
 	tests := []struct {
 		name             string
@@ -123,3 +255,400 @@ func TestClientConfigWebSocketURL(t *testing.T) {
 	}
 
 }
+
+func TestClientConfigLocalURL(t *testing.T) {
+	tests := []struct {
+		name         string
+		scheme       string
+		port         int
+		path         string
+		wantLocalURL string
+	}{
+		{
+			name:         "test default scheme is http",
+			scheme:       "",
+			port:         3000,
+			path:         "/api",
+			wantLocalURL: "http://localhost:3000/api",
+		},
+		{
+			name:         "test https scheme",
+			scheme:       "https",
+			port:         8443,
+			path:         "",
+			wantLocalURL: "https://localhost:8443",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConfig := ClientConfig{
+				LocalScheme: tt.scheme,
+			}
+			if got := clientConfig.LocalURL(tt.port, tt.path); got != tt.wantLocalURL {
+				t.Errorf("LocalURL() = %v, want %v", got, tt.wantLocalURL)
+			}
+		})
+	}
+}
+
+func TestServerConfigTCPURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		baseUrl string
+		want    string
+	}{
+		{
+			name:    "test localhost url drops scheme and http port",
+			baseUrl: "http://localhost",
+			want:    "tcp://localhost:40001",
+		},
+		{
+			name:    "test production url",
+			baseUrl: "https://tunol.dev",
+			want:    "tcp://tunol.dev:40001",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConfig := ServerConfig{BaseURL: tt.baseUrl, Port: "8001"}
+			if got := serverConfig.TCPURL(40001); got != tt.want {
+				t.Errorf("TCPURL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerConfigPortURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		baseUrl  string
+		certFile string
+		want     string
+	}{
+		{
+			name:    "test localhost url swaps the server port for the tunnels",
+			baseUrl: "http://localhost:8001",
+			want:    "http://localhost:40001",
+		},
+		{
+			name:    "test https url is served over http on its own port",
+			baseUrl: "https://dev.example.com",
+			want:    "http://dev.example.com:40001",
+		},
+		{
+			name:     "test server serving tls serves its ports over https",
+			baseUrl:  "https://dev.example.com",
+			certFile: "cert.pem",
+			want:     "https://dev.example.com:40001",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConfig := ServerConfig{BaseURL: tt.baseUrl, Port: "8001", TLSCertFile: tt.certFile}
+			if got := serverConfig.PortURL(40001); got != tt.want {
+				t.Errorf("PortURL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientConfigBasicAuthCredentials(t *testing.T) {
+	tests := []struct {
+		name      string
+		basicAuth string
+		wantUser  string
+		wantPass  string
+		wantOk    bool
+	}{
+		{
+			name:      "test valid credentials",
+			basicAuth: "user:pass",
+			wantUser:  "user",
+			wantPass:  "pass",
+			wantOk:    true,
+		},
+		{
+			name:      "test password containing a colon",
+			basicAuth: "user:pa:ss",
+			wantUser:  "user",
+			wantPass:  "pa:ss",
+			wantOk:    true,
+		},
+		{
+			name:      "test not set",
+			basicAuth: "",
+			wantOk:    false,
+		},
+		{
+			name:      "test missing password",
+			basicAuth: "user:",
+			wantOk:    false,
+		},
+		{
+			name:      "test missing separator",
+			basicAuth: "user",
+			wantOk:    false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConfig := ClientConfig{BasicAuth: tt.basicAuth}
+			user, pass, ok := clientConfig.BasicAuthCredentials()
+			if user != tt.wantUser || pass != tt.wantPass || ok != tt.wantOk {
+				t.Errorf("BasicAuthCredentials() = %v, %v, %v, want %v, %v, %v", user, pass, ok, tt.wantUser, tt.wantPass, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestAuthConfigAllowsUser(t *testing.T) {
+	tests := []struct {
+		name     string
+		allowed  string
+		username string
+		want     bool
+	}{
+		{
+			name:     "test empty list allows all users",
+			allowed:  "",
+			username: "anyone",
+			want:     true,
+		},
+		{
+			name:     "test listed user",
+			allowed:  "alice, bob",
+			username: "bob",
+			want:     true,
+		},
+		{
+			name:     "test listed user with different case",
+			allowed:  "alice,bob",
+			username: "Alice",
+			want:     true,
+		},
+		{
+			name:     "test unlisted user",
+			allowed:  "alice,bob",
+			username: "mallory",
+			want:     false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := AuthConfig{AllowedGithubUsers: splitList(tt.allowed)}
+			if got := c.AllowsUser(tt.username); got != tt.want {
+				t.Errorf("AllowsUser() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientConfigForTunnel(t *testing.T) {
+	c := &ClientConfig{
+		Headers: map[string]string{"X-Env": "flag"},
+		Tunnels: []TunnelConfig{
+			{
+				Name:      "api",
+				Port:      8080,
+				LocalHost: "127.0.0.1",
+				Subdomain: "myapi",
+				Headers:   map[string]string{"x-api-key": "secret", "X-Env": "file"},
+
+				NoCaptureBodies: true,
+				Verbatim:        true,
+				RewriteLinks:    true,
+			},
+		},
+	}
+
+	api := c.ForTunnel(8080)
+	if api.LocalAddr(8080) != "127.0.0.1:8080" {
+		t.Errorf("LocalAddr() = %v, want %v", api.LocalAddr(8080), "127.0.0.1:8080")
+	}
+	if api.Subdomain != "myapi" {
+		t.Errorf("Subdomain = %v, want %v", api.Subdomain, "myapi")
+	}
+	if api.Headers["X-Api-Key"] != "secret" {
+		t.Errorf("Headers[X-Api-Key] = %v, want %v", api.Headers["X-Api-Key"], "secret")
+	}
+	if api.Headers["X-Env"] != "flag" {
+		t.Errorf("Headers[X-Env] = %v, want the flag value to win", api.Headers["X-Env"])
+	}
+	if !api.NoCaptureBodies {
+		t.Errorf("NoCaptureBodies = false, want the config file value")
+	}
+	if !api.Verbatim {
+		t.Errorf("Verbatim = false, want the config file value")
+	}
+	if !api.RewriteLinks {
+		t.Errorf("RewriteLinks = false, want the config file value")
+	}
+	if len(c.Headers) != 1 {
+		t.Errorf("ForTunnel() should not modify the original headers, got %v", c.Headers)
+	}
+
+	// Tunnels not declared in the config file are left unchanged
+	other := c.ForTunnel(3000)
+	if other.LocalAddr(3000) != "localhost:3000" || other.Subdomain != "" || other.Headers["X-Api-Key"] != "" || other.NoCaptureBodies || other.Verbatim || other.RewriteLinks {
+		t.Errorf("ForTunnel() applied overrides to an undeclared port: %+v", other)
+	}
+
+	// Flags win over the config file
+	c.LocalHost = "host.docker.internal"
+	c.Subdomain = "fromflag"
+	api = c.ForTunnel(8080)
+	if api.LocalHost != "host.docker.internal" || api.Subdomain != "fromflag" {
+		t.Errorf("ForTunnel() overrode flag values: %+v", api)
+	}
+}
+
+func TestClientConfigTunnelName(t *testing.T) {
+	cfg := &ClientConfig{
+		Tunnels: []TunnelConfig{
+			{Name: "web", Port: 3000},
+			{Port: 8080},
+		},
+	}
+
+	if got := cfg.TunnelName(3000); got != "web" {
+		t.Errorf("TunnelName(3000) = %q, want %q", got, "web")
+	}
+	if got := cfg.TunnelName(8080); got != "" {
+		t.Errorf("TunnelName(8080) = %q, want empty", got)
+	}
+	if got := cfg.TunnelName(9000); got != "" {
+		t.Errorf("TunnelName(9000) = %q, want empty", got)
+	}
+}
+
+func TestServerConfigListenAddr(t *testing.T) {
+	tests := []struct {
+		name     string
+		bindAddr string
+		port     string
+		want     string
+	}{
+		{
+			name: "test all interfaces by default",
+			port: "8001",
+			want: ":8001",
+		},
+		{
+			name:     "test loopback only",
+			bindAddr: "127.0.0.1",
+			port:     "8001",
+			want:     "127.0.0.1:8001",
+		},
+		{
+			name:     "test ipv6 address",
+			bindAddr: "::1",
+			port:     "8001",
+			want:     "[::1]:8001",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConfig := ServerConfig{BindAddr: tt.bindAddr, Port: tt.port}
+			if got := serverConfig.ListenAddr(); got != tt.want {
+				t.Errorf("ListenAddr() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerConfigMetricsListenAddr(t *testing.T) {
+	tests := []struct {
+		name        string
+		bindAddr    string
+		metricsAddr string
+		want        string
+	}{
+		{
+			name:        "test port only listens on all interfaces by default",
+			metricsAddr: ":9090",
+			want:        ":9090",
+		},
+		{
+			name:        "test port only uses the bind address",
+			bindAddr:    "127.0.0.1",
+			metricsAddr: ":9090",
+			want:        "127.0.0.1:9090",
+		},
+		{
+			name:        "test explicit host is kept",
+			bindAddr:    "127.0.0.1",
+			metricsAddr: "10.0.0.2:9090",
+			want:        "10.0.0.2:9090",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConfig := ServerConfig{BindAddr: tt.bindAddr, MetricsAddr: tt.metricsAddr}
+			if got := serverConfig.MetricsListenAddr(); got != tt.want {
+				t.Errorf("MetricsListenAddr() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	prefixes, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "2001:db8::/32", "10.1.2.3/16"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{"10.0.0.0/8", "192.168.1.1/32", "2001:db8::/32", "10.1.0.0/16"}
+	for i, p := range prefixes {
+		if p.String() != want[i] {
+			t.Errorf("prefix %d = %v, want %v", i, p, want[i])
+		}
+	}
+
+	for _, invalid := range []string{"cloudflare", "10.0.0.0/33", "10.0.0"} {
+		if _, err := parseTrustedProxies([]string{invalid}); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestCLIConfigDir(t *testing.T) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip("no home directory")
+	}
+
+	tests := []struct {
+		name      string
+		configDir string
+		want      string
+	}{
+		{name: "test default dir", want: filepath.Join(homeDir, ".tunol")},
+		{name: "test dir from env", configDir: "/tmp/tunol", want: "/tmp/tunol"},
+		{name: "test $HOME is expanded", configDir: "$HOME/.config/tunol", want: homeDir + "/.config/tunol"},
+		{name: "test ${HOME} is expanded", configDir: "${HOME}/.config/tunol", want: homeDir + "/.config/tunol"},
+		{name: "test ~ is expanded", configDir: "~/.config/tunol", want: homeDir + "/.config/tunol"},
+		{name: "test bare ~ is expanded", configDir: "~", want: homeDir},
+		{name: "test ~user is left alone", configDir: "~someone/tunol", want: "~someone/tunol"},
+		{name: "test other vars are left alone", configDir: "$HOMEDIR/tunol", want: "$HOMEDIR/tunol"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TUNOL_CONFIG_DIR", tt.configDir)
+			got, err := CLIConfigDir()
+			if err != nil {
+				t.Fatalf("CLIConfigDir() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("CLIConfigDir() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,16 +2,39 @@ package db
 
 import (
 	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
 	"github.com/jwtly10/go-tunol/internal/config"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// The supported database drivers
+const (
+	DriverSQLite   = "sqlite3"
+	DriverPostgres = "postgres"
+)
+
+// Database wraps the connection so queries can be written once, with ? placeholders, for every driver
 type Database struct {
 	*sql.DB
+	driver string
 }
 
 func Initialize(cfg config.DatabaseConfig) (*Database, error) {
-	db, err := sql.Open("sqlite3", cfg.Path)
+	driver, dsn := cfg.Driver, cfg.Path
+	switch driver {
+	case "", DriverSQLite:
+		driver = DriverSQLite
+	case DriverPostgres:
+		dsn = cfg.URL
+	default:
+		return nil, fmt.Errorf("unsupported database driver: %s", cfg.Driver)
+	}
+
+	db, err := sql.Open(driver, dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -20,9 +43,99 @@ func Initialize(cfg config.DatabaseConfig) (*Database, error) {
 		return nil, err
 	}
 
-	if err := applyMigrations(db); err != nil {
+	d := &Database{DB: db, driver: driver}
+	if err := applyMigrations(d); err != nil {
 		return nil, err
 	}
 
-	return &Database{db}, nil
+	return d, nil
+}
+
+func (d *Database) Exec(query string, args ...any) (sql.Result, error) {
+	return d.DB.Exec(d.rebind(query), args...)
+}
+
+func (d *Database) Query(query string, args ...any) (*sql.Rows, error) {
+	return d.DB.Query(d.rebind(query), args...)
+}
+
+func (d *Database) QueryRow(query string, args ...any) *sql.Row {
+	return d.DB.QueryRow(d.rebind(query), args...)
+}
+
+// Insert runs the insert and returns the id of the new row. Postgres doesn't support LastInsertId, so
+// the id is returned by the statement instead, which SQLite supports too
+func (d *Database) Insert(query string, args ...any) (int64, error) {
+	var id int64
+	if err := d.QueryRow(strings.TrimSpace(query)+" RETURNING id", args...).Scan(&id); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// Querier is what the Database and its transactions have in common, so a query can be run in either
+type Querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+	Insert(query string, args ...any) (int64, error)
+}
+
+// Tx wraps a transaction, so its queries are rebound like those of the Database
+type Tx struct {
+	*sql.Tx
+	d *Database
+}
+
+// Transaction runs fn in a transaction, which is committed if fn returns nil and rolled back otherwise
+func (d *Database) Transaction(fn func(tx *Tx) error) error {
+	sqlTx, err := d.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	if err := fn(&Tx{Tx: sqlTx, d: d}); err != nil {
+		sqlTx.Rollback()
+		return err
+	}
+	return sqlTx.Commit()
+}
+
+func (t *Tx) Exec(query string, args ...any) (sql.Result, error) {
+	return t.Tx.Exec(t.d.rebind(query), args...)
+}
+
+func (t *Tx) QueryRow(query string, args ...any) *sql.Row {
+	return t.Tx.QueryRow(t.d.rebind(query), args...)
+}
+
+// Insert runs the insert in the transaction and returns the id of the new row, see Database.Insert
+func (t *Tx) Insert(query string, args ...any) (int64, error) {
+	var id int64
+	if err := t.QueryRow(strings.TrimSpace(query)+" RETURNING id", args...).Scan(&id); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// rebind rewrites the ? placeholders of the query to the $1, $2... placeholders Postgres expects
+func (d *Database) rebind(query string) string {
+	if d.driver != DriverPostgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	inString := false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			inString = !inString
+		case r == '?' && !inString:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
 }
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/jwtly10/go-tunol/internal/config"
+)
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		name   string
+		driver string
+		query  string
+		want   string
+	}{
+		{
+			name:   "sqlite keeps the ? placeholders",
+			driver: DriverSQLite,
+			query:  "SELECT id FROM users WHERE provider = ? AND provider_user_id = ?",
+			want:   "SELECT id FROM users WHERE provider = ? AND provider_user_id = ?",
+		},
+		{
+			name:   "postgres numbers the placeholders",
+			driver: DriverPostgres,
+			query:  "SELECT id FROM users WHERE provider = ? AND provider_user_id = ?",
+			want:   "SELECT id FROM users WHERE provider = $1 AND provider_user_id = $2",
+		},
+		{
+			name:   "question marks in strings are left alone",
+			driver: DriverPostgres,
+			query:  "UPDATE tokens SET description = 'why?' WHERE id = ?",
+			want:   "UPDATE tokens SET description = 'why?' WHERE id = $1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Database{driver: tt.driver}
+			if got := d.rebind(tt.query); got != tt.want {
+				t.Errorf("rebind() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPendingMigrations(t *testing.T) {
+	d, err := Initialize(config.DatabaseConfig{Path: filepath.Join(t.TempDir(), "test.db")})
+	if err != nil {
+		t.Fatalf("Initialize() error = %v", err)
+	}
+	defer d.Close()
+
+	pending, err := d.PendingMigrations()
+	if err != nil {
+		t.Fatalf("PendingMigrations() error = %v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("PendingMigrations() = %v, want none after initializing", pending)
+	}
+
+	if _, err := d.Exec("DELETE FROM schema_migrations WHERE filename = ?", "006_create_credentials.sql"); err != nil {
+		t.Fatalf("failed to forget migration: %v", err)
+	}
+	pending, err = d.PendingMigrations()
+	if err != nil {
+		t.Fatalf("PendingMigrations() error = %v", err)
+	}
+	if len(pending) != 1 || pending[0] != "006_create_credentials.sql" {
+		t.Errorf("PendingMigrations() = %v, want [006_create_credentials.sql]", pending)
+	}
+}
@@ -7,16 +7,15 @@ import (
 	"path/filepath"
 )
 
-// applyMigrations reads all migration files from the migrations directory
-func applyMigrations(db *sql.DB) error {
+// applyMigrations reads all migration files from the migrations directory of the driver. The schema
+// differs between SQLite and Postgres, so Postgres has its own migrations in db/migrations/postgres
+func applyMigrations(db *Database) error {
 	fmt.Println("Applying migrations")
 
-	// Find migrations dir
-	projectRoot, err := findProjectRoot()
+	migrationsDir, err := db.migrationsDir()
 	if err != nil {
-		return fmt.Errorf("failed to find project root: %w", err)
+		return err
 	}
-	migrationsDir := filepath.Join(projectRoot, "db", "migrations")
 
 	fmt.Printf("Using migrations directory: %s\n", migrationsDir)
 
@@ -73,7 +72,7 @@ func applyMigrations(db *sql.DB) error {
 		}
 
 		// Record migration
-		if _, err = tx.Exec("INSERT INTO schema_migrations (filename, query) VALUES (?, ?)", file.Name(), migrationSQL); err != nil {
+		if _, err = tx.Exec(db.rebind("INSERT INTO schema_migrations (filename, query) VALUES (?, ?)"), file.Name(), string(migrationSQL)); err != nil {
 			tx.Rollback()
 			return fmt.Errorf("failed to record migration %s: %w", file.Name(), err)
 		}
@@ -89,6 +88,57 @@ func applyMigrations(db *sql.DB) error {
 	return nil
 }
 
+// migrationsDir returns the directory holding the migrations of the driver
+func (d *Database) migrationsDir() (string, error) {
+	projectRoot, err := findProjectRoot()
+	if err != nil {
+		return "", fmt.Errorf("failed to find project root: %w", err)
+	}
+	dir := filepath.Join(projectRoot, "db", "migrations")
+	if d.driver == DriverPostgres {
+		dir = filepath.Join(dir, "postgres")
+	}
+	return dir, nil
+}
+
+// PendingMigrations returns the migration files that haven't been applied to the database, in order
+func (d *Database) PendingMigrations() ([]string, error) {
+	dir, err := d.migrationsDir()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations directory: %w", err)
+	}
+
+	applied := make(map[string]bool)
+	rows, err := d.Query("SELECT filename FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list applied migrations: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var filename string
+		if err := rows.Scan(&filename); err != nil {
+			return nil, err
+		}
+		applied[filename] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var pending []string
+	for _, file := range files {
+		if filepath.Ext(file.Name()) == ".sql" && !applied[file.Name()] {
+			pending = append(pending, file.Name())
+		}
+	}
+	return pending, nil
+}
+
 // findProjectRoot finds the root directory of the project by looking for a go.mod file
 func findProjectRoot() (string, error) {
 	dir, err := os.Getwd()
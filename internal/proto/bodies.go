@@ -0,0 +1,87 @@
+package proto
+
+import "time"
+
+// Limits on the bodies waiting for their message in PendingBodies
+const (
+	// PendingBodyMaxAge is how long a body can wait. It's sent just before its message, so only waits
+	// on the frames other tunnels send in between
+	PendingBodyMaxAge = time.Minute
+	// PendingBodyMaxBytes is how many bytes of bodies can wait at once, the oldest are dropped past it
+	PendingBodyMaxBytes = 64 << 20
+)
+
+// PendingBodies holds the bodies received as BodyFrames until the message they come before claims them.
+// A body whose message never arrives, e.g. as its request timed out or its tunnel was removed, would
+// otherwise be held for the life of the connection, so bodies are dropped once they're too old or too
+// many bytes are waiting. It's only used by the loop reading the connection, so isn't safe for concurrent use
+type PendingBodies struct {
+	maxAge   time.Duration
+	maxBytes int
+
+	bodies map[string]pendingBody // Keyed by request id
+	size   int                    // Total bytes of the bodies
+}
+
+type pendingBody struct {
+	body     []byte
+	received time.Time
+}
+
+func NewPendingBodies(maxAge time.Duration, maxBytes int) *PendingBodies {
+	return &PendingBodies{
+		maxAge:   maxAge,
+		maxBytes: maxBytes,
+		bodies:   make(map[string]pendingBody),
+	}
+}
+
+// Put holds the body until Take is called for its request, dropping the bodies that have waited too long
+// and then the oldest until the rest fit. The new body is always kept, even if it's over the limit by itself
+func (p *PendingBodies) Put(requestID string, body []byte) {
+	p.Drop(requestID)
+
+	now := time.Now()
+	for id, b := range p.bodies {
+		if now.Sub(b.received) > p.maxAge {
+			p.Drop(id)
+		}
+	}
+	for len(p.bodies) > 0 && p.size+len(body) > p.maxBytes {
+		p.Drop(p.oldest())
+	}
+
+	p.bodies[requestID] = pendingBody{body: body, received: now}
+	p.size += len(body)
+}
+
+// Take returns the body of the request and forgets it, nil if there isn't one
+func (p *PendingBodies) Take(requestID string) []byte {
+	body := p.bodies[requestID].body
+	p.Drop(requestID)
+	return body
+}
+
+// Drop forgets the body of the request, if there is one
+func (p *PendingBodies) Drop(requestID string) {
+	if b, ok := p.bodies[requestID]; ok {
+		p.size -= len(b.body)
+		delete(p.bodies, requestID)
+	}
+}
+
+// Len returns the number of bodies waiting
+func (p *PendingBodies) Len() int {
+	return len(p.bodies)
+}
+
+func (p *PendingBodies) oldest() string {
+	var oldestID string
+	var oldest time.Time
+	for id, b := range p.bodies {
+		if oldestID == "" || b.received.Before(oldest) {
+			oldestID, oldest = id, b.received
+		}
+	}
+	return oldestID
+}
@@ -0,0 +1,59 @@
+package proto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPendingBodies(t *testing.T) {
+	t.Run("bodies are claimed once", func(t *testing.T) {
+		p := NewPendingBodies(time.Minute, 1024)
+		p.Put("req-1", []byte("hello"))
+
+		require.Equal(t, []byte("hello"), p.Take("req-1"))
+		require.Nil(t, p.Take("req-1"))
+		require.Zero(t, p.Len())
+	})
+
+	t.Run("bodies that wait too long are dropped", func(t *testing.T) {
+		p := NewPendingBodies(10*time.Millisecond, 1024)
+		p.Put("abandoned", []byte("never claimed"))
+		time.Sleep(20 * time.Millisecond)
+
+		p.Put("req-2", []byte("claimed"))
+		require.Nil(t, p.Take("abandoned"))
+		require.Equal(t, []byte("claimed"), p.Take("req-2"))
+	})
+
+	t.Run("the oldest bodies are dropped past the byte limit", func(t *testing.T) {
+		p := NewPendingBodies(time.Minute, 10)
+		p.Put("first", []byte("12345"))
+		p.Put("second", []byte("12345"))
+		p.Put("third", []byte("12345"))
+
+		require.Equal(t, 2, p.Len())
+		require.Nil(t, p.Take("first"))
+		require.NotNil(t, p.Take("second"))
+		require.NotNil(t, p.Take("third"))
+	})
+
+	t.Run("a body over the limit by itself is still kept", func(t *testing.T) {
+		p := NewPendingBodies(time.Minute, 4)
+		p.Put("small", []byte("1"))
+		p.Put("large", []byte("123456"))
+
+		require.Equal(t, 1, p.Len())
+		require.Equal(t, []byte("123456"), p.Take("large"))
+	})
+
+	t.Run("a body sent again replaces the first", func(t *testing.T) {
+		p := NewPendingBodies(time.Minute, 10)
+		p.Put("req-3", []byte("12345678"))
+		p.Put("req-3", []byte("abcdefgh"))
+
+		require.Equal(t, 1, p.Len())
+		require.Equal(t, []byte("abcdefgh"), p.Take("req-3"))
+	})
+}
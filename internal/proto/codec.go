@@ -0,0 +1,79 @@
+package proto
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+
+	"golang.org/x/net/websocket"
+)
+
+// FrameCodec sends and receives WSFrame values as single websocket messages, keeping
+// track of whether each message is text or binary
+var FrameCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		f := v.(*WSFrame)
+		if f.Binary {
+			return f.Data, websocket.BinaryFrame, nil
+		}
+		return f.Data, websocket.TextFrame, nil
+	},
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		f := v.(*WSFrame)
+		f.Data = data
+		f.Binary = payloadType == websocket.BinaryFrame
+		return nil
+	},
+}
+
+// BodyFrame is the body of an HTTPRequest or HTTPResponse, sent on its own as a binary websocket message
+// just before the message it belongs to, which has BodyFrame set. This saves base64 encoding the body
+// into the JSON, see FeatureBinaryBodies
+type BodyFrame struct {
+	RequestId string
+	Body      []byte
+}
+
+// Received is a message read from the tunnel connection by MessageCodec, either a Message or a BodyFrame
+type Received struct {
+	Message Message
+	Body    *BodyFrame // Set instead of Message for binary frames
+}
+
+// MessageCodec sends Messages as JSON text frames, like websocket.JSON, and *BodyFrame values as binary
+// frames. It receives either into a Received. A binary frame starts with the length of the request id,
+// as 2 big endian bytes, followed by the id and then the body, so ids can't be longer than math.MaxUint16
+var MessageCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		if f, ok := v.(*BodyFrame); ok {
+			if len(f.RequestId) > math.MaxUint16 {
+				return nil, websocket.BinaryFrame, errors.New("body frame request id is too long")
+			}
+			data := make([]byte, 2+len(f.RequestId)+len(f.Body))
+			binary.BigEndian.PutUint16(data, uint16(len(f.RequestId)))
+			copy(data[2:], f.RequestId)
+			copy(data[2+len(f.RequestId):], f.Body)
+			return data, websocket.BinaryFrame, nil
+		}
+		data, err := json.Marshal(v)
+		return data, websocket.TextFrame, err
+	},
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		r := v.(*Received)
+		*r = Received{}
+		if payloadType != websocket.BinaryFrame {
+			return json.Unmarshal(data, &r.Message)
+		}
+
+		if len(data) < 2 {
+			return errors.New("body frame is too short")
+		}
+		idLen := int(binary.BigEndian.Uint16(data))
+		if len(data) < 2+idLen {
+			return errors.New("body frame is too short")
+		}
+		r.Body = &BodyFrame{RequestId: string(data[2 : 2+idLen]), Body: data[2+idLen:]}
+		return nil
+	},
+}
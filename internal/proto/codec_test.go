@@ -0,0 +1,76 @@
+package proto
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+func TestMessageCodecBodyFrames(t *testing.T) {
+	tests := []struct {
+		name      string
+		frame     BodyFrame
+		marshalOK bool
+	}{
+		{name: "round trip", frame: BodyFrame{RequestId: "req-1", Body: []byte("hello")}, marshalOK: true},
+		{name: "empty body", frame: BodyFrame{RequestId: "req-2", Body: []byte{}}, marshalOK: true},
+		{name: "longest id", frame: BodyFrame{RequestId: strings.Repeat("a", math.MaxUint16), Body: []byte("x")}, marshalOK: true},
+		{name: "oversized id", frame: BodyFrame{RequestId: strings.Repeat("a", math.MaxUint16+1), Body: []byte("x")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, payloadType, err := MessageCodec.Marshal(&tt.frame)
+			if !tt.marshalOK {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, byte(websocket.BinaryFrame), payloadType)
+
+			var r Received
+			require.NoError(t, MessageCodec.Unmarshal(data, payloadType, &r))
+			require.NotNil(t, r.Body)
+			require.Equal(t, tt.frame.RequestId, r.Body.RequestId)
+			require.Equal(t, tt.frame.Body, r.Body.Body)
+		})
+	}
+}
+
+func TestMessageCodecShortFrames(t *testing.T) {
+	longPrefix := make([]byte, 2, 5)
+	binary.BigEndian.PutUint16(longPrefix, 10)
+	longPrefix = append(longPrefix, "abc"...)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty frame", data: []byte{}},
+		{name: "partial length prefix", data: []byte{0}},
+		{name: "id length prefix longer than the frame", data: longPrefix},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r Received
+			require.EqualError(t, MessageCodec.Unmarshal(tt.data, websocket.BinaryFrame, &r), "body frame is too short")
+		})
+	}
+}
+
+func TestMessageCodecMessages(t *testing.T) {
+	data, payloadType, err := MessageCodec.Marshal(Message{Type: MessageTypeHTTPRequest, TunnelID: "abc"})
+	require.NoError(t, err)
+	require.Equal(t, byte(websocket.TextFrame), payloadType)
+
+	var r Received
+	require.NoError(t, MessageCodec.Unmarshal(data, payloadType, &r))
+	require.Nil(t, r.Body)
+	require.Equal(t, MessageTypeHTTPRequest, r.Message.Type)
+	require.Equal(t, "abc", r.Message.TunnelID)
+}
@@ -0,0 +1,70 @@
+package proto
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// BodyEncodingGzip marks a request or response body gzipped for the trip through the tunnel
+const BodyEncodingGzip = "gzip"
+
+// CompressMinBytes is the smallest body worth compressing, smaller ones gain little once base64 encoded
+const CompressMinBytes = 1024
+
+// ErrBodyTooLarge is returned when a compressed body turns out to be over the limit once decompressed
+var ErrBodyTooLarge = errors.New("body is too large")
+
+// CompressBody gzips a body for the tunnel, returning it with its body encoding. Bodies that are small, or
+// that don't get smaller, e.g. images, are returned as they are with no encoding
+func CompressBody(body []byte) ([]byte, string) {
+	if len(body) < CompressMinBytes {
+		return body, ""
+	}
+
+	var buf bytes.Buffer
+	gz, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed) // Only fails for an invalid level
+	if _, err := gz.Write(body); err != nil {
+		return body, ""
+	}
+	if err := gz.Close(); err != nil {
+		return body, ""
+	}
+	if buf.Len() >= len(body) {
+		return body, ""
+	}
+	return buf.Bytes(), BodyEncodingGzip
+}
+
+// DecompressBody returns the body as it was before CompressBody. Decompressed bodies over maxBytes
+// return ErrBodyTooLarge, 0 for no limit
+func DecompressBody(body []byte, encoding string, maxBytes int64) ([]byte, error) {
+	switch encoding {
+	case "":
+		return body, nil
+	case BodyEncodingGzip:
+	default:
+		return nil, fmt.Errorf("unsupported body encoding %q", encoding)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var r io.Reader = gz
+	if maxBytes > 0 {
+		r = io.LimitReader(gz, maxBytes+1)
+	}
+	decompressed, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if maxBytes > 0 && int64(len(decompressed)) > maxBytes {
+		return nil, ErrBodyTooLarge
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,56 @@
+package proto
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     []byte
+		encoding string
+	}{
+		{name: "compressible body", body: []byte(strings.Repeat("hello ", 1000)), encoding: BodyEncodingGzip},
+		{name: "small body", body: []byte("hello"), encoding: ""},
+		{name: "empty body", body: []byte{}, encoding: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressed, encoding := CompressBody(tt.body)
+			require.Equal(t, tt.encoding, encoding)
+			if encoding != "" {
+				require.Less(t, len(compressed), len(tt.body))
+			}
+
+			body, err := DecompressBody(compressed, encoding, 0)
+			require.NoError(t, err)
+			require.Equal(t, tt.body, body)
+		})
+	}
+}
+
+func TestDecompressBodyLimit(t *testing.T) {
+	original := []byte(strings.Repeat("a", 4096))
+	compressed, encoding := CompressBody(original)
+	require.Equal(t, BodyEncodingGzip, encoding)
+
+	t.Run("bodies at the limit are kept", func(t *testing.T) {
+		body, err := DecompressBody(compressed, encoding, int64(len(original)))
+		require.NoError(t, err)
+		require.Equal(t, original, body)
+	})
+
+	t.Run("bodies over the limit are rejected", func(t *testing.T) {
+		_, err := DecompressBody(compressed, encoding, int64(len(original)-1))
+		require.ErrorIs(t, err, ErrBodyTooLarge)
+	})
+
+	t.Run("unknown encodings are rejected", func(t *testing.T) {
+		_, err := DecompressBody(compressed, "br", 0)
+		require.Error(t, err)
+	})
+}
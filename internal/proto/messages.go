@@ -1,31 +1,212 @@
 package proto
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type MessageType string
 
 const (
 	MessageTypePing MessageType = "ping"
 	MessageTypePong MessageType = "pong"
 
-	MessageTypeTunnelReq  MessageType = "tunnel_req"
-	MessageTypeTunnelResp MessageType = "tunnel_resp"
+	MessageTypeHello    MessageType = "hello"
+	MessageTypeHelloAck MessageType = "hello_ack"
+
+	MessageTypeTunnelReq   MessageType = "tunnel_req"
+	MessageTypeTunnelResp  MessageType = "tunnel_resp"
+	MessageTypeTunnelClose MessageType = "tunnel_close"
 
 	MessageTypeHTTPRequest  MessageType = "http_request"
 	MessageTypeHTTPResponse MessageType = "http_response"
 
+	MessageTypeHTTPBodyChunk   MessageType = "http_body_chunk"
+	MessageTypeHTTPStreamClose MessageType = "http_stream_close"
+
+	MessageTypeTCPData  MessageType = "tcp_data"
+	MessageTypeTCPClose MessageType = "tcp_close"
+
+	MessageTypeWSOpen  MessageType = "ws_open"
+	MessageTypeWSFrame MessageType = "ws_frame"
+	MessageTypeWSClose MessageType = "ws_close"
+
+	MessageTypeServerShutdown MessageType = "server_shutdown"
+	MessageTypeRateLimited    MessageType = "rate_limited"
+	MessageTypeTunnelClosed   MessageType = "tunnel_closed"
+
 	MessageTypeError MessageType = "error"
 )
 
+// ProtocolVersion is the version of the message set the client and server speak. It's bumped whenever
+// a change to the messages would break a client or server that doesn't know about it
+const ProtocolVersion = 1
+
+// MinProtocolVersion is the oldest version of the message set the server still supports
+const MinProtocolVersion = 1
+
+// ProtocolHeader carries the clients ProtocolVersion in the websocket handshake. Clients from before
+// the protocol was versioned don't send it
+const ProtocolHeader = "X-Tunol-Protocol"
+
+// Protocols a tunnel can be registered with
+const (
+	ProtocolHTTP = "http"
+	ProtocolTCP  = "tcp"
+)
+
+// Features a client or server can support, exchanged in the hello
+const (
+	FeatureTCP        = "tcp"        // Raw tcp tunnels
+	FeatureStreaming  = "streaming"  // Streamed event stream responses
+	FeatureWebSocket  = "websocket"  // Websocket passthrough to the local server
+	FeatureSubdomains = "subdomains" // Tunnels are served on subdomains, rather than paths
+	FeatureMultiplex  = "multiplex"  // Several tunnels can share one connection, their messages are tagged with TunnelID
+	// FeatureCompression is set when request and response bodies can be sent gzipped, tagged with their
+	// BodyEncoding. Bodies are only compressed when both sides support it
+	FeatureCompression = "compression"
+	// FeatureBinaryBodies is set when request and response bodies can be sent as binary BodyFrames, rather
+	// than base64 encoded in the JSON. Like compression, it's only used when both sides support it
+	FeatureBinaryBodies = "binary_bodies"
+)
+
+// Message is sent in both directions over the tunnel connection. The payload is kept as raw JSON until
+// the messages type is known, then decoded once with its typed accessor, e.g. AsHTTPRequest
 type Message struct {
-	Type    MessageType `json:"type"`
-	Payload interface{} `json:"payload,omitempty"`
+	Type    MessageType     `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// TunnelID is the servers id of the tunnel the message is for, so several tunnels can share a
+	// connection. Empty for messages about the connection, and from servers that don't multiplex
+	TunnelID string `json:"tunnel_id,omitempty"`
+}
+
+// Hello is sent by the client when it connects, before requesting tunnels. Servers from before the hello
+// ignore it, so the client mustn't wait for the HelloAck before requesting a tunnel
+type Hello struct {
+	Version         string   `json:"version"`          // The version of the CLI
+	ProtocolVersion int      `json:"protocol_version"` // The ProtocolVersion the CLI speaks
+	OS              string   `json:"os"`               // e.g. darwin/arm64
+	Capabilities    []string `json:"capabilities,omitempty"`
+}
+
+// HelloAck answers the clients Hello, describing the server so the CLI can adapt to it
+type HelloAck struct {
+	Version         string   `json:"version"`
+	ProtocolVersion int      `json:"protocol_version"`
+	Features        []string `json:"features,omitempty"` // The features enabled on the server
+	Limits          Limits   `json:"limits"`
+}
+
+// Limits are the limits the server puts on tunnels, 0 for each is unlimited
+type Limits struct {
+	MaxTunnels          int     `json:"max_tunnels,omitempty"` // Per user, across all their connections
+	MaxBodyBytes        int64   `json:"max_body_bytes,omitempty"`
+	RequestsPerSecond   float64 `json:"requests_per_second,omitempty"`
+	RequestTimeoutMs    int64   `json:"request_timeout_ms,omitempty"`
+	TunnelIdleTimeoutMs int64   `json:"tunnel_idle_timeout_ms,omitempty"`
+	TunnelMaxLifetimeMs int64   `json:"tunnel_max_lifetime_ms,omitempty"`
 }
 
 type TunnelRequest struct {
 	// LocalPort is the local port to tunnel and expose to the public internet
 	LocalPort int `json:"local_port"`
+	// Subdomain is an optional tunnel id requested by the client, used instead of a random id
+	Subdomain string `json:"subdomain,omitempty"`
+	// Protocol is the type of tunnel, http or tcp. Defaults to http when empty
+	Protocol string `json:"protocol,omitempty"`
+	// BasicAuthUser and BasicAuthPassHash optionally protect an http tunnel with basic auth.
+	// The password is sent as a hex encoded SHA-256 hash, so the server never sees it in plain text
+	BasicAuthUser     string `json:"basic_auth_user,omitempty"`
+	BasicAuthPassHash string `json:"basic_auth_pass_hash,omitempty"`
+	// RequestsPerSecond optionally limits the rate of requests to the tunnel. The server may cap it
+	RequestsPerSecond float64 `json:"requests_per_second,omitempty"`
+	// PassAllHeaders forwards all response headers except hop-by-hop ones, instead of only the
+	// default allowlist. AllowHeaders extends the allowlist instead
+	PassAllHeaders bool     `json:"pass_all_headers,omitempty"`
+	AllowHeaders   []string `json:"allow_headers,omitempty"`
+	// Verbatim forwards requests exactly as the public client sent them, with every header and no
+	// forwarding headers added, so signatures over the request (e.g. webhooks) still validate.
+	// Only X-Forwarded-For and X-Real-Ip are replaced with the real client, and Forwarded dropped
+	Verbatim bool `json:"verbatim,omitempty"`
+	// CaptureBodies is whether the client keeps request and response bodies for its dashboard and
+	// inspector. When false only their metadata is recorded, e.g. for tunnels carrying sensitive data
+	CaptureBodies bool `json:"capture_bodies"`
+	// CORS optionally has the server answer CORS preflight requests matching the policy itself, without a
+	// round trip to the local server. The local server never sees them, so its own CORS handling is bypassed
+	CORS *CORSPolicy `json:"cors,omitempty"`
+}
+
+// CORSPolicy is what the server answers preflight requests to a tunnel with. Preflights it doesn't allow
+// are forwarded as usual, so the local server can still answer them
+type CORSPolicy struct {
+	AllowOrigins     []string `json:"allow_origins"`           // Origins allowed, * for any
+	AllowMethods     []string `json:"allow_methods,omitempty"` // Empty allows any method
+	AllowHeaders     []string `json:"allow_headers,omitempty"` // Empty allows any request headers
+	AllowCredentials bool     `json:"allow_credentials,omitempty"`
+	MaxAgeSeconds    int      `json:"max_age_seconds,omitempty"` // How long browsers may cache the answer, 0 leaves it to them
 }
 
 type TunnelResponse struct {
 	// URL is the public URL of the tunnel to the local port
 	URL string `json:"url"`
+	// ID is the servers id for the tunnel, which is its subdomain for http tunnels. Empty from older servers
+	ID string `json:"id,omitempty"`
+	// Created is when the server registered the tunnel, zero from older servers
+	Created time.Time `json:"created"`
+	// RequestsPerSecond is the rate limit the server enforces on the tunnel, 0 if unlimited
+	RequestsPerSecond float64 `json:"requests_per_second,omitempty"`
+	// MaxBodyBytes is the largest response body the client should send through the tunnel, 0 if unlimited
+	MaxBodyBytes int64 `json:"max_body_bytes,omitempty"`
+	// RequestTimeoutMs is how long the server waits for the response to a request, so the client can
+	// give up on the local server before then. 0 if the server didn't say
+	RequestTimeoutMs int64 `json:"request_timeout_ms,omitempty"`
+	// ExpiresAt is when the server closes the tunnel however much it's used, zero if it doesn't expire
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type RateLimited struct {
+	// Rejected is the total number of requests to the tunnel rejected by the rate limit
+	Rejected int `json:"rejected"`
+}
+
+type ServerShutdown struct {
+	// Message is a human readable reason for the shutdown, to show to the user
+	Message string `json:"message"`
+}
+
+// Reasons the server closes a tunnel
+const (
+	TunnelClosedIdle    = "idle"    // No requests came through the tunnel within the servers idle timeout
+	TunnelClosedExpired = "expired" // The tunnel was open for the servers max lifetime
+)
+
+// TunnelClosed is sent before the server closes a tunnel, so the client doesn't try to reconnect it
+type TunnelClosed struct {
+	Reason string `json:"reason"`
+	// Message is a human readable reason for closing the tunnel, to show to the user
+	Message string `json:"message"`
+}
+
+// Codes of the errors the server sends, so the client can tell why it was rejected without parsing the message
+const (
+	ErrorCodeInvalidToken        = "invalid_token"        // The token is missing, invalid or expired
+	ErrorCodeUnsupportedProtocol = "unsupported_protocol" // The client speaks a protocol version the server doesn't support
+	ErrorCodeInvalidRequest      = "invalid_request"      // The tunnel request has options that can't be used together
+	ErrorCodeInvalidSubdomain    = "invalid_subdomain"    // The requested subdomain isn't a valid name
+	ErrorCodeSubdomainTaken      = "subdomain_taken"      // The requested subdomain is in use, or reserved by another user
+	ErrorCodeTunnelLimitExceeded = "tunnel_limit_exceeded"
+	ErrorCodeShuttingDown        = "server_shutting_down"
+	ErrorCodeInternal            = "internal_error" // Something went wrong on the server, trying again may work
+)
+
+// ErrorPayload is the payload of every error message the server sends
+type ErrorPayload struct {
+	// Code is one of the error codes, empty from servers that predate them
+	Code string `json:"code,omitempty"`
+	// Message is a human readable description of the error, to show to the user. It keeps the
+	// "error" key older clients read it from
+	Message string `json:"error"`
+	// Retryable is set when trying again later may succeed, e.g. the server is restarting. Other
+	// errors won't go away without the user doing something about them
+	Retryable bool `json:"retryable,omitempty"`
 }
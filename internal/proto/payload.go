@@ -0,0 +1,44 @@
+package proto
+
+import "encoding/json"
+
+// NewMessage encodes the payload into a message of the type, ready to send
+func NewMessage(msgType MessageType, payload interface{}) (Message, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Type: msgType, Payload: b}, nil
+}
+
+// decodePayload decodes the messages payload into a T. A message without a payload decodes to the zero T
+func decodePayload[T any](m Message) (T, error) {
+	var v T
+	if len(m.Payload) == 0 {
+		return v, nil
+	}
+	err := json.Unmarshal(m.Payload, &v)
+	return v, err
+}
+
+// The typed accessors decode the payload of a message of the matching type
+
+func (m Message) AsHello() (Hello, error)                   { return decodePayload[Hello](m) }
+func (m Message) AsHelloAck() (HelloAck, error)             { return decodePayload[HelloAck](m) }
+func (m Message) AsTunnelRequest() (TunnelRequest, error)   { return decodePayload[TunnelRequest](m) }
+func (m Message) AsTunnelResponse() (TunnelResponse, error) { return decodePayload[TunnelResponse](m) }
+func (m Message) AsError() (ErrorPayload, error)            { return decodePayload[ErrorPayload](m) }
+func (m Message) AsRateLimited() (RateLimited, error)       { return decodePayload[RateLimited](m) }
+func (m Message) AsServerShutdown() (ServerShutdown, error) { return decodePayload[ServerShutdown](m) }
+func (m Message) AsTunnelClosed() (TunnelClosed, error)     { return decodePayload[TunnelClosed](m) }
+func (m Message) AsHTTPRequest() (HTTPRequest, error)       { return decodePayload[HTTPRequest](m) }
+func (m Message) AsHTTPResponse() (HTTPResponse, error)     { return decodePayload[HTTPResponse](m) }
+func (m Message) AsHTTPBodyChunk() (HTTPBodyChunk, error)   { return decodePayload[HTTPBodyChunk](m) }
+func (m Message) AsHTTPStreamClose() (HTTPStreamClose, error) {
+	return decodePayload[HTTPStreamClose](m)
+}
+func (m Message) AsTCPData() (TCPData, error)   { return decodePayload[TCPData](m) }
+func (m Message) AsTCPClose() (TCPClose, error) { return decodePayload[TCPClose](m) }
+func (m Message) AsWSOpen() (WSOpen, error)     { return decodePayload[WSOpen](m) }
+func (m Message) AsWSFrame() (WSFrame, error)   { return decodePayload[WSFrame](m) }
+func (m Message) AsWSClose() (WSClose, error)   { return decodePayload[WSClose](m) }
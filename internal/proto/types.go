@@ -1,11 +1,25 @@
 package proto
 
+import "time"
+
 type HTTPRequest struct {
 	Method    string            `json:"method"`
 	Path      string            `json:"path"`
 	Headers   map[string]string `json:"headers"`
 	Body      []byte            `json:"body"`
 	RequestId string            `json:"request_id"`
+	// Trailers are sent after a chunked body, e.g. by gRPC-web clients
+	Trailers map[string]string `json:"trailers,omitempty"`
+	// HeaderValues are every value of every header as the public client sent them, only for verbatim
+	// tunnels. Headers still has the first value of each, for logging and the inspector
+	HeaderValues map[string][]string `json:"header_values,omitempty"`
+	// BodyEncoding is how Body was compressed for the tunnel, empty if it wasn't. See FeatureCompression
+	BodyEncoding string `json:"body_encoding,omitempty"`
+	// BodyFrame is set when the body was sent just before the message as a BodyFrame, Body is then empty
+	BodyFrame bool `json:"body_frame,omitempty"`
+	// SentAt is when the server sent the request to the client, in unix nanoseconds on the servers clock.
+	// The client returns it in the response, so the server can time the round trip through the tunnel
+	SentAt int64 `json:"sent_at,omitempty"`
 }
 
 type HTTPResponse struct {
@@ -13,4 +27,63 @@ type HTTPResponse struct {
 	Headers    map[string]string `json:"headers"`
 	Body       []byte            `json:"body"`
 	RequestId  string            `json:"request_id"`
+	// Streaming is set when the body is sent afterwards as HTTPBodyChunk messages, instead of in Body
+	Streaming bool `json:"streaming,omitempty"`
+	// Trailers are sent after the body, for streaming responses they are on the final chunk instead
+	Trailers map[string]string `json:"trailers,omitempty"`
+	// BodyEncoding is how Body was compressed for the tunnel, empty if it wasn't. See FeatureCompression
+	BodyEncoding string `json:"body_encoding,omitempty"`
+	// BodyFrame is set when the body was sent just before the message as a BodyFrame, Body is then empty
+	BodyFrame bool `json:"body_frame,omitempty"`
+	// RequestSentAt is the SentAt of the request, and LocalDuration how long the client took to answer it,
+	// mostly waiting on the local server. The rest of the round trip is spent in the tunnel. Both are unset
+	// by older clients. For streaming responses LocalDuration is the time until the head was sent
+	RequestSentAt int64         `json:"request_sent_at,omitempty"`
+	LocalDuration time.Duration `json:"local_duration,omitempty"`
+}
+
+// HTTPBodyChunk is part of the body of a streaming response, the last chunk has Final set
+type HTTPBodyChunk struct {
+	RequestId string `json:"request_id"`
+	Data      []byte `json:"data"`
+	Final     bool   `json:"final,omitempty"`
+	// Trailers of the response, only set on the final chunk
+	Trailers map[string]string `json:"trailers,omitempty"`
+}
+
+// HTTPStreamClose tells the client the public caller of a streaming response has gone away
+type HTTPStreamClose struct {
+	RequestId string `json:"request_id"`
+}
+
+// TCPData is a frame of raw bytes for a single connection of a tcp tunnel. The first
+// frame for a connection id (which may be empty) signals a new connection
+type TCPData struct {
+	ConnID string `json:"conn_id"`
+	Data   []byte `json:"data"`
+}
+
+// TCPClose signals that one side of a tcp tunnel connection has closed
+type TCPClose struct {
+	ConnID string `json:"conn_id"`
+}
+
+// WSOpen asks the client to open a websocket connection to the local server, for a
+// public websocket connection that has been accepted by the server
+type WSOpen struct {
+	ConnID  string            `json:"conn_id"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+}
+
+// WSFrame is a single message of a passthrough websocket connection, in either direction
+type WSFrame struct {
+	ConnID string `json:"conn_id"`
+	Binary bool   `json:"binary"`
+	Data   []byte `json:"data"`
+}
+
+// WSClose signals that one side of a passthrough websocket connection has closed
+type WSClose struct {
+	ConnID string `json:"conn_id"`
 }
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"log/slog"
+	"time"
+)
+
+// accessLogEntry describes a single request proxied through a tunnel
+type accessLogEntry struct {
+	TunnelID  string
+	RequestID string
+	Method    string
+	Path      string
+	Status    int
+	Duration  time.Duration
+	BytesIn   int
+	BytesOut  int
+	// Duration split between the client, mostly waiting on the local server, and the tunnel. Only
+	// known, and Timed set, for clients that report how long they took
+	Timed         bool
+	LocalDuration time.Duration
+	TunnelLatency time.Duration
+}
+
+// logAccess writes the access log line of a proxied request. Every proxied request gets
+// exactly one, so the keys should stay stable for anything parsing them
+func logAccess(logger *slog.Logger, e accessLogEntry) {
+	path := e.Path
+	if path == "" {
+		path = "/"
+	}
+
+	args := []interface{}{
+		"tunnel_id", e.TunnelID,
+		"request_id", e.RequestID,
+		"method", e.Method,
+		"path", path,
+		"status", e.Status,
+		"duration_ms", e.Duration.Milliseconds(),
+		"bytes_in", e.BytesIn,
+		"bytes_out", e.BytesOut,
+	}
+	if e.Timed {
+		args = append(args, "local_ms", e.LocalDuration.Milliseconds(), "tunnel_ms", e.TunnelLatency.Milliseconds())
+	}
+	logger.Info("access", args...)
+}
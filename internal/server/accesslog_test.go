@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestLogAccess(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	logAccess(logger, accessLogEntry{
+		TunnelID:  "myapp",
+		RequestID: "req-1",
+		Method:    "GET",
+		Path:      "",
+		Status:    200,
+		Duration:  150 * time.Millisecond,
+		BytesIn:   0,
+		BytesOut:  42,
+	})
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("access log line is not valid json: %v", err)
+	}
+
+	want := map[string]interface{}{
+		"level":       "INFO",
+		"msg":         "access",
+		"tunnel_id":   "myapp",
+		"request_id":  "req-1",
+		"method":      "GET",
+		"path":        "/",
+		"status":      float64(200),
+		"duration_ms": float64(150),
+		"bytes_in":    float64(0),
+		"bytes_out":   float64(42),
+	}
+	for k, v := range want {
+		if line[k] != v {
+			t.Errorf("access log %s = %v, want %v", k, line[k], v)
+		}
+	}
+}
+
+func TestLogAccessTimed(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	logAccess(logger, accessLogEntry{TunnelID: "myapp", Status: 200, Duration: 150 * time.Millisecond})
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("access log line is not valid json: %v", err)
+	}
+	if _, ok := line["tunnel_ms"]; ok {
+		t.Errorf("access log has tunnel_ms for a request that wasn't timed")
+	}
+
+	buf.Reset()
+	logAccess(logger, accessLogEntry{
+		TunnelID:      "myapp",
+		Status:        200,
+		Duration:      150 * time.Millisecond,
+		Timed:         true,
+		LocalDuration: 120 * time.Millisecond,
+		TunnelLatency: 25 * time.Millisecond,
+	})
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("access log line is not valid json: %v", err)
+	}
+	if line["local_ms"] != float64(120) || line["tunnel_ms"] != float64(25) {
+		t.Errorf("access log local_ms = %v and tunnel_ms = %v, want 120 and 25", line["local_ms"], line["tunnel_ms"])
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// servePreflight answers a CORS preflight request to the tunnel from its policy, returning false if the
+// request isn't a preflight the policy allows, in which case it's forwarded as usual
+func (th *TunnelHandler) servePreflight(w http.ResponseWriter, r *http.Request, t *Tunnel, realPath string) bool {
+	origin := r.Header.Get("Origin")
+	method := r.Header.Get("Access-Control-Request-Method")
+	if r.Method != http.MethodOptions || origin == "" || method == "" {
+		return false
+	}
+
+	policy := t.CORS
+	anyOrigin := slices.Contains(policy.AllowOrigins, "*")
+	if !anyOrigin && !containsFold(policy.AllowOrigins, origin) {
+		return false
+	}
+	if len(policy.AllowMethods) > 0 && !containsFold(policy.AllowMethods, method) {
+		return false
+	}
+	requested := splitHeaderList(r.Header.Get("Access-Control-Request-Headers"))
+	if len(policy.AllowHeaders) > 0 {
+		for _, h := range requested {
+			if !containsFold(policy.AllowHeaders, h) {
+				return false
+			}
+		}
+	}
+
+	start := time.Now()
+	h := w.Header()
+	h.Set("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+
+	// A wildcard can't be used with credentials, so the origin is echoed instead
+	if anyOrigin && !policy.AllowCredentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if policy.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if len(policy.AllowMethods) > 0 {
+		h.Set("Access-Control-Allow-Methods", strings.Join(policy.AllowMethods, ", "))
+	} else {
+		h.Set("Access-Control-Allow-Methods", method)
+	}
+	if len(policy.AllowHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(policy.AllowHeaders, ", "))
+	} else if len(requested) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+	}
+	if policy.MaxAgeSeconds > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(policy.MaxAgeSeconds))
+	}
+	w.WriteHeader(http.StatusNoContent)
+
+	preflightsAnswered.Inc()
+	logAccess(th.logger, accessLogEntry{
+		TunnelID:  t.ID,
+		RequestID: generateID(),
+		Method:    r.Method,
+		Path:      realPath,
+		Status:    http.StatusNoContent,
+		Duration:  time.Since(start),
+	})
+	return true
+}
+
+// splitHeaderList splits a comma separated header value, e.g. Access-Control-Request-Headers
+func splitHeaderList(v string) []string {
+	var values []string
+	for _, part := range strings.Split(v, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			values = append(values, part)
+		}
+	}
+	return values
+}
+
+func containsFold(values []string, v string) bool {
+	return slices.ContainsFunc(values, func(s string) bool { return strings.EqualFold(s, v) })
+}
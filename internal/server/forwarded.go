@@ -0,0 +1,137 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// trustsProxy reports whether the address is one of the trusted proxies in front of the server
+func (th *TunnelHandler) trustsProxy(addr netip.Addr) bool {
+	for _, p := range th.trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteAddr returns the address the request was received from
+func remoteAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// clientIP returns the address of the client that made the request. X-Forwarded-For is only believed
+// as far back as it was added by trusted proxies, so a client can't spoof its address by sending one
+func (th *TunnelHandler) clientIP(r *http.Request) string {
+	remote, ok := remoteAddr(r)
+	if !ok {
+		return ""
+	}
+	if !th.trustsProxy(remote) {
+		return remote.String()
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	if len(hops) == 0 {
+		if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-Ip"))); err == nil {
+			return addr.Unmap().String()
+		}
+		return remote.String()
+	}
+
+	// Each proxy appends the address it received the request from, so walk back from the server until
+	// an address that isn't a trusted proxy
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = addr.Unmap()
+		if !th.trustsProxy(client) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// forwardedProto returns the scheme the client used to reach the server
+func (th *TunnelHandler) forwardedProto(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if remote, ok := remoteAddr(r); ok && th.trustsProxy(remote) {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			return proto
+		}
+	}
+	return "http"
+}
+
+// verbatimHeaders returns the headers of a public request as they were received, for verbatim tunnels.
+// Only the headers naming the client are changed, so it can't spoof its address to the local server.
+// X-Forwarded-For and X-Real-Ip are replaced with the real client, and Forwarded is dropped
+func (th *TunnelHandler) verbatimHeaders(r *http.Request) (map[string]string, map[string][]string) {
+	headers := make(map[string]string, len(r.Header))
+	values := make(map[string][]string, len(r.Header))
+	for k, v := range r.Header {
+		headers[k] = v[0]
+		values[k] = v
+	}
+
+	for _, k := range []string{"Forwarded", "X-Forwarded-For", "X-Real-Ip"} {
+		delete(headers, k)
+		delete(values, k)
+	}
+	if ip := th.clientIP(r); ip != "" {
+		for _, k := range []string{"X-Forwarded-For", "X-Real-Ip"} {
+			headers[k] = ip
+			values[k] = []string{ip}
+		}
+	}
+	return headers, values
+}
+
+// forwardHeaders returns the headers of a public request to send to the local server, with the
+// forwarding headers replaced by clean ones naming the real client
+func (th *TunnelHandler) forwardHeaders(r *http.Request) map[string]string {
+	headers := make(map[string]string)
+	for k, v := range r.Header {
+		headers[k] = v[0]
+	}
+
+	delete(headers, "Forwarded")
+	delete(headers, "X-Forwarded-For")
+	delete(headers, "X-Real-Ip")
+
+	proto := th.forwardedProto(r)
+	headers["X-Forwarded-Proto"] = proto
+
+	ip := th.clientIP(r)
+	if ip == "" {
+		return headers
+	}
+	headers["X-Forwarded-For"] = ip
+	headers["X-Real-Ip"] = ip
+
+	// IPv6 addresses have to be quoted, as their colons aren't allowed in a token
+	forwardedFor := ip
+	if strings.Contains(ip, ":") {
+		forwardedFor = `"[` + ip + `]"`
+	}
+	headers["Forwarded"] = "for=" + forwardedFor + ";proto=" + proto
+	return headers
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jwtly10/go-tunol/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardHeaders(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tmpl := template.Must(template.New("test").Parse("test"))
+	cfg := &config.ServerConfig{BaseURL: "http://localhost", TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1"}}
+	th := NewTunnelHandler(nil, nil, nil, tmpl, logger, cfg)
+
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		headers       map[string]string
+		wantIP        string
+		wantProto     string
+		wantForwarded string
+	}{
+		{
+			name:          "test direct client",
+			remoteAddr:    "203.0.113.7:5000",
+			wantIP:        "203.0.113.7",
+			wantProto:     "http",
+			wantForwarded: "for=203.0.113.7;proto=http",
+		},
+		{
+			name:       "test direct client spoofing forwarding headers",
+			remoteAddr: "203.0.113.7:5000",
+			headers: map[string]string{
+				"X-Forwarded-For":   "1.2.3.4",
+				"X-Real-Ip":         "1.2.3.4",
+				"X-Forwarded-Proto": "https",
+				"Forwarded":         "for=1.2.3.4",
+			},
+			wantIP:        "203.0.113.7",
+			wantProto:     "http",
+			wantForwarded: "for=203.0.113.7;proto=http",
+		},
+		{
+			name:          "test trusted proxy",
+			remoteAddr:    "10.1.2.3:443",
+			headers:       map[string]string{"X-Forwarded-For": "198.51.100.2", "X-Forwarded-Proto": "https"},
+			wantIP:        "198.51.100.2",
+			wantProto:     "https",
+			wantForwarded: "for=198.51.100.2;proto=https",
+		},
+		{
+			name:          "test chain of trusted proxies with spoofed first hop",
+			remoteAddr:    "10.1.2.3:443",
+			headers:       map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.2, 192.168.1.1"},
+			wantIP:        "198.51.100.2",
+			wantProto:     "http",
+			wantForwarded: "for=198.51.100.2;proto=http",
+		},
+		{
+			name:          "test trusted proxy with real ip header",
+			remoteAddr:    "10.1.2.3:443",
+			headers:       map[string]string{"X-Real-Ip": "198.51.100.2"},
+			wantIP:        "198.51.100.2",
+			wantProto:     "http",
+			wantForwarded: "for=198.51.100.2;proto=http",
+		},
+		{
+			name:          "test trusted proxy with garbage header",
+			remoteAddr:    "10.1.2.3:443",
+			headers:       map[string]string{"X-Forwarded-For": "not-an-ip"},
+			wantIP:        "10.1.2.3",
+			wantProto:     "http",
+			wantForwarded: "for=10.1.2.3;proto=http",
+		},
+		{
+			name:          "test ipv6 client",
+			remoteAddr:    "[2001:db8::1]:5000",
+			wantIP:        "2001:db8::1",
+			wantProto:     "http",
+			wantForwarded: `for="[2001:db8::1]";proto=http`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+
+			headers := th.forwardHeaders(r)
+			require.Equal(t, tt.wantIP, headers["X-Forwarded-For"])
+			require.Equal(t, tt.wantIP, headers["X-Real-Ip"])
+			require.Equal(t, tt.wantProto, headers["X-Forwarded-Proto"])
+			require.Equal(t, tt.wantForwarded, headers["Forwarded"])
+		})
+	}
+}
+
+func TestVerbatimHeaders(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tmpl := template.Must(template.New("test").Parse("test"))
+	cfg := &config.ServerConfig{BaseURL: "http://localhost", TrustedProxies: []string{"10.0.0.0/8"}}
+	th := NewTunnelHandler(nil, nil, nil, tmpl, logger, cfg)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		wantIP     string
+	}{
+		{
+			name:       "test direct client",
+			remoteAddr: "203.0.113.7:5000",
+			wantIP:     "203.0.113.7",
+		},
+		{
+			name:       "test direct client spoofing forwarding headers",
+			remoteAddr: "203.0.113.7:5000",
+			headers: map[string]string{
+				"X-Forwarded-For": "1.2.3.4",
+				"X-Real-Ip":       "1.2.3.4",
+				"Forwarded":       "for=1.2.3.4",
+			},
+			wantIP: "203.0.113.7",
+		},
+		{
+			name:       "test trusted proxy",
+			remoteAddr: "10.1.2.3:443",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.2"},
+			wantIP:     "198.51.100.2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Header.Set("X-Signature", "abc123")
+			r.Header.Set("X-Forwarded-Proto", "https")
+			r.Header["X-Multi"] = []string{"one", "two"}
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+
+			headers, values := th.verbatimHeaders(r)
+			require.Equal(t, tt.wantIP, headers["X-Forwarded-For"])
+			require.Equal(t, tt.wantIP, headers["X-Real-Ip"])
+			require.Equal(t, []string{tt.wantIP}, values["X-Forwarded-For"])
+			require.Equal(t, []string{tt.wantIP}, values["X-Real-Ip"])
+			require.NotContains(t, headers, "Forwarded")
+			require.NotContains(t, values, "Forwarded")
+
+			// Everything else is left as it was sent
+			require.Equal(t, "abc123", headers["X-Signature"])
+			require.Equal(t, "https", headers["X-Forwarded-Proto"])
+			require.Equal(t, []string{"one", "two"}, values["X-Multi"])
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/version"
+)
+
+// healthCheckTimeout is how long the database is given to answer a health check
+const healthCheckTimeout = 2 * time.Second
+
+// HealthDatabase is the database as checked by the health endpoints
+type HealthDatabase interface {
+	PingContext(ctx context.Context) error
+	// PendingMigrations returns the migrations not yet applied to the database
+	PendingMigrations() ([]string, error)
+}
+
+// healthStatus is the JSON body of the health endpoints
+type healthStatus struct {
+	Status            string   `json:"status"` // ok, or unavailable if the instance shouldn't be routed traffic
+	Database          string   `json:"database"`
+	ActiveTunnels     int      `json:"active_tunnels"`
+	UptimeSeconds     int64    `json:"uptime_seconds"`
+	PendingMigrations []string `json:"pending_migrations,omitempty"`
+	Error             string   `json:"error,omitempty"`
+}
+
+// healthHandler serves /health for load balancers, and /readyz for orchestrators deciding whether
+// to route traffic to the instance
+type healthHandler struct {
+	db      HealthDatabase
+	tunnels *TunnelHandler
+	started time.Time
+}
+
+func newHealthHandler(db HealthDatabase, tunnels *TunnelHandler) *healthHandler {
+	return &healthHandler{db: db, tunnels: tunnels, started: time.Now()}
+}
+
+// status checks the database can be reached, filling in the rest of the status from the tunnels
+func (h *healthHandler) status(ctx context.Context) healthStatus {
+	h.tunnels.mu.Lock()
+	status := healthStatus{
+		Status:        "ok",
+		Database:      "ok",
+		ActiveTunnels: len(h.tunnels.tunnels),
+		UptimeSeconds: int64(time.Since(h.started).Seconds()),
+	}
+	h.tunnels.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	if err := h.db.PingContext(ctx); err != nil {
+		status.Status = "unavailable"
+		status.Database = "unreachable"
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// handleHealth reports whether the instance, and its database, are up
+func (h *healthHandler) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, h.status(r.Context()))
+}
+
+// handleReady reports whether the instance is ready for traffic, which it isn't while shutting down
+// or if the database is unreachable or behind on migrations
+func (h *healthHandler) handleReady(w http.ResponseWriter, r *http.Request) {
+	status := h.status(r.Context())
+	if status.Database == "ok" {
+		pending, err := h.db.PendingMigrations()
+		switch {
+		case err != nil:
+			status.Status = "unavailable"
+			status.Error = "failed to check migrations: " + err.Error()
+		case len(pending) > 0:
+			status.Status = "unavailable"
+			status.Database = "migrations pending"
+			status.PendingMigrations = pending
+		}
+	}
+
+	h.tunnels.mu.Lock()
+	shuttingDown := h.tunnels.shuttingDown
+	h.tunnels.mu.Unlock()
+	if shuttingDown {
+		status.Status = "unavailable"
+		status.Error = "server is shutting down"
+	}
+
+	writeHealth(w, status)
+}
+
+// versionHandler reports the version the server was built as, and the latest CLI release so the CLI
+// can tell users to update. The latest CLI defaults to the version of the server
+func versionHandler(latestCLI string) http.HandlerFunc {
+	if latestCLI == "" {
+		latestCLI = version.Version
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"version":            version.Version,
+			"commit":             version.Commit,
+			"latest_cli_version": latestCLI,
+		})
+	}
+}
+
+func writeHealth(w http.ResponseWriter, status healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
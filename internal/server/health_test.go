@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	testutil "github.com/jwtly10/go-tunol/internal/testutils"
+	"github.com/jwtly10/go-tunol/internal/version"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHealthDB is a database whose health is set by the test
+type fakeHealthDB struct {
+	pingErr error
+	pending []string
+}
+
+func (d *fakeHealthDB) PingContext(context.Context) error    { return d.pingErr }
+func (d *fakeHealthDB) PendingMigrations() ([]string, error) { return d.pending, nil }
+
+func checkHealth(t *testing.T, h http.HandlerFunc) (int, healthStatus) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest("GET", "/", nil))
+
+	var status healthStatus
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	return rec.Code, status
+}
+
+func TestHealth(t *testing.T) {
+	th, ts, token := setupTestTunnelServer(t)
+	registerTestTunnel(t, dialTestTunnelServer(t, ts, token), "healthy")
+
+	db, cleanup := testutil.SetupTestDB(t)
+	defer cleanup()
+	h := newHealthHandler(db, th)
+
+	code, status := checkHealth(t, h.handleHealth)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "ok", status.Status)
+	require.Equal(t, 1, status.ActiveTunnels)
+
+	code, status = checkHealth(t, h.handleReady)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "ok", status.Status)
+
+	// A database that's gone away fails both checks
+	db.Close()
+	code, status = checkHealth(t, h.handleHealth)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "unreachable", status.Database)
+
+	code, _ = checkHealth(t, h.handleReady)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+func TestReadyWithPendingMigrations(t *testing.T) {
+	th, _, _ := setupTestTunnelServer(t)
+	h := newHealthHandler(&fakeHealthDB{pending: []string{"007_add_things.sql"}}, th)
+
+	// Still healthy, but shouldn't be routed traffic until migrated
+	code, _ := checkHealth(t, h.handleHealth)
+	require.Equal(t, http.StatusOK, code)
+
+	code, status := checkHealth(t, h.handleReady)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, []string{"007_add_things.sql"}, status.PendingMigrations)
+}
+
+func TestReadyWhileShuttingDown(t *testing.T) {
+	th, _, _ := setupTestTunnelServer(t)
+	h := newHealthHandler(&fakeHealthDB{}, th)
+	require.NoError(t, th.Shutdown(context.Background()))
+
+	code, status := checkHealth(t, h.handleReady)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "server is shutting down", status.Error)
+
+	h = newHealthHandler(&fakeHealthDB{pingErr: errors.New("connection refused")}, th)
+	code, status = checkHealth(t, h.handleHealth)
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "connection refused", status.Error)
+}
+
+func TestVersion(t *testing.T) {
+	defer func(v string) { version.Version = v }(version.Version)
+	version.Version = "v1.2.3"
+
+	rec := httptest.NewRecorder()
+	versionHandler("")(rec, httptest.NewRequest("GET", "/version", nil))
+
+	var body map[string]string
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+	require.Equal(t, "v1.2.3", body["version"])
+	require.NotEmpty(t, body["commit"])
+	require.Equal(t, "v1.2.3", body["latest_cli_version"], "Expected the latest CLI to default to the servers version")
+
+	rec = httptest.NewRecorder()
+	versionHandler("v1.3.0")(rec, httptest.NewRequest("GET", "/version", nil))
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+	require.Equal(t, "v1.3.0", body["latest_cli_version"])
+}
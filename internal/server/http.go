@@ -1,8 +1,13 @@
 package server
 
 import (
+	"encoding/json"
 	"net/http"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/web/user"
 )
 
 func (th *TunnelHandler) extractToken(r *http.Request) string {
@@ -13,3 +18,51 @@ func (th *TunnelHandler) extractToken(r *http.Request) string {
 
 	return ""
 }
+
+// TunnelSummary is the public view of an active tunnel, as returned by the API
+type TunnelSummary struct {
+	ID           string    `json:"id"`
+	URL          string    `json:"url"`
+	LocalPort    int       `json:"local_port"`
+	Protocol     string    `json:"protocol"`
+	Created      time.Time `json:"created"`
+	LastActivity time.Time `json:"last_activity"`
+	RequestCount int       `json:"request_count"`
+}
+
+// HandleListInstanceTunnels returns the active tunnels of the authenticated user connected to this instance.
+// When instances share tunnels through a registry, the users tunnels held by other instances aren't listed
+func (th *TunnelHandler) HandleListInstanceTunnels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	u := r.Context().Value("user").(*user.User)
+
+	th.mu.Lock()
+	tunnels := make([]TunnelSummary, 0)
+	for _, t := range th.tunnels {
+		if t.UserID != u.ID {
+			continue
+		}
+		tunnels = append(tunnels, TunnelSummary{
+			ID:           t.ID,
+			URL:          t.Path,
+			LocalPort:    t.LocalPort,
+			Protocol:     t.Protocol,
+			Created:      t.Created,
+			LastActivity: t.LastActivity,
+			RequestCount: t.RequestCount,
+		})
+	}
+	th.mu.Unlock()
+
+	// Oldest first, so the order is stable between calls
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].Created.Before(tunnels[j].Created)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tunnels)
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/auth/token"
+	"github.com/jwtly10/go-tunol/internal/config"
+	"github.com/jwtly10/go-tunol/internal/web/auth"
+)
+
+// Janitor periodically deletes expired sessions and old tokens, which otherwise build up in the database
+type Janitor struct {
+	sessionService *auth.SessionService
+	tokenService   *token.Service
+	cfg            *config.ServerConfig
+	logger         *slog.Logger
+}
+
+func NewJanitor(sessionService *auth.SessionService, tokenService *token.Service, cfg *config.ServerConfig, logger *slog.Logger) *Janitor {
+	return &Janitor{
+		sessionService: sessionService,
+		tokenService:   tokenService,
+		cfg:            cfg,
+		logger:         logger,
+	}
+}
+
+// Run purges every purge interval until the context is cancelled, it does nothing if purging is disabled
+func (j *Janitor) Run(ctx context.Context) {
+	if j.cfg.PurgeInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(j.cfg.PurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		j.Purge(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Purge deletes the sessions expired by now, and tokens revoked or expired for longer than the token retention
+func (j *Janitor) Purge(now time.Time) {
+	sessions, err := j.sessionService.PurgeExpired(now)
+	if err != nil {
+		j.logger.Error("Failed to purge expired sessions", "error", err)
+	}
+
+	tokens, err := j.tokenService.PurgeRevoked(now.Add(-j.cfg.TokenRetention))
+	if err != nil {
+		j.logger.Error("Failed to purge revoked tokens", "error", err)
+	}
+
+	if sessions > 0 || tokens > 0 {
+		j.logger.Info("Purged database", "sessions", sessions, "tokens", tokens)
+	}
+}
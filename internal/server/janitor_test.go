@@ -0,0 +1,70 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/auth/token"
+	"github.com/jwtly10/go-tunol/internal/config"
+	testutil "github.com/jwtly10/go-tunol/internal/testutils"
+	"github.com/jwtly10/go-tunol/internal/web/auth"
+	"github.com/jwtly10/go-tunol/internal/web/user"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJanitorPurge(t *testing.T) {
+	db, cleanup := testutil.SetupTestDB(t)
+	defer cleanup()
+
+	sessionService := auth.NewSessionService(db, nil)
+	tokenService := token.NewTokenService(db)
+	userRepo := user.NewUserRepository(db)
+	cfg := &config.ServerConfig{PurgeInterval: time.Hour, TokenRetention: 24 * time.Hour}
+	janitor := NewJanitor(sessionService, tokenService, cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	u, err := userRepo.CreateUser(&user.User{Provider: "github", ProviderUserID: "12345", Username: "testuser"})
+	require.NoError(t, err)
+
+	expiredSession, err := sessionService.CreateSession(u.ID, -time.Minute)
+	require.NoError(t, err)
+	activeSession, err := sessionService.CreateSession(u.ID, time.Hour)
+	require.NoError(t, err)
+
+	active, err := tokenService.CreateToken(u.ID, "Active", 24*time.Hour)
+	require.NoError(t, err)
+	recentlyRevoked, err := tokenService.CreateToken(u.ID, "Recently revoked", 24*time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, tokenService.RevokeToken(recentlyRevoked.ID, u.ID))
+	longRevoked, err := tokenService.CreateToken(u.ID, "Long revoked", 24*time.Hour)
+	require.NoError(t, err)
+	_, err = db.Exec(`UPDATE tokens SET revoked_at = ? WHERE id = ?`, time.Now().Add(-48*time.Hour), longRevoked.ID)
+	require.NoError(t, err)
+	longExpired, err := tokenService.CreateToken(u.ID, "Long expired", -48*time.Hour)
+	require.NoError(t, err)
+
+	janitor.Purge(time.Now())
+
+	var sessions []string
+	rows, err := db.Query(`SELECT token FROM sessions`)
+	require.NoError(t, err)
+	for rows.Next() {
+		var s string
+		require.NoError(t, rows.Scan(&s))
+		sessions = append(sessions, s)
+	}
+	require.NoError(t, rows.Close())
+	require.Equal(t, []string{activeSession.Token}, sessions)
+	require.NotContains(t, sessions, expiredSession.Token)
+
+	tokens, err := tokenService.ListUserTokens(u.ID)
+	require.NoError(t, err)
+	var kept []int64
+	for _, tok := range tokens {
+		kept = append(kept, tok.ID)
+	}
+	require.ElementsMatch(t, []int64{active.ID, recentlyRevoked.ID}, kept, "Expected tokens to be kept until the retention has passed")
+	require.NotContains(t, kept, longRevoked.ID)
+	require.NotContains(t, kept, longExpired.ID)
+}
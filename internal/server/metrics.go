@@ -0,0 +1,75 @@
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics are registered with the default prometheus registry, and served by promhttp.Handler
+var (
+	activeTunnels = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tunol_active_tunnels",
+		Help: "Number of tunnels currently registered",
+	})
+
+	websocketConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tunol_websocket_connections",
+		Help: "Number of CLI websocket connections currently open",
+	})
+
+	requestsForwarded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunol_requests_forwarded_total",
+		Help: "Number of HTTP requests forwarded through tunnels, by response status code",
+	}, []string{"code"})
+
+	requestDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tunol_request_duration_seconds",
+		Help:    "Time taken for a forwarded request to be answered by the CLI",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	tunnelDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tunol_tunnel_latency_seconds",
+		Help:    "Time a forwarded request spent travelling through the tunnel, without the time the CLI took to answer it",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	tunnelNotFound = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tunol_tunnel_not_found_total",
+		Help: "Number of requests for a tunnel that does not exist",
+	})
+
+	requestsToInstance = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tunol_requests_to_instance_total",
+		Help: "Number of requests sent on to the server instance holding their tunnel",
+	})
+
+	rateLimitedRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tunol_rate_limited_requests_total",
+		Help: "Number of requests rejected by the rate limit of their tunnel",
+	})
+
+	overCapacityRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tunol_over_capacity_requests_total",
+		Help: "Number of requests rejected as their tunnel had too many requests in flight",
+	})
+
+	preflightsAnswered = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tunol_preflights_answered_total",
+		Help: "Number of CORS preflight requests answered by the server rather than forwarded through their tunnel",
+	})
+)
+
+// observeRequest records a request forwarded through a tunnel
+func observeRequest(statusCode int, start time.Time) {
+	requestsForwarded.WithLabelValues(strconv.Itoa(statusCode)).Inc()
+	requestDuration.Observe(time.Since(start).Seconds())
+}
+
+// observeTunnelLatency records the time a request spent in the tunnel, see tunnelLatency
+func observeTunnelLatency(latency time.Duration) {
+	tunnelDuration.Observe(latency.Seconds())
+}
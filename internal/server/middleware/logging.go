@@ -16,7 +16,14 @@ func (w *loggingResponseWriter) WriteHeader(code int) {
 	w.ResponseWriter.WriteHeader(code)
 }
 
-func WithLogging(next http.Handler, logger *slog.Logger) http.Handler {
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to flush streamed responses
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// WithLogging logs a line for each request. Proxied requests already get an access line from the tunnel
+// handler, so theirs is only logged at debug level
+func WithLogging(next http.Handler, logger *slog.Logger, proxied func(r *http.Request) bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Dont log websocket requests
 		if r.Header.Get("Upgrade") == "websocket" {
@@ -29,7 +36,11 @@ func WithLogging(next http.Handler, logger *slog.Logger) http.Handler {
 
 		next.ServeHTTP(lw, r)
 
-		logger.Info("http request",
+		level := slog.LevelInfo
+		if proxied != nil && proxied(r) {
+			level = slog.LevelDebug
+		}
+		logger.Log(r.Context(), level, "http request",
 			"method", r.Method,
 			"path", r.URL.Path,
 			"host", r.Host,
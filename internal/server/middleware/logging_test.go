@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestWithLoggingProxied tests that proxied requests, which get their own access line, are only logged at
+// debug level, while the servers own pages are still logged at info
+func TestWithLoggingProxied(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	proxied := func(r *http.Request) bool { return strings.HasPrefix(r.URL.Path, "/local/") }
+	h := WithLogging(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), logger, proxied)
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/local/abc/", nil))
+	require.Contains(t, buf.String(), "level=DEBUG")
+	require.NotContains(t, buf.String(), "level=INFO")
+
+	buf.Reset()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/dashboard", nil))
+	require.Contains(t, buf.String(), "level=INFO")
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/proto"
+	"github.com/jwtly10/go-tunol/internal/utils"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// wsWriteQueueSize is how many frames can wait on a public websocket connection before it's closed for
+	// not keeping up, and wsWriteTimeout how long writing one can take
+	wsWriteQueueSize = 64
+	wsWriteTimeout   = 30 * time.Second
+)
+
+// publicWSConn is a public websocket connection of a tunnel. It's written to from its own goroutine, so a
+// slow visitor never holds up the websocket read loop of its client
+type publicWSConn struct {
+	conn   *websocket.Conn
+	tunnel *Tunnel
+	writes *utils.WriteQueue[*proto.WSFrame]
+}
+
+func newPublicWSConn(conn *websocket.Conn, t *Tunnel) *publicWSConn {
+	return &publicWSConn{
+		conn:   conn,
+		tunnel: t,
+		writes: utils.NewWriteQueueFunc(wsWriteQueueSize, wsWriteTimeout, func(conn net.Conn, frame *proto.WSFrame) error {
+			return proto.FrameCodec.Send(conn.(*websocket.Conn), frame)
+		}),
+	}
+}
+
+// isWebSocketUpgrade reports whether a public request is asking to upgrade to a websocket
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// serveWebSocket accepts a public websocket connection and streams its messages to the
+// CLI, which opens the matching connection to the local server
+func (th *TunnelHandler) serveWebSocket(w http.ResponseWriter, r *http.Request, t *Tunnel, path string) {
+	headers := th.forwardHeaders(r)
+
+	srv := websocket.Server{
+		// The local app decides which origins it accepts, so we don't check here. We can only
+		// agree to one subprotocol, so we pick the clients preferred one
+		Handshake: func(cfg *websocket.Config, r *http.Request) error {
+			if len(cfg.Protocol) > 1 {
+				cfg.Protocol = cfg.Protocol[:1]
+			}
+			return nil
+		},
+		Handler: func(conn *websocket.Conn) {
+			th.pipeWebSocket(t, conn, path, headers)
+		},
+	}
+	srv.ServeHTTP(w, r)
+}
+
+// pipeWebSocket forwards messages from a public websocket connection over the tunnel until either side closes
+func (th *TunnelHandler) pipeWebSocket(t *Tunnel, conn *websocket.Conn, path string, headers map[string]string) {
+	// Prefixed with the tunnel id to make logs easier to follow, connections are cleaned up by their tunnel
+	connID := t.ID + "-" + generateID()
+	th.logger.Info("accepted websocket passthrough connection", "id", t.ID, "connId", connID, "path", path)
+
+	pc := newPublicWSConn(conn, t)
+	th.mu.Lock()
+	th.wsPassthrough[connID] = pc
+	th.mu.Unlock()
+	go th.writeWebSocket(connID, pc)
+
+	if err := t.send(proto.MessageTypeWSOpen, proto.WSOpen{ConnID: connID, Path: path, Headers: headers}); err != nil {
+		th.logger.Error("failed to open websocket over tunnel", "connId", connID, "error", err)
+		th.removePassthroughConn(connID)
+		return
+	}
+
+	for {
+		var frame proto.WSFrame
+		if err := proto.FrameCodec.Receive(conn, &frame); err != nil {
+			break
+		}
+
+		frame.ConnID = connID
+		if err := t.send(proto.MessageTypeWSFrame, frame); err != nil {
+			th.logger.Error("failed to send websocket frame", "connId", connID, "error", err)
+			break
+		}
+	}
+
+	th.closePassthroughConn(connID)
+}
+
+// writeWebSocket writes the frames queued for a public websocket connection until either side closes
+func (th *TunnelHandler) writeWebSocket(connID string, pc *publicWSConn) {
+	if err := pc.writes.Run(pc.conn); err != nil {
+		th.logger.Error("failed to write websocket frame", "connId", connID, "error", err)
+		th.closePassthroughConn(connID)
+	}
+}
+
+// closePassthroughConn closes a public websocket connection from the server side, telling the client
+// unless it closed first, in which case it already knows
+func (th *TunnelHandler) closePassthroughConn(connID string) {
+	th.mu.Lock()
+	pc, exists := th.wsPassthrough[connID]
+	th.mu.Unlock()
+
+	if exists && th.removePassthroughConn(connID) {
+		if err := pc.tunnel.send(proto.MessageTypeWSClose, proto.WSClose{ConnID: connID}); err != nil {
+			th.logger.Error("failed to send websocket close", "connId", connID, "error", err)
+		}
+	}
+}
+
+// handleWSFrame queues a frame received from the client for its public websocket connection
+func (th *TunnelHandler) handleWSFrame(msg proto.Message) {
+	frame, err := msg.AsWSFrame()
+	if err != nil {
+		th.logger.Error("failed to unmarshal websocket frame", "error", err)
+		return
+	}
+
+	th.mu.Lock()
+	pc, exists := th.wsPassthrough[frame.ConnID]
+	th.mu.Unlock()
+
+	if !exists {
+		th.logger.Warn("received websocket frame for unknown connection", "connId", frame.ConnID)
+		return
+	}
+
+	if !pc.writes.Queue(&frame) {
+		th.logger.Warn("public websocket connection can't keep up, closing it", "connId", frame.ConnID)
+		th.closePassthroughConn(frame.ConnID)
+	}
+}
+
+// handleWSClose closes a public websocket connection after the client closed its side
+func (th *TunnelHandler) handleWSClose(msg proto.Message) {
+	closed, err := msg.AsWSClose()
+	if err != nil {
+		th.logger.Error("failed to unmarshal websocket close", "error", err)
+		return
+	}
+
+	th.removePassthroughConn(closed.ConnID)
+}
+
+// removePassthroughConn forgets a public websocket connection, which is closed once the frames queued for it
+// are written. It reports whether the connection was still open
+func (th *TunnelHandler) removePassthroughConn(connID string) bool {
+	th.mu.Lock()
+	pc, exists := th.wsPassthrough[connID]
+	delete(th.wsPassthrough, connID)
+	th.mu.Unlock()
+
+	if exists {
+		pc.writes.Close()
+	}
+	return exists
+}
+
+// closePassthroughConnsLocked closes the open websocket connections of a tunnel. The caller must hold th.mu
+func (th *TunnelHandler) closePassthroughConnsLocked(t *Tunnel) {
+	// Matched by tunnel rather than id prefix, as ids can have hyphens, e.g. app is a prefix of app-x
+	for connID, pc := range th.wsPassthrough {
+		if pc.tunnel == t {
+			pc.writes.Close()
+			pc.conn.Close()
+			delete(th.wsPassthrough, connID)
+		}
+	}
+}
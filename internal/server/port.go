@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// portShutdownTimeout is how long the own port of a closed tunnel waits for its requests to be answered,
+// they are failed as soon as the tunnel closes so this is only a backstop
+const portShutdownTimeout = 5 * time.Second
+
+// listenPort opens a public port for an http tunnel, chosen by the OS, that serves the tunnel at its root.
+// It's for local dev, where tunnels are otherwise under /local/<id>, with tools that can't handle the prefix.
+// The port listens on the servers bind address, and serves HTTPS when the server does
+func (th *TunnelHandler) listenPort(t *Tunnel) error {
+	ln, err := net.Listen("tcp", net.JoinHostPort(th.cfg.BindAddr, "0"))
+	if err != nil {
+		return err
+	}
+	if th.tlsConfig != nil {
+		ln = tls.NewListener(ln, th.tlsConfig)
+	}
+
+	t.Listener = ln
+	t.Path = th.cfg.PortURL(ln.Addr().(*net.TCPAddr).Port)
+	t.portServer = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			th.serveTunnel(w, r, t.ID, r.URL.String())
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return nil
+}
+
+// servePort serves requests on the own port of an http tunnel until the tunnel is closed
+func (th *TunnelHandler) servePort(t *Tunnel) {
+	if err := t.portServer.Serve(t.Listener); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+		th.logger.Error("failed to serve tunnel port", "id", t.ID, "error", err)
+	}
+}
+
+// closePortLocked stops serving the own port of an http tunnel, if it has one. The caller must hold th.mu
+func (th *TunnelHandler) closePortLocked(t *Tunnel) {
+	if t.portServer == nil {
+		return
+	}
+
+	// Shutting down, rather than closing, lets the requests still waiting on the client be answered
+	// with why they failed
+	srv := t.portServer
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), portShutdownTimeout)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/proto"
+	"golang.org/x/time/rate"
+)
+
+// rateLimitNoticeInterval is the most often a client is told its tunnel is being rate limited,
+// so a flood of rejected requests doesn't turn into a flood of messages
+const rateLimitNoticeInterval = time.Second
+
+// rateLimitFor returns the requests per second limit of a new tunnel. The requested limit is
+// used if set, but can't exceed the server wide limit. 0 means the tunnel is unlimited
+func (th *TunnelHandler) rateLimitFor(requested float64) float64 {
+	limit := th.cfg.RateLimit
+	if requested > 0 && (limit <= 0 || requested < limit) {
+		limit = requested
+	}
+	return max(limit, 0)
+}
+
+// newRateLimiter creates a token bucket allowing rps requests per second, with bursts of up to
+// a seconds worth of requests. It returns nil if rps is 0, as the tunnel is unlimited
+func newRateLimiter(rps float64) *rate.Limiter {
+	if rps <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(rps), max(1, int(math.Ceil(rps))))
+}
+
+// rejectRateLimited responds to a request over the rate limit of the tunnel, letting the client
+// know its tunnel is being throttled
+func (th *TunnelHandler) rejectRateLimited(w http.ResponseWriter, t *Tunnel) {
+	rateLimitedRequests.Inc()
+
+	th.mu.Lock()
+	t.RateLimited++
+	rejected := t.RateLimited
+	notify := time.Since(t.lastRateLimitNotice) >= rateLimitNoticeInterval
+	if notify {
+		t.lastRateLimitNotice = time.Now()
+	}
+	th.mu.Unlock()
+
+	th.logger.Debug("rate limited request", "id", t.ID, "rejected", rejected)
+
+	if notify {
+		if err := t.send(proto.MessageTypeRateLimited, proto.RateLimited{Rejected: rejected}); err != nil {
+			th.logger.Error("failed to send rate limited message", "id", t.ID, "error", err)
+		}
+	}
+
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+}
+
+// acquireSlot takes one of the in flight slots of the tunnel for a request, returning false if they're
+// all taken. Tunnels without a limit always have a slot
+func (t *Tunnel) acquireSlot() bool {
+	if t.inFlight == nil {
+		return true
+	}
+	select {
+	case t.inFlight <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseSlot gives back the slot taken by acquireSlot once the request is answered
+func (t *Tunnel) releaseSlot() {
+	if t.inFlight != nil {
+		<-t.inFlight
+	}
+}
+
+// rejectOverCapacity responds to a request that arrived with every in flight slot of the tunnel taken.
+// It's only temporary, so the caller is asked to try again shortly
+func (th *TunnelHandler) rejectOverCapacity(w http.ResponseWriter, t *Tunnel) {
+	overCapacityRequests.Inc()
+	th.logger.Debug("rejected request over the in flight limit", "id", t.ID, "limit", cap(t.inFlight))
+
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Tunnel is busy, too many requests in flight", http.StatusServiceUnavailable)
+}
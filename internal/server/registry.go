@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Registry tracks which server instance holds the websocket of each tunnel, so instances behind a
+// load balancer can forward requests for tunnels connected to another instance
+type Registry interface {
+	// Claim records the instance as holding the tunnel, returning false if another instance already does.
+	// Claiming a tunnel the instance already holds renews the claim
+	Claim(ctx context.Context, tunnelID, instance string) (bool, error)
+	// Release removes the instances claim on the tunnel, if it still holds it
+	Release(ctx context.Context, tunnelID, instance string) error
+	// Owner returns the instance holding the tunnel, or "" if no instance does
+	Owner(ctx context.Context, tunnelID string) (string, error)
+}
+
+// memoryRegistry is the registry of a single instance, where every tunnel is held locally
+type memoryRegistry struct {
+	owners map[string]string
+	mu     sync.Mutex
+}
+
+func newMemoryRegistry() *memoryRegistry {
+	return &memoryRegistry{owners: make(map[string]string)}
+}
+
+func (r *memoryRegistry) Claim(_ context.Context, tunnelID, instance string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if owner, exists := r.owners[tunnelID]; exists && owner != instance {
+		return false, nil
+	}
+	r.owners[tunnelID] = instance
+	return true, nil
+}
+
+func (r *memoryRegistry) Release(_ context.Context, tunnelID, instance string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.owners[tunnelID] == instance {
+		delete(r.owners, tunnelID)
+	}
+	return nil
+}
+
+func (r *memoryRegistry) Owner(_ context.Context, tunnelID string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.owners[tunnelID], nil
+}
+
+// redisRegistry shares tunnel ownership between instances through Redis. Claims expire after the ttl,
+// so the tunnels of an instance that dies without releasing them can be claimed again
+type redisRegistry struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// NewRedisRegistry connects to the Redis server at the url, claims must be renewed within the ttl
+func NewRedisRegistry(url string, ttl time.Duration) (Registry, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &redisRegistry{client: client, ttl: ttl}, nil
+}
+
+func registryKey(tunnelID string) string {
+	return "tunol:tunnel:" + tunnelID
+}
+
+// claimScript sets the owner if the tunnel is unclaimed, or renews the claim if the instance holds it
+var claimScript = redis.NewScript(`
+local owner = redis.call("GET", KEYS[1])
+if owner == false or owner == ARGV[1] then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// releaseScript deletes the claim only if the instance still holds it, so a claim made by another
+// instance after this one's expired isn't removed
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+func (r *redisRegistry) Claim(ctx context.Context, tunnelID, instance string) (bool, error) {
+	claimed, err := claimScript.Run(ctx, r.client, []string{registryKey(tunnelID)}, instance, r.ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return claimed == 1, nil
+}
+
+func (r *redisRegistry) Release(ctx context.Context, tunnelID, instance string) error {
+	return releaseScript.Run(ctx, r.client, []string{registryKey(tunnelID)}, instance).Err()
+}
+
+func (r *redisRegistry) Owner(ctx context.Context, tunnelID string) (string, error) {
+	owner, err := r.client.Get(ctx, registryKey(tunnelID)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return owner, err
+}
+
+// localInstance is the name of the instance in the registry when it isn't shared with other instances
+const localInstance = "local"
+
+// forwardedHeader marks a request sent on from another instance, so it's never sent on again
+const forwardedHeader = "X-Tunol-Forwarded"
+
+// SetRegistry shares the tunnels of this instance through the registry, where it's known by its url.
+// It must be called before the handler starts serving
+func (th *TunnelHandler) SetRegistry(registry Registry, instanceURL string) {
+	th.registry = registry
+	th.instance = instanceURL
+}
+
+// claimTunnel claims a new tunnel for this instance, returning false if another instance holds it
+func (th *TunnelHandler) claimTunnel(id string) bool {
+	claimed, err := th.registry.Claim(context.Background(), id, th.instance)
+	if err != nil {
+		th.logger.Error("failed to claim tunnel in registry", "id", id, "error", err)
+		return false
+	}
+	return claimed
+}
+
+// releaseTunnels releases the claims of this instance on closed tunnels
+func (th *TunnelHandler) releaseTunnels(ids ...string) {
+	for _, id := range ids {
+		if err := th.registry.Release(context.Background(), id, th.instance); err != nil {
+			th.logger.Error("failed to release tunnel in registry", "id", id, "error", err)
+		}
+	}
+}
+
+// renewClaims renews the claims on the tunnels of this instance, so they don't expire while connected
+func (th *TunnelHandler) renewClaims() {
+	th.mu.Lock()
+	ids := make([]string, 0, len(th.tunnels))
+	for id := range th.tunnels {
+		ids = append(ids, id)
+	}
+	th.mu.Unlock()
+
+	for _, id := range ids {
+		if claimed, err := th.registry.Claim(context.Background(), id, th.instance); err != nil || !claimed {
+			th.logger.Error("failed to renew tunnel claim", "id", id, "claimed", claimed, "error", err)
+		}
+	}
+}
+
+// forwardToOwner sends a request for a tunnel that isn't connected to this instance on to the instance
+// holding it, returning false if no other instance holds the tunnel
+func (th *TunnelHandler) forwardToOwner(w http.ResponseWriter, r *http.Request, tunnelID string) bool {
+	// Never forward twice, in case the registry is out of date and the instances disagree
+	if r.Header.Get(forwardedHeader) != "" {
+		return false
+	}
+
+	owner, err := th.registry.Owner(r.Context(), tunnelID)
+	if err != nil {
+		th.logger.Error("failed to find tunnel in registry", "id", tunnelID, "error", err)
+		return false
+	}
+	if owner == "" || owner == th.instance {
+		return false
+	}
+
+	target, err := url.Parse(owner)
+	if err != nil {
+		th.logger.Error("invalid instance url in registry", "id", tunnelID, "instance", owner, "error", err)
+		return false
+	}
+
+	// The host and path are kept as is, so the owner extracts the same tunnel id from them
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		th.logger.Error("failed to forward request to instance", "id", tunnelID, "instance", owner, "error", err)
+		http.Error(w, "Failed to reach tunnel", http.StatusBadGateway)
+	}
+
+	th.logger.Debug("forwarding request to instance holding tunnel", "id", tunnelID, "instance", owner)
+	requestsToInstance.Inc()
+	r.Header.Set(forwardedHeader, th.instance)
+	proxy.ServeHTTP(w, r)
+	return true
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/jwtly10/go-tunol/internal/proto"
+	testutil "github.com/jwtly10/go-tunol/internal/testutils"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+func TestRegistries(t *testing.T) {
+	mr := miniredis.RunT(t)
+	redisRegistry, err := NewRedisRegistry("redis://"+mr.Addr(), time.Minute)
+	require.NoError(t, err)
+
+	registries := map[string]Registry{
+		"memory": newMemoryRegistry(),
+		"redis":  redisRegistry,
+	}
+
+	for name, registry := range registries {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			claimed, err := registry.Claim(ctx, "myapp", "http://a")
+			require.NoError(t, err)
+			require.True(t, claimed)
+
+			owner, err := registry.Owner(ctx, "myapp")
+			require.NoError(t, err)
+			require.Equal(t, "http://a", owner)
+
+			// Only the owner can claim it again, which renews the claim
+			claimed, err = registry.Claim(ctx, "myapp", "http://b")
+			require.NoError(t, err)
+			require.False(t, claimed, "Expected the tunnel to be taken by the other instance")
+			claimed, err = registry.Claim(ctx, "myapp", "http://a")
+			require.NoError(t, err)
+			require.True(t, claimed)
+
+			// Other instances can't release it either
+			require.NoError(t, registry.Release(ctx, "myapp", "http://b"))
+			owner, err = registry.Owner(ctx, "myapp")
+			require.NoError(t, err)
+			require.Equal(t, "http://a", owner)
+
+			require.NoError(t, registry.Release(ctx, "myapp", "http://a"))
+			owner, err = registry.Owner(ctx, "myapp")
+			require.NoError(t, err)
+			require.Empty(t, owner)
+		})
+	}
+}
+
+func TestRedisRegistryClaimsExpire(t *testing.T) {
+	mr := miniredis.RunT(t)
+	registry, err := NewRedisRegistry("redis://"+mr.Addr(), time.Minute)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	claimed, err := registry.Claim(ctx, "myapp", "http://a")
+	require.NoError(t, err)
+	require.True(t, claimed)
+
+	// An instance that dies without releasing its tunnels stops renewing them
+	mr.FastForward(2 * time.Minute)
+
+	claimed, err = registry.Claim(ctx, "myapp", "http://b")
+	require.NoError(t, err)
+	require.True(t, claimed, "Expected the expired claim to be taken over")
+}
+
+// TestForwardToOwningInstance tests that a request reaching an instance that doesn't hold the tunnel
+// is sent on to the instance that does
+func TestForwardToOwningInstance(t *testing.T) {
+	a, tsA, tokenA := setupTestTunnelServer(t)
+	b, tsB, _ := setupTestTunnelServer(t)
+	b.templates = template.Must(template.New("tunnel-not-found").Parse("not found"))
+
+	registry := newMemoryRegistry()
+	a.SetRegistry(registry, tsA.URL)
+	b.SetRegistry(registry, tsB.URL)
+
+	ws := dialTestTunnelServer(t, tsA, tokenA)
+	registerTestTunnel(t, ws, "shared")
+
+	go func() {
+		for {
+			var msg proto.Message
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			if msg.Type != proto.MessageTypeHTTPRequest {
+				continue
+			}
+
+			var req proto.HTTPRequest
+			b, _ := json.Marshal(msg.Payload)
+			json.Unmarshal(b, &req)
+
+			body := "from a " + req.Path
+			if _, forwarded := req.Headers[forwardedHeader]; forwarded {
+				body = "leaked forwarded header"
+			}
+			websocket.JSON.Send(ws, proto.Message{
+				Type:    proto.MessageTypeHTTPResponse,
+				Payload: testutil.Payload(t, proto.HTTPResponse{StatusCode: http.StatusOK, Body: []byte(body), RequestId: req.RequestId}),
+			})
+		}
+	}()
+
+	res, err := http.Get(tsB.URL + "/local/shared/hello")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "from a /hello", string(body))
+
+	// The tunnel is released once its client disconnects, so the request isn't sent on
+	ws.Close()
+	require.Eventually(t, func() bool {
+		owner, _ := registry.Owner(context.Background(), "shared")
+		return owner == ""
+	}, 5*time.Second, 10*time.Millisecond)
+
+	res, err = http.Get(tsB.URL + "/local/shared/hello")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestSubdomainTakenOnAnotherInstance(t *testing.T) {
+	a, tsA, tokenA := setupTestTunnelServer(t)
+	b, tsB, tokenB := setupTestTunnelServer(t)
+
+	registry := newMemoryRegistry()
+	a.SetRegistry(registry, tsA.URL)
+	b.SetRegistry(registry, tsB.URL)
+
+	registerTestTunnel(t, dialTestTunnelServer(t, tsA, tokenA), "shared")
+
+	ws := dialTestTunnelServer(t, tsB, tokenB)
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type:    proto.MessageTypeTunnelReq,
+		Payload: testutil.Payload(t, proto.TunnelRequest{LocalPort: 3000, Subdomain: "shared"}),
+	}))
+	var resp proto.Message
+	require.NoError(t, websocket.JSON.Receive(ws, &resp))
+	require.Equal(t, proto.MessageTypeError, resp.Type)
+	require.Contains(t, testutil.PayloadMap(t, resp)["error"], "already in use")
+
+	b.mu.Lock()
+	_, exists := b.tunnels["shared"]
+	b.mu.Unlock()
+	require.False(t, exists, "Expected the rejected tunnel to be removed")
+}
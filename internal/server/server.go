@@ -38,20 +38,20 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// But on prod this will look more like
 	// https://tunnelID.tunol.dev/externalpath
 
-	if s.cfg.UseSubdomains {
-		parts := strings.Split(r.Host, ".")
-
-		// Check if we have a subdomain (more than 2 parts and not "www")
-		if len(parts) > 2 && parts[0] != "www" {
-			s.tunnel.ServeHTTP(w, r)
-			return
-		}
-	}
-
-	if strings.HasPrefix(r.URL.Path, "/local/") {
+	if s.IsTunnelRequest(r) {
 		s.tunnel.ServeHTTP(w, r)
 		return
 	}
 
 	s.web.ServeHTTP(w, r)
 }
+
+// IsTunnelRequest reports whether a request is for a tunnel, rather than the servers own pages
+func (s *Server) IsTunnelRequest(r *http.Request) bool {
+	if s.cfg.UseSubdomains {
+		if _, ok := s.cfg.SubdomainTunnelID(r.Host); ok {
+			return true
+		}
+	}
+	return strings.HasPrefix(r.URL.Path, "/local/")
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/jwtly10/go-tunol/internal/proto"
+)
+
+// streamChunkQueueSize is how many body chunks of a streaming response can wait on a slow caller before
+// the stream is closed for not keeping up
+const streamChunkQueueSize = 64
+
+// responseStream carries the body chunks of a streaming response to the waiting ServeHTTP
+type responseStream struct {
+	chunks chan *proto.HTTPBodyChunk
+	done   chan struct{} // Closed once ServeHTTP stops reading chunks
+	full   chan struct{} // Closed by the websocket read loop once chunks has no room left
+}
+
+func newResponseStream() *responseStream {
+	return &responseStream{
+		chunks: make(chan *proto.HTTPBodyChunk, streamChunkQueueSize),
+		done:   make(chan struct{}),
+		full:   make(chan struct{}),
+	}
+}
+
+// streamResponse writes a streaming response (e.g. server-sent events) to the public caller,
+// flushing each chunk as it arrives from the CLI
+func (th *TunnelHandler) streamResponse(w http.ResponseWriter, r *http.Request, t *Tunnel, resp *proto.HTTPResponse, headers map[string]string) {
+	th.mu.Lock()
+	stream, exists := th.pendingStreams[resp.RequestId]
+	th.mu.Unlock()
+
+	if !exists {
+		th.logger.Error("no stream for streaming response", "requestId", resp.RequestId)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	finished := false
+	defer func() {
+		th.mu.Lock()
+		delete(th.pendingStreams, resp.RequestId)
+		th.mu.Unlock()
+		close(stream.done)
+
+		// Let the CLI stop reading from the local server if the caller went away first
+		if !finished {
+			if err := t.send(proto.MessageTypeHTTPStreamClose, proto.HTTPStreamClose{RequestId: resp.RequestId}); err != nil {
+				th.logger.Error("failed to send stream close", "requestId", resp.RequestId, "error", err)
+			}
+		}
+	}()
+
+	for k, v := range headers {
+		if k == "Content-Length" {
+			continue
+		}
+		w.Header().Set(k, v)
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	// The writer may be wrapped by middleware, so flush through a controller
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		th.logger.Warn("streaming response can't be flushed", "requestId", resp.RequestId, "error", err)
+	}
+
+	th.logger.Info("streaming response", "requestId", resp.RequestId, "statusCode", resp.StatusCode)
+
+	for {
+		select {
+		case chunk := <-stream.chunks:
+			if len(chunk.Data) > 0 {
+				if _, err := w.Write(chunk.Data); err != nil {
+					th.logger.Info("caller closed streaming response", "requestId", resp.RequestId, "error", err)
+					return
+				}
+				rc.Flush()
+			}
+			if chunk.Final {
+				writeTrailers(w, chunk.Trailers)
+				finished = true
+				return
+			}
+		case <-r.Context().Done():
+			th.logger.Info("caller closed streaming response", "requestId", resp.RequestId)
+			return
+		case <-stream.full:
+			th.logger.Warn("caller can't keep up with streaming response, closing it", "requestId", resp.RequestId)
+			return
+		case <-t.done:
+			th.logger.Info("tunnel closed during streaming response", "requestId", resp.RequestId)
+			finished = true // There's no one left to tell
+			return
+		case <-th.done:
+			// The client connection is closed on shutdown, so there's no one to tell
+			finished = true
+			return
+		}
+	}
+}
+
+// handleHTTPBodyChunk passes a body chunk from the client to the ServeHTTP streaming its response. Waiting
+// on a slow caller would hold up every tunnel on the connection, so the stream is closed once it falls behind
+func (th *TunnelHandler) handleHTTPBodyChunk(msg proto.Message) {
+	chunk, err := msg.AsHTTPBodyChunk()
+	if err != nil {
+		th.logger.Error("failed to unmarshal http body chunk", "error", err)
+		return
+	}
+
+	th.mu.Lock()
+	stream, exists := th.pendingStreams[chunk.RequestId]
+	th.mu.Unlock()
+
+	if !exists {
+		th.logger.Debug("received body chunk for unknown stream", "requestId", chunk.RequestId)
+		return
+	}
+
+	select {
+	case stream.chunks <- &chunk:
+	case <-stream.done:
+	default:
+		// Only the read loop closes it, and later chunks may arrive before ServeHTTP has stopped
+		select {
+		case <-stream.full:
+		default:
+			close(stream.full)
+		}
+	}
+}
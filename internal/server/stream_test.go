@@ -0,0 +1,49 @@
+package server
+
+import (
+	"html/template"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/config"
+	"github.com/jwtly10/go-tunol/internal/proto"
+	testutil "github.com/jwtly10/go-tunol/internal/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+// TestStreamSlowCaller tests that body chunks for a caller that isn't reading never block the websocket
+// read loop, and that the stream is closed once it has fallen too far behind
+func TestStreamSlowCaller(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tmpl := template.Must(template.New("test").Parse("test"))
+	th := NewTunnelHandler(nil, nil, nil, tmpl, logger, &config.ServerConfig{BaseURL: "http://localhost"})
+
+	stream := newResponseStream()
+	th.pendingStreams["req-1"] = stream
+
+	handled := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*streamChunkQueueSize; i++ {
+			th.handleHTTPBodyChunk(proto.Message{
+				Type:    proto.MessageTypeHTTPBodyChunk,
+				Payload: testutil.Payload(t, proto.HTTPBodyChunk{RequestId: "req-1", Data: []byte("data: tick\n\n")}),
+			})
+		}
+		close(handled)
+	}()
+
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the chunks to be handled, the read loop is blocked")
+	}
+
+	select {
+	case <-stream.full:
+	default:
+		t.Fatal("Expected the stream to be closed for falling behind")
+	}
+	require.Len(t, stream.chunks, streamChunkQueueSize)
+}
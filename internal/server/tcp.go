@@ -0,0 +1,179 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/proto"
+	"github.com/jwtly10/go-tunol/internal/utils"
+)
+
+const (
+	// tcpReadBufferSize is the max number of bytes sent in a single tcp data frame
+	tcpReadBufferSize = 32 * 1024
+	// tcpWriteQueueSize is how many frames can wait on a public connection before it's closed for not
+	// keeping up, and tcpWriteTimeout how long writing one can take
+	tcpWriteQueueSize = 64
+	tcpWriteTimeout   = 30 * time.Second
+)
+
+// tcpConn is a public connection of a tcp tunnel. It's written to from its own goroutine, so a slow
+// connection never holds up the websocket read loop of its client
+type tcpConn struct {
+	conn   net.Conn
+	tunnel *Tunnel
+	writes *utils.WriteQueue[[]byte]
+}
+
+// listenTCP opens the public listener for a tcp tunnel, on a port chosen by the OS and the servers bind address
+func (th *TunnelHandler) listenTCP(t *Tunnel) error {
+	ln, err := net.Listen("tcp", net.JoinHostPort(th.cfg.BindAddr, "0"))
+	if err != nil {
+		return err
+	}
+
+	t.Listener = ln
+	t.Path = th.cfg.TCPURL(ln.Addr().(*net.TCPAddr).Port)
+	return nil
+}
+
+// acceptTCP accepts public connections for a tcp tunnel until its listener is closed
+func (th *TunnelHandler) acceptTCP(t *Tunnel) {
+	for {
+		conn, err := t.Listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				th.logger.Error("failed to accept tcp connection", "id", t.ID, "error", err)
+			}
+			return
+		}
+
+		// Prefixed with the tunnel id to make logs easier to follow, connections are cleaned up by their tunnel
+		connID := t.ID + "-" + generateID()
+		th.logger.Info("accepted tcp connection", "id", t.ID, "connId", connID, "remote", conn.RemoteAddr())
+
+		tc := &tcpConn{conn: conn, tunnel: t, writes: utils.NewWriteQueue(tcpWriteQueueSize, tcpWriteTimeout)}
+		th.mu.Lock()
+		th.tcpConns[connID] = tc
+		t.LastRequest = time.Now()
+		th.mu.Unlock()
+
+		go th.pipeTCP(t, connID, conn)
+		go th.writeTCP(connID, tc)
+	}
+}
+
+// writeTCP writes the frames queued for a public tcp connection until either side closes
+func (th *TunnelHandler) writeTCP(connID string, tc *tcpConn) {
+	if err := tc.writes.Run(tc.conn); err != nil {
+		th.logger.Error("failed to write tcp data", "connId", connID, "error", err)
+		th.closeTCPConn(connID)
+	}
+}
+
+// pipeTCP frames bytes read from a public tcp connection over the tunnel websocket
+func (th *TunnelHandler) pipeTCP(t *Tunnel, connID string, conn net.Conn) {
+	// An empty frame lets the client open its local connection straight away, for
+	// protocols where the server speaks first (e.g. ssh)
+	if err := t.send(proto.MessageTypeTCPData, proto.TCPData{ConnID: connID}); err != nil {
+		th.logger.Error("failed to open tcp connection over tunnel", "connId", connID, "error", err)
+		th.removeTCPConn(connID)
+		return
+	}
+
+	buf := make([]byte, tcpReadBufferSize)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if err := t.send(proto.MessageTypeTCPData, proto.TCPData{ConnID: connID, Data: buf[:n]}); err != nil {
+				th.logger.Error("failed to send tcp data", "connId", connID, "error", err)
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	th.closeTCPConn(connID)
+}
+
+// closeTCPConn closes a public tcp connection from the server side, telling the client unless it
+// closed first, in which case it already knows
+func (th *TunnelHandler) closeTCPConn(connID string) {
+	th.mu.Lock()
+	tc, exists := th.tcpConns[connID]
+	th.mu.Unlock()
+
+	if exists && th.removeTCPConn(connID) {
+		if err := tc.tunnel.send(proto.MessageTypeTCPClose, proto.TCPClose{ConnID: connID}); err != nil {
+			th.logger.Error("failed to send tcp close", "connId", connID, "error", err)
+		}
+	}
+}
+
+// handleTCPData queues a frame received from the client for its public tcp connection
+func (th *TunnelHandler) handleTCPData(msg proto.Message) {
+	data, err := msg.AsTCPData()
+	if err != nil {
+		th.logger.Error("failed to unmarshal tcp data", "error", err)
+		return
+	}
+
+	th.mu.Lock()
+	tc, exists := th.tcpConns[data.ConnID]
+	th.mu.Unlock()
+
+	if !exists {
+		th.logger.Warn("received tcp data for unknown connection", "connId", data.ConnID)
+		return
+	}
+
+	if !tc.writes.Queue(data.Data) {
+		th.logger.Warn("public tcp connection can't keep up, closing it", "connId", data.ConnID)
+		th.closeTCPConn(data.ConnID)
+	}
+}
+
+// handleTCPClose closes a public tcp connection after the client closed its side
+func (th *TunnelHandler) handleTCPClose(msg proto.Message) {
+	closed, err := msg.AsTCPClose()
+	if err != nil {
+		th.logger.Error("failed to unmarshal tcp close", "error", err)
+		return
+	}
+
+	th.removeTCPConn(closed.ConnID)
+}
+
+// removeTCPConn forgets a public tcp connection, which is closed once the frames queued for it are written.
+// It reports whether the connection was still open
+func (th *TunnelHandler) removeTCPConn(connID string) bool {
+	th.mu.Lock()
+	tc, exists := th.tcpConns[connID]
+	delete(th.tcpConns, connID)
+	th.mu.Unlock()
+
+	if exists {
+		tc.writes.Close()
+	}
+	return exists
+}
+
+// closeTCPTunnelLocked closes the listener and open connections of a tcp tunnel. The caller must hold th.mu
+func (th *TunnelHandler) closeTCPTunnelLocked(t *Tunnel) {
+	if t.Listener == nil {
+		return
+	}
+
+	t.Listener.Close()
+	// Matched by tunnel rather than id prefix, as ids can have hyphens, e.g. app is a prefix of app-x
+	for connID, tc := range th.tcpConns {
+		if tc.tunnel == t {
+			tc.writes.Close()
+			tc.conn.Close()
+			delete(th.tcpConns, connID)
+		}
+	}
+}
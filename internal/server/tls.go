@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/url"
+
+	"github.com/jwtly10/go-tunol/internal/config"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// NewTLSConfig returns the TLS config the server serves HTTPS with, or nil if it doesn't serve HTTPS
+// itself. Certificates are either loaded from the configured files, or fetched from Let's Encrypt for
+// the server domain and its reserved subdomains
+func NewTLSConfig(cfg *config.ServerConfig, th *TunnelHandler) (*tls.Config, error) {
+	if !cfg.TLSEnabled() {
+		return nil, nil
+	}
+
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tls certificate: %w", err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+	}
+
+	// Certificates are verified with the tls-alpn-01 challenge, so the server must be reachable on 443
+	u, err := url.Parse(cfg.BaseURL)
+	if err != nil || u.Hostname() == "" {
+		return nil, fmt.Errorf("TLS_AUTOCERT needs SERVER_URL to have a domain: %s", cfg.BaseURL)
+	}
+	if cfg.UseSubdomains {
+		th.logger.Warn("TLS_AUTOCERT only fetches certificates for reserved subdomains, tunnels with other ids need a wildcard TLS_CERT_FILE to be served over HTTPS")
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.TLSAutocertDir),
+		HostPolicy: th.autocertHostPolicy(u.Hostname()),
+		Email:      cfg.TLSAutocertMail,
+	}
+	return m.TLSConfig(), nil
+}
+
+// SetTLSConfig has the own ports of http tunnels served with HTTPS, like the server. It must be called
+// before the handler starts serving
+func (th *TunnelHandler) SetTLSConfig(tlsConfig *tls.Config) {
+	th.tlsConfig = tlsConfig
+}
+
+// autocertHostPolicy only allows certificates for the server host, and reserved subdomains. Fetching one
+// for every random tunnel id would soon hit the Let's Encrypt limit of 50 certificates per domain a week,
+// and then fail TLS for everyone. Users can only reserve a few subdomains each, which stay well under it
+func (th *TunnelHandler) autocertHostPolicy(serverHost string) autocert.HostPolicy {
+	return func(_ context.Context, host string) error {
+		if host == serverHost {
+			return nil
+		}
+
+		if id, ok := th.cfg.SubdomainTunnelID(host); ok && th.cfg.UseSubdomains && th.subdomains != nil {
+			reservation, err := th.subdomains.FindBySubdomain(id)
+			if err != nil {
+				return fmt.Errorf("failed to check subdomain reservation: %w", err)
+			}
+			if reservation != nil {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("no certificate for host %s", host)
+	}
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"html/template"
+	"io"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/config"
+	testutil "github.com/jwtly10/go-tunol/internal/testutils"
+	"github.com/jwtly10/go-tunol/internal/web/subdomain"
+	"github.com/jwtly10/go-tunol/internal/web/user"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCertificate writes a self signed certificate and key to the dir, returning their paths
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "*.tunol.dev"},
+		DNSNames:     []string{"tunol.dev", "*.tunol.dev"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tmpl := template.Must(template.New("test").Parse("test"))
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir)
+
+	t.Run("disabled", func(t *testing.T) {
+		cfg := &config.ServerConfig{BaseURL: "https://tunol.dev"}
+		tlsConfig, err := NewTLSConfig(cfg, NewTunnelHandler(nil, nil, nil, tmpl, logger, cfg))
+		require.NoError(t, err)
+		require.Nil(t, tlsConfig)
+	})
+
+	t.Run("certificate files", func(t *testing.T) {
+		cfg := &config.ServerConfig{BaseURL: "https://tunol.dev", TLSCertFile: certFile, TLSKeyFile: keyFile}
+		tlsConfig, err := NewTLSConfig(cfg, NewTunnelHandler(nil, nil, nil, tmpl, logger, cfg))
+		require.NoError(t, err)
+		require.Len(t, tlsConfig.Certificates, 1)
+	})
+
+	t.Run("missing certificate", func(t *testing.T) {
+		cfg := &config.ServerConfig{BaseURL: "https://tunol.dev", TLSCertFile: filepath.Join(dir, "missing.pem"), TLSKeyFile: keyFile}
+		_, err := NewTLSConfig(cfg, NewTunnelHandler(nil, nil, nil, tmpl, logger, cfg))
+		require.Error(t, err)
+	})
+
+	t.Run("autocert", func(t *testing.T) {
+		cfg := &config.ServerConfig{BaseURL: "https://tunol.dev", TLSAutocert: true, TLSAutocertDir: dir}
+		tlsConfig, err := NewTLSConfig(cfg, NewTunnelHandler(nil, nil, nil, tmpl, logger, cfg))
+		require.NoError(t, err)
+		require.NotNil(t, tlsConfig.GetCertificate)
+		require.Contains(t, tlsConfig.NextProtos, "acme-tls/1")
+	})
+}
+
+// TestAutocertHostPolicy tests that certificates are only fetched for the server host and reserved
+// subdomains, never for the generated ids of other tunnels, even while they're connected
+func TestAutocertHostPolicy(t *testing.T) {
+	db, cleanup := testutil.SetupTestDB(t)
+	defer cleanup()
+
+	owner, err := user.NewUserRepository(db).CreateUser(&user.User{Provider: "github", ProviderUserID: "1", Username: "owner"})
+	require.NoError(t, err)
+	subdomainRepo := subdomain.NewSubdomainRepository(db)
+	_, err = subdomainRepo.Reserve(owner.ID, "myapp")
+	require.NoError(t, err)
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tmpl := template.Must(template.New("test").Parse("test"))
+	cfg := &config.ServerConfig{BaseURL: "https://tunol.dev", UseSubdomains: true}
+	th := NewTunnelHandler(nil, subdomainRepo, nil, tmpl, logger, cfg)
+	th.tunnels["generated"] = &Tunnel{ID: "generated"}
+	policy := th.autocertHostPolicy("tunol.dev")
+
+	tests := []struct {
+		host    string
+		allowed bool
+	}{
+		{"tunol.dev", true},
+		{"myapp.tunol.dev", true},
+		{"generated.tunol.dev", false},
+		{"unknown.tunol.dev", false},
+		{"a.myapp.tunol.dev", false},
+		{"myapp.example.com", false},
+		{"eviltunol.dev", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			err := policy(context.Background(), tt.host)
+			if tt.allowed {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+
+	// Without subdomains tunnels are served from the domain, so only it needs a certificate
+	cfg.UseSubdomains = false
+	require.Error(t, policy(context.Background(), "myapp.tunol.dev"))
+
+	// Without reservations there is nothing to check against, so only the server host is allowed
+	cfg.UseSubdomains = true
+	noReservations := NewTunnelHandler(nil, nil, nil, tmpl, logger, cfg).autocertHostPolicy("tunol.dev")
+	require.NoError(t, noReservations(context.Background(), "tunol.dev"))
+	require.Error(t, noReservations(context.Background(), "myapp.tunol.dev"))
+}
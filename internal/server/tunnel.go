@@ -1,13 +1,20 @@
 package server
 
 import (
-	"bytes"
-	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"html/template"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,40 +22,126 @@ import (
 	"github.com/jwtly10/go-tunol/internal/auth/token"
 	"github.com/jwtly10/go-tunol/internal/config"
 	"github.com/jwtly10/go-tunol/internal/proto"
+	"github.com/jwtly10/go-tunol/internal/utils"
+	"github.com/jwtly10/go-tunol/internal/version"
+	"github.com/jwtly10/go-tunol/internal/web/subdomain"
+	"github.com/jwtly10/go-tunol/internal/web/usage"
 	"golang.org/x/net/websocket"
+	"golang.org/x/time/rate"
 )
 
 type TunnelHandler struct {
 	tunnels         map[string]*Tunnel
-	pendingRequests map[string]chan *proto.HTTPResponse
+	pendingRequests map[string]*pendingRequest // Requests waiting on a client response, keyed by request id
+	pendingStreams  map[string]*responseStream // Body chunks of streaming responses, keyed by request id
+	tcpConns        map[string]*tcpConn        // Public connections of tcp tunnels, keyed by connection id
+	wsPassthrough   map[string]*publicWSConn   // Public websocket connections, keyed by connection id
 	tokenService    *token.Service
+	subdomains      *subdomain.Repository // May be nil, in which case reservations are not enforced
+	usage           *usage.Repository     // May be nil, in which case usage is not recorded
 	templates       *template.Template
+	registry        Registry       // Which instance holds each tunnel, only shared between instances once SetRegistry is called
+	instance        string         // The url of this instance in the registry
+	trustedProxies  []netip.Prefix // Proxies whose forwarding headers are believed, see clientIP
+	tlsConfig       *tls.Config    // Serves the own ports of http tunnels with HTTPS, nil when the server doesnt serve HTTPS
+
+	mu           sync.Mutex
+	logger       *slog.Logger
+	cfg          *config.ServerConfig
+	done         chan struct{} // Signal for cleanup goroutine
+	shuttingDown bool          // Set once Shutdown starts, after which new tunnels are rejected
+}
 
-	mu     sync.Mutex
-	logger *slog.Logger
-	cfg    *config.ServerConfig
-	done   chan struct{} // Signal for cleanup goroutine
+// pendingRequest is a request waiting on the response from the client of its tunnel
+type pendingRequest struct {
+	tunnelID string
+	resp     chan *proto.HTTPResponse // Only ever sent one response, the request waits on the tunnel closing too
 }
 
 type Tunnel struct {
 	ID           string
+	UserID       int64 // The user who owns the tunnel
 	LocalPort    int
+	Protocol     string // http or tcp
 	WSConn       *websocket.Conn
 	Path         string    // For local dev & pre-subdomain routing
 	UrlPrefix    string    // For subdomain routing
 	LastActivity time.Time // For tracking healthy connections
+	LastRequest  time.Time // When the tunnel was last used, for closing idle tunnels. Heartbeats don't count
 	Created      time.Time
+	RequestCount int // Number of requests proxied through the tunnel
+
+	Listener   net.Listener // The public listener, only set for tcp tunnels and http tunnels with their own port
+	portServer *http.Server // Serves the own port of an http tunnel, see listenPort
+
+	done chan struct{} // Closed once the tunnel is removed, failing the requests still waiting on the client
+
+	// Optional basic auth credentials visitors must supply, the password is a SHA-256 hash
+	BasicAuthUser     string
+	BasicAuthPassHash string
+
+	RateLimit           float64       // Max requests per second, 0 if unlimited
+	RateLimited         int           // Number of requests rejected by the rate limit
+	limiter             *rate.Limiter // Nil if the tunnel is unlimited
+	lastRateLimitNotice time.Time     // When the client was last told about rejected requests
+
+	inFlight chan struct{} // Holds a slot for each request waiting on the client, nil if unlimited
+
+	// Response headers forwarded on top of the default allowlist
+	PassAllHeaders bool     // Forward all but hop-by-hop headers
+	AllowHeaders   []string // Extra headers to forward
+
+	Verbatim bool // Requests are forwarded with their headers exactly as received
+
+	CORS *proto.CORSPolicy // Preflight requests it allows are answered by the server, nil forwards them all
+
+	clientFeatures []string // The optional features the client said it supports in its hello
+}
+
+// clientSupports reports whether the client of the tunnel supports an optional feature
+func (t *Tunnel) clientSupports(feature string) bool {
+	return slices.Contains(t.clientFeatures, feature)
+}
+
+// sendHTTPRequest sends a request to the client, with the body in its own binary frame if the client supports it
+func (t *Tunnel) sendHTTPRequest(req proto.HTTPRequest) error {
+	if len(req.Body) > 0 && t.clientSupports(proto.FeatureBinaryBodies) {
+		if err := proto.MessageCodec.Send(t.WSConn, &proto.BodyFrame{RequestId: req.RequestId, Body: req.Body}); err != nil {
+			return err
+		}
+		req.Body, req.BodyFrame = nil, true
+	}
+	return t.send(proto.MessageTypeHTTPRequest, req)
+}
+
+// send sends a message for the tunnel to its client, tagged with the tunnel id as the
+// connection may carry several tunnels
+func (t *Tunnel) send(msgType proto.MessageType, payload interface{}) error {
+	msg, err := proto.NewMessage(msgType, payload)
+	if err != nil {
+		return err
+	}
+	msg.TunnelID = t.ID
+	return websocket.JSON.Send(t.WSConn, msg)
 }
 
-func NewTunnelHandler(tokenService *token.Service, templates *template.Template, logger *slog.Logger, cfg *config.ServerConfig) *TunnelHandler {
+func NewTunnelHandler(tokenService *token.Service, subdomains *subdomain.Repository, usage *usage.Repository, templates *template.Template, logger *slog.Logger, cfg *config.ServerConfig) *TunnelHandler {
 	if logger == nil {
 		logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
 	}
 	th := &TunnelHandler{
 		tunnels:         make(map[string]*Tunnel),
-		pendingRequests: make(map[string]chan *proto.HTTPResponse),
+		pendingRequests: make(map[string]*pendingRequest),
+		pendingStreams:  make(map[string]*responseStream),
+		tcpConns:        make(map[string]*tcpConn),
+		wsPassthrough:   make(map[string]*publicWSConn),
 		tokenService:    tokenService,
+		subdomains:      subdomains,
+		usage:           usage,
 		templates:       templates,
+		registry:        newMemoryRegistry(),
+		instance:        localInstance,
+		trustedProxies:  cfg.TrustedProxyPrefixes(),
 
 		logger: logger,
 		cfg:    cfg,
@@ -64,73 +157,178 @@ func NewTunnelHandler(tokenService *token.Service, templates *template.Template,
 func (th *TunnelHandler) HandleWS() http.Handler {
 	return websocket.Handler(func(ws *websocket.Conn) {
 		// Authenticate WebSocket connection
-		if err := th.authenticateWebSocket(ws); err != nil {
+		userID, err := th.authenticateWebSocket(ws)
+		if err != nil {
 			th.logger.Error("websocket authentication failed", "error", err)
 			// Send error message before closing
-			errMsg := proto.Message{
-				Type: proto.MessageTypeError,
-				Payload: map[string]string{
-					"error": err.Error(),
-				},
-			}
-			err := websocket.JSON.Send(ws, errMsg)
-			if err != nil {
-				th.logger.Error("failed to send error message", "error", err)
-			}
+			th.sendError(ws, err)
+			ws.Close()
+			return
+		}
+
+		th.logClientVersion(ws, userID)
+		if err := th.checkProtocolVersion(ws); err != nil {
+			th.logger.Warn("rejected client with unsupported protocol version", "userID", userID, "error", err)
+			th.sendError(ws, err)
 			ws.Close()
 			return
 		}
 
-		th.handleWS(ws)
+		th.handleWS(ws, userID)
 	})
 }
 
+// logClientVersion logs the version of the CLI connecting, warning if it's a release this server may
+// not work with. CLIs from before the version was sent are logged as unknown
+func (th *TunnelHandler) logClientVersion(ws *websocket.Conn, userID int64) {
+	clientVersion := "unknown"
+	if ws.Request() != nil && ws.Request().Header.Get(version.Header) != "" {
+		clientVersion = ws.Request().Header.Get(version.Header)
+	}
+
+	if !version.Compatible(clientVersion) {
+		th.logger.Warn("client version may be incompatible with server", "userID", userID, "clientVersion", clientVersion, "serverVersion", version.Version)
+		return
+	}
+	th.logger.Debug("client connected", "userID", userID, "clientVersion", clientVersion)
+}
+
+// checkProtocolVersion returns an error for clients speaking a version of the protocol this server
+// doesn't support, telling the user which side needs upgrading. Clients from before the protocol was
+// versioned are let through, as they speak the first version
+func (th *TunnelHandler) checkProtocolVersion(ws *websocket.Conn) error {
+	if ws.Request() == nil || ws.Request().Header.Get(proto.ProtocolHeader) == "" {
+		th.logger.Debug("client didn't send a protocol version, assuming the first")
+		return nil
+	}
+
+	v, err := strconv.Atoi(ws.Request().Header.Get(proto.ProtocolHeader))
+	if err != nil {
+		return withCode(proto.ErrorCodeUnsupportedProtocol, fmt.Errorf("invalid protocol version %q", ws.Request().Header.Get(proto.ProtocolHeader)))
+	}
+	if v < proto.MinProtocolVersion {
+		return withCode(proto.ErrorCodeUnsupportedProtocol, fmt.Errorf("this tunol CLI is too old for the server (protocol %d, the server needs at least %d), please upgrade it", v, proto.MinProtocolVersion))
+	}
+	if v > proto.ProtocolVersion {
+		return withCode(proto.ErrorCodeUnsupportedProtocol, fmt.Errorf("this tunol CLI is newer than the server supports (protocol %d, the server supports up to %d), please use an older CLI or upgrade the server", v, proto.ProtocolVersion))
+	}
+	return nil
+}
+
+// renderTunnelNotFound renders the page for a request that can't be sent to a tunnel, either because
+// the url can't be a tunnel's or because no tunnel is connected with the id
+func (th *TunnelHandler) renderTunnelNotFound(w http.ResponseWriter, status int, data map[string]interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store") // The tunnel may connect at any moment
+	w.WriteHeader(status)
+	data["Status"] = status
+	if err := th.templates.ExecuteTemplate(w, "tunnel-not-found", data); err != nil {
+		th.logger.Error("failed to render not found template", "error", err)
+	}
+}
+
 // ServeHTTP handles incoming HTTP tunnel requests from the client, for proxying to the CLI tunnel
 func (th *TunnelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	th.logger.Info("1. initial request proxied from cloudflare", "headers", r.Header)
-	th.logger.Info("received http request", "method", r.Method, "rawPath", r.URL.Path)
+	th.logger.Debug("1. initial request proxied from cloudflare", "headers", r.Header)
+	th.logger.Debug("received http request", "method", r.Method, "rawPath", r.URL.Path)
 
 	// https://tunelID.tunol.dev/some_external_path/and/maybe/more
 	// http://localhost:8001/local/tunnelID/some_external_path/and/maybe/more
-	tunnelId, realPath, err := extractTunnelIDAndPath(r.URL.String(), r.Host, th.cfg.UseSubdomains)
+	tunnelId, realPath, err := extractTunnelIDAndPath(r.URL.String(), r.Host, th.cfg)
+	if err == nil {
+		// Every tunnel id is a valid subdomain, so anything else can't be one
+		err = subdomain.Validate(tunnelId)
+	}
 	if err != nil {
-		th.logger.Error("failed to extract tunnel_id from url", "error", err)
+		th.logger.Warn("failed to extract tunnel_id from url", "url", r.URL.String(), "host", r.Host, "error", err)
+		th.renderTunnelNotFound(w, http.StatusBadRequest, map[string]interface{}{
+			"Malformed": true,
+			"TunnelUrl": r.Host + r.URL.Path,
+			"Error":     err.Error(),
+		})
+		return
 	}
 
+	th.serveTunnel(w, r, tunnelId, realPath)
+}
+
+// serveTunnel proxies a request to the tunnel with the id, at the path the local server should get
+func (th *TunnelHandler) serveTunnel(w http.ResponseWriter, r *http.Request, tunnelId, realPath string) {
 	th.mu.Lock()
 	tunnel, exists := th.tunnels[tunnelId]
+	if exists {
+		tunnel.RequestCount++
+		tunnel.LastRequest = time.Now()
+	}
 	th.mu.Unlock()
 
+	if !exists && th.forwardToOwner(w, r, tunnelId) {
+		return
+	}
+	r.Header.Del(forwardedHeader)
+
 	if !exists {
+		tunnelNotFound.Inc()
 		th.logger.Warn("tunnel not found", "id", tunnelId)
-		w.WriteHeader(http.StatusNotFound)
-
-		// nicer formatting of content for the template
-		var data map[string]interface{}
-		if th.cfg.UseSubdomains {
-			// x8q4j44y.tunol.dev/
-			data = map[string]interface{}{
-				"TunnelUrl": r.Host,
-			}
-		} else {
-			// localhost:8001/local/fjkdsfs  or
-			data = map[string]interface{}{
-				"TunnelUrl": r.Host + "/local/" + tunnelId,
-			}
-		}
 
-		if err := th.templates.ExecuteTemplate(w, "tunnel-not-found", data); err != nil {
-			th.logger.Error("failed to render not found template", "error", err)
+		// The url the tunnel would have, rather than the host, which may include the port
+		th.renderTunnelNotFound(w, http.StatusNotFound, map[string]interface{}{
+			"TunnelUrl": th.cfg.SubdomainURL(tunnelId),
+			"TunnelID":  tunnelId,
+		})
+		return
+	}
+
+	if tunnel.Protocol == proto.ProtocolTCP {
+		th.logger.Warn("http request for tcp tunnel", "id", tunnelId)
+		http.Error(w, "Tunnel only accepts raw TCP connections", http.StatusBadRequest)
+		return
+	}
+
+	if tunnel.limiter != nil && !tunnel.limiter.Allow() {
+		th.rejectRateLimited(w, tunnel)
+		return
+	}
+
+	// Preflights never carry credentials, so they're answered before basic auth would reject them
+	if tunnel.CORS != nil && th.servePreflight(w, r, tunnel, realPath) {
+		return
+	}
+
+	if !tunnel.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="tunol", charset="UTF-8"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Websockets can't be carried by the request/response model, so they are streamed instead
+	if isWebSocketUpgrade(r) {
+		th.serveWebSocket(w, r, tunnel, realPath)
+		return
+	}
+
+	// Bodies are buffered in memory, so reject any over the limit before reading them
+	if th.cfg.MaxBodyBytes > 0 {
+		if r.ContentLength > th.cfg.MaxBodyBytes {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
 		}
+		r.Body = http.MaxBytesReader(w, r.Body, th.cfg.MaxBodyBytes)
+	}
+
+	if !tunnel.acquireSlot() {
+		th.rejectOverCapacity(w, tunnel)
 		return
 	}
+	defer tunnel.releaseSlot()
 
 	// We need to be able to wait for the response from the CLI tunnel
+	start := time.Now()
 	respChan := make(chan *proto.HTTPResponse, 1)
 	requestId := generateID()
 
 	th.mu.Lock()
-	th.pendingRequests[requestId] = respChan
+	th.pendingRequests[requestId] = &pendingRequest{tunnelID: tunnel.ID, resp: respChan}
 	th.mu.Unlock()
 
 	// Clean up the pending request once done
@@ -141,14 +339,24 @@ func (th *TunnelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	// Map the HTTP request to a WS message
-	th.logger.Info("initial request headers", "headers", r.Header)
-	headers := make(map[string]string)
-	for k, v := range r.Header {
-		headers[k] = v[0]
+	th.logger.Debug("initial request headers", "headers", r.Header)
+	var headers map[string]string
+	var headerValues map[string][]string
+	if tunnel.Verbatim {
+		headers, headerValues = th.verbatimHeaders(r)
+	} else {
+		headers = th.forwardHeaders(r)
 	}
 
+	// Chunked request bodies are decoded by net/http, so reading the body reassembles the
+	// chunks and the client forwards the whole body to the local server
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		th.logger.Error("failed to read request body", "error", err)
 		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
 		return
@@ -160,23 +368,29 @@ func (th *TunnelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		Body:      body,
 		Headers:   headers,
 		RequestId: requestId,
-	}
+		Trailers:  flattenTrailers(r.Trailer), // Only populated once the body has been read
 
-	msg := proto.Message{
-		Type:    proto.MessageTypeHTTPRequest,
-		Payload: httpReq,
+		HeaderValues: headerValues,
 	}
 
-	th.logger.Info("fowarding http request to tunel ",
+	th.logger.Debug("fowarding http request to tunel ",
 		"tunnel_id", tunnelId,
 		"headers", httpReq.Headers,
 		"method", r.Method,
 		"path", realPath,
 		"requestId", requestId)
 
-	th.logger.Info("2. sending through websocket", "headers", httpReq.Headers)
+	th.logger.Debug("2. sending through websocket", "headers", httpReq.Headers)
+
+	// The body is only compressed on the wire, the request is logged and recorded as it was received
+	wireReq := httpReq
+	if tunnel.clientSupports(proto.FeatureCompression) {
+		wireReq.Body, wireReq.BodyEncoding = proto.CompressBody(httpReq.Body)
+	}
+	wireReq.SentAt = time.Now().UnixNano()
 
-	if err := websocket.JSON.Send(tunnel.WSConn, msg); err != nil {
+	if err := tunnel.sendHTTPRequest(wireReq); err != nil {
+		th.finishRequest(tunnel, httpReq, http.StatusInternalServerError, start, nil)
 		http.Error(w, "Failed to forward request", http.StatusInternalServerError)
 		return
 	}
@@ -184,7 +398,9 @@ func (th *TunnelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Wait for response with timeout
 	select {
 	case resp := <-respChan:
-		th.logger.Info("received response through tunnel",
+		th.finishRequest(tunnel, httpReq, resp.StatusCode, start, resp)
+
+		th.logger.Debug("received response through tunnel",
 			"requestId", requestId,
 			"statusCode", resp.StatusCode,
 			"responseHeaders", resp.Headers)
@@ -197,19 +413,33 @@ func (th *TunnelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		// Headers to keep
 		var responseHeadersToKeep = map[string]bool{
-			"content-type":   true,
-			"content-length": true,
-			"set-cookie":     true,
-			"location":       true,
-			"cache-control":  true,
-			"expires":        true,
-			"etag":           true,
-			"last-modified":  true,
-			"vary":           true,
-			"x-request-id":   true,
-			"date":           true,
-			"server":         true,
-			"authorization":  true,
+			"content-type":     true,
+			"content-length":   true,
+			"content-encoding": true, // Bodies are passed through still encoded, whatever the encoding
+			"set-cookie":       true,
+			"location":         true,
+			"cache-control":    true,
+			"expires":          true,
+			"etag":             true,
+			"last-modified":    true,
+			"vary":             true,
+			"x-request-id":     true,
+			"date":             true,
+			"server":           true,
+			"authorization":    true,
+
+			// Partial responses to range requests
+			"accept-ranges": true,
+			"content-range": true,
+
+			// CORS, so browser apps can call a tunneled api
+			"access-control-allow-origin":          true,
+			"access-control-allow-methods":         true,
+			"access-control-allow-headers":         true,
+			"access-control-allow-credentials":     true,
+			"access-control-allow-private-network": true,
+			"access-control-expose-headers":        true,
+			"access-control-max-age":               true,
 		}
 
 		// Add WebSocket specific headers if needed
@@ -222,78 +452,213 @@ func (th *TunnelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			responseHeadersToKeep["sec-websocket-extensions"] = true
 		}
 
+		for _, h := range tunnel.AllowHeaders {
+			responseHeadersToKeep[strings.ToLower(h)] = true
+		}
+
 		cleaned := make(map[string]string)
 		for k, v := range resp.Headers {
 			headerLower := strings.ToLower(k)
-			if responseHeadersToKeep[headerLower] {
+			if responseHeadersToKeep[headerLower] || (tunnel.PassAllHeaders && !utils.IsHopByHopHeader(k)) {
 				cleaned[k] = v
 			}
 		}
 
-		// We also need to handle gzipped responses
-		if isGzipped(resp.Headers) {
-			delete(cleaned, "Content-Encoding")
-
-			reader, err := gzip.NewReader(bytes.NewReader(resp.Body))
-			if err != nil {
-				th.logger.Error("failed to create gzip reader", "error", err)
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-				return
-			}
-			defer reader.Close()
-
-			// Read the uncompressed content
-			uncompressedBody, err := io.ReadAll(reader)
-			if err != nil {
-				th.logger.Error("failed to read gzipped content", "error", err)
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-				return
-			}
-
-			for k, v := range cleaned {
-				w.Header().Set(k, v)
-			}
-
-			th.logger.Info("final response details",
-				"status_code", resp.StatusCode,
-				"is_redirect", resp.StatusCode >= 300 && resp.StatusCode < 400,
-				"final_location", w.Header().Get("Location"),
-				"all_headers", w.Header(),
-				"original_headers", resp.Headers,
-				"request_id", requestId)
-
-			th.logger.Info("7. this is what cloudflare gets on the other end", "headers", cleaned)
-
-			w.WriteHeader(resp.StatusCode)
-			w.Write(uncompressedBody)
+		// Trailers can only follow a chunked body, so the length can't be sent up front, and they
+		// must be declared so a short body isn't sent with a length
+		if len(resp.Trailers) > 0 {
+			delete(cleaned, "Content-Length")
+			cleaned["Trailer"] = trailerNames(resp.Trailers)
+		}
 
-			th.logger.Info("handled gzipped response")
+		// Streaming responses (e.g. server-sent events) are written as the chunks arrive
+		if resp.Streaming {
+			th.streamResponse(w, r, tunnel, resp, cleaned)
 			return
-
 		}
-		// Else handle non-gzipped response
 
+		// The body is written exactly as the local server encoded it (gzip, deflate, br or none),
+		// along with its Content-Encoding, so the caller decodes it as it would locally
 		for k, v := range cleaned {
 			w.Header().Set(k, v)
 		}
 
-		th.logger.Info("7. this is what cloudflare gets on the other end", "headers", cleaned)
+		th.logger.Debug("final response details",
+			"status_code", resp.StatusCode,
+			"is_redirect", resp.StatusCode >= 300 && resp.StatusCode < 400,
+			"final_location", w.Header().Get("Location"),
+			"all_headers", w.Header(),
+			"original_headers", resp.Headers,
+			"request_id", requestId)
+
+		th.logger.Debug("7. this is what cloudflare gets on the other end", "headers", cleaned)
 		w.WriteHeader(resp.StatusCode)
 
+		// The response to a HEAD keeps the local servers Content-Length, for the body a GET would have.
+		// Neither it nor a 304 Not Modified has a body, the caller uses the one it already has
+		if r.Method == http.MethodHead || resp.StatusCode == http.StatusNotModified {
+			return
+		}
 		w.Write(resp.Body)
+		writeTrailers(w, resp.Trailers)
 
-	case <-time.After(30 * time.Second): // TODO: Make this some sort of configurable timeout
+	case <-time.After(th.requestTimeout()):
+		th.finishRequest(tunnel, httpReq, http.StatusGatewayTimeout, start, nil)
 
 		http.Error(w, "Request timed out", http.StatusGatewayTimeout)
+
+	case <-tunnel.done: // The client disconnected, or the tunnel was closed, before the client responded
+		th.finishRequest(tunnel, httpReq, http.StatusBadGateway, start, nil)
+
+		http.Error(w, "Tunnel disconnected", http.StatusBadGateway)
+
+	case <-th.done: // The server shut down before the client responded
+		th.finishRequest(tunnel, httpReq, http.StatusServiceUnavailable, start, nil)
+
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+	}
+}
+
+// finishRequest records the outcome of a proxied request in the access log, metrics and usage. The
+// response is nil if the client never answered
+func (th *TunnelHandler) finishRequest(t *Tunnel, req proto.HTTPRequest, status int, start time.Time, resp *proto.HTTPResponse) {
+	entry := accessLogEntry{
+		TunnelID:  t.ID,
+		RequestID: req.RequestId,
+		Method:    req.Method,
+		Path:      req.Path,
+		Status:    status,
+		Duration:  time.Since(start),
+		BytesIn:   len(req.Body),
+	}
+	if resp != nil {
+		entry.BytesOut = len(resp.Body)
+		if latency, ok := tunnelLatency(resp); ok {
+			entry.Timed, entry.LocalDuration, entry.TunnelLatency = true, resp.LocalDuration, latency
+			observeTunnelLatency(latency)
+		}
+	}
+	logAccess(th.logger, entry)
+	observeRequest(status, start)
+	th.recordUsage(t, len(req.Body), entry.BytesOut, status >= 500)
+}
+
+// tunnelLatency is how long the request and its response spent in the tunnel, the round trip from the
+// server to the client and back without the time the client spent on it. It's unknown, and false is
+// returned, for clients that don't report how long they took
+func tunnelLatency(resp *proto.HTTPResponse) (time.Duration, bool) {
+	if resp.RequestSentAt == 0 {
+		return 0, false
+	}
+	latency := time.Since(time.Unix(0, resp.RequestSentAt)) - resp.LocalDuration
+	return max(latency, 0), true
+}
+
+// recordUsage adds a proxied request to the persisted usage of the tunnel owner
+func (th *TunnelHandler) recordUsage(t *Tunnel, bytesIn, bytesOut int, failed bool) {
+	if th.usage == nil {
+		return
+	}
+
+	// Usage is nice to have, so failing to record it shouldn't fail the request
+	if err := th.usage.Record(t.UserID, t.ID, bytesIn, bytesOut, failed); err != nil {
+		th.logger.Error("failed to record tunnel usage", "id", t.ID, "error", err)
 	}
 }
 
-// Shutdown provides a way to gracefully shutdown the server
-func (th *TunnelHandler) Shutdown() {
+// Shutdown gracefully shuts down the tunnels. New tunnels are rejected and connected clients are told the
+// server is going away, then pending requests are given until the ctx deadline to complete before every
+// tunnel is closed. The ctx error is returned if requests were still pending at the deadline
+func (th *TunnelHandler) Shutdown(ctx context.Context) error {
+	th.mu.Lock()
+	if th.shuttingDown {
+		th.mu.Unlock()
+		return nil
+	}
+	th.shuttingDown = true
+
+	// A client connection may carry several tunnels, but should only be told once
+	conns := make(map[*websocket.Conn]bool)
+	for _, tunnel := range th.tunnels {
+		conns[tunnel.WSConn] = true
+	}
+	th.mu.Unlock()
+
+	th.logger.Info("shutting down tunnels", "clients", len(conns))
+
+	msg, _ := proto.NewMessage(proto.MessageTypeServerShutdown, proto.ServerShutdown{Message: "tunol server is shutting down"}) // Always marshals
+	for ws := range conns {
+		if err := websocket.JSON.Send(ws, msg); err != nil {
+			th.logger.Warn("failed to send shutdown message", "error", err)
+		}
+	}
+
+	err := th.waitForPendingRequests(ctx)
+	if err != nil {
+		th.logger.Warn("shutdown deadline reached with requests still pending", "error", err)
+	}
+
 	close(th.done)
-	th.cleanupDeadConnections()
+	th.closeAllTunnels()
+
+	return err
 }
 
-func isGzipped(headers map[string]string) bool {
-	return strings.Contains(strings.ToLower(headers["Content-Encoding"]), "gzip")
+// waitForPendingRequests blocks until there are no requests waiting on a client response, or ctx is done
+func (th *TunnelHandler) waitForPendingRequests(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		th.mu.Lock()
+		pending := len(th.pendingRequests)
+		th.mu.Unlock()
+
+		if pending == 0 {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// closeAllTunnels closes and removes every tunnel, disconnecting all clients
+func (th *TunnelHandler) closeAllTunnels() {
+	th.mu.Lock()
+	var closed []string
+	for id, tunnel := range th.tunnels {
+		// The done channel is left open, as requests still waiting are failed by the shutdown instead
+		tunnel.WSConn.Close()
+		th.closeTCPTunnelLocked(tunnel)
+		th.closePortLocked(tunnel)
+		th.closePassthroughConnsLocked(tunnel)
+		delete(th.tunnels, id)
+		activeTunnels.Dec()
+		closed = append(closed, id)
+	}
+	th.mu.Unlock()
+
+	th.releaseTunnels(closed...)
+}
+
+// authorized checks the request carries the basic auth credentials of the tunnel, if it has any.
+// The credentials are for the tunnel, so they are removed rather than forwarded to the local server
+func (t *Tunnel) authorized(r *http.Request) bool {
+	if t.BasicAuthUser == "" {
+		return true
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	r.Header.Del("Authorization")
+
+	userMatch := subtle.ConstantTimeCompare([]byte(user), []byte(t.BasicAuthUser)) == 1
+	passMatch := subtle.ConstantTimeCompare([]byte(utils.HashToken(pass)), []byte(t.BasicAuthPassHash)) == 1
+	return userMatch && passMatch
 }
@@ -1,14 +1,20 @@
 package server
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"encoding/json"
 	"html/template"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -16,7 +22,11 @@ import (
 	"github.com/jwtly10/go-tunol/internal/auth/token"
 	"github.com/jwtly10/go-tunol/internal/proto"
 	testutil "github.com/jwtly10/go-tunol/internal/testutils"
+	"github.com/jwtly10/go-tunol/internal/utils"
+	"github.com/jwtly10/go-tunol/internal/web/subdomain"
+	"github.com/jwtly10/go-tunol/internal/web/usage"
 	"github.com/jwtly10/go-tunol/internal/web/user"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 
 	"github.com/jwtly10/go-tunol/internal/config"
@@ -47,11 +57,12 @@ func TestServerStartAndAcceptConnections(t *testing.T) {
 
 	// Create test user
 	user := &user.User{
-		ID:              0,
-		GithubID:        12345,
-		GithubUsername:  "testuser",
-		GithubAvatarURL: "https://github.com/avatar.jpg",
-		GithubEmail:     "test@example.com",
+		ID:             0,
+		Provider:       "github",
+		ProviderUserID: "12345",
+		Username:       "testuser",
+		AvatarURL:      "https://github.com/avatar.jpg",
+		Email:          "test@example.com",
 	}
 	user, err := userRepo.CreateUser(user)
 	require.NoError(t, err)
@@ -63,7 +74,7 @@ func TestServerStartAndAcceptConnections(t *testing.T) {
 
 	// TODO: This is probably a terrible way to mock this
 	tmpl := template.Must(template.New("test").Parse("test"))
-	tunnelHandler := NewTunnelHandler(tokenService, tmpl, logger, &cfg)
+	tunnelHandler := NewTunnelHandler(tokenService, nil, nil, tmpl, logger, &cfg)
 	ts := httptest.NewServer(tunnelHandler.HandleWS())
 	defer ts.Close()
 
@@ -111,11 +122,12 @@ func TestTunnelRegistration(t *testing.T) {
 
 	// Create test user
 	user := &user.User{
-		ID:              0,
-		GithubID:        12345,
-		GithubUsername:  "testuser",
-		GithubAvatarURL: "https://github.com/avatar.jpg",
-		GithubEmail:     "test@example.com",
+		ID:             0,
+		Provider:       "github",
+		ProviderUserID: "12345",
+		Username:       "testuser",
+		AvatarURL:      "https://github.com/avatar.jpg",
+		Email:          "test@example.com",
 	}
 	user, err := userRepo.CreateUser(user)
 	require.NoError(t, err)
@@ -126,7 +138,7 @@ func TestTunnelRegistration(t *testing.T) {
 	}
 
 	tmpl := template.Must(template.New("test").Parse("test"))
-	tunnelHandler := NewTunnelHandler(tokenService, tmpl, logger, &cfg)
+	tunnelHandler := NewTunnelHandler(tokenService, nil, nil, tmpl, logger, &cfg)
 	ts := httptest.NewServer(tunnelHandler.HandleWS())
 	defer ts.Close()
 
@@ -147,9 +159,9 @@ func TestTunnelRegistration(t *testing.T) {
 
 	req := proto.Message{
 		Type: proto.MessageTypeTunnelReq,
-		Payload: proto.TunnelRequest{
+		Payload: testutil.Payload(t, proto.TunnelRequest{
 			LocalPort: 8000,
-		},
+		}),
 	}
 	if err := websocket.JSON.Send(ws, req); err != nil {
 		t.Fatalf("could not send tunnel request: %v", err)
@@ -202,11 +214,12 @@ func TestHTTPForwarding(t *testing.T) {
 	userRepo := user.NewUserRepository(db)
 	// Create test user
 	user := &user.User{
-		ID:              0,
-		GithubID:        12345,
-		GithubUsername:  "testuser",
-		GithubAvatarURL: "https://github.com/avatar.jpg",
-		GithubEmail:     "test@example.com",
+		ID:             0,
+		Provider:       "github",
+		ProviderUserID: "12345",
+		Username:       "testuser",
+		AvatarURL:      "https://github.com/avatar.jpg",
+		Email:          "test@example.com",
 	}
 	user, err := userRepo.CreateUser(user)
 	require.NoError(t, err)
@@ -217,7 +230,7 @@ func TestHTTPForwarding(t *testing.T) {
 	}
 
 	tmpl := template.Must(template.New("test").Parse("test"))
-	tunnelHandler := NewTunnelHandler(tokenService, tmpl, logger, &cfg)
+	tunnelHandler := NewTunnelHandler(tokenService, nil, nil, tmpl, logger, &cfg)
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("Upgrade") == "websocket" {
 			tunnelHandler.HandleWS().ServeHTTP(w, r)
@@ -250,7 +263,7 @@ func TestHTTPForwarding(t *testing.T) {
 	// Register a tunnel
 	tunnelReq := proto.Message{
 		Type:    proto.MessageTypeTunnelReq,
-		Payload: proto.TunnelRequest{LocalPort: 8000},
+		Payload: testutil.Payload(t, proto.TunnelRequest{LocalPort: 8000}),
 	}
 	if err := websocket.JSON.Send(ws, tunnelReq); err != nil {
 		t.Fatal(err)
@@ -288,12 +301,12 @@ func TestHTTPForwarding(t *testing.T) {
 				// Mock local server response
 				responseMsg := proto.Message{
 					Type: proto.MessageTypeHTTPResponse,
-					Payload: proto.HTTPResponse{
+					Payload: testutil.Payload(t, proto.HTTPResponse{
 						StatusCode: 200,
 						Headers:    map[string]string{"Content-Type": "text/plain"},
 						Body:       []byte("Hello from local server"),
 						RequestId:  req.RequestId,
-					},
+					}),
 				}
 				websocket.JSON.Send(ws, responseMsg)
 			}
@@ -324,11 +337,12 @@ func TestClientDisconnection(t *testing.T) {
 	userRepo := user.NewUserRepository(db)
 	// Create test user
 	user := &user.User{
-		ID:              0,
-		GithubID:        12345,
-		GithubUsername:  "testuser",
-		GithubAvatarURL: "https://github.com/avatar.jpg",
-		GithubEmail:     "test@example.com",
+		ID:             0,
+		Provider:       "github",
+		ProviderUserID: "12345",
+		Username:       "testuser",
+		AvatarURL:      "https://github.com/avatar.jpg",
+		Email:          "test@example.com",
 	}
 	user, err := userRepo.CreateUser(user)
 	require.NoError(t, err)
@@ -339,7 +353,7 @@ func TestClientDisconnection(t *testing.T) {
 	}
 
 	tmpl := template.Must(template.New("test").Parse("test"))
-	tunnelHandler := NewTunnelHandler(tokenService, tmpl, logger, &cfg)
+	tunnelHandler := NewTunnelHandler(tokenService, nil, nil, tmpl, logger, &cfg)
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("Upgrade") == "websocket" {
 			tunnelHandler.HandleWS().ServeHTTP(w, r)
@@ -366,7 +380,7 @@ func TestClientDisconnection(t *testing.T) {
 
 	tunnelReq := proto.Message{
 		Type:    proto.MessageTypeTunnelReq,
-		Payload: proto.TunnelRequest{LocalPort: 8000},
+		Payload: testutil.Payload(t, proto.TunnelRequest{LocalPort: 8000}),
 	}
 	if err := websocket.JSON.Send(client, tunnelReq); err != nil {
 		t.Fatal(err)
@@ -396,3 +410,1990 @@ func TestClientDisconnection(t *testing.T) {
 		t.Errorf("expected 0 tunnels after disconnect, got %d", finalTunnels)
 	}
 }
+
+// setupTestTunnelServer starts a test server handling both websocket and http traffic,
+// and returns a valid auth token for it
+func setupTestTunnelServer(t *testing.T) (*TunnelHandler, *httptest.Server, string) {
+	t.Helper()
+
+	db, cleanup := testutil.SetupTestDB(t)
+	t.Cleanup(cleanup)
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	cfg := setupUnitTestEnv(t)
+	tokenService := token.NewTokenService(db)
+	userRepo := user.NewUserRepository(db)
+
+	u, err := userRepo.CreateUser(&user.User{
+		Provider:       "github",
+		ProviderUserID: "12345",
+		Username:       "testuser",
+	})
+	require.NoError(t, err)
+
+	tok, err := tokenService.CreateToken(u.ID, "Test token", 24*time.Hour)
+	require.NoError(t, err)
+
+	tmpl := template.Must(template.New("test").Parse("test"))
+	tunnelHandler := NewTunnelHandler(tokenService, nil, usage.NewUsageRepository(db), tmpl, logger, &cfg)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "websocket" {
+			tunnelHandler.HandleWS().ServeHTTP(w, r)
+		} else {
+			tunnelHandler.ServeHTTP(w, r)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	// The tunnel URLs should point at the test server
+	tsURL, _ := url.Parse(ts.URL)
+	tunnelHandler.cfg.Port = tsURL.Port()
+
+	return tunnelHandler, ts, tok.PlainToken
+}
+
+// dialTestTunnelServer opens an authenticated websocket connection to the test server
+func dialTestTunnelServer(t *testing.T, ts *httptest.Server, token string) *websocket.Conn {
+	t.Helper()
+
+	wsURL := strings.Replace(ts.URL, "http", "ws", 1)
+	wsConfig, err := websocket.NewConfig(wsURL, ts.URL)
+	require.NoError(t, err)
+	wsConfig.Header.Set("Authorization", "Bearer "+token)
+
+	ws, err := websocket.DialConfig(wsConfig)
+	require.NoError(t, err)
+	t.Cleanup(func() { ws.Close() })
+
+	return ws
+}
+
+// TestProtocolVersionNegotiation tests that clients speaking an unsupported protocol version are told
+// why they can't connect, while clients from before the protocol was versioned still can
+func TestProtocolVersionNegotiation(t *testing.T) {
+	_, ts, token := setupTestTunnelServer(t)
+
+	dial := func(protocol string) *websocket.Conn {
+		wsConfig, err := websocket.NewConfig(strings.Replace(ts.URL, "http", "ws", 1), ts.URL)
+		require.NoError(t, err)
+		wsConfig.Header.Set("Authorization", "Bearer "+token)
+		if protocol != "" {
+			wsConfig.Header.Set(proto.ProtocolHeader, protocol)
+		}
+		ws, err := websocket.DialConfig(wsConfig)
+		require.NoError(t, err)
+		t.Cleanup(func() { ws.Close() })
+		return ws
+	}
+
+	tests := []struct {
+		name     string
+		protocol string
+		wantErr  string
+	}{
+		{name: "current version", protocol: strconv.Itoa(proto.ProtocolVersion)},
+		{name: "unversioned client", protocol: ""},
+		{name: "too old", protocol: strconv.Itoa(proto.MinProtocolVersion - 1), wantErr: "too old"},
+		{name: "too new", protocol: strconv.Itoa(proto.ProtocolVersion + 1), wantErr: "newer than the server supports"},
+		{name: "invalid", protocol: "latest", wantErr: "invalid protocol version"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := dial(tt.protocol)
+			require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+				Type:    proto.MessageTypeTunnelReq,
+				Payload: testutil.Payload(t, proto.TunnelRequest{LocalPort: 3000}),
+			}))
+
+			var msg proto.Message
+			require.NoError(t, websocket.JSON.Receive(ws, &msg))
+			if tt.wantErr == "" {
+				require.Equal(t, proto.MessageTypeTunnelResp, msg.Type)
+				return
+			}
+			require.Equal(t, proto.MessageTypeError, msg.Type)
+			require.Contains(t, testutil.PayloadMap(t, msg)["error"], tt.wantErr)
+		})
+	}
+}
+
+// TestHelloHandshake tests that the server answers the clients hello with its features and limits,
+// and that the tunnel limit it reports is enforced
+func TestHelloHandshake(t *testing.T) {
+	th, ts, token := setupTestTunnelServer(t)
+	th.cfg.MaxTunnelsPerUser = 1
+	th.cfg.MaxBodyBytes = 1 << 20
+	th.cfg.TunnelIdleTimeout = 10 * time.Minute
+
+	ws := dialTestTunnelServer(t, ts, token)
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type: proto.MessageTypeHello,
+		Payload: testutil.Payload(t, proto.Hello{
+			Version:         "1.2.3",
+			ProtocolVersion: proto.ProtocolVersion,
+			OS:              "linux/amd64",
+			Capabilities:    []string{proto.FeatureTCP},
+		}),
+	}))
+
+	var msg proto.Message
+	require.NoError(t, websocket.JSON.Receive(ws, &msg))
+	require.Equal(t, proto.MessageTypeHelloAck, msg.Type)
+
+	ack, err := msg.AsHelloAck()
+	require.NoError(t, err)
+	require.Equal(t, proto.ProtocolVersion, ack.ProtocolVersion)
+	require.Contains(t, ack.Features, proto.FeatureTCP)
+	require.Equal(t, 1, ack.Limits.MaxTunnels)
+	require.Equal(t, int64(1<<20), ack.Limits.MaxBodyBytes)
+	require.Equal(t, (10 * time.Minute).Milliseconds(), ack.Limits.TunnelIdleTimeoutMs)
+
+	registerTestTunnel(t, ws, "first")
+
+	// The limit is per user, so it applies across connections
+	other := dialTestTunnelServer(t, ts, token)
+	require.NoError(t, websocket.JSON.Send(other, proto.Message{
+		Type:    proto.MessageTypeTunnelReq,
+		Payload: testutil.Payload(t, proto.TunnelRequest{LocalPort: 3001, Subdomain: "second"}),
+	}))
+	require.NoError(t, websocket.JSON.Receive(other, &msg))
+	require.Equal(t, proto.MessageTypeError, msg.Type)
+	require.Contains(t, testutil.PayloadMap(t, msg)["error"], "only have 1 tunnels open")
+	require.Equal(t, proto.ErrorCodeTunnelLimitExceeded, testutil.PayloadMap(t, msg)["code"])
+}
+
+// TestTunnelRegistrationWithSubdomain tests that a client can request a subdomain,
+// and that the same subdomain cannot be claimed twice
+func TestTunnelRegistrationWithSubdomain(t *testing.T) {
+	_, ts, token := setupTestTunnelServer(t)
+
+	register := func(ws *websocket.Conn, subdomain string) proto.Message {
+		req := proto.Message{
+			Type:    proto.MessageTypeTunnelReq,
+			Payload: testutil.Payload(t, proto.TunnelRequest{LocalPort: 8000, Subdomain: subdomain}),
+		}
+		require.NoError(t, websocket.JSON.Send(ws, req))
+
+		var resp proto.Message
+		require.NoError(t, websocket.JSON.Receive(ws, &resp))
+		return resp
+	}
+
+	first := dialTestTunnelServer(t, ts, token)
+	resp := register(first, "myapp")
+	require.Equal(t, proto.MessageTypeTunnelResp, resp.Type)
+
+	tunnelResp, err := resp.AsTunnelResponse()
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(tunnelResp.URL, "/local/myapp"), "unexpected url %s", tunnelResp.URL)
+
+	// A second client should be rejected, but the connection should stay usable
+	second := dialTestTunnelServer(t, ts, token)
+	resp = register(second, "myapp")
+	require.Equal(t, proto.MessageTypeError, resp.Type)
+	require.Contains(t, testutil.PayloadMap(t, resp)["error"], "already in use")
+	require.Equal(t, proto.ErrorCodeSubdomainTaken, testutil.PayloadMap(t, resp)["code"])
+
+	resp = register(second, "Not_Valid")
+	require.Equal(t, proto.MessageTypeError, resp.Type)
+	require.Contains(t, testutil.PayloadMap(t, resp)["error"], "invalid subdomain")
+	require.Equal(t, proto.ErrorCodeInvalidSubdomain, testutil.PayloadMap(t, resp)["code"])
+	require.NotContains(t, testutil.PayloadMap(t, resp), "retryable")
+
+	resp = register(second, "")
+	require.Equal(t, proto.MessageTypeTunnelResp, resp.Type)
+}
+
+// TestTunnelRegistrationWithReservedSubdomain tests that reserved subdomains are used by default
+// for their owner, and can't be claimed by other users
+func TestTunnelRegistrationWithReservedSubdomain(t *testing.T) {
+	db, cleanup := testutil.SetupTestDB(t)
+	defer cleanup()
+
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	cfg := setupUnitTestEnv(t)
+	tokenService := token.NewTokenService(db)
+	userRepo := user.NewUserRepository(db)
+	subdomainRepo := subdomain.NewSubdomainRepository(db)
+
+	owner, err := userRepo.CreateUser(&user.User{Provider: "github", ProviderUserID: "1", Username: "owner"})
+	require.NoError(t, err)
+	other, err := userRepo.CreateUser(&user.User{Provider: "github", ProviderUserID: "2", Username: "other"})
+	require.NoError(t, err)
+
+	_, err = subdomainRepo.Reserve(owner.ID, "myapp")
+	require.NoError(t, err)
+
+	ownerToken, err := tokenService.CreateToken(owner.ID, "Owner token", 24*time.Hour)
+	require.NoError(t, err)
+	otherToken, err := tokenService.CreateToken(other.ID, "Other token", 24*time.Hour)
+	require.NoError(t, err)
+
+	tmpl := template.Must(template.New("test").Parse("test"))
+	tunnelHandler := NewTunnelHandler(tokenService, subdomainRepo, nil, tmpl, logger, &cfg)
+	ts := httptest.NewServer(tunnelHandler.HandleWS())
+	defer ts.Close()
+
+	register := func(ws *websocket.Conn, subdomain string) proto.Message {
+		req := proto.Message{
+			Type:    proto.MessageTypeTunnelReq,
+			Payload: testutil.Payload(t, proto.TunnelRequest{LocalPort: 8000, Subdomain: subdomain}),
+		}
+		require.NoError(t, websocket.JSON.Send(ws, req))
+
+		var resp proto.Message
+		require.NoError(t, websocket.JSON.Receive(ws, &resp))
+		return resp
+	}
+
+	// Other users can't use the reserved subdomain
+	otherWS := dialTestTunnelServer(t, ts, otherToken.PlainToken)
+	resp := register(otherWS, "myapp")
+	require.Equal(t, proto.MessageTypeError, resp.Type)
+	require.Contains(t, testutil.PayloadMap(t, resp)["error"], "reserved by another user")
+
+	// The owner gets their reservation even without asking for it
+	ownerWS := dialTestTunnelServer(t, ts, ownerToken.PlainToken)
+	resp = register(ownerWS, "")
+	require.Equal(t, proto.MessageTypeTunnelResp, resp.Type)
+	require.True(t, strings.HasSuffix(testutil.PayloadMap(t, resp)["url"].(string), "/local/myapp"))
+
+	// Once their reservation is in use, further tunnels fall back to a random id
+	resp = register(ownerWS, "")
+	require.Equal(t, proto.MessageTypeTunnelResp, resp.Type)
+	require.False(t, strings.HasSuffix(testutil.PayloadMap(t, resp)["url"].(string), "/local/myapp"))
+}
+
+// TestTunnelRegistrationInvalidRequest tests that a tunnel request that can't be decoded is rejected,
+// rather than registering a default tunnel
+func TestTunnelRegistrationInvalidRequest(t *testing.T) {
+	th, ts, token := setupTestTunnelServer(t)
+	ws := dialTestTunnelServer(t, ts, token)
+
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type:    proto.MessageTypeTunnelReq,
+		Payload: json.RawMessage(`{"local_port":"not a port"}`),
+	}))
+	var resp proto.Message
+	require.NoError(t, websocket.JSON.Receive(ws, &resp))
+	require.Equal(t, proto.MessageTypeError, resp.Type)
+	require.Contains(t, testutil.PayloadMap(t, resp)["error"], "invalid tunnel request")
+	require.Equal(t, proto.ErrorCodeInvalidRequest, testutil.PayloadMap(t, resp)["code"])
+
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	require.Empty(t, th.tunnels)
+}
+
+func TestTCPTunnelRegistration(t *testing.T) {
+	th, ts, token := setupTestTunnelServer(t)
+	ws := dialTestTunnelServer(t, ts, token)
+
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type:    proto.MessageTypeTunnelReq,
+		Payload: testutil.Payload(t, proto.TunnelRequest{LocalPort: 5432, Protocol: proto.ProtocolTCP}),
+	}))
+
+	var resp proto.Message
+	require.NoError(t, websocket.JSON.Receive(ws, &resp))
+	require.Equal(t, proto.MessageTypeTunnelResp, resp.Type)
+
+	tunnelResp, err := resp.AsTunnelResponse()
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(tunnelResp.URL, "tcp://localhost:"), "unexpected url %s", tunnelResp.URL)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(tunnelResp.URL, "tcp://"))
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	receiveTCPData := func() proto.TCPData {
+		var msg proto.Message
+		require.NoError(t, websocket.JSON.Receive(ws, &msg))
+		require.Equal(t, proto.MessageTypeTCPData, msg.Type)
+
+		data, err := msg.AsTCPData()
+		require.NoError(t, err)
+		return data
+	}
+
+	// The server should announce the connection before any bytes are sent
+	open := receiveTCPData()
+	require.NotEmpty(t, open.ConnID)
+	require.Empty(t, open.Data)
+
+	_, err = conn.Write([]byte("from public"))
+	require.NoError(t, err)
+	data := receiveTCPData()
+	require.Equal(t, open.ConnID, data.ConnID)
+	require.Equal(t, "from public", string(data.Data))
+
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type:    proto.MessageTypeTCPData,
+		Payload: testutil.Payload(t, proto.TCPData{ConnID: open.ConnID, Data: []byte("from local")}),
+	}))
+	buf := make([]byte, 32)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "from local", string(buf[:n]))
+
+	// Closing from the client side should close the public connection
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type:    proto.MessageTypeTCPClose,
+		Payload: testutil.Payload(t, proto.TCPClose{ConnID: open.ConnID}),
+	}))
+	_, err = conn.Read(buf)
+	require.ErrorIs(t, err, io.EOF)
+
+	// HTTP requests to a tcp tunnel should be rejected
+	var id string
+	th.mu.Lock()
+	for tunnelID := range th.tunnels {
+		id = tunnelID
+	}
+	th.mu.Unlock()
+	httpResp, err := http.Get(ts.URL + "/local/" + id + "/")
+	require.NoError(t, err)
+	httpResp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, httpResp.StatusCode)
+}
+
+func TestTCPTunnelSlowConnection(t *testing.T) {
+	_, ts, token := setupTestTunnelServer(t)
+	ws := dialTestTunnelServer(t, ts, token)
+
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type:    proto.MessageTypeTunnelReq,
+		Payload: testutil.Payload(t, proto.TunnelRequest{LocalPort: 5432, Protocol: proto.ProtocolTCP}),
+	}))
+	var resp proto.Message
+	require.NoError(t, websocket.JSON.Receive(ws, &resp))
+	tunnelResp, err := resp.AsTunnelResponse()
+	require.NoError(t, err)
+	addr := strings.TrimPrefix(tunnelResp.URL, "tcp://")
+
+	frames := make(chan proto.Message, 16)
+	go func() {
+		for {
+			var msg proto.Message
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				close(frames)
+				return
+			}
+			frames <- msg
+		}
+	}()
+	openConn := func() (net.Conn, string) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		for msg := range frames {
+			if msg.Type == proto.MessageTypeTCPData { // Skipping the close of the slow connection
+				open, err := msg.AsTCPData()
+				require.NoError(t, err)
+				return conn, open.ConnID
+			}
+		}
+		t.Fatal("websocket closed before the connection opened")
+		return nil, ""
+	}
+
+	// A public connection that never reads, and more data for it than the socket buffers hold
+	_, slowID := openConn()
+	chunk := make([]byte, tcpReadBufferSize)
+	for i := 0; i < 400; i++ {
+		require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+			Type:    proto.MessageTypeTCPData,
+			Payload: testutil.Payload(t, proto.TCPData{ConnID: slowID, Data: chunk}),
+		}))
+	}
+
+	// Other connections on the websocket are still written to
+	fast, fastID := openConn()
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type:    proto.MessageTypeTCPData,
+		Payload: testutil.Payload(t, proto.TCPData{ConnID: fastID, Data: []byte("not held up")}),
+	}))
+	fast.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 32)
+	n, err := fast.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "not held up", string(buf[:n]))
+}
+
+// TestTCPTunnelCloseOwnConnections tests that closing a tcp tunnel only closes its own connections, not
+// those of a tunnel whose id starts with its id and a hyphen
+func TestTCPTunnelCloseOwnConnections(t *testing.T) {
+	th, _, _ := setupTestTunnelServer(t)
+
+	newTunnel := func(id string) (*Tunnel, net.Conn) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { ln.Close() })
+
+		public, local := net.Pipe()
+		t.Cleanup(func() { local.Close() })
+		tunnel := &Tunnel{ID: id, Listener: ln}
+		th.tcpConns[id+"-"+generateID()] = &tcpConn{conn: public, tunnel: tunnel, writes: utils.NewWriteQueue(tcpWriteQueueSize, tcpWriteTimeout)}
+		return tunnel, public
+	}
+
+	th.mu.Lock()
+	app, _ := newTunnel("app")
+	_, other := newTunnel("app-x")
+	th.closeTCPTunnelLocked(app)
+	th.mu.Unlock()
+
+	require.Len(t, th.tcpConns, 1)
+	for _, tc := range th.tcpConns {
+		require.Equal(t, "app-x", tc.tunnel.ID)
+	}
+	// Nothing reads the pipe, so an open connection times out writing while a closed one fails straight away
+	other.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := other.Write([]byte("x"))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded, "Expected the other tunnels connection to stay open")
+}
+
+// TestPassthroughCloseOwnConnections tests that closing a tunnel only closes its own websocket passthrough
+// connections, not those of a tunnel whose id starts with its id and a hyphen
+func TestPassthroughCloseOwnConnections(t *testing.T) {
+	th, _, _ := setupTestTunnelServer(t)
+
+	public := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(io.Discard, ws)
+	}))
+	defer public.Close()
+
+	newConn := func(tunnel *Tunnel) *websocket.Conn {
+		conn, err := websocket.Dial("ws"+strings.TrimPrefix(public.URL, "http"), "", public.URL)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		th.wsPassthrough[tunnel.ID+"-"+generateID()] = newPublicWSConn(conn, tunnel)
+		return conn
+	}
+
+	app, other := &Tunnel{ID: "app"}, &Tunnel{ID: "app-x"}
+	th.mu.Lock()
+	closed := newConn(app)
+	open := newConn(other)
+	th.closePassthroughConnsLocked(app)
+	th.mu.Unlock()
+
+	require.Len(t, th.wsPassthrough, 1)
+	for _, pc := range th.wsPassthrough {
+		require.Same(t, other, pc.tunnel)
+	}
+	_, err := closed.Write([]byte("x"))
+	require.Error(t, err)
+	_, err = open.Write([]byte("x"))
+	require.NoError(t, err, "Expected the other tunnels connection to stay open")
+}
+
+// TestPassthroughSlowConnection tests that a public websocket connection that doesn't read doesn't hold up
+// the websocket read loop, so other connections of the client are still written to
+func TestPassthroughSlowConnection(t *testing.T) {
+	th, ts, token := setupTestTunnelServer(t)
+	ws := dialTestTunnelServer(t, ts, token)
+	public := httptest.NewServer(th)
+	defer public.Close()
+
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type:    proto.MessageTypeTunnelReq,
+		Payload: testutil.Payload(t, proto.TunnelRequest{LocalPort: 3000, Subdomain: "slowws"}),
+	}))
+	var resp proto.Message
+	require.NoError(t, websocket.JSON.Receive(ws, &resp))
+	require.Equal(t, proto.MessageTypeTunnelResp, resp.Type)
+
+	frames := make(chan proto.Message, 16)
+	go func() {
+		for {
+			var msg proto.Message
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				close(frames)
+				return
+			}
+			frames <- msg
+		}
+	}()
+	openConn := func() (*websocket.Conn, string) {
+		conn, err := websocket.Dial("ws"+strings.TrimPrefix(public.URL, "http")+"/local/slowws/", "", public.URL)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		for msg := range frames {
+			if msg.Type == proto.MessageTypeWSOpen { // Skipping the close of the slow connection
+				open, err := msg.AsWSOpen()
+				require.NoError(t, err)
+				return conn, open.ConnID
+			}
+		}
+		t.Fatal("websocket closed before the connection opened")
+		return nil, ""
+	}
+
+	// A visitor that never reads, and more frames for it than the socket buffers hold
+	_, slowID := openConn()
+	chunk := make([]byte, tcpReadBufferSize)
+	for i := 0; i < 400; i++ {
+		require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+			Type:    proto.MessageTypeWSFrame,
+			Payload: testutil.Payload(t, proto.WSFrame{ConnID: slowID, Binary: true, Data: chunk}),
+		}))
+	}
+
+	// Other visitors on the websocket are still written to
+	fast, fastID := openConn()
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type:    proto.MessageTypeWSFrame,
+		Payload: testutil.Payload(t, proto.WSFrame{ConnID: fastID, Data: []byte("not held up")}),
+	}))
+	fast.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg string
+	require.NoError(t, websocket.Message.Receive(fast, &msg))
+	require.Equal(t, "not held up", msg)
+}
+
+func TestTCPTunnelBindAddr(t *testing.T) {
+	th, ts, token := setupTestTunnelServer(t)
+	th.cfg.BindAddr = "127.0.0.1"
+	ws := dialTestTunnelServer(t, ts, token)
+
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type:    proto.MessageTypeTunnelReq,
+		Payload: testutil.Payload(t, proto.TunnelRequest{LocalPort: 5432, Protocol: proto.ProtocolTCP}),
+	}))
+	var resp proto.Message
+	require.NoError(t, websocket.JSON.Receive(ws, &resp))
+	require.Equal(t, proto.MessageTypeTunnelResp, resp.Type)
+
+	// The tunnel port must only listen on the bind address, not on every interface
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	require.Len(t, th.tunnels, 1)
+	for _, tunnel := range th.tunnels {
+		addr := tunnel.Listener.Addr().(*net.TCPAddr)
+		require.Equal(t, "127.0.0.1", addr.IP.String())
+	}
+}
+
+func TestListInstanceTunnels(t *testing.T) {
+	th, ts, token := setupTestTunnelServer(t)
+
+	tok, err := th.tokenService.FindByPlainToken(token)
+	require.NoError(t, err)
+
+	ws := dialTestTunnelServer(t, ts, token)
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type:    proto.MessageTypeTunnelReq,
+		Payload: testutil.Payload(t, proto.TunnelRequest{LocalPort: 3000, Subdomain: "listed"}),
+	}))
+	var resp proto.Message
+	require.NoError(t, websocket.JSON.Receive(ws, &resp))
+	require.Equal(t, proto.MessageTypeTunnelResp, resp.Type)
+
+	// Another users tunnel should not be listed
+	th.mu.Lock()
+	th.tunnels["someone-else"] = &Tunnel{ID: "someone-else", UserID: tok.UserId + 1}
+	th.mu.Unlock()
+
+	list := func(userID int64) []TunnelSummary {
+		req := httptest.NewRequest(http.MethodGet, "/api/instance/tunnels", nil)
+		req = req.WithContext(context.WithValue(req.Context(), "user", &user.User{ID: userID}))
+		rec := httptest.NewRecorder()
+		th.HandleListInstanceTunnels(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var tunnels []TunnelSummary
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&tunnels))
+		return tunnels
+	}
+
+	tunnels := list(tok.UserId)
+	require.Len(t, tunnels, 1)
+	require.Equal(t, "listed", tunnels[0].ID)
+	require.Equal(t, 3000, tunnels[0].LocalPort)
+	require.Equal(t, proto.ProtocolHTTP, tunnels[0].Protocol)
+	require.False(t, tunnels[0].Created.IsZero())
+
+	require.Empty(t, list(tok.UserId+2))
+}
+
+func TestTunnelUsageRecorded(t *testing.T) {
+	th, ts, token := setupTestTunnelServer(t)
+
+	tok, err := th.tokenService.FindByPlainToken(token)
+	require.NoError(t, err)
+
+	ws := dialTestTunnelServer(t, ts, token)
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type:    proto.MessageTypeTunnelReq,
+		Payload: testutil.Payload(t, proto.TunnelRequest{LocalPort: 3000, Subdomain: "metered"}),
+	}))
+	var resp proto.Message
+	require.NoError(t, websocket.JSON.Receive(ws, &resp))
+	tunnelResp, err := resp.AsTunnelResponse()
+	require.NoError(t, err)
+
+	// Respond to each request, failing the second one
+	go func() {
+		status := 200
+		for {
+			var msg proto.Message
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			if msg.Type != proto.MessageTypeHTTPRequest {
+				continue
+			}
+
+			var req proto.HTTPRequest
+			b, _ := json.Marshal(msg.Payload)
+			json.Unmarshal(b, &req)
+
+			websocket.JSON.Send(ws, proto.Message{
+				Type:    proto.MessageTypeHTTPResponse,
+				Payload: testutil.Payload(t, proto.HTTPResponse{StatusCode: status, Body: []byte("12345"), RequestId: req.RequestId}),
+			})
+			status = 500
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		res, err := http.Post(tunnelResp.URL+"/", "text/plain", strings.NewReader("abc"))
+		require.NoError(t, err)
+		res.Body.Close()
+	}
+
+	summaries, err := th.usage.ListByTunnel(tok.UserId, time.Now().AddDate(0, 0, -1))
+	require.NoError(t, err)
+	require.Equal(t, []usage.Summary{{Key: "metered", Requests: 2, Errors: 1, BytesIn: 6, BytesOut: 10}}, summaries)
+}
+
+func TestTunnelMetrics(t *testing.T) {
+	th, ts, token := setupTestTunnelServer(t)
+	th.templates = template.Must(template.New("tunnel-not-found").Parse("not found"))
+
+	// Tunnels from earlier tests are cleaned up asynchronously as their clients disconnect
+	require.Eventually(t, func() bool {
+		return promtestutil.ToFloat64(activeTunnels) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	notFoundBefore := promtestutil.ToFloat64(tunnelNotFound)
+	tunnelsBefore := promtestutil.ToFloat64(activeTunnels)
+
+	res, err := http.Get(ts.URL + "/local/does-not-exist/")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, notFoundBefore+1, promtestutil.ToFloat64(tunnelNotFound))
+
+	ws := dialTestTunnelServer(t, ts, token)
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type:    proto.MessageTypeTunnelReq,
+		Payload: testutil.Payload(t, proto.TunnelRequest{LocalPort: 3000}),
+	}))
+	var resp proto.Message
+	require.NoError(t, websocket.JSON.Receive(ws, &resp))
+	require.Equal(t, tunnelsBefore+1, promtestutil.ToFloat64(activeTunnels))
+
+	// The gauge should drop again once the client disconnects
+	ws.Close()
+	require.Eventually(t, func() bool {
+		return promtestutil.ToFloat64(activeTunnels) == tunnelsBefore
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// registerTestTunnel registers a tunnel on the connection, returning its public URL
+func registerTestTunnel(t *testing.T, ws *websocket.Conn, subdomain string) string {
+	t.Helper()
+
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type:    proto.MessageTypeTunnelReq,
+		Payload: testutil.Payload(t, proto.TunnelRequest{LocalPort: 3000, Subdomain: subdomain}),
+	}))
+	var resp proto.Message
+	require.NoError(t, websocket.JSON.Receive(ws, &resp))
+	require.Equal(t, proto.MessageTypeTunnelResp, resp.Type)
+
+	tunnelResp, err := resp.AsTunnelResponse()
+	require.NoError(t, err)
+	return tunnelResp.URL
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	th, ts, token := setupTestTunnelServer(t)
+
+	ws := dialTestTunnelServer(t, ts, token)
+	tunnelURL := registerTestTunnel(t, ws, "draining")
+
+	statusChan := make(chan int, 1)
+	go func() {
+		res, err := http.Get(tunnelURL + "/")
+		if err != nil {
+			statusChan <- 0
+			return
+		}
+		res.Body.Close()
+		statusChan <- res.StatusCode
+	}()
+
+	var msg proto.Message
+	require.NoError(t, websocket.JSON.Receive(ws, &msg))
+	require.Equal(t, proto.MessageTypeHTTPRequest, msg.Type)
+	req, err := msg.AsHTTPRequest()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- th.Shutdown(ctx)
+	}()
+
+	// The client is told about the shutdown
+	require.NoError(t, websocket.JSON.Receive(ws, &msg))
+	require.Equal(t, proto.MessageTypeServerShutdown, msg.Type)
+
+	// New tunnels are rejected while draining
+	ws2 := dialTestTunnelServer(t, ts, token)
+	require.NoError(t, websocket.JSON.Send(ws2, proto.Message{
+		Type:    proto.MessageTypeTunnelReq,
+		Payload: testutil.Payload(t, proto.TunnelRequest{LocalPort: 3001}),
+	}))
+	require.NoError(t, websocket.JSON.Receive(ws2, &msg))
+	require.Equal(t, proto.MessageTypeError, msg.Type)
+	require.Equal(t, "server is shutting down", testutil.PayloadMap(t, msg)["error"])
+	require.Equal(t, proto.ErrorCodeShuttingDown, testutil.PayloadMap(t, msg)["code"])
+	require.Equal(t, true, testutil.PayloadMap(t, msg)["retryable"])
+
+	// Shutdown waits for the pending request
+	select {
+	case <-shutdownErr:
+		t.Fatal("shutdown returned with a request still pending")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type:    proto.MessageTypeHTTPResponse,
+		Payload: testutil.Payload(t, proto.HTTPResponse{StatusCode: http.StatusOK, Body: []byte("done"), RequestId: req.RequestId}),
+	}))
+	require.Equal(t, http.StatusOK, <-statusChan)
+	require.NoError(t, <-shutdownErr)
+
+	// The client connection is closed once drained
+	require.Error(t, websocket.JSON.Receive(ws, &msg))
+
+	th.mu.Lock()
+	require.Empty(t, th.tunnels)
+	th.mu.Unlock()
+}
+
+func TestGracefulShutdownDeadline(t *testing.T) {
+	th, ts, token := setupTestTunnelServer(t)
+
+	ws := dialTestTunnelServer(t, ts, token)
+	tunnelURL := registerTestTunnel(t, ws, "stuck")
+
+	// The client never responds to requests
+	go func() {
+		for {
+			var msg proto.Message
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	statusChan := make(chan int, 1)
+	go func() {
+		res, err := http.Get(tunnelURL + "/")
+		if err != nil {
+			statusChan <- 0
+			return
+		}
+		res.Body.Close()
+		statusChan <- res.StatusCode
+	}()
+
+	require.Eventually(t, func() bool {
+		th.mu.Lock()
+		defer th.mu.Unlock()
+		return len(th.pendingRequests) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, th.Shutdown(ctx), context.DeadlineExceeded)
+
+	// The stuck request is failed rather than left to time out
+	require.Equal(t, http.StatusServiceUnavailable, <-statusChan)
+}
+
+func TestDeadTunnelCleanup(t *testing.T) {
+	th, ts, token := setupTestTunnelServer(t)
+
+	staleWS := dialTestTunnelServer(t, ts, token)
+	registerTestTunnel(t, staleWS, "stale")
+	aliveWS := dialTestTunnelServer(t, ts, token)
+	registerTestTunnel(t, aliveWS, "alive")
+
+	th.mu.Lock()
+	th.tunnels["stale"].LastActivity = time.Now().Add(-time.Hour)
+	th.tunnels["alive"].LastActivity = time.Now().Add(-time.Hour)
+	th.mu.Unlock()
+
+	// A ping from the client counts as activity
+	require.NoError(t, websocket.JSON.Send(aliveWS, proto.Message{Type: proto.MessageTypePing}))
+	var msg proto.Message
+	require.NoError(t, websocket.JSON.Receive(aliveWS, &msg))
+	require.Equal(t, proto.MessageTypePong, msg.Type)
+
+	th.cleanupDeadConnections()
+
+	th.mu.Lock()
+	_, staleExists := th.tunnels["stale"]
+	_, aliveExists := th.tunnels["alive"]
+	th.mu.Unlock()
+	require.False(t, staleExists)
+	require.True(t, aliveExists)
+
+	// The stale client is disconnected
+	require.Error(t, websocket.JSON.Receive(staleWS, &msg))
+}
+
+func TestPendingRequestsFailedOnDisconnect(t *testing.T) {
+	th, ts, token := setupTestTunnelServer(t)
+
+	// sendRequest starts a request the client never answers
+	sendRequest := func(tunnelURL string) chan int {
+		statusChan := make(chan int, 1)
+		go func() {
+			res, err := http.Get(tunnelURL + "/")
+			if err != nil {
+				statusChan <- 0
+				return
+			}
+			res.Body.Close()
+			statusChan <- res.StatusCode
+		}()
+		return statusChan
+	}
+	pendingFor := func(id string) int {
+		th.mu.Lock()
+		defer th.mu.Unlock()
+		n := 0
+		for _, pending := range th.pendingRequests {
+			if pending.tunnelID == id {
+				n++
+			}
+		}
+		return n
+	}
+
+	goneWS := dialTestTunnelServer(t, ts, token)
+	goneURL := registerTestTunnel(t, goneWS, "gone")
+	staleWS := dialTestTunnelServer(t, ts, token)
+	staleURL := registerTestTunnel(t, staleWS, "stale")
+	aliveWS := dialTestTunnelServer(t, ts, token)
+	aliveURL := registerTestTunnel(t, aliveWS, "alive")
+
+	goneStatus := sendRequest(goneURL)
+	staleStatus := sendRequest(staleURL)
+	aliveStatus := sendRequest(aliveURL)
+	require.Eventually(t, func() bool {
+		return pendingFor("gone") == 1 && pendingFor("stale") == 1 && pendingFor("alive") == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// A client disconnecting fails its requests straight away, rather than after the request timeout
+	goneWS.Close()
+	select {
+	case status := <-goneStatus:
+		require.Equal(t, http.StatusBadGateway, status)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not failed when the client disconnected")
+	}
+
+	// As does the client being found dead
+	th.mu.Lock()
+	th.tunnels["stale"].LastActivity = time.Now().Add(-time.Hour)
+	th.mu.Unlock()
+	th.cleanupDeadConnections()
+	select {
+	case status := <-staleStatus:
+		require.Equal(t, http.StatusBadGateway, status)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not failed when the tunnel was found dead")
+	}
+
+	// Requests for other tunnels keep waiting on their client
+	require.Zero(t, pendingFor("gone"))
+	require.Zero(t, pendingFor("stale"))
+	require.Equal(t, 1, pendingFor("alive"))
+
+	var msg proto.Message
+	require.NoError(t, websocket.JSON.Receive(aliveWS, &msg))
+	require.Equal(t, proto.MessageTypeHTTPRequest, msg.Type)
+	req, err := msg.AsHTTPRequest()
+	require.NoError(t, err)
+	require.NoError(t, websocket.JSON.Send(aliveWS, proto.Message{
+		Type:    proto.MessageTypeHTTPResponse,
+		Payload: testutil.Payload(t, proto.HTTPResponse{StatusCode: http.StatusOK, RequestId: req.RequestId}),
+	}))
+	require.Equal(t, http.StatusOK, <-aliveStatus)
+}
+
+func TestDisconnectDuringInFlightRequests(t *testing.T) {
+	th, ts, token := setupTestTunnelServer(t)
+
+	ws := dialTestTunnelServer(t, ts, token)
+	tunnelURL := registerTestTunnel(t, ws, "flaky")
+
+	const requests = 20
+	statuses := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			res, err := http.Get(tunnelURL + "/")
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			res.Body.Close()
+			statuses <- res.StatusCode
+		}()
+	}
+
+	var reqIDs []string
+	for len(reqIDs) < requests {
+		var msg proto.Message
+		require.NoError(t, websocket.JSON.Receive(ws, &msg))
+		if msg.Type != proto.MessageTypeHTTPRequest {
+			continue
+		}
+		req, err := msg.AsHTTPRequest()
+		require.NoError(t, err)
+		reqIDs = append(reqIDs, req.RequestId)
+	}
+
+	// Half the responses race the client disconnecting
+	go func() {
+		for _, id := range reqIDs[:requests/2] {
+			websocket.JSON.Send(ws, proto.Message{
+				Type:    proto.MessageTypeHTTPResponse,
+				Payload: testutil.Payload(t, proto.HTTPResponse{StatusCode: http.StatusOK, RequestId: id}),
+			})
+		}
+	}()
+	ws.Close()
+
+	// Every request is answered well before the request timeout, either by the client or the disconnect
+	deadline := time.After(5 * time.Second)
+	for i := 0; i < requests; i++ {
+		select {
+		case status := <-statuses:
+			require.Contains(t, []int{http.StatusOK, http.StatusBadGateway}, status)
+		case <-deadline:
+			t.Fatalf("only %d of %d requests finished after the client disconnected", i, requests)
+		}
+	}
+
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	require.Empty(t, th.pendingRequests)
+	require.Empty(t, th.tunnels)
+}
+
+func TestIdleTunnelClosed(t *testing.T) {
+	th, ts, token := setupTestTunnelServer(t)
+	th.cfg.TunnelIdleTimeout = time.Minute
+
+	idleWS := dialTestTunnelServer(t, ts, token)
+	registerTestTunnel(t, idleWS, "idle")
+	usedWS := dialTestTunnelServer(t, ts, token)
+	registerTestTunnel(t, usedWS, "used")
+
+	th.mu.Lock()
+	th.tunnels["idle"].LastRequest = time.Now().Add(-time.Hour)
+	th.tunnels["used"].LastRequest = time.Now().Add(-time.Second)
+	th.mu.Unlock()
+
+	// Heartbeats keep the connection alive, but don't count as using the tunnel
+	require.NoError(t, websocket.JSON.Send(idleWS, proto.Message{Type: proto.MessageTypePing}))
+	var msg proto.Message
+	require.NoError(t, websocket.JSON.Receive(idleWS, &msg))
+	require.Equal(t, proto.MessageTypePong, msg.Type)
+
+	th.closeExpiredTunnels()
+
+	th.mu.Lock()
+	_, idleExists := th.tunnels["idle"]
+	_, usedExists := th.tunnels["used"]
+	th.mu.Unlock()
+	require.False(t, idleExists)
+	require.True(t, usedExists)
+
+	// The client is told why before being disconnected
+	require.NoError(t, websocket.JSON.Receive(idleWS, &msg))
+	require.Equal(t, proto.MessageTypeTunnelClosed, msg.Type)
+	require.Equal(t, proto.TunnelClosedIdle, testutil.PayloadMap(t, msg)["reason"])
+	require.Error(t, websocket.JSON.Receive(idleWS, &msg))
+}
+
+// TestMultiplexedTunnels tests that one connection can carry several tunnels, with messages for each
+// tagged with its id, and that closing one leaves the others open
+func TestMultiplexedTunnels(t *testing.T) {
+	th, ts, token := setupTestTunnelServer(t)
+
+	ws := dialTestTunnelServer(t, ts, token)
+	firstURL := registerTestTunnel(t, ws, "first")
+	secondURL := registerTestTunnel(t, ws, "second")
+
+	// Requests are tagged with the tunnel they're for
+	statusChan := make(chan int, 1)
+	go func() {
+		res, err := http.Get(secondURL + "/")
+		if err != nil {
+			statusChan <- 0
+			return
+		}
+		res.Body.Close()
+		statusChan <- res.StatusCode
+	}()
+
+	var msg proto.Message
+	require.NoError(t, websocket.JSON.Receive(ws, &msg))
+	require.Equal(t, proto.MessageTypeHTTPRequest, msg.Type)
+	require.Equal(t, "second", msg.TunnelID)
+
+	req, err := msg.AsHTTPRequest()
+	require.NoError(t, err)
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type:     proto.MessageTypeHTTPResponse,
+		Payload:  testutil.Payload(t, proto.HTTPResponse{StatusCode: http.StatusOK, RequestId: req.RequestId}),
+		TunnelID: "second",
+	}))
+	require.Equal(t, http.StatusOK, <-statusChan)
+
+	// Closing a tunnel leaves the connection open for the other
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{Type: proto.MessageTypeTunnelClose, TunnelID: "first"}))
+	require.Eventually(t, func() bool {
+		th.mu.Lock()
+		defer th.mu.Unlock()
+		_, exists := th.tunnels["first"]
+		return !exists
+	}, time.Second, 10*time.Millisecond)
+
+	res, err := http.Get(firstURL + "/")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{Type: proto.MessageTypePing}))
+	require.NoError(t, websocket.JSON.Receive(ws, &msg))
+	require.Equal(t, proto.MessageTypePong, msg.Type)
+
+	th.mu.Lock()
+	_, secondExists := th.tunnels["second"]
+	th.mu.Unlock()
+	require.True(t, secondExists)
+}
+
+func TestExpiredTunnelClosed(t *testing.T) {
+	th, ts, token := setupTestTunnelServer(t)
+	th.cfg.TunnelMaxLifetime = 2 * time.Hour
+
+	// The client is told when the tunnel expires
+	ws := dialTestTunnelServer(t, ts, token)
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type:    proto.MessageTypeTunnelReq,
+		Payload: testutil.Payload(t, proto.TunnelRequest{LocalPort: 3000, Subdomain: "expiring"}),
+	}))
+	var msg proto.Message
+	require.NoError(t, websocket.JSON.Receive(ws, &msg))
+	tunnelResp, err := msg.AsTunnelResponse()
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(2*time.Hour), tunnelResp.ExpiresAt, time.Minute)
+
+	freshWS := dialTestTunnelServer(t, ts, token)
+	registerTestTunnel(t, freshWS, "fresh")
+
+	// Use doesn't extend the lifetime
+	th.mu.Lock()
+	th.tunnels["expiring"].Created = time.Now().Add(-3 * time.Hour)
+	th.tunnels["expiring"].LastRequest = time.Now()
+	th.mu.Unlock()
+
+	th.closeExpiredTunnels()
+
+	th.mu.Lock()
+	_, expiredExists := th.tunnels["expiring"]
+	_, freshExists := th.tunnels["fresh"]
+	th.mu.Unlock()
+	require.False(t, expiredExists)
+	require.True(t, freshExists)
+
+	require.NoError(t, websocket.JSON.Receive(ws, &msg))
+	require.Equal(t, proto.MessageTypeTunnelClosed, msg.Type)
+	require.Equal(t, proto.TunnelClosedExpired, testutil.PayloadMap(t, msg)["reason"])
+}
+
+func TestConcurrentTunnelRegistrationUniqueIDs(t *testing.T) {
+	th, ts, token := setupTestTunnelServer(t)
+
+	const clients = 20
+	urls := make(chan string, clients)
+	for i := 0; i < clients; i++ {
+		ws := dialTestTunnelServer(t, ts, token)
+		go func() {
+			var resp proto.Message
+			if err := websocket.JSON.Send(ws, proto.Message{
+				Type:    proto.MessageTypeTunnelReq,
+				Payload: testutil.Payload(t, proto.TunnelRequest{LocalPort: 3000}),
+			}); err != nil {
+				urls <- ""
+				return
+			}
+			if err := websocket.JSON.Receive(ws, &resp); err != nil {
+				urls <- ""
+				return
+			}
+			var tunnelResp proto.TunnelResponse
+			b, _ := json.Marshal(resp.Payload)
+			json.Unmarshal(b, &tunnelResp)
+			urls <- tunnelResp.URL
+		}()
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < clients; i++ {
+		u := <-urls
+		require.NotEmpty(t, u)
+		require.False(t, seen[u], "duplicate tunnel url %s", u)
+		seen[u] = true
+	}
+
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	require.Len(t, th.tunnels, clients)
+}
+
+func TestTunnelBasicAuth(t *testing.T) {
+	_, ts, token := setupTestTunnelServer(t)
+
+	ws := dialTestTunnelServer(t, ts, token)
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type: proto.MessageTypeTunnelReq,
+		Payload: testutil.Payload(t, proto.TunnelRequest{
+			LocalPort:         3000,
+			Subdomain:         "private",
+			BasicAuthUser:     "admin",
+			BasicAuthPassHash: utils.HashToken("secret"),
+		}),
+	}))
+	var resp proto.Message
+	require.NoError(t, websocket.JSON.Receive(ws, &resp))
+	tunnelResp, err := resp.AsTunnelResponse()
+	require.NoError(t, err)
+
+	// Echo whether the credentials were forwarded to the local server
+	go func() {
+		for {
+			var msg proto.Message
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			var req proto.HTTPRequest
+			b, _ := json.Marshal(msg.Payload)
+			json.Unmarshal(b, &req)
+
+			websocket.JSON.Send(ws, proto.Message{
+				Type:    proto.MessageTypeHTTPResponse,
+				Payload: testutil.Payload(t, proto.HTTPResponse{StatusCode: 200, Body: []byte(req.Headers["Authorization"]), RequestId: req.RequestId}),
+			})
+		}
+	}()
+
+	tests := []struct {
+		name       string
+		user, pass string
+		wantStatus int
+	}{
+		{name: "no credentials", wantStatus: http.StatusUnauthorized},
+		{name: "wrong password", user: "admin", pass: "wrong", wantStatus: http.StatusUnauthorized},
+		{name: "wrong user", user: "someone", pass: "secret", wantStatus: http.StatusUnauthorized},
+		{name: "correct credentials", user: "admin", pass: "secret", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, tunnelResp.URL+"/", nil)
+			require.NoError(t, err)
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.pass)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer res.Body.Close()
+			body, _ := io.ReadAll(res.Body)
+
+			require.Equal(t, tt.wantStatus, res.StatusCode)
+			if tt.wantStatus == http.StatusUnauthorized {
+				require.Contains(t, res.Header.Get("WWW-Authenticate"), "Basic")
+			} else {
+				require.Empty(t, string(body), "credentials should not be forwarded")
+			}
+		})
+	}
+}
+
+func TestTunnelBasicAuthRequiresHTTP(t *testing.T) {
+	_, ts, token := setupTestTunnelServer(t)
+
+	ws := dialTestTunnelServer(t, ts, token)
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type: proto.MessageTypeTunnelReq,
+		Payload: testutil.Payload(t, proto.TunnelRequest{
+			LocalPort:         5432,
+			Protocol:          proto.ProtocolTCP,
+			BasicAuthUser:     "admin",
+			BasicAuthPassHash: utils.HashToken("secret"),
+		}),
+	}))
+	var resp proto.Message
+	require.NoError(t, websocket.JSON.Receive(ws, &resp))
+	require.Equal(t, proto.MessageTypeError, resp.Type)
+}
+
+func TestTunnelCORSPreflight(t *testing.T) {
+	_, ts, token := setupTestTunnelServer(t)
+
+	ws := dialTestTunnelServer(t, ts, token)
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type: proto.MessageTypeTunnelReq,
+		Payload: testutil.Payload(t, proto.TunnelRequest{
+			LocalPort:         3000,
+			Subdomain:         "cors",
+			BasicAuthUser:     "admin",
+			BasicAuthPassHash: utils.HashToken("secret"),
+			CORS: &proto.CORSPolicy{
+				AllowOrigins:     []string{"https://app.example.com"},
+				AllowMethods:     []string{"GET", "POST"},
+				AllowHeaders:     []string{"Content-Type", "X-Api-Key"},
+				AllowCredentials: true,
+				MaxAgeSeconds:    600,
+			},
+		}),
+	}))
+	var resp proto.Message
+	require.NoError(t, websocket.JSON.Receive(ws, &resp))
+	tunnelResp, err := resp.AsTunnelResponse()
+	require.NoError(t, err)
+
+	// Nothing should reach the client, preflights the policy doesnt allow are left to basic auth like any request
+	forwarded := make(chan string, 10)
+	go func() {
+		for {
+			var msg proto.Message
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			req, _ := msg.AsHTTPRequest()
+			forwarded <- req.Headers["Origin"]
+			websocket.JSON.Send(ws, proto.Message{
+				Type:    proto.MessageTypeHTTPResponse,
+				Payload: testutil.Payload(t, proto.HTTPResponse{StatusCode: http.StatusTeapot, RequestId: req.RequestId}),
+			})
+		}
+	}()
+
+	preflight := func(origin, method, headers string) *http.Response {
+		req, err := http.NewRequest(http.MethodOptions, tunnelResp.URL+"/api/orders", nil)
+		require.NoError(t, err)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		if headers != "" {
+			req.Header.Set("Access-Control-Request-Headers", headers)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+		return res
+	}
+
+	// Answered at the server, even though the tunnel needs basic auth, which preflights never send
+	res := preflight("https://app.example.com", "POST", "content-type, x-api-key")
+	require.Equal(t, http.StatusNoContent, res.StatusCode)
+	require.Equal(t, "https://app.example.com", res.Header.Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "GET, POST", res.Header.Get("Access-Control-Allow-Methods"))
+	require.Equal(t, "Content-Type, X-Api-Key", res.Header.Get("Access-Control-Allow-Headers"))
+	require.Equal(t, "true", res.Header.Get("Access-Control-Allow-Credentials"))
+	require.Equal(t, "600", res.Header.Get("Access-Control-Max-Age"))
+	require.Contains(t, res.Header.Get("Vary"), "Origin")
+	require.Empty(t, forwarded)
+
+	tests := []struct {
+		name                    string
+		origin, method, headers string
+	}{
+		{name: "other origin", origin: "https://evil.example.com", method: "POST"},
+		{name: "other method", origin: "https://app.example.com", method: "DELETE"},
+		{name: "other header", origin: "https://app.example.com", method: "GET", headers: "X-Other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := preflight(tt.origin, tt.method, tt.headers)
+			require.Equal(t, http.StatusUnauthorized, res.StatusCode, "Expected the preflight to be left to the tunnel")
+		})
+	}
+}
+
+func TestTunnelCORSPreflightAnyOrigin(t *testing.T) {
+	_, ts, token := setupTestTunnelServer(t)
+
+	ws := dialTestTunnelServer(t, ts, token)
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type: proto.MessageTypeTunnelReq,
+		Payload: testutil.Payload(t, proto.TunnelRequest{
+			LocalPort: 3000,
+			Subdomain: "anycors",
+			CORS:      &proto.CORSPolicy{AllowOrigins: []string{"*"}},
+		}),
+	}))
+	var resp proto.Message
+	require.NoError(t, websocket.JSON.Receive(ws, &resp))
+	tunnelResp, err := resp.AsTunnelResponse()
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodOptions, tunnelResp.URL+"/", nil)
+	require.NoError(t, err)
+	req.Header.Set("Origin", "https://anywhere.example.com")
+	req.Header.Set("Access-Control-Request-Method", "PATCH")
+	req.Header.Set("Access-Control-Request-Headers", "X-One, X-Two")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+
+	// Without a list of methods and headers, the ones asked for are allowed
+	require.Equal(t, http.StatusNoContent, res.StatusCode)
+	require.Equal(t, "*", res.Header.Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "PATCH", res.Header.Get("Access-Control-Allow-Methods"))
+	require.Equal(t, "X-One, X-Two", res.Header.Get("Access-Control-Allow-Headers"))
+	require.Empty(t, res.Header.Get("Access-Control-Allow-Credentials"))
+
+	// A policy needs an origin
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type:    proto.MessageTypeTunnelReq,
+		Payload: testutil.Payload(t, proto.TunnelRequest{LocalPort: 3001, CORS: &proto.CORSPolicy{}}),
+	}))
+	require.NoError(t, websocket.JSON.Receive(ws, &resp))
+	require.Equal(t, proto.MessageTypeError, resp.Type)
+}
+
+func TestTunnelRateLimit(t *testing.T) {
+	_, ts, token := setupTestTunnelServer(t)
+
+	ws := dialTestTunnelServer(t, ts, token)
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type:    proto.MessageTypeTunnelReq,
+		Payload: testutil.Payload(t, proto.TunnelRequest{LocalPort: 3000, Subdomain: "limited", RequestsPerSecond: 1}),
+	}))
+	var resp proto.Message
+	require.NoError(t, websocket.JSON.Receive(ws, &resp))
+	tunnelResp, err := resp.AsTunnelResponse()
+	require.NoError(t, err)
+	require.Equal(t, float64(1), tunnelResp.RequestsPerSecond)
+
+	rateLimited := make(chan proto.RateLimited, 1)
+	go func() {
+		for {
+			var msg proto.Message
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			b, _ := json.Marshal(msg.Payload)
+
+			switch msg.Type {
+			case proto.MessageTypeHTTPRequest:
+				var req proto.HTTPRequest
+				json.Unmarshal(b, &req)
+				websocket.JSON.Send(ws, proto.Message{
+					Type:    proto.MessageTypeHTTPResponse,
+					Payload: testutil.Payload(t, proto.HTTPResponse{StatusCode: 200, RequestId: req.RequestId}),
+				})
+			case proto.MessageTypeRateLimited:
+				var limited proto.RateLimited
+				json.Unmarshal(b, &limited)
+				rateLimited <- limited
+			}
+		}
+	}()
+
+	// The burst allows one request, the next is over the limit
+	res, err := http.Get(tunnelResp.URL + "/")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	res, err = http.Get(tunnelResp.URL + "/")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	require.Equal(t, "1", res.Header.Get("Retry-After"))
+
+	select {
+	case limited := <-rateLimited:
+		require.Equal(t, 1, limited.Rejected)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for rate limited message")
+	}
+}
+
+func TestTunnelInFlightLimit(t *testing.T) {
+	th, ts, token := setupTestTunnelServer(t)
+	th.cfg.MaxInFlight = 3
+
+	ws := dialTestTunnelServer(t, ts, token)
+	tunnelURL := registerTestTunnel(t, ws, "busy")
+
+	const requests = 20
+	statuses := make(chan int, requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			res, err := http.Get(tunnelURL + "/")
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			res.Body.Close()
+			statuses <- res.StatusCode
+		}()
+	}
+
+	// The client holds on to the requests it gets, so every other request finds the tunnel full
+	var reqIDs []string
+	for len(reqIDs) < th.cfg.MaxInFlight {
+		var msg proto.Message
+		require.NoError(t, websocket.JSON.Receive(ws, &msg))
+		if msg.Type != proto.MessageTypeHTTPRequest {
+			continue
+		}
+		req, err := msg.AsHTTPRequest()
+		require.NoError(t, err)
+		reqIDs = append(reqIDs, req.RequestId)
+	}
+	for i := 0; i < requests-th.cfg.MaxInFlight; i++ {
+		select {
+		case status := <-statuses:
+			require.Equal(t, http.StatusServiceUnavailable, status)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d requests were rejected", i)
+		}
+	}
+
+	th.mu.Lock()
+	require.Len(t, th.pendingRequests, th.cfg.MaxInFlight)
+	th.mu.Unlock()
+
+	for _, id := range reqIDs {
+		require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+			Type:    proto.MessageTypeHTTPResponse,
+			Payload: testutil.Payload(t, proto.HTTPResponse{StatusCode: http.StatusOK, RequestId: id}),
+		}))
+	}
+	for range reqIDs {
+		select {
+		case status := <-statuses:
+			require.Equal(t, http.StatusOK, status)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the held requests to be answered")
+		}
+	}
+
+	// The slots are given back once the requests are answered
+	go func() {
+		var msg proto.Message
+		for msg.Type != proto.MessageTypeHTTPRequest {
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+		}
+		req, _ := msg.AsHTTPRequest()
+		websocket.JSON.Send(ws, proto.Message{
+			Type:    proto.MessageTypeHTTPResponse,
+			Payload: testutil.Payload(t, proto.HTTPResponse{StatusCode: http.StatusOK, RequestId: req.RequestId}),
+		})
+	}()
+	res, err := http.Get(tunnelURL + "/")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestTunnelPorts(t *testing.T) {
+	th, ts, token := setupTestTunnelServer(t)
+	th.cfg.TunnelPorts = true
+
+	ws := dialTestTunnelServer(t, ts, token)
+	tunnelURL := registerTestTunnel(t, ws, "ported")
+	u, err := url.Parse(tunnelURL)
+	require.NoError(t, err)
+	require.NotEqual(t, th.cfg.Port, u.Port(), "Expected the tunnel to have its own port")
+	require.Empty(t, u.Path, "Expected the tunnel to be served at the root of its port")
+
+	paths := make(chan string, 2)
+	go func() {
+		for {
+			var msg proto.Message
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			if msg.Type != proto.MessageTypeHTTPRequest {
+				continue
+			}
+			req, _ := msg.AsHTTPRequest()
+			paths <- req.Path
+			websocket.JSON.Send(ws, proto.Message{
+				Type:    proto.MessageTypeHTTPResponse,
+				Payload: testutil.Payload(t, proto.HTTPResponse{StatusCode: http.StatusOK, RequestId: req.RequestId}),
+			})
+		}
+	}()
+
+	res, err := http.Get(tunnelURL + "/hooks/stripe?attempt=1")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "/hooks/stripe?attempt=1", <-paths)
+
+	// The tunnel is still on the server port too
+	res, err = http.Get(ts.URL + "/local/ported/health")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "/health", <-paths)
+
+	// The port is given up once the tunnel closes
+	ws.Close()
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", u.Host)
+		if err != nil {
+			return true
+		}
+		conn.Close()
+		return false
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func TestTunnelPortsTLS(t *testing.T) {
+	th, ts, token := setupTestTunnelServer(t)
+	th.cfg.TunnelPorts = true
+	th.cfg.BindAddr = "127.0.0.1"
+	th.cfg.TLSCertFile = "cert.pem" // Only read by NewTLSConfig, the test servers certificate is used instead
+
+	// Borrow the certificate of a test server, which its client trusts
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsServer.Close()
+	th.SetTLSConfig(tlsServer.TLS)
+
+	ws := dialTestTunnelServer(t, ts, token)
+	tunnelURL := registerTestTunnel(t, ws, "secure")
+	u, err := url.Parse(tunnelURL)
+	require.NoError(t, err)
+	require.Equal(t, "https", u.Scheme)
+
+	go func() {
+		for {
+			var msg proto.Message
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			if msg.Type != proto.MessageTypeHTTPRequest {
+				continue
+			}
+			req, _ := msg.AsHTTPRequest()
+			websocket.JSON.Send(ws, proto.Message{
+				Type:    proto.MessageTypeHTTPResponse,
+				Payload: testutil.Payload(t, proto.HTTPResponse{StatusCode: http.StatusOK, RequestId: req.RequestId}),
+			})
+		}
+	}()
+
+	// The certificate is for 127.0.0.1, which the port only listens on
+	res, err := tlsServer.Client().Get("https://" + net.JoinHostPort("127.0.0.1", u.Port()) + "/")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestRateLimitFor(t *testing.T) {
+	tests := []struct {
+		name       string
+		serverRate float64
+		requested  float64
+		want       float64
+	}{
+		{name: "unlimited by default", want: 0},
+		{name: "server wide limit", serverRate: 10, want: 10},
+		{name: "requested limit", requested: 5, want: 5},
+		{name: "requested limit below server limit", serverRate: 10, requested: 5, want: 5},
+		{name: "requested limit capped by server limit", serverRate: 10, requested: 50, want: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			th := &TunnelHandler{cfg: &config.ServerConfig{RateLimit: tt.serverRate}}
+			require.Equal(t, tt.want, th.rateLimitFor(tt.requested))
+		})
+	}
+}
+
+// loadTestTemplates parses the templates the server renders
+func loadTestTemplates(t *testing.T) *template.Template {
+	t.Helper()
+	tmpl, err := template.ParseGlob("../../templates/*.html")
+	require.NoError(t, err)
+	return tmpl
+}
+
+func TestMalformedTunnelURL(t *testing.T) {
+	th, ts, _ := setupTestTunnelServer(t)
+	th.templates = loadTestTemplates(t)
+
+	for _, path := range []string{"/", "/local/", "/other/abc123"} {
+		res, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+
+		require.Equal(t, http.StatusBadRequest, res.StatusCode, "path %s", path)
+		require.Contains(t, string(body), "Invalid tunnel URL")
+	}
+}
+
+func TestTunnelNotFoundPage(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tmpl := loadTestTemplates(t)
+
+	tests := []struct {
+		name          string
+		useSubdomains bool
+		host          string
+		path          string
+		wantStatus    int
+		wantBody      string
+	}{
+		{
+			name:          "test unregistered subdomain tunnel",
+			useSubdomains: true,
+			host:          "abc123.tunol.dev:8001",
+			path:          "/some/path",
+			wantStatus:    http.StatusNotFound,
+			wantBody:      "https://abc123.tunol.dev</code>",
+		},
+		{
+			name:          "test malformed subdomain tunnel",
+			useSubdomains: true,
+			host:          "a_b.tunol.dev",
+			path:          "/",
+			wantStatus:    http.StatusBadRequest,
+			wantBody:      "may only contain lowercase letters",
+		},
+		{
+			name:          "test unregistered local tunnel",
+			useSubdomains: false,
+			host:          "tunol.dev",
+			path:          "/local/abc123/some/path",
+			wantStatus:    http.StatusNotFound,
+			wantBody:      "https://tunol.dev/local/abc123</code>",
+		},
+		{
+			name:          "test malformed local tunnel",
+			useSubdomains: false,
+			host:          "tunol.dev",
+			path:          "/local/ab",
+			wantStatus:    http.StatusBadRequest,
+			wantBody:      "must be between 3 and 32 characters",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.ServerConfig{BaseURL: "https://tunol.dev", Port: "8001", UseSubdomains: tt.useSubdomains}
+			th := NewTunnelHandler(nil, nil, nil, tmpl, logger, cfg)
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Host = tt.host
+			rec := httptest.NewRecorder()
+			th.ServeHTTP(rec, req)
+
+			require.Equal(t, tt.wantStatus, rec.Code)
+			require.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+			require.Contains(t, rec.Body.String(), tt.wantBody)
+			if tt.wantStatus == http.StatusNotFound {
+				require.Contains(t, rec.Body.String(), "try again in a few seconds")
+			} else {
+				require.Contains(t, rec.Body.String(), "Invalid tunnel URL")
+			}
+		})
+	}
+}
+
+func TestRequestBodyTooLarge(t *testing.T) {
+	th, ts, token := setupTestTunnelServer(t)
+	th.cfg.MaxBodyBytes = 16
+
+	ws := dialTestTunnelServer(t, ts, token)
+	url := registerTestTunnel(t, ws, "limited-body")
+
+	go func() {
+		for {
+			var msg proto.Message
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			if msg.Type == proto.MessageTypeHTTPRequest {
+				var req proto.HTTPRequest
+				b, _ := json.Marshal(msg.Payload)
+				json.Unmarshal(b, &req)
+				websocket.JSON.Send(ws, proto.Message{
+					Type:    proto.MessageTypeHTTPResponse,
+					Payload: testutil.Payload(t, proto.HTTPResponse{StatusCode: 200, RequestId: req.RequestId}),
+				})
+			}
+		}
+	}()
+
+	res, err := http.Post(url+"/", "text/plain", strings.NewReader("small body"))
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	// Rejected up front from the content length
+	res, err = http.Post(url+"/", "text/plain", strings.NewReader(strings.Repeat("a", 17)))
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+
+	// Chunked bodies have no length, so are rejected once the limit is read
+	body := io.MultiReader(strings.NewReader(strings.Repeat("a", 10)), strings.NewReader(strings.Repeat("b", 10)))
+	res, err = http.Post(url+"/", "text/plain", body)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+}
+
+func TestResponseContentEncodingPassthrough(t *testing.T) {
+	_, ts, token := setupTestTunnelServer(t)
+	ws := dialTestTunnelServer(t, ts, token)
+	url := registerTestTunnel(t, ws, "encoded")
+
+	const content = "hello from an encoded local response"
+
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write([]byte(content))
+	gw.Close()
+
+	var deflated bytes.Buffer
+	zw := zlib.NewWriter(&deflated)
+	zw.Write([]byte(content))
+	zw.Close()
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		decode   func(io.Reader) (io.Reader, error)
+	}{
+		{
+			name:     "test gzip",
+			encoding: "gzip",
+			body:     gzipped.Bytes(),
+			decode:   func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		},
+		{
+			name:     "test deflate",
+			encoding: "deflate",
+			body:     deflated.Bytes(),
+			decode:   func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) },
+		},
+		{
+			name:     "test identity",
+			encoding: "",
+			body:     []byte(content),
+			decode:   func(r io.Reader) (io.Reader, error) { return r, nil },
+		},
+	}
+
+	// The fake client answers each request with the next test response
+	responses := make(chan proto.HTTPResponse, 1)
+	go func() {
+		for {
+			var msg proto.Message
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			if msg.Type != proto.MessageTypeHTTPRequest {
+				continue
+			}
+			var req proto.HTTPRequest
+			b, _ := json.Marshal(msg.Payload)
+			json.Unmarshal(b, &req)
+
+			resp := <-responses
+			resp.RequestId = req.RequestId
+			websocket.JSON.Send(ws, proto.Message{Type: proto.MessageTypeHTTPResponse, Payload: testutil.Payload(t, resp)})
+		}
+	}()
+
+	// Don't let the test client decode responses, so we see exactly what was sent
+	httpClient := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{"Content-Type": "text/plain"}
+			if tt.encoding != "" {
+				headers["Content-Encoding"] = tt.encoding
+			}
+			responses <- proto.HTTPResponse{StatusCode: http.StatusOK, Headers: headers, Body: tt.body}
+
+			res, err := httpClient.Get(url + "/")
+			require.NoError(t, err)
+			defer res.Body.Close()
+
+			require.Equal(t, tt.encoding, res.Header.Get("Content-Encoding"))
+			raw, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			require.Equal(t, tt.body, raw, "body should be passed through still encoded")
+
+			decoded, err := tt.decode(bytes.NewReader(raw))
+			require.NoError(t, err)
+			body, err := io.ReadAll(decoded)
+			require.NoError(t, err)
+			require.Equal(t, content, string(body))
+		})
+	}
+}
+
+// TestCompressedBodies tests that bodies are gzipped through the tunnel only for clients that said they
+// support it, and that compressed responses reach the public client as they were
+func TestCompressedBodies(t *testing.T) {
+	_, ts, token := setupTestTunnelServer(t)
+	body := strings.Repeat("a compressible line of text\n", 500)
+
+	roundTrip := func(ws *websocket.Conn, tunnelURL string) proto.HTTPRequest {
+		result := make(chan string, 1)
+		go func() {
+			res, err := http.Post(tunnelURL+"/", "text/plain", strings.NewReader(body))
+			if err != nil {
+				result <- err.Error()
+				return
+			}
+			defer res.Body.Close()
+			b, _ := io.ReadAll(res.Body)
+			result <- string(b)
+		}()
+
+		var msg proto.Message
+		require.NoError(t, websocket.JSON.Receive(ws, &msg))
+		require.Equal(t, proto.MessageTypeHTTPRequest, msg.Type)
+		req, err := msg.AsHTTPRequest()
+		require.NoError(t, err)
+
+		reqBody, err := proto.DecompressBody(req.Body, req.BodyEncoding, 0)
+		require.NoError(t, err)
+		require.Equal(t, body, string(reqBody))
+
+		resp := proto.HTTPResponse{StatusCode: http.StatusOK, RequestId: req.RequestId}
+		resp.Body, resp.BodyEncoding = proto.CompressBody([]byte(body))
+		require.NoError(t, websocket.JSON.Send(ws, proto.Message{Type: proto.MessageTypeHTTPResponse, Payload: testutil.Payload(t, resp)}))
+		require.Equal(t, body, <-result)
+		return req
+	}
+
+	ws := dialTestTunnelServer(t, ts, token)
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type:    proto.MessageTypeHello,
+		Payload: testutil.Payload(t, proto.Hello{ProtocolVersion: proto.ProtocolVersion, Capabilities: []string{proto.FeatureCompression}}),
+	}))
+	var ack proto.Message
+	require.NoError(t, websocket.JSON.Receive(ws, &ack))
+	require.Contains(t, testutil.PayloadMap(t, ack)["features"], proto.FeatureCompression)
+
+	req := roundTrip(ws, registerTestTunnel(t, ws, "compressed"))
+	require.Equal(t, proto.BodyEncodingGzip, req.BodyEncoding)
+	require.Less(t, len(req.Body), len(body))
+
+	// Clients that didn't say they support compression get the body as it is
+	plain := dialTestTunnelServer(t, ts, token)
+	req = roundTrip(plain, registerTestTunnel(t, plain, "plain"))
+	require.Empty(t, req.BodyEncoding)
+}
+
+// TestBinaryBodies tests that bodies are sent as binary frames to clients that support them, and that
+// clients can answer the same way
+func TestBinaryBodies(t *testing.T) {
+	_, ts, token := setupTestTunnelServer(t)
+	body := []byte{0x00, 0xff, 'b', 'i', 'n', 0x80}
+
+	ws := dialTestTunnelServer(t, ts, token)
+	require.NoError(t, websocket.JSON.Send(ws, proto.Message{
+		Type:    proto.MessageTypeHello,
+		Payload: testutil.Payload(t, proto.Hello{ProtocolVersion: proto.ProtocolVersion, Capabilities: []string{proto.FeatureBinaryBodies}}),
+	}))
+	var ack proto.Received
+	require.NoError(t, proto.MessageCodec.Receive(ws, &ack))
+	require.Contains(t, testutil.PayloadMap(t, ack.Message)["features"], proto.FeatureBinaryBodies)
+	tunnelURL := registerTestTunnel(t, ws, "binary")
+
+	result := make(chan []byte, 1)
+	go func() {
+		res, err := http.Post(tunnelURL+"/", "application/octet-stream", bytes.NewReader(body))
+		if err != nil {
+			result <- nil
+			return
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		result <- b
+	}()
+
+	// The body comes first, then the request it belongs to without one
+	var frame proto.Received
+	require.NoError(t, proto.MessageCodec.Receive(ws, &frame))
+	require.NotNil(t, frame.Body)
+	require.Equal(t, body, frame.Body.Body)
+
+	var msg proto.Received
+	require.NoError(t, proto.MessageCodec.Receive(ws, &msg))
+	require.Equal(t, proto.MessageTypeHTTPRequest, msg.Message.Type)
+	var req proto.HTTPRequest
+	b, _ := json.Marshal(msg.Message.Payload)
+	require.NoError(t, json.Unmarshal(b, &req))
+	require.True(t, req.BodyFrame)
+	require.Empty(t, req.Body)
+	require.Equal(t, req.RequestId, frame.Body.RequestId)
+
+	reversed := []byte{0x80, 'n', 'i', 'b', 0xff, 0x00}
+	require.NoError(t, proto.MessageCodec.Send(ws, &proto.BodyFrame{RequestId: req.RequestId, Body: reversed}))
+	require.NoError(t, proto.MessageCodec.Send(ws, proto.Message{
+		Type:    proto.MessageTypeHTTPResponse,
+		Payload: testutil.Payload(t, proto.HTTPResponse{StatusCode: http.StatusOK, RequestId: req.RequestId, BodyFrame: true}),
+	}))
+	require.Equal(t, reversed, <-result)
+}
+
+func TestTunnelLatency(t *testing.T) {
+	_, ok := tunnelLatency(&proto.HTTPResponse{LocalDuration: time.Second})
+	require.False(t, ok, "Expected no latency for a client that doesnt return the timestamp")
+
+	sentAt := time.Now().Add(-300 * time.Millisecond)
+	latency, ok := tunnelLatency(&proto.HTTPResponse{RequestSentAt: sentAt.UnixNano(), LocalDuration: 200 * time.Millisecond})
+	require.True(t, ok)
+	require.GreaterOrEqual(t, latency, 100*time.Millisecond)
+	require.Less(t, latency, 200*time.Millisecond)
+
+	// A client whose local duration covers the whole round trip never has a negative latency
+	latency, _ = tunnelLatency(&proto.HTTPResponse{RequestSentAt: sentAt.UnixNano(), LocalDuration: time.Second})
+	require.Equal(t, time.Duration(0), latency)
+}
@@ -3,37 +3,69 @@ package server
 import (
 	"crypto/rand"
 	"fmt"
+	"net/http"
 	"net/url"
+	"sort"
 	"strings"
+
+	"github.com/jwtly10/go-tunol/internal/config"
 )
 
-// generateID generates a unique ID
+// generateID generates a random ID. Collisions are possible, so callers that need a unique ID
+// must check it isn't already in use
 func generateID() string {
-	// TODO: This is a nicer ID that UUID, but collisons are possible. We need to consider this in future
-	// if this was to be more than a personal application
 	const charset = "abcdefghjkmnpqrstuvwxyz23456789"
 	length := 8
 	id := make([]byte, length)
 
-	for i := range id {
-		randByte := make([]byte, 1)
-		if _, err := rand.Read(randByte); err != nil {
-			panic(err)
-		}
-		id[i] = charset[randByte[0]%byte(len(charset))]
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	for i, b := range id {
+		id[i] = charset[b%byte(len(charset))]
 	}
 
 	return string(id)
 }
 
+// flattenTrailers converts request trailers into their proto form, nil if there are none
+func flattenTrailers(trailer http.Header) map[string]string {
+	if len(trailer) == 0 {
+		return nil
+	}
+	trailers := make(map[string]string, len(trailer))
+	for k, v := range trailer {
+		if len(v) > 0 {
+			trailers[k] = v[0]
+		}
+	}
+	return trailers
+}
+
+// trailerNames lists the trailers for the Trailer header, in a stable order
+func trailerNames(trailers map[string]string) string {
+	names := make([]string, 0, len(trailers))
+	for k := range trailers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// writeTrailers sets trailers on a response after its body has been written
+func writeTrailers(w http.ResponseWriter, trailers map[string]string) {
+	for k, v := range trailers {
+		w.Header().Set(http.TrailerPrefix+k, v)
+	}
+}
+
 // extractTunnelIDAndPath extracts the tunnel ID and the remaining path from a URL
-func extractTunnelIDAndPath(urlStr string, host string, useSubdomain bool) (tunnelID string, remainingPath string, err error) {
-	if useSubdomain {
-		parts := strings.Split(host, ".")
-		if len(parts) < 2 {
-			return "", "", fmt.Errorf("invalid host: %s", host)
+func extractTunnelIDAndPath(urlStr string, host string, cfg *config.ServerConfig) (tunnelID string, remainingPath string, err error) {
+	if cfg.UseSubdomains {
+		tunnelID, ok := cfg.SubdomainTunnelID(host)
+		if !ok {
+			return "", "", fmt.Errorf("invalid tunnel host: %s", host)
 		}
-		tunnelID = parts[0]
 		remainingPath = urlStr // Use full URL path
 		return tunnelID, remainingPath, nil
 	}
@@ -44,10 +76,11 @@ func extractTunnelIDAndPath(urlStr string, host string, useSubdomain bool) (tunn
 		return "", "", err
 	}
 
-	segments := strings.Split(strings.TrimPrefix(parsedURL.Path, "/"), "/")
+	// The path is kept escaped, so the local server gets it as the client sent it
+	segments := strings.Split(strings.TrimPrefix(parsedURL.EscapedPath(), "/"), "/")
 	// We only need 2 segments: "local" and the tunnelID
 	if len(segments) < 2 || segments[0] != "local" {
-		return "", "", fmt.Errorf("invalid local tunnel path format")
+		return "", "", fmt.Errorf("invalid local tunnel path format, expected /local/<tunnel_id>")
 	}
 
 	tunnelID = segments[1]
@@ -59,6 +92,9 @@ func extractTunnelIDAndPath(urlStr string, host string, useSubdomain bool) (tunn
 	if len(segments) > 2 {
 		remainingPath = "/" + strings.Join(segments[2:], "/")
 	}
+	if parsedURL.RawQuery != "" {
+		remainingPath += "?" + parsedURL.RawQuery
+	}
 
 	return tunnelID, remainingPath, nil
 }
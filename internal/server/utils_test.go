@@ -1,6 +1,11 @@
 package server
 
-import "testing"
+import (
+	"sync"
+	"testing"
+
+	"github.com/jwtly10/go-tunol/internal/config"
+)
 
 func TestExtractTunnelId(t *testing.T) {
 	tests := []struct {
@@ -27,6 +32,14 @@ func TestExtractTunnelId(t *testing.T) {
 			wantId:       "abc123",
 			wantPath:     "",
 		},
+		{
+			name:         "test valid local tunnel keeps the query and escaped path",
+			urlStr:       "/local/abc123/a%2Fb/c%20d?x=1&y=%3D",
+			host:         "localhost:8001",
+			useSubdomain: false,
+			wantId:       "abc123",
+			wantPath:     "/a%2Fb/c%20d?x=1&y=%3D",
+		},
 		{
 			name:         "test valid subdomain tunnel with path",
 			urlStr:       "/path",
@@ -47,7 +60,7 @@ func TestExtractTunnelId(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			id, path, err := extractTunnelIDAndPath(tt.urlStr, tt.host, tt.useSubdomain)
+			id, path, err := extractTunnelIDAndPath(tt.urlStr, tt.host, &config.ServerConfig{BaseURL: "http://domain", UseSubdomains: tt.useSubdomain})
 			if err != nil {
 				t.Errorf("unexpected error: %v", err)
 			}
@@ -63,3 +76,95 @@ func TestExtractTunnelId(t *testing.T) {
 	}
 
 }
+
+func TestGenerateIDUnique(t *testing.T) {
+	const (
+		workers   = 10
+		perWorker = 1000
+	)
+
+	ids := make(chan string, workers*perWorker)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				ids <- generateID()
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[string]bool, workers*perWorker)
+	for id := range ids {
+		if len(id) != 8 {
+			t.Fatalf("expected id of length 8, got %q", id)
+		}
+		if seen[id] {
+			t.Fatalf("duplicate id generated: %s", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestExtractTunnelIdInvalid(t *testing.T) {
+	tests := []struct {
+		name         string
+		urlStr       string
+		host         string
+		useSubdomain bool
+	}{
+		{
+			name:         "test empty local path",
+			urlStr:       "",
+			host:         "localhost:8001",
+			useSubdomain: false,
+		},
+		{
+			name:         "test local path without tunnel id",
+			urlStr:       "/local",
+			host:         "localhost:8001",
+			useSubdomain: false,
+		},
+		{
+			name:         "test local path with empty tunnel id",
+			urlStr:       "/local/",
+			host:         "localhost:8001",
+			useSubdomain: false,
+		},
+		{
+			name:         "test path without local prefix",
+			urlStr:       "/other/abc123/path",
+			host:         "localhost:8001",
+			useSubdomain: false,
+		},
+		{
+			name:         "test malformed url",
+			urlStr:       "/local/%zz",
+			host:         "localhost:8001",
+			useSubdomain: false,
+		},
+		{
+			name:         "test subdomain host without domain",
+			urlStr:       "/path",
+			host:         "localhost",
+			useSubdomain: true,
+		},
+		{
+			name:         "test subdomain host with empty subdomain",
+			urlStr:       "/path",
+			host:         ".domain:8001",
+			useSubdomain: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := extractTunnelIDAndPath(tt.urlStr, tt.host, &config.ServerConfig{BaseURL: "http://domain", UseSubdomains: tt.useSubdomain}); err == nil {
+				t.Errorf("expected error for url %q and host %q", tt.urlStr, tt.host)
+			}
+		})
+	}
+}
@@ -22,6 +22,8 @@ func NewWebHandler(
 	authMiddleware *auth.Middleware,
 	dashboardHandler *dashboard.Handler,
 	authHandler *auth.Handler,
+	tunnelHandler *TunnelHandler,
+	db HealthDatabase,
 	logger *slog.Logger,
 ) *WebHandler {
 	mux := http.NewServeMux()
@@ -32,10 +34,10 @@ func NewWebHandler(
 	})
 
 	// Public routes
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
+	health := newHealthHandler(db, tunnelHandler)
+	mux.HandleFunc("/health", health.handleHealth)
+	mux.HandleFunc("/readyz", health.handleReady)
+	mux.HandleFunc("/version", versionHandler(tunnelHandler.cfg.LatestCLIVersion))
 
 	mux.HandleFunc("/terms", func(w http.ResponseWriter, r *http.Request) {
 		if err := templates.ExecuteTemplate(w, "terms", nil); err != nil {
@@ -49,14 +51,24 @@ func NewWebHandler(
 	})
 
 	mux.HandleFunc("/login", authHandler.HandleLogin)
+	mux.HandleFunc("/register", authHandler.HandleRegister)
 	mux.HandleFunc("/auth/logout", authHandler.HandleLogout)
 	mux.HandleFunc("/auth/validate", authHandler.HandleValidateToken)
-	mux.HandleFunc("/auth/github/login", authHandler.HandleGitHubLogin)
-	mux.HandleFunc("/auth/github/callback", authHandler.HandleGitHubCallback)
+	mux.HandleFunc("/auth/whoami", authHandler.HandleWhoAmI)
+	mux.HandleFunc("/auth/{provider}/login", authHandler.HandleOAuthLogin)
+	mux.HandleFunc("/auth/{provider}/callback", authHandler.HandleOAuthCallback)
 
 	// Protected routes
 	mux.Handle("/dashboard", authMiddleware.RequireAuth(http.HandlerFunc(dashboardHandler.HandleDashboard)))
 	mux.Handle("/dashboard/tokens", authMiddleware.RequireAuth(http.HandlerFunc(dashboardHandler.HandleCreateToken)))
+	mux.Handle("/dashboard/tokens/revoke", authMiddleware.RequireAuth(http.HandlerFunc(dashboardHandler.HandleRevokeToken)))
+	mux.Handle("/dashboard/subdomains", authMiddleware.RequireAuth(http.HandlerFunc(dashboardHandler.HandleReserveSubdomain)))
+	mux.Handle("/dashboard/subdomains/release", authMiddleware.RequireAuth(http.HandlerFunc(dashboardHandler.HandleReleaseSubdomain)))
+	mux.Handle("/auth/logout/all", authMiddleware.RequireAuth(http.HandlerFunc(authHandler.HandleLogoutEverywhere)))
+	mux.Handle("/auth/cli", authMiddleware.RequireAuth(http.HandlerFunc(authHandler.HandleCLILogin)))
+
+	// API routes, authenticated with a session or bearer token
+	mux.Handle("/api/instance/tunnels", authMiddleware.RequireAPIAuth(http.HandlerFunc(tunnelHandler.HandleListInstanceTunnels)))
 
 	return &WebHandler{
 		mux:            mux,
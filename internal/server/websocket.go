@@ -1,47 +1,56 @@
 package server
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"strings"
+	"net/http"
 	"time"
 
+	"github.com/jwtly10/go-tunol/internal/config"
 	"github.com/jwtly10/go-tunol/internal/proto"
+	"github.com/jwtly10/go-tunol/internal/version"
+	"github.com/jwtly10/go-tunol/internal/web/subdomain"
 	"golang.org/x/net/websocket"
 )
 
-func (th *TunnelHandler) handleWS(ws *websocket.Conn) {
+func (th *TunnelHandler) handleWS(ws *websocket.Conn, userID int64) {
+	websocketConnections.Inc()
+	defer websocketConnections.Dec()
+
 	defer func() {
 		th.mu.Lock()
 		// Clean up all tunnels associated with this connection
+		var closed []string
 		for id, tunnel := range th.tunnels {
 			if tunnel.WSConn == ws {
 				th.logger.Info("cleaning up disconnected tunnel", "id", id, "total", len(th.tunnels)-1)
-				tunnel.WSConn.Close()
-				delete(th.tunnels, id)
-
-				// Clean up any pending requests for this tunnel
-				for reqID, ch := range th.pendingRequests {
-					if strings.HasPrefix(reqID, id) {
-						close(ch)
-						delete(th.pendingRequests, reqID)
-					}
-				}
+				th.removeTunnelLocked(tunnel)
+				closed = append(closed, id)
 			}
 		}
 		th.mu.Unlock()
+
+		th.releaseTunnels(closed...)
 	}()
 
+	// Set by the clients hello, which comes before its tunnel requests. Clients that predate the hello
+	// don't support any of the optional features
+	var features []string
+	// Bodies sent as binary frames, waiting on the response they come before
+	bodies := proto.NewPendingBodies(proto.PendingBodyMaxAge, proto.PendingBodyMaxBytes)
+
 	for {
-		var msg proto.Message
-		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+		var received proto.Received
+		if err := proto.MessageCodec.Receive(ws, &received); err != nil {
 			var id string
+			th.mu.Lock()
 			for _, tunnel := range th.tunnels {
 				if tunnel.WSConn == ws {
 					id = tunnel.ID
 				}
 			}
+			th.mu.Unlock()
 			if err == io.EOF {
 				th.logger.Info("client disconnected", "id", id, "error", err)
 			} else {
@@ -50,156 +59,591 @@ func (th *TunnelHandler) handleWS(ws *websocket.Conn) {
 			return // Trigger deferred clean up
 		}
 
-		if msg.Type == proto.MessageTypeHTTPResponse {
-			var resp proto.HTTPResponse
-			if b, err := json.Marshal(msg.Payload); err == nil {
-				if err := json.Unmarshal(b, &resp); err == nil {
-					th.mu.Lock()
-					for _, tunnel := range th.tunnels {
-						if tunnel.WSConn == ws {
-							tunnel.LastActivity = time.Now()
-						}
-					}
-					th.mu.Unlock()
-				}
+		// Any message, including the clients heartbeat pings, shows the connection is alive
+		th.mu.Lock()
+		for _, tunnel := range th.tunnels {
+			if tunnel.WSConn == ws {
+				tunnel.LastActivity = time.Now()
 			}
 		}
+		th.mu.Unlock()
+
+		if received.Body != nil {
+			th.mu.Lock()
+			_, pending := th.pendingRequests[received.Body.RequestId]
+			th.mu.Unlock()
+			// Bodies of requests that aren't waiting, e.g. they timed out, would never be claimed
+			if pending {
+				bodies.Put(received.Body.RequestId, received.Body.Body)
+			}
+			continue
+		}
+		msg := received.Message
 
 		switch msg.Type {
 		case proto.MessageTypePing:
-			th.logger.Info("received ping message")
+			th.logger.Debug("received ping message")
 			if err := websocket.JSON.Send(ws, proto.Message{Type: proto.MessageTypePong}); err != nil {
 				th.logger.Error("failed to send websocket message", "error", err)
 				return
 			}
 
 		case proto.MessageTypePong:
-			th.logger.Info("received pong message")
+			th.logger.Debug("received pong message")
 
-		case proto.MessageTypeTunnelReq:
-			th.logger.Info("received tunnel request", "payload", msg.Payload)
-			var req proto.TunnelRequest
-			b, err := json.Marshal(msg.Payload)
+		case proto.MessageTypeHello:
+			hello, err := th.handleHello(ws, userID, msg)
 			if err != nil {
-				th.logger.Error("failed to marshal tunnel request", "error", err)
+				th.logger.Error("failed to answer hello", "error", err)
 				return
 			}
+			features = hello.Capabilities
 
-			if err := json.Unmarshal(b, &req); err != nil {
+		case proto.MessageTypeTunnelReq:
+			th.mu.Lock()
+			shuttingDown := th.shuttingDown
+			th.mu.Unlock()
+			if shuttingDown {
+				th.sendError(ws, retryableWithCode(proto.ErrorCodeShuttingDown, fmt.Errorf("server is shutting down")))
+				continue
+			}
+
+			req, err := msg.AsTunnelRequest()
+			if err != nil {
 				th.logger.Error("failed to unmarshal tunnel request", "error", err)
+				th.sendError(ws, withCode(proto.ErrorCodeInvalidRequest, fmt.Errorf("invalid tunnel request: %w", err)))
+				continue
+			}
+			// Not the whole payload, it carries the basic auth hash
+			th.logger.Debug("received tunnel request", "localPort", req.LocalPort, "subdomain", req.Subdomain, "protocol", req.Protocol, "basicAuth", req.BasicAuthUser != "")
+
+			protocol := req.Protocol
+			if protocol == "" {
+				protocol = proto.ProtocolHTTP
+			}
+			if protocol != proto.ProtocolHTTP && protocol != proto.ProtocolTCP {
+				th.sendError(ws, withCode(proto.ErrorCodeInvalidRequest, fmt.Errorf("unsupported tunnel protocol %s", protocol)))
+				continue
+			}
+
+			if (req.BasicAuthUser == "") != (req.BasicAuthPassHash == "") {
+				th.sendError(ws, withCode(proto.ErrorCodeInvalidRequest, fmt.Errorf("basic auth requires both a user and password")))
+				continue
+			}
+			if req.BasicAuthUser != "" && protocol != proto.ProtocolHTTP {
+				th.sendError(ws, withCode(proto.ErrorCodeInvalidRequest, fmt.Errorf("basic auth is only supported for http tunnels")))
+				continue
 			}
 
-			id := generateID()
+			if req.CORS != nil && (protocol != proto.ProtocolHTTP || len(req.CORS.AllowOrigins) == 0) {
+				th.sendError(ws, withCode(proto.ErrorCodeInvalidRequest, fmt.Errorf("a cors policy needs at least one allowed origin, and is only supported for http tunnels")))
+				continue
+			}
+
+			id, generated, err := th.resolveTunnelID(userID, req.Subdomain)
+			if err != nil {
+				th.logger.Warn("failed to resolve tunnel id", "subdomain", req.Subdomain, "error", err)
+				th.sendError(ws, err)
+				continue
+			}
 
 			t := &Tunnel{
 				ID:           id,
+				UserID:       userID,
 				LocalPort:    req.LocalPort,
+				Protocol:     protocol,
 				WSConn:       ws,
 				Path:         th.cfg.SubdomainURL(id),
 				LastActivity: time.Now(),
+				LastRequest:  time.Now(),
 				Created:      time.Now(),
+				done:         make(chan struct{}),
+
+				BasicAuthUser:     req.BasicAuthUser,
+				BasicAuthPassHash: req.BasicAuthPassHash,
+
+				RateLimit: th.rateLimitFor(req.RequestsPerSecond),
+
+				PassAllHeaders: req.PassAllHeaders,
+				AllowHeaders:   req.AllowHeaders,
+
+				Verbatim: req.Verbatim,
+
+				CORS: req.CORS,
+
+				clientFeatures: features,
+			}
+			t.limiter = newRateLimiter(t.RateLimit)
+			if th.cfg.MaxInFlight > 0 {
+				t.inFlight = make(chan struct{}, th.cfg.MaxInFlight)
+			}
+
+			if protocol == proto.ProtocolTCP {
+				if err := th.listenTCP(t); err != nil {
+					th.logger.Error("failed to open tcp listener", "id", id, "error", err)
+					th.sendError(ws, fmt.Errorf("failed to open tcp listener"))
+					continue
+				}
+			} else if th.cfg.TunnelPorts {
+				if err := th.listenPort(t); err != nil {
+					th.logger.Error("failed to open tunnel port", "id", id, "error", err)
+					th.sendError(ws, fmt.Errorf("failed to open tunnel port"))
+					continue
+				}
 			}
 
+			// Check and register under the same lock, so two clients can't claim the same subdomain
 			th.mu.Lock()
-			th.tunnels[id] = t
+			_, taken := th.tunnels[id]
+			// A generated id is only a collision, so rather than rejecting the tunnel just pick another
+			for taken && generated {
+				id = generateID()
+				_, taken = th.tunnels[id]
+				t.ID = id
+				if t.Listener == nil {
+					t.Path = th.cfg.SubdomainURL(id)
+				}
+			}
+			limited := !taken && th.cfg.MaxTunnelsPerUser > 0 && th.userTunnelsLocked(userID) >= th.cfg.MaxTunnelsPerUser
+			if !taken && !limited {
+				th.tunnels[id] = t
+				activeTunnels.Inc()
+			}
+			totalTunnels := len(th.tunnels)
 			th.mu.Unlock()
 
-			resp := proto.Message{
-				Type: proto.MessageTypeTunnelResp,
-				Payload: proto.TunnelResponse{
-					URL: t.Path,
-				},
+			if limited {
+				if t.Listener != nil {
+					t.Listener.Close()
+				}
+				th.logger.Warn("user has reached the tunnel limit", "userID", userID, "limit", th.cfg.MaxTunnelsPerUser)
+				th.sendError(ws, withCode(proto.ErrorCodeTunnelLimitExceeded, fmt.Errorf("you can only have %d tunnels open at once", th.cfg.MaxTunnelsPerUser)))
+				continue
 			}
 
-			if err := websocket.JSON.Send(ws, resp); err != nil {
+			// Another instance may hold a tunnel with the same id, in which case it's taken all the same
+			if !taken && !th.claimTunnel(id) {
+				th.mu.Lock()
+				delete(th.tunnels, id)
+				activeTunnels.Dec()
+				th.mu.Unlock()
+				taken = true
+			}
+
+			if taken {
+				if t.Listener != nil {
+					t.Listener.Close()
+				}
+				th.logger.Warn("requested subdomain already in use", "subdomain", id)
+				// Retryable, as it's often the clients own tunnel from a connection that dropped, which is freed
+				// once the server notices
+				th.sendError(ws, retryableWithCode(proto.ErrorCodeSubdomainTaken, fmt.Errorf("subdomain %s is already in use", id)))
+				continue
+			}
+
+			resp := proto.TunnelResponse{
+				URL:               t.Path,
+				ID:                t.ID,
+				Created:           t.Created,
+				RequestsPerSecond: t.RateLimit,
+				MaxBodyBytes:      th.cfg.MaxBodyBytes,
+				RequestTimeoutMs:  th.requestTimeout().Milliseconds(),
+				ExpiresAt:         th.expiresAt(t),
+			}
+
+			if err := t.send(proto.MessageTypeTunnelResp, resp); err != nil {
 				th.logger.Error("failed to send tunnel response", "error", err)
 			}
 
-			th.logger.Info("new tunnel registered", "totalTunnels", len(th.tunnels), "id", id, "localPort", req.LocalPort, "url", t.Path)
+			th.logger.Info("new tunnel registered", "totalTunnels", totalTunnels, "id", id, "localPort", req.LocalPort, "url", t.Path)
+
+			if t.portServer != nil {
+				go th.servePort(t)
+			} else if t.Listener != nil {
+				go th.acceptTCP(t)
+			}
+
+		case proto.MessageTypeTunnelClose:
+			th.handleTunnelClose(ws, msg.TunnelID)
 
 		case proto.MessageTypeHTTPResponse:
-			var resp proto.HTTPResponse
-			b, _ := json.Marshal(msg.Payload)
-			if err := json.Unmarshal(b, &resp); err != nil {
+			resp, err := msg.AsHTTPResponse()
+			if err != nil {
 				th.logger.Error("failed to unmarshal HTTP response", "error", err)
 				continue
 			}
-			th.logger.Info("received http response from tunnel", "requestId", resp.RequestId, "status", resp.StatusCode)
-			th.logger.Info("6. after return journey in ws", "headers", resp.Headers)
+			// Taken either way, as nothing else can claim a body once its request is answered
+			if body := bodies.Take(resp.RequestId); resp.BodyFrame {
+				resp.Body = body
+			}
+			// A body that can't be decompressed still answers the request, so it isn't left waiting
+			if body, err := proto.DecompressBody(resp.Body, resp.BodyEncoding, th.cfg.MaxBodyBytes); err != nil {
+				th.logger.Error("failed to decompress HTTP response", "requestId", resp.RequestId, "error", err)
+				resp = proto.HTTPResponse{
+					StatusCode: http.StatusBadGateway,
+					Headers:    map[string]string{"Content-Type": "text/plain; charset=utf-8"},
+					Body:       []byte("Failed to read response from tunnel"),
+					RequestId:  resp.RequestId,
+				}
+			} else {
+				resp.Body, resp.BodyEncoding = body, ""
+			}
+			th.logger.Debug("received http response from tunnel", "requestId", resp.RequestId, "status", resp.StatusCode)
+			th.logger.Debug("6. after return journey in ws", "headers", resp.Headers)
 
 			th.mu.Lock()
-			if ch, exists := th.pendingRequests[resp.RequestId]; exists {
-				ch <- &resp
+			if pending, exists := th.pendingRequests[resp.RequestId]; exists {
+				// The chunks follow this message, so the stream must exist before we handle the next one
+				if resp.Streaming {
+					th.pendingStreams[resp.RequestId] = newResponseStream()
+				}
+				pending.resp <- &resp
 				delete(th.pendingRequests, resp.RequestId)
 			}
 			th.mu.Unlock()
 
+		case proto.MessageTypeHTTPBodyChunk:
+			th.handleHTTPBodyChunk(msg)
+
+		case proto.MessageTypeTCPData:
+			th.handleTCPData(msg)
+
+		case proto.MessageTypeTCPClose:
+			th.handleTCPClose(msg)
+
+		case proto.MessageTypeWSFrame:
+			th.handleWSFrame(msg)
+
+		case proto.MessageTypeWSClose:
+			th.handleWSClose(msg)
+
 		default:
-			th.logger.Warn("unknown message type", "type", msg.Type, "content", msg)
+			th.logger.Warn("unknown message type", "type", msg.Type, "tunnelId", msg.TunnelID)
+		}
+	}
+}
+
+// handleHello answers the hello the client sends when it connects with what the server supports,
+// returning the hello so the connection can use the features the client supports
+func (th *TunnelHandler) handleHello(ws *websocket.Conn, userID int64, msg proto.Message) (*proto.Hello, error) {
+	hello, err := msg.AsHello()
+	if err != nil {
+		return nil, err
+	}
+
+	th.logger.Info("client hello", "userID", userID, "version", hello.Version, "protocol", hello.ProtocolVersion, "os", hello.OS, "capabilities", hello.Capabilities)
+
+	ack, err := proto.NewMessage(proto.MessageTypeHelloAck, th.helloAck())
+	if err != nil {
+		return nil, err
+	}
+	return &hello, websocket.JSON.Send(ws, ack)
+}
+
+// helloAck describes the server to clients, from its config
+func (th *TunnelHandler) helloAck() proto.HelloAck {
+	features := []string{
+		proto.FeatureTCP, proto.FeatureStreaming, proto.FeatureWebSocket, proto.FeatureMultiplex,
+		proto.FeatureCompression, proto.FeatureBinaryBodies,
+	}
+	if th.cfg.UseSubdomains {
+		features = append(features, proto.FeatureSubdomains)
+	}
+
+	return proto.HelloAck{
+		Version:         version.Version,
+		ProtocolVersion: proto.ProtocolVersion,
+		Features:        features,
+		Limits: proto.Limits{
+			MaxTunnels:          th.cfg.MaxTunnelsPerUser,
+			MaxBodyBytes:        th.cfg.MaxBodyBytes,
+			RequestsPerSecond:   th.cfg.RateLimit,
+			RequestTimeoutMs:    th.requestTimeout().Milliseconds(),
+			TunnelIdleTimeoutMs: th.cfg.TunnelIdleTimeout.Milliseconds(),
+			TunnelMaxLifetimeMs: th.cfg.TunnelMaxLifetime.Milliseconds(),
+		},
+	}
+}
+
+// handleTunnelClose closes a tunnel the client no longer needs, leaving the other tunnels sharing
+// its connection open
+func (th *TunnelHandler) handleTunnelClose(ws *websocket.Conn, id string) {
+	th.mu.Lock()
+	tunnel, exists := th.tunnels[id]
+	// Clients can only close their own tunnels
+	if !exists || tunnel.WSConn != ws {
+		th.mu.Unlock()
+		th.logger.Warn("client asked to close unknown tunnel", "id", id)
+		return
+	}
+	th.logger.Info("client closed tunnel", "id", id)
+	th.removeTunnelLocked(tunnel)
+	th.mu.Unlock()
+
+	th.releaseTunnels(id)
+}
+
+// userTunnelsLocked counts the tunnels the user has open on this instance. The caller must hold the lock
+func (th *TunnelHandler) userTunnelsLocked(userID int64) int {
+	n := 0
+	for _, t := range th.tunnels {
+		if t.UserID == userID {
+			n++
 		}
 	}
+	return n
 }
 
-// authenticateWebSocket verifies the token during WebSocket upgrade
-func (th *TunnelHandler) authenticateWebSocket(ws *websocket.Conn) error {
-	token := ""
+// codedError is an error sent to the client along with a code saying why, see sendError
+type codedError struct {
+	code      string
+	retryable bool
+	err       error
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+func (e *codedError) Unwrap() error { return e.err }
+
+// withCode gives an error the code it's sent to the client with. The client won't retry it
+func withCode(code string, err error) error {
+	return &codedError{code: code, err: err}
+}
+
+// retryableWithCode is withCode for errors that may go away on their own, so the client can try again later
+func retryableWithCode(code string, err error) error {
+	return &codedError{code: code, retryable: true, err: err}
+}
+
+// sendError sends an error message to the client, with the code from withCode or retryableWithCode.
+// Errors without one are internal errors, which are worth retrying
+func (th *TunnelHandler) sendError(ws *websocket.Conn, err error) {
+	payload := proto.ErrorPayload{Code: proto.ErrorCodeInternal, Message: err.Error(), Retryable: true}
+	var coded *codedError
+	if errors.As(err, &coded) {
+		payload.Code = coded.code
+		payload.Retryable = coded.retryable
+	}
+
+	errMsg, err := proto.NewMessage(proto.MessageTypeError, payload)
+	if err != nil {
+		th.logger.Error("failed to marshal error message", "error", err)
+		return
+	}
+	if err := websocket.JSON.Send(ws, errMsg); err != nil {
+		th.logger.Error("failed to send error message", "error", err)
+	}
+}
+
+// resolveTunnelID decides the id of a new tunnel. A requested subdomain is used if it's valid and not
+// reserved by another user, otherwise the users own reserved subdomains are preferred over a random id.
+// generated is true if the id was randomly generated, rather than requested or reserved
+func (th *TunnelHandler) resolveTunnelID(userID int64, requested string) (id string, generated bool, err error) {
+	if requested != "" {
+		if err := subdomain.Validate(requested); err != nil {
+			return "", false, withCode(proto.ErrorCodeInvalidSubdomain, fmt.Errorf("invalid subdomain: %w", err))
+		}
+
+		if th.subdomains != nil {
+			reservation, err := th.subdomains.FindBySubdomain(requested)
+			if err != nil {
+				return "", false, fmt.Errorf("failed to check subdomain reservation: %w", err)
+			}
+			if reservation != nil && reservation.UserID != userID {
+				return "", false, withCode(proto.ErrorCodeSubdomainTaken, fmt.Errorf("subdomain %s is reserved by another user", requested))
+			}
+		}
+
+		return requested, false, nil
+	}
+
+	if th.subdomains != nil {
+		reservations, err := th.subdomains.ListUserReservations(userID)
+		if err != nil {
+			// Not fatal, the user can still tunnel with a random id
+			th.logger.Error("failed to list reserved subdomains", "userID", userID, "error", err)
+		}
+
+		for _, r := range reservations {
+			th.mu.Lock()
+			_, inUse := th.tunnels[r.Subdomain]
+			th.mu.Unlock()
+			if !inUse {
+				return r.Subdomain, false, nil
+			}
+		}
+	}
+
+	return generateID(), true, nil
+}
+
+// authenticateWebSocket verifies the token during WebSocket upgrade, returning the id of the user who owns it
+func (th *TunnelHandler) authenticateWebSocket(ws *websocket.Conn) (int64, error) {
+	plainToken := ""
 	if ws.Request() != nil {
-		token = th.extractToken(ws.Request())
+		plainToken = th.extractToken(ws.Request())
 	}
 
-	if token == "" {
-		return fmt.Errorf("no token provided")
+	if plainToken == "" {
+		return 0, withCode(proto.ErrorCodeInvalidToken, fmt.Errorf("no token provided"))
 	}
 
-	valid, err := th.tokenService.ValidateToken(token)
+	valid, err := th.tokenService.ValidateToken(plainToken)
 	// We will never have an error without valid being false, so we can just handle that as is
 	// So if false, theres a specific error we may need to handle
 	if !valid {
-		return fmt.Errorf("invalid token: %v", err)
+		return 0, withCode(proto.ErrorCodeInvalidToken, fmt.Errorf("invalid token: %v", err))
+	}
+
+	t, err := th.tokenService.FindByPlainToken(plainToken)
+	if err != nil || t == nil {
+		return 0, withCode(proto.ErrorCodeInvalidToken, fmt.Errorf("failed to find token owner: %v", err))
+	}
+
+	return t.UserId, nil
+}
+
+// heartbeat returns how often tunnels are checked for activity, and how long a tunnel can go
+// without activity before it's closed, falling back to the defaults if not configured
+func (th *TunnelHandler) heartbeat() (interval, timeout time.Duration) {
+	interval, timeout = th.cfg.HeartbeatInterval, th.cfg.HeartbeatTimeout
+	if interval <= 0 {
+		interval = config.DefaultHeartbeatInterval
+	}
+	if timeout <= 0 {
+		timeout = config.DefaultHeartbeatTimeout
 	}
+	return interval, timeout
+}
 
-	return nil
+// requestTimeout returns how long to wait for the client to answer a proxied request
+func (th *TunnelHandler) requestTimeout() time.Duration {
+	if th.cfg.RequestTimeout <= 0 {
+		return config.DefaultRequestTimeout
+	}
+	return th.cfg.RequestTimeout
 }
 
 // cleanupLoop periodically checks for dead connections and cleans them up
 func (th *TunnelHandler) cleanupLoop() {
-	ticker := time.NewTicker(60 * time.Second) // Check every 60 seconds
+	interval, _ := th.heartbeat()
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
 			th.cleanupDeadConnections()
+			th.closeExpiredTunnels()
+			th.renewClaims()
 		case <-th.done:
 			return
 		}
 	}
 }
 
-// isConnClosed pings the websocket connection to check if it's still alive
-func (th *TunnelHandler) isConnClosed(ws *websocket.Conn) bool {
-	err := websocket.JSON.Send(ws, proto.Message{Type: proto.MessageTypePing})
-	return err != nil
-}
-
-// cleanupDeadConnections removes any tunnels with closed connections
+// cleanupDeadConnections removes any tunnels that haven't heard from their client within the heartbeat timeout
 func (th *TunnelHandler) cleanupDeadConnections() {
 	th.logger.Debug("running cleanup dead connections")
-	th.mu.Lock()
-	defer th.mu.Unlock()
+	_, timeout := th.heartbeat()
 
+	th.mu.Lock()
+	var closed []string
 	for id, tunnel := range th.tunnels {
-		if th.isConnClosed(tunnel.WSConn) {
-			th.logger.Info("removing dead tunnel connection", "id", id)
-			delete(th.tunnels, id)
-
-			// Clean up any pending requests for this tunnel
-			for reqID, ch := range th.pendingRequests {
-				if strings.HasPrefix(reqID, id) {
-					close(ch)
-					delete(th.pendingRequests, reqID)
-				}
+		if time.Since(tunnel.LastActivity) > timeout {
+			th.logger.Info("removing dead tunnel connection", "id", id, "lastActivity", tunnel.LastActivity)
+			th.removeTunnelLocked(tunnel)
+			closed = append(closed, id)
+		}
+	}
+	th.mu.Unlock()
+
+	th.releaseTunnels(closed...)
+}
+
+// expiresAt returns when the tunnel reaches the max lifetime, zero if tunnels don't expire
+func (th *TunnelHandler) expiresAt(t *Tunnel) time.Time {
+	if th.cfg.TunnelMaxLifetime <= 0 {
+		return time.Time{}
+	}
+	return t.Created.Add(th.cfg.TunnelMaxLifetime)
+}
+
+// closeExpiredTunnels closes any tunnels past their max lifetime, or that haven't been used within the
+// idle timeout, telling their client why so it doesn't reconnect them
+func (th *TunnelHandler) closeExpiredTunnels() {
+	if th.cfg.TunnelIdleTimeout <= 0 && th.cfg.TunnelMaxLifetime <= 0 {
+		return
+	}
+
+	th.mu.Lock()
+	expired := make(map[*Tunnel]proto.TunnelClosed)
+	for _, tunnel := range th.tunnels {
+		switch expiresAt := th.expiresAt(tunnel); {
+		case !expiresAt.IsZero() && time.Now().After(expiresAt):
+			th.logger.Info("closing expired tunnel", "id", tunnel.ID, "created", tunnel.Created)
+			expired[tunnel] = proto.TunnelClosed{
+				Reason:  proto.TunnelClosedExpired,
+				Message: fmt.Sprintf("tunnel expired after %s", th.cfg.TunnelMaxLifetime),
+			}
+		case th.cfg.TunnelIdleTimeout > 0 && time.Since(tunnel.LastRequest) > th.cfg.TunnelIdleTimeout:
+			th.logger.Info("closing idle tunnel", "id", tunnel.ID, "lastRequest", tunnel.LastRequest)
+			expired[tunnel] = proto.TunnelClosed{
+				Reason:  proto.TunnelClosedIdle,
+				Message: "tunnel closed due to inactivity",
 			}
 		}
 	}
+	th.mu.Unlock()
+
+	for tunnel, reason := range expired {
+		th.closeTunnel(tunnel, reason)
+	}
+}
+
+// closeTunnel tells the client why its tunnel is being closed, then closes it
+func (th *TunnelHandler) closeTunnel(tunnel *Tunnel, reason proto.TunnelClosed) {
+	if err := tunnel.send(proto.MessageTypeTunnelClosed, reason); err != nil {
+		th.logger.Warn("failed to send tunnel closed message", "id", tunnel.ID, "error", err)
+	}
+
+	th.mu.Lock()
+	// The client may have disconnected, or the tunnel been closed, in the meantime
+	if th.tunnels[tunnel.ID] != tunnel {
+		th.mu.Unlock()
+		return
+	}
+	th.removeTunnelLocked(tunnel)
+	th.mu.Unlock()
+
+	th.releaseTunnels(tunnel.ID)
+}
+
+// removeTunnelLocked closes the connections of the tunnel and removes it, closing the clients websocket
+// once no other tunnel shares it. The caller must hold the lock
+func (th *TunnelHandler) removeTunnelLocked(tunnel *Tunnel) {
+	th.closeTCPTunnelLocked(tunnel)
+	th.closePortLocked(tunnel)
+	th.closePassthroughConnsLocked(tunnel)
+	th.removePendingRequestsLocked(tunnel)
+	close(tunnel.done)
+	delete(th.tunnels, tunnel.ID)
+	activeTunnels.Dec()
+
+	for _, other := range th.tunnels {
+		if other.WSConn == tunnel.WSConn {
+			return
+		}
+	}
+	tunnel.WSConn.Close()
+}
+
+// removePendingRequestsLocked drops the requests still waiting on the client of a removed tunnel, so a
+// late response isn't delivered. The requests themselves are failed by the tunnel closing. The caller
+// must hold the lock
+func (th *TunnelHandler) removePendingRequestsLocked(tunnel *Tunnel) {
+	for reqID, pending := range th.pendingRequests {
+		if pending.tunnelID == tunnel.ID {
+			delete(th.pendingRequests, reqID)
+		}
+	}
 }
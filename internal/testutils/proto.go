@@ -0,0 +1,30 @@
+package testutil
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/jwtly10/go-tunol/internal/proto"
+)
+
+// Payload encodes a message payload for a proto.Message sent by a test
+func Payload(t *testing.T, v interface{}) json.RawMessage {
+	t.Helper()
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Could not marshal payload: %v", err)
+	}
+	return b
+}
+
+// PayloadMap decodes the payload of a received message into a map, for checking single fields
+func PayloadMap(t *testing.T, msg proto.Message) map[string]interface{} {
+	t.Helper()
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(msg.Payload, &m); err != nil {
+		t.Fatalf("Could not unmarshal payload: %v", err)
+	}
+	return m
+}
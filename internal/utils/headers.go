@@ -0,0 +1,21 @@
+package utils
+
+import "net/http"
+
+// hopByHopHeaders only apply to a single connection, so must never be forwarded by a proxy
+var hopByHopHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// IsHopByHopHeader reports whether the header only applies to a single connection
+func IsHopByHopHeader(name string) bool {
+	return hopByHopHeaders[http.CanonicalHeaderKey(name)]
+}
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// redactedValue replaces the value of sensitive headers in logs
+const redactedValue = "[REDACTED]"
+
+// sensitiveHeaders carry credentials, so their values are never logged
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Api-Key",
+}
+
+// HeaderRedactor masks the values of sensitive headers logged as an http.Header or map[string]string,
+// the two forms headers are logged in by the server and the client
+type HeaderRedactor struct {
+	names map[string]bool
+}
+
+// NewHeaderRedactor redacts the default sensitive headers, along with any extra ones
+func NewHeaderRedactor(extra []string) *HeaderRedactor {
+	names := make(map[string]bool, len(sensitiveHeaders)+len(extra))
+	for _, name := range sensitiveHeaders {
+		names[name] = true
+	}
+	for _, name := range extra {
+		names[http.CanonicalHeaderKey(name)] = true
+	}
+	return &HeaderRedactor{names: names}
+}
+
+// ReplaceAttr is used as the slog.HandlerOptions ReplaceAttr, so headers are redacted however they're logged
+func (r *HeaderRedactor) ReplaceAttr(_ []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() != slog.KindAny {
+		return a
+	}
+
+	switch h := a.Value.Any().(type) {
+	case http.Header:
+		a.Value = slog.AnyValue(r.redactHeader(h))
+	case map[string]string:
+		a.Value = slog.AnyValue(r.redactMap(h))
+	}
+	return a
+}
+
+func (r *HeaderRedactor) redactHeader(h http.Header) http.Header {
+	redacted := make(http.Header, len(h))
+	for k, v := range h {
+		if r.names[http.CanonicalHeaderKey(k)] {
+			v = []string{redactedValue}
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
+
+func (r *HeaderRedactor) redactMap(h map[string]string) map[string]string {
+	redacted := make(map[string]string, len(h))
+	for k, v := range h {
+		if r.names[http.CanonicalHeaderKey(k)] {
+			v = redactedValue
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
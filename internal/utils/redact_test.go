@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHeaderRedactor(t *testing.T) {
+	var buf bytes.Buffer
+	redactor := NewHeaderRedactor([]string{"x-internal-secret"})
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{ReplaceAttr: redactor.ReplaceAttr}))
+
+	header := http.Header{
+		"Authorization":     {"Bearer secret-token"},
+		"Cookie":            {"session=secret-session"},
+		"X-Internal-Secret": {"secret-extra"},
+		"Accept":            {"text/html"},
+	}
+	headers := map[string]string{
+		"set-cookie":   "session=secret-cookie",
+		"X-Api-Key":    "secret-key",
+		"Content-Type": "application/json",
+	}
+	logger.Info("request", "headers", header, "forwarded", headers, "path", "/kept-path")
+
+	out := buf.String()
+	if strings.Contains(out, "secret-") {
+		t.Errorf("sensitive header values were logged: %s", out)
+	}
+	for _, want := range []string{"text/html", "application/json", "/kept-path", redactedValue} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in log: %s", want, out)
+		}
+	}
+
+	// The logged headers are copies, the originals are still used for the request
+	if header.Get("Authorization") != "Bearer secret-token" || headers["X-Api-Key"] != "secret-key" {
+		t.Errorf("redacting modified the original headers")
+	}
+}
@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"net"
+	"time"
+)
+
+// WriteQueue writes frames to a connection from its own goroutine, so whoever hands it frames, e.g. the loop
+// reading a websocket shared by many tunnels, never waits on one slow connection
+type WriteQueue[T any] struct {
+	frames  chan T
+	closing chan struct{}
+	timeout time.Duration
+	write   func(conn net.Conn, frame T) error
+}
+
+// NewWriteQueue holds up to size frames waiting to be written, each of which must be written within the timeout
+func NewWriteQueue(size int, timeout time.Duration) *WriteQueue[[]byte] {
+	return NewWriteQueueFunc(size, timeout, func(conn net.Conn, frame []byte) error {
+		_, err := conn.Write(frame)
+		return err
+	})
+}
+
+// NewWriteQueueFunc is NewWriteQueue for frames that aren't just bytes, e.g. websocket messages with their
+// payload type, which are written to the connection by write
+func NewWriteQueueFunc[T any](size int, timeout time.Duration, write func(conn net.Conn, frame T) error) *WriteQueue[T] {
+	return &WriteQueue[T]{
+		frames:  make(chan T, size),
+		closing: make(chan struct{}),
+		timeout: timeout,
+		write:   write,
+	}
+}
+
+// Queue hands a frame to the writer, reporting false if the queue is full. Frames are never dropped, as that
+// would corrupt the stream, so a full queue means the connection can't keep up and should be closed
+func (q *WriteQueue[T]) Queue(frame T) bool {
+	select {
+	case <-q.closing:
+		return true // The frame is no longer wanted
+	default:
+	}
+
+	select {
+	case q.frames <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops the writer once the frames already queued are written. It must only be called once
+func (q *WriteQueue[T]) Close() {
+	close(q.closing)
+}
+
+// Run writes queued frames to the connection until the queue is closed or a write fails, then closes the
+// connection. Closing the connection from elsewhere stops it straight away
+func (q *WriteQueue[T]) Run(conn net.Conn) error {
+	defer conn.Close()
+	for {
+		select {
+		case frame := <-q.frames:
+			if err := q.writeFrame(conn, frame); err != nil {
+				return err
+			}
+		case <-q.closing:
+			for {
+				select {
+				case frame := <-q.frames:
+					if err := q.writeFrame(conn, frame); err != nil {
+						return err
+					}
+				default:
+					return nil
+				}
+			}
+		}
+	}
+}
+
+func (q *WriteQueue[T]) writeFrame(conn net.Conn, frame T) error {
+	conn.SetWriteDeadline(time.Now().Add(q.timeout))
+	return q.write(conn, frame)
+}
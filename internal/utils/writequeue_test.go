@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWriteQueue(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	q := NewWriteQueue(2, time.Second)
+	done := make(chan error, 1)
+	go func() { done <- q.Run(local) }()
+
+	// Frames queued before closing are still written, and the connection is closed after them
+	if !q.Queue([]byte("hello ")) || !q.Queue([]byte("world")) {
+		t.Fatal("expected frames to be queued")
+	}
+	q.Close()
+
+	got, err := io.ReadAll(remote)
+	if err != nil {
+		t.Fatalf("failed to read frames: %v", err)
+	}
+	if string(got) != "hello world" {
+		t.Errorf("expected %q to be written, got %q", "hello world", got)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("expected the writer to stop cleanly, got %v", err)
+	}
+}
+
+func TestWriteQueueFull(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	// Nothing reads the pipe, so the writer is stuck on the first frame and the rest wait in the queue
+	q := NewWriteQueue(1, 50*time.Millisecond)
+	done := make(chan error, 1)
+	go func() { done <- q.Run(local) }()
+
+	q.Queue([]byte("stuck"))
+	full := false
+	for i := 0; i < 3; i++ {
+		if !q.Queue([]byte("waiting")) {
+			full = true
+		}
+	}
+	if !full {
+		t.Error("expected the queue to fill up behind a slow connection")
+	}
+
+	// The write times out rather than holding the writer forever
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected the stuck write to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the stuck write to fail")
+	}
+}
@@ -0,0 +1,108 @@
+// Package version holds the version the server and CLI were built as, which is set at build time with
+//
+//	go build -ldflags "-X github.com/jwtly10/go-tunol/internal/version.Version=v0.2.0 -X github.com/jwtly10/go-tunol/internal/version.Commit=$(git rev-parse --short HEAD)"
+package version
+
+import (
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// Version is the release the binary was built as, dev if it wasn't built for a release
+var Version = "dev"
+
+// Commit is the commit the binary was built from. If not set at build time, it's taken from the
+// build info go embeds when building from a git checkout
+var Commit = ""
+
+// Header is sent by the CLI in the websocket handshake, so the server knows which version it's talking to
+const Header = "X-Tunol-Version"
+
+func init() {
+	if Commit != "" {
+		return
+	}
+	Commit = "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" && len(s.Value) >= 7 {
+				Commit = s.Value[:7]
+			}
+		}
+	}
+}
+
+// String returns the version and commit, as shown by `tunol --version`
+func String() string {
+	return Version + " (" + Commit + ")"
+}
+
+// Major returns the major version of a release like v1.2.3, or false for dev builds and anything
+// that isn't a release version
+func Major(v string) (int, bool) {
+	v, ok := strings.CutPrefix(v, "v")
+	if !ok {
+		return 0, false
+	}
+	major, _, _ := strings.Cut(v, ".")
+	n, err := strconv.Atoi(major)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// release parses the major, minor and patch numbers of a release like v1.2.3, missing numbers are 0.
+// Anything after a - or +, e.g. v1.2.3-rc.1, is ignored. False is returned for anything that isn't a release
+func release(v string) ([3]int, bool) {
+	var parts [3]int
+	v, ok := strings.CutPrefix(v, "v")
+	if !ok {
+		return parts, false
+	}
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	for i, s := range strings.SplitN(v, ".", 3) {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return parts, false
+		}
+		parts[i] = n
+	}
+	return parts, true
+}
+
+// Newer reports whether the release latest is newer than current. It's false if either isn't a release,
+// so dev builds are never told to update
+func Newer(latest, current string) bool {
+	l, ok := release(latest)
+	if !ok {
+		return false
+	}
+	c, ok := release(current)
+	if !ok {
+		return false
+	}
+	for i := range l {
+		if l[i] != c[i] {
+			return l[i] > c[i]
+		}
+	}
+	return false
+}
+
+// Compatible reports whether a client of the version can be expected to work with this build. Releases
+// are compatible within a major version, and dev builds are assumed to be compatible with everything
+func Compatible(client string) bool {
+	clientMajor, ok := Major(client)
+	if !ok {
+		return true
+	}
+	major, ok := Major(Version)
+	if !ok {
+		return true
+	}
+	return clientMajor == major
+}
@@ -0,0 +1,78 @@
+package version
+
+import "testing"
+
+func TestMajor(t *testing.T) {
+	tests := []struct {
+		version string
+		want    int
+		wantOk  bool
+	}{
+		{"v1.2.3", 1, true},
+		{"v0.1.0", 0, true},
+		{"v2", 2, true},
+		{"dev", 0, false},
+		{"1.2.3", 0, false},
+		{"vnext", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := Major(tt.version)
+		if got != tt.want || ok != tt.wantOk {
+			t.Errorf("Major(%q) = %v, %v, want %v, %v", tt.version, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
+
+func TestCompatible(t *testing.T) {
+	defer func(v string) { Version = v }(Version)
+	Version = "v1.4.0"
+
+	tests := []struct {
+		client string
+		want   bool
+	}{
+		{"v1.0.0", true},
+		{"v1.9.2", true},
+		{"v0.3.0", false},
+		{"v2.0.0", false},
+		{"dev", true},
+		{"", true},
+	}
+
+	for _, tt := range tests {
+		if got := Compatible(tt.client); got != tt.want {
+			t.Errorf("Compatible(%q) = %v, want %v", tt.client, got, tt.want)
+		}
+	}
+
+	// A dev server doesn't know what it's compatible with
+	Version = "dev"
+	if !Compatible("v0.3.0") {
+		t.Errorf("Compatible() = false for a dev build, want true")
+	}
+}
+
+func TestNewer(t *testing.T) {
+	tests := []struct {
+		latest, current string
+		want            bool
+	}{
+		{"v1.3.0", "v1.2.9", true},
+		{"v1.10.0", "v1.9.0", true},
+		{"v2.0.0", "v1.9.9", true},
+		{"v1.2.1", "v1.2", true},
+		{"v1.2.3", "v1.2.3", false},
+		{"v1.2.3", "v1.2.3-rc.1", false},
+		{"v1.2.0", "v1.3.0", false},
+		{"v1.3.0", "dev", false},
+		{"dev", "v1.3.0", false},
+		{"", "v1.3.0", false},
+	}
+
+	for _, tt := range tests {
+		if got := Newer(tt.latest, tt.current); got != tt.want {
+			t.Errorf("Newer(%q, %q) = %v, want %v", tt.latest, tt.current, got, tt.want)
+		}
+	}
+}
@@ -2,13 +2,14 @@ package auth
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/jwtly10/go-tunol/internal/auth/token"
@@ -24,6 +25,8 @@ type Handler struct {
 	tokenService   *token.Service
 	sessionService *SessionService
 	userRepository *user.Repository
+	providers      map[string]OAuthProvider // The providers users can sign in with, keyed by name
+	credentials    *CredentialService       // Local accounts, used when password login is enabled
 	cfg            *config.ServerConfig
 	logger         *slog.Logger
 }
@@ -39,13 +42,54 @@ func NewAuthHandler(db *db.Database, tmpl *template.Template, tokenService *toke
 		tokenService:   tokenService,
 		sessionService: sessionService,
 		userRepository: userRepository,
+		providers:      newProviders(cfg),
+		credentials:    NewCredentialService(db, userRepository),
 		cfg:            cfg,
 		logger:         logger,
 	}
 }
 
-// HandleLogin shows the login page
+// loginPage is the data for the login and register pages
+type loginPage struct {
+	GitHub   bool
+	Google   bool
+	Password bool   // Whether local accounts are enabled
+	Register bool   // Whether new local accounts can be registered
+	Email    string // Kept in the form when it is re-rendered with an error
+	Error    string
+}
+
+func (h *Handler) renderLoginPage(w http.ResponseWriter, name string, status int, page loginPage) {
+	// The page shows a button for each provider that's configured
+	page.GitHub = h.providers["github"] != nil
+	page.Google = h.providers["google"] != nil
+	page.Password = h.passwordLoginEnabled()
+	page.Register = h.registrationEnabled()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := h.templates.ExecuteTemplate(w, name, page); err != nil {
+		h.logger.Error("Failed to render template", "template", name, "error", err)
+	}
+}
+
+func (h *Handler) passwordLoginEnabled() bool {
+	return h.cfg != nil && h.cfg.Auth.PasswordLogin
+}
+
+// registrationEnabled reports whether anyone can register a local account. It's never checked against the
+// OAuth allowlist, as nothing verifies the email belongs to whoever registers it
+func (h *Handler) registrationEnabled() bool {
+	return h.passwordLoginEnabled() && h.cfg.Auth.PasswordRegister
+}
+
+// HandleLogin shows the login page, or signs in a local account when the login form is posted
 func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		h.handlePasswordLogin(w, r)
+		return
+	}
+
 	// Check if user is already authenticated
 	cookie, err := r.Cookie(sessionCookie)
 	if err == nil {
@@ -57,12 +101,60 @@ func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	err = h.templates.ExecuteTemplate(w, "login.html", nil)
+	h.renderLoginPage(w, "login.html", http.StatusOK, loginPage{})
+}
+
+// handlePasswordLogin signs in a local account with the email and password from the login form
+func (h *Handler) handlePasswordLogin(w http.ResponseWriter, r *http.Request) {
+	if !h.passwordLoginEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	email := r.FormValue("email")
+	u, err := h.credentials.Authenticate(email, r.FormValue("password"))
+	if errors.Is(err, ErrInvalidCredentials) {
+		h.logger.Warn("Failed password login", "email", email)
+		h.renderLoginPage(w, "login.html", http.StatusUnauthorized, loginPage{Email: email, Error: "Invalid email or password"})
+		return
+	}
+	if err != nil {
+		h.logger.Error("Failed to authenticate user", "error", err)
+		http.Error(w, "Authentication failed", http.StatusInternalServerError)
+		return
+	}
+
+	h.startSession(w, r, u)
+}
+
+// HandleRegister shows the register page, or creates a local account when the register form is posted
+func (h *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
+	if !h.registrationEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		h.renderLoginPage(w, "register.html", http.StatusOK, loginPage{})
+		return
+	}
+
+	email := r.FormValue("email")
+	u, err := h.credentials.Register(email, r.FormValue("password"))
+	if errors.Is(err, ErrEmailTaken) || errors.Is(err, ErrInvalidEmail) || errors.Is(err, ErrWeakPassword) {
+		h.logger.Warn("Failed to register user", "email", email, "error", err)
+		h.renderLoginPage(w, "register.html", http.StatusBadRequest, loginPage{Email: email, Error: err.Error()})
+		return
+	}
 	if err != nil {
-		h.logger.Error("Failed to render login template", "error", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		// Not shown, it may be a database error
+		h.logger.Error("Failed to register user", "email", email, "error", err)
+		h.renderLoginPage(w, "register.html", http.StatusInternalServerError, loginPage{Email: email, Error: "Registration failed, please try again"})
 		return
 	}
+
+	h.logger.Info("User registered", "user", u.Username)
+	h.startSession(w, r, u)
 }
 
 // ValidateClientToken is for validation of any client HTTP requests have a valid token
@@ -89,24 +181,18 @@ func (h *Handler) ValidateClientToken(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-// GitHub oAuth flow
-const (
-	githubTokenURL = "https://github.com/login/oauth/access_token"
-	githubUserURL  = "https://api.github.com/user"
-)
-
-type githubUser struct {
-	ID        int64  `json:"id"`
-	Login     string `json:"login"`
-	AvatarURL string `json:"avatar_url"`
-	Email     string `json:"email"`
-}
+// HandleOAuthLogin redirects the user to the provider in the path to sign in
+func (h *Handler) HandleOAuthLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := h.providers[r.PathValue("provider")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
 
-func (h *Handler) HandleGitHubLogin(w http.ResponseWriter, r *http.Request) {
 	state := uuid.New().String()
 
 	http.SetCookie(w, &http.Cookie{
-		Name:     "github_oauth_state",
+		Name:     stateCookie(provider),
 		Value:    state,
 		Path:     "/",
 		HttpOnly: true,
@@ -115,18 +201,19 @@ func (h *Handler) HandleGitHubLogin(w http.ResponseWriter, r *http.Request) {
 		SameSite: http.SameSiteLaxMode,
 	})
 
-	authURL := fmt.Sprintf(
-		"https://github.com/login/oauth/authorize?client_id=%s&state=%s&scope=user:email",
-		h.cfg.Auth.GithubClientId,
-		state,
-	)
-
-	// Only pass the headers that are needed to github
-	w.Header().Set("Location", authURL)
+	// Only pass the headers that are needed to the provider
+	w.Header().Set("Location", provider.AuthURL(state))
 	w.WriteHeader(http.StatusTemporaryRedirect)
 }
 
-func (h *Handler) HandleGitHubCallback(w http.ResponseWriter, r *http.Request) {
+// HandleOAuthCallback signs in the user the provider in the path has redirected back
+func (h *Handler) HandleOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := h.providers[r.PathValue("provider")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
 	code := r.URL.Query().Get("code")
 	state := r.URL.Query().Get("state")
 
@@ -135,40 +222,50 @@ func (h *Handler) HandleGitHubCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	expectedState, err := r.Cookie("github_oauth_state")
+	expectedState, err := r.Cookie(stateCookie(provider))
 	if err != nil || state != expectedState.Value {
 		http.Error(w, "Invalid state parameter", http.StatusBadRequest)
 		return
 	}
 
-	// Exchange code for GitHub access token
-	accessToken, err := h.exchangeCodeForToken(code)
+	// The state is single use, so clear it now it has been checked
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie(provider),
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	// Exchange code for an access token with the provider
+	accessToken, err := provider.Exchange(r.Context(), code)
 	if err != nil {
-		h.logger.Error("Failed to exchange code for token", "error", err)
+		h.logger.Error("Failed to exchange code for token", "provider", provider.Name(), "error", err)
 		http.Error(w, "Authentication failed", http.StatusInternalServerError)
 		return
 	}
 
-	// Fetch GitHub user info
-	githubUser, err := h.fetchGitHubUser(accessToken)
+	// Fetch the users info from the provider
+	providerUser, err := provider.FetchUser(r.Context(), accessToken)
 	if err != nil {
-		h.logger.Error("Failed to fetch GitHub user", "error", err)
+		h.logger.Error("Failed to fetch provider user", "provider", provider.Name(), "error", err)
 		http.Error(w, "Failed to fetch user information", http.StatusInternalServerError)
 		return
 	}
 
 	user := &user.User{
-		GithubID:        githubUser.ID,
-		GithubUsername:  githubUser.Login,
-		GithubAvatarURL: githubUser.AvatarURL,
-		GithubEmail:     githubUser.Email,
+		Provider:       provider.Name(),
+		ProviderUserID: providerUser.ID,
+		Username:       providerUser.Username,
+		AvatarURL:      providerUser.AvatarURL,
+		Email:          providerUser.Email,
 	}
 
 	// TODO, remove this after testing/dev
-	allowedUsers := []string{"jwtly10"}
-
-	if !contains(allowedUsers, user.GithubUsername) {
-		h.logger.Error("Unauthed user signed up", "username", user.GithubUsername)
+	if !h.cfg.Auth.AllowsUser(user.Username) {
+		h.logger.Error("Unauthed user signed up", "provider", user.Provider, "username", user.Username)
 		http.Error(w, "Access denied. This service is coming soon!", http.StatusForbidden)
 		return
 	}
@@ -181,26 +278,51 @@ func (h *Handler) HandleGitHubCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create a new session
-	session, err := h.sessionService.CreateSession(user.ID, sessionDuration)
+	h.startSession(w, r, user)
+}
+
+// startSession signs the user in to the dashboard with a new session cookie
+func (h *Handler) startSession(w http.ResponseWriter, r *http.Request, u *user.User) {
+	session, err := h.sessionService.CreateSession(u.ID, sessionDuration)
 	if err != nil {
 		h.logger.Error("Failed to create session", "error", err)
 		http.Error(w, "Failed to create session", http.StatusInternalServerError)
 		return
 	}
 
-	// Set http only session cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     sessionCookie,
-		Value:    session.Token,
-		Path:     cookiePath,
-		Expires:  session.ExpiresAt,
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteLaxMode,
-	})
+	setSessionCookie(w, session)
+
+	// Send the user back to the page that needed them to log in, if there was one
+	target := "/dashboard"
+	if returnTo, err := r.Cookie(returnToCookie); err == nil && isLocalPath(returnTo.Value) {
+		target = returnTo.Value
+		http.SetCookie(w, &http.Cookie{
+			Name:     returnToCookie,
+			Value:    "",
+			Path:     cookiePath,
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
 
-	http.Redirect(w, r, "/dashboard", http.StatusTemporaryRedirect)
+	// A temporary redirect would repeat a form post, so the page has to be fetched instead
+	status := http.StatusTemporaryRedirect
+	if r.Method == http.MethodPost {
+		status = http.StatusSeeOther
+	}
+	http.Redirect(w, r, target, status)
+}
+
+// isLocalPath checks the path is on this server, so the return to cookie can't redirect elsewhere
+func isLocalPath(path string) bool {
+	return strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "//") && !strings.HasPrefix(path, "/\\")
+}
+
+// stateCookie is the name of the cookie holding the oauth state while signing in with the provider
+func stateCookie(p OAuthProvider) string {
+	return p.Name() + "_oauth_state"
 }
 
 func (h *Handler) HandleLogout(w http.ResponseWriter, r *http.Request) {
@@ -227,90 +349,122 @@ func (h *Handler) HandleLogout(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
 }
 
-func (h *Handler) exchangeCodeForToken(code string) (string, error) {
-	data := url.Values{
-		"client_id":     {h.cfg.Auth.GithubClientId},
-		"client_secret": {h.cfg.Auth.GithubClientSecret},
-		"code":          {code},
-	}
-
-	req, err := http.NewRequest("POST", githubTokenURL, strings.NewReader(data.Encode()))
-	if err != nil {
-		return "", err
+// HandleLogoutEverywhere deletes all of the users sessions, e.g. if a device they were logged in on is lost
+func (h *Handler) HandleLogoutEverywhere(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", err
+	u := r.Context().Value("user").(*user.User)
+	if err := h.sessionService.DeleteAllUserSessions(u.ID); err != nil {
+		h.logger.Error("Failed to delete sessions", "error", err)
+		http.Error(w, "Failed to log out everywhere", http.StatusInternalServerError)
+		return
 	}
-	defer resp.Body.Close()
 
-	var result struct {
-		AccessToken string `json:"access_token"`
-		TokenType   string `json:"token_type"`
-		Scope       string `json:"scope"`
-	}
+	h.logger.Info("User logged out everywhere", "userID", u.ID)
 
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", err
-	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     cookiePath,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
 
-	return result.AccessToken, nil
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
-func (h *Handler) fetchGitHubUser(accessToken string) (*githubUser, error) {
-	req, err := http.NewRequest("GET", githubUserURL, nil)
-	if err != nil {
-		return nil, err
+func (h *Handler) HandleValidateToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	req.Header.Set("Authorization", "token "+accessToken)
-	req.Header.Set("Accept", "application/json")
+	// Read the authorisation header and validate
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		http.Error(w, "No token provided", http.StatusUnauthorized)
+		return
+	}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
+	plainToken := strings.TrimPrefix(authHeader, "Bearer ")
+	if valid, err := h.tokenService.ValidateToken(plainToken); !valid {
+		h.logger.Warn("Failed to validate token", "error", err)
+		http.Error(w, fmt.Sprintf("Invalid token: %s", err), http.StatusUnauthorized)
+		return
 	}
-	defer resp.Body.Close()
 
-	var user githubUser
-	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
-		return nil, err
+	t, err := h.tokenService.FindByPlainToken(plainToken)
+	if err != nil || t == nil {
+		h.logger.Error("Failed to find token", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
 
-	return &user, nil
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TokenStatus{
+		Valid:     true,
+		ExpiresAt: t.ExpiresAt,
+	})
 }
 
-func (h *Handler) HandleValidateToken(w http.ResponseWriter, r *http.Request) {
+// TokenStatus is returned when a token is validated, so the CLI can warn before it expires
+type TokenStatus struct {
+	Valid     bool      `json:"valid"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Profile is the user and token behind a bearer token, as shown by the CLI
+type Profile struct {
+	Username         string    `json:"username"`
+	GithubUsername   string    `json:"github_username"` // Deprecated: kept for older CLIs, use Username
+	TokenDescription string    `json:"token_description"`
+	TokenExpiresAt   time.Time `json:"token_expires_at"`
+}
+
+// HandleWhoAmI returns the profile of the user who owns the bearer token
+func (h *Handler) HandleWhoAmI(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Read the authorisation header and validate
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
 		http.Error(w, "No token provided", http.StatusUnauthorized)
 		return
 	}
 
-	token := strings.TrimPrefix(authHeader, "Bearer ")
-	_, err := h.tokenService.ValidateToken(token)
-	if err != nil {
-		h.logger.Error("Failed to validate token", "error", err)
-		http.Error(w, fmt.Sprintf("Invalid token: %s", err), http.StatusInternalServerError)
+	plainToken := strings.TrimPrefix(authHeader, "Bearer ")
+	if valid, err := h.tokenService.ValidateToken(plainToken); !valid {
+		h.logger.Warn("Failed to validate token", "error", err)
+		http.Error(w, fmt.Sprintf("Invalid token: %s", err), http.StatusUnauthorized)
 		return
 	}
-}
 
-func contains(arr []string, val string) bool {
-	for _, v := range arr {
-		if v == val {
-			return true
-		}
+	t, err := h.tokenService.FindByPlainToken(plainToken)
+	if err != nil || t == nil {
+		h.logger.Error("Failed to find token", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
-	return false
+
+	u, err := h.userRepository.FindByID(t.UserId)
+	if err != nil || u == nil {
+		h.logger.Error("Failed to fetch token owner", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Profile{
+		Username:         u.Username,
+		GithubUsername:   u.Username,
+		TokenDescription: t.Description,
+		TokenExpiresAt:   t.ExpiresAt,
+	})
 }
@@ -0,0 +1,340 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/auth/token"
+	"github.com/jwtly10/go-tunol/internal/config"
+	testutil "github.com/jwtly10/go-tunol/internal/testutils"
+	"github.com/jwtly10/go-tunol/internal/web/user"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleWhoAmI(t *testing.T) {
+	db, cleanup := testutil.SetupTestDB(t)
+	defer cleanup()
+
+	tokenService := token.NewTokenService(db)
+	userRepo := user.NewUserRepository(db)
+	h := NewAuthHandler(db, nil, tokenService, nil, userRepo, nil, nil)
+
+	u, err := userRepo.CreateUser(&user.User{
+		Provider:       "github",
+		ProviderUserID: "12345",
+		Username:       "testuser",
+	})
+	require.NoError(t, err)
+
+	tok, err := tokenService.CreateToken(u.ID, "Laptop", 24*time.Hour)
+	require.NoError(t, err)
+
+	t.Run("returns the token owner", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/auth/whoami", nil)
+		req.Header.Set("Authorization", "Bearer "+tok.PlainToken)
+		rec := httptest.NewRecorder()
+
+		h.HandleWhoAmI(rec, req)
+
+		require.Equal(t, http.StatusOK, rec.Code)
+		var profile Profile
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&profile))
+		require.Equal(t, "testuser", profile.Username)
+		require.Equal(t, "Laptop", profile.TokenDescription)
+		require.WithinDuration(t, tok.ExpiresAt, profile.TokenExpiresAt, time.Second)
+	})
+
+	t.Run("rejects a missing token", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.HandleWhoAmI(rec, httptest.NewRequest(http.MethodGet, "/auth/whoami", nil))
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("rejects an unknown token", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/auth/whoami", nil)
+		req.Header.Set("Authorization", "Bearer not-a-real-token")
+		rec := httptest.NewRecorder()
+
+		h.HandleWhoAmI(rec, req)
+
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+}
+
+func TestHandleGitHubLoginSetsState(t *testing.T) {
+	h := NewAuthHandler(nil, nil, nil, nil, nil, &config.ServerConfig{}, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/github/login", nil)
+	req.SetPathValue("provider", "github")
+	rec := httptest.NewRecorder()
+	h.HandleOAuthLogin(rec, req)
+
+	require.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+
+	var state *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "github_oauth_state" {
+			state = c
+		}
+	}
+	require.NotNil(t, state)
+	require.NotEmpty(t, state.Value)
+
+	location, err := url.Parse(rec.Header().Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, state.Value, location.Query().Get("state"))
+}
+
+func TestHandleGitHubCallbackRejectsInvalidState(t *testing.T) {
+	h := NewAuthHandler(nil, nil, nil, nil, nil, &config.ServerConfig{}, nil)
+
+	tests := []struct {
+		name        string
+		query       string
+		cookieState string
+	}{
+		{name: "missing state", query: "code=abc"},
+		{name: "missing state cookie", query: "code=abc&state=expected"},
+		{name: "mismatched state", query: "code=abc&state=forged", cookieState: "expected"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/auth/github/callback?"+tt.query, nil)
+			req.SetPathValue("provider", "github")
+			if tt.cookieState != "" {
+				req.AddCookie(&http.Cookie{Name: "github_oauth_state", Value: tt.cookieState})
+			}
+			rec := httptest.NewRecorder()
+
+			h.HandleOAuthCallback(rec, req)
+
+			require.Equal(t, http.StatusBadRequest, rec.Code)
+		})
+	}
+}
+
+func TestHandleValidateToken(t *testing.T) {
+	db, cleanup := testutil.SetupTestDB(t)
+	defer cleanup()
+
+	tokenService := token.NewTokenService(db)
+	userRepo := user.NewUserRepository(db)
+	h := NewAuthHandler(db, nil, tokenService, nil, userRepo, nil, nil)
+
+	u, err := userRepo.CreateUser(&user.User{Provider: "github", ProviderUserID: "12345", Username: "testuser"})
+	require.NoError(t, err)
+
+	tok, err := tokenService.CreateToken(u.ID, "Laptop", 72*time.Hour)
+	require.NoError(t, err)
+
+	validate := func(plainToken string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/auth/validate", nil)
+		req.Header.Set("Authorization", "Bearer "+plainToken)
+		rec := httptest.NewRecorder()
+		h.HandleValidateToken(rec, req)
+		return rec
+	}
+
+	rec := validate(tok.PlainToken)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var status TokenStatus
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+	require.True(t, status.Valid)
+	require.WithinDuration(t, tok.ExpiresAt, status.ExpiresAt, time.Second)
+
+	require.NoError(t, tokenService.RevokeToken(tok.ID, u.ID))
+	require.Equal(t, http.StatusUnauthorized, validate(tok.PlainToken).Code)
+	require.Equal(t, http.StatusUnauthorized, validate("not-a-real-token").Code)
+}
+
+// fakeProvider signs in a fixed user, without talking to a real OAuth service
+type fakeProvider struct {
+	user *ProviderUser
+}
+
+func (p *fakeProvider) Name() string { return "fake" }
+func (p *fakeProvider) AuthURL(state string) string {
+	return "https://fake.example.com/authorize?state=" + state
+}
+
+func (p *fakeProvider) Exchange(_ context.Context, code string) (string, error) {
+	if code != "good-code" {
+		return "", fmt.Errorf("bad code")
+	}
+	return "access-token", nil
+}
+
+func (p *fakeProvider) FetchUser(_ context.Context, accessToken string) (*ProviderUser, error) {
+	return p.user, nil
+}
+
+func TestHandleOAuthCallbackSignsInUser(t *testing.T) {
+	db, cleanup := testutil.SetupTestDB(t)
+	defer cleanup()
+
+	userRepo := user.NewUserRepository(db)
+	h := NewAuthHandler(db, nil, nil, NewSessionService(db, nil), userRepo, &config.ServerConfig{}, nil)
+	h.providers["fake"] = &fakeProvider{user: &ProviderUser{ID: "abc-123", Username: "alice@example.com", Email: "alice@example.com"}}
+
+	callback := func(code string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/auth/fake/callback?code="+code+"&state=expected", nil)
+		req.SetPathValue("provider", "fake")
+		req.AddCookie(&http.Cookie{Name: "fake_oauth_state", Value: "expected"})
+		rec := httptest.NewRecorder()
+		h.HandleOAuthCallback(rec, req)
+		return rec
+	}
+
+	rec := callback("good-code")
+	require.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+	require.Equal(t, "/dashboard", rec.Header().Get("Location"))
+
+	var session *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == sessionCookie {
+			session = c
+		}
+	}
+	require.NotNil(t, session, "Expected a session cookie to be set")
+
+	u, err := userRepo.FindByProviderID("fake", "abc-123")
+	require.NoError(t, err)
+	require.NotNil(t, u, "Expected the user to be created for their provider")
+	require.Equal(t, "alice@example.com", u.Username)
+
+	// Signing in again updates the same user, rather than creating another
+	rec = callback("good-code")
+	require.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+	again, err := userRepo.FindByProviderID("fake", "abc-123")
+	require.NoError(t, err)
+	require.Equal(t, u.ID, again.ID)
+
+	rec = callback("bad-code")
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+}
+
+func TestHandleOAuthUnknownProvider(t *testing.T) {
+	h := NewAuthHandler(nil, nil, nil, nil, nil, &config.ServerConfig{}, nil)
+
+	for _, path := range []string{"/auth/gitlab/login", "/auth/gitlab/callback?code=abc&state=abc"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.SetPathValue("provider", "gitlab")
+		rec := httptest.NewRecorder()
+
+		if strings.Contains(path, "callback") {
+			h.HandleOAuthCallback(rec, req)
+		} else {
+			h.HandleOAuthLogin(rec, req)
+		}
+
+		require.Equal(t, http.StatusNotFound, rec.Code, "Expected %s to 404 when the provider isn't configured", path)
+	}
+}
+
+func TestPasswordLogin(t *testing.T) {
+	db, cleanup := testutil.SetupTestDB(t)
+	defer cleanup()
+
+	tmpl := template.Must(template.New("").Parse(`{{define "login.html"}}login {{.Error}}{{end}}{{define "register.html"}}register {{.Error}}{{end}}`))
+	cfg := &config.ServerConfig{Auth: config.AuthConfig{PasswordLogin: true, PasswordRegister: true}}
+	h := NewAuthHandler(db, tmpl, nil, NewSessionService(db, nil), user.NewUserRepository(db), cfg, nil)
+
+	post := func(handler http.HandlerFunc, path string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+	hasSession := func(rec *httptest.ResponseRecorder) bool {
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == sessionCookie && c.Value != "" {
+				return true
+			}
+		}
+		return false
+	}
+
+	rec := post(h.HandleRegister, "/register", url.Values{"email": {"alice@example.com"}, "password": {"correct-horse"}})
+	require.Equal(t, http.StatusSeeOther, rec.Code, "Expected the form post to redirect to the dashboard")
+	require.Equal(t, "/dashboard", rec.Header().Get("Location"))
+	require.True(t, hasSession(rec), "Expected registering to sign the user in")
+
+	rec = post(h.HandleRegister, "/register", url.Values{"email": {"alice@example.com"}, "password": {"correct-horse"}})
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "already exists")
+
+	rec = post(h.HandleLogin, "/login", url.Values{"email": {"alice@example.com"}, "password": {"wrong-password"}})
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Contains(t, rec.Body.String(), "Invalid email or password")
+	require.False(t, hasSession(rec))
+
+	rec = post(h.HandleLogin, "/login", url.Values{"email": {"alice@example.com"}, "password": {"correct-horse"}})
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.True(t, hasSession(rec))
+}
+
+func TestRegisterHidesInternalErrors(t *testing.T) {
+	db, cleanup := testutil.SetupTestDB(t)
+	defer cleanup()
+
+	tmpl := template.Must(template.New("").Parse(`{{define "register.html"}}register {{.Error}}{{end}}`))
+	cfg := &config.ServerConfig{Auth: config.AuthConfig{PasswordLogin: true, PasswordRegister: true}}
+	h := NewAuthHandler(db, tmpl, nil, NewSessionService(db, nil), user.NewUserRepository(db), cfg, nil)
+
+	_, err := db.Exec(`CREATE TRIGGER fail_credentials BEFORE INSERT ON credentials BEGIN SELECT RAISE(ABORT, 'constraint failed: credentials'); END`)
+	require.NoError(t, err)
+
+	form := url.Values{"email": {"alice@example.com"}, "password": {"correct-horse"}}
+	req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.HandleRegister(rec, req)
+
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+	require.Contains(t, rec.Body.String(), "Registration failed")
+	require.NotContains(t, rec.Body.String(), "constraint", "Expected the database error to stay out of the page")
+}
+
+// TestPasswordRegisterDisabled tests that local accounts can only be registered when registration is enabled
+// on its own, as an allowlisted email proves nothing when nobody has verified it
+func TestPasswordRegisterDisabled(t *testing.T) {
+	db, cleanup := testutil.SetupTestDB(t)
+	defer cleanup()
+
+	tmpl := template.Must(template.New("").Parse(`{{define "login.html"}}login{{if .Register}} register{{end}}{{end}}`))
+	cfg := &config.ServerConfig{Auth: config.AuthConfig{PasswordLogin: true, AllowedGithubUsers: []string{"alice@example.com"}}}
+	h := NewAuthHandler(db, tmpl, nil, NewSessionService(db, nil), user.NewUserRepository(db), cfg, nil)
+
+	form := url.Values{"email": {"alice@example.com"}, "password": {"correct-horse"}}
+	req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.HandleRegister(rec, req)
+	require.Equal(t, http.StatusNotFound, rec.Code, "Expected an allowlisted email not to be enough to register")
+
+	rec = httptest.NewRecorder()
+	h.HandleLogin(rec, httptest.NewRequest(http.MethodGet, "/login", nil))
+	require.Equal(t, "login", rec.Body.String(), "Expected the login page not to link to registering")
+}
+
+func TestPasswordLoginDisabled(t *testing.T) {
+	h := NewAuthHandler(nil, nil, nil, nil, nil, &config.ServerConfig{}, nil)
+
+	rec := httptest.NewRecorder()
+	h.HandleRegister(rec, httptest.NewRequest(http.MethodGet, "/register", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.HandleLogin(rec, httptest.NewRequest(http.MethodPost, "/login", strings.NewReader("email=a@b.com&password=12345678")))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/web/user"
+)
+
+// cliTokenValidity is how long tokens minted for `tunol login` are valid for
+const cliTokenValidity = 30 * 24 * time.Hour
+
+// cliStatePattern matches the state the CLI generates, so it's safe to pass back in a url
+var cliStatePattern = regexp.MustCompile(`^[A-Za-z0-9-]{16,64}$`)
+
+// cliLoginRequest is a request from `tunol login` to be handed a token
+type cliLoginRequest struct {
+	Port  int    // The port the CLI is listening on for the token
+	State string // Echoed back to the CLI, so it only accepts the token it asked for
+	Name  string // The machine the CLI is running on, used to describe the token
+}
+
+// parseCLILoginRequest validates the query of a CLI login request
+func parseCLILoginRequest(r *http.Request) (cliLoginRequest, error) {
+	port, err := strconv.Atoi(r.FormValue("port"))
+	if err != nil || port < 1024 || port > 65535 {
+		return cliLoginRequest{}, fmt.Errorf("invalid port")
+	}
+
+	state := r.FormValue("state")
+	if !cliStatePattern.MatchString(state) {
+		return cliLoginRequest{}, fmt.Errorf("invalid state")
+	}
+
+	name := r.FormValue("name")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	if name == "" {
+		name = "unknown machine"
+	}
+
+	return cliLoginRequest{Port: port, State: state, Name: name}, nil
+}
+
+// callbackURL is where the browser is sent with the token, which is always the CLI on this machine
+func (c cliLoginRequest) callbackURL(plainToken string) string {
+	return fmt.Sprintf("http://127.0.0.1:%d/callback?%s", c.Port, url.Values{
+		"token": {plainToken},
+		"state": {c.State},
+	}.Encode())
+}
+
+// HandleCLILogin asks the logged in user to authorise `tunol login`, then mints a token and hands it
+// to the CLI by redirecting the browser to the CLIs local callback
+func (h *Handler) HandleCLILogin(w http.ResponseWriter, r *http.Request) {
+	req, err := parseCLILoginRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid CLI login request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	u := r.Context().Value("user").(*user.User)
+
+	// The user has to confirm, so a link can't silently mint a token for someone
+	if r.Method != http.MethodPost {
+		if err := h.templates.ExecuteTemplate(w, "cli-login.html", map[string]any{
+			"User":    u,
+			"Request": req,
+		}); err != nil {
+			h.logger.Error("Failed to render CLI login template", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	t, err := h.tokenService.CreateToken(u.ID, "CLI login ("+req.Name+")", cliTokenValidity)
+	if err != nil {
+		h.logger.Error("Failed to create token", "error", err)
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+
+	h.logger.Info("Created token for CLI login", "userID", u.ID, "name", req.Name)
+	http.Redirect(w, r, req.callbackURL(t.PlainToken), http.StatusSeeOther)
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"context"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/jwtly10/go-tunol/internal/auth/token"
+	"github.com/jwtly10/go-tunol/internal/config"
+	testutil "github.com/jwtly10/go-tunol/internal/testutils"
+	"github.com/jwtly10/go-tunol/internal/web/user"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleCLILogin(t *testing.T) {
+	db, cleanup := testutil.SetupTestDB(t)
+	defer cleanup()
+
+	tokenService := token.NewTokenService(db)
+	userRepo := user.NewUserRepository(db)
+	tmpl := template.Must(template.New("").Parse(`{{define "cli-login.html"}}authorise {{.Request.Name}} as {{.User.Username}}{{end}}`))
+	h := NewAuthHandler(db, tmpl, tokenService, nil, userRepo, &config.ServerConfig{}, nil)
+
+	u, err := userRepo.CreateUser(&user.User{Provider: "github", ProviderUserID: "12345", Username: "testuser"})
+	require.NoError(t, err)
+
+	const state = "0b6c1c7e-5d0a-4a57-9a3e-d1c3a2c0f9b1"
+	withUser := func(r *http.Request) *http.Request {
+		return r.WithContext(context.WithValue(r.Context(), "user", u))
+	}
+
+	t.Run("asks the user to confirm", func(t *testing.T) {
+		req := withUser(httptest.NewRequest(http.MethodGet, "/auth/cli?port=53682&state="+state+"&name=laptop", nil))
+		rec := httptest.NewRecorder()
+		h.HandleCLILogin(rec, req)
+
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "authorise laptop as testuser", rec.Body.String())
+	})
+
+	t.Run("hands a new token to the CLI once confirmed", func(t *testing.T) {
+		form := url.Values{"port": {"53682"}, "state": {state}, "name": {"laptop"}}
+		req := withUser(httptest.NewRequest(http.MethodPost, "/auth/cli", strings.NewReader(form.Encode())))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		h.HandleCLILogin(rec, req)
+
+		require.Equal(t, http.StatusSeeOther, rec.Code)
+		location, err := url.Parse(rec.Header().Get("Location"))
+		require.NoError(t, err)
+		require.Equal(t, "127.0.0.1:53682", location.Host, "Expected the token to only be sent to this machine")
+		require.Equal(t, "/callback", location.Path)
+		require.Equal(t, state, location.Query().Get("state"))
+
+		valid, err := tokenService.ValidateToken(location.Query().Get("token"))
+		require.NoError(t, err)
+		require.True(t, valid)
+
+		tokens, err := tokenService.ListUserTokens(u.ID)
+		require.NoError(t, err)
+		require.Len(t, tokens, 1)
+		require.Equal(t, "CLI login (laptop)", tokens[0].Description)
+	})
+
+	t.Run("rejects invalid requests", func(t *testing.T) {
+		for _, query := range []string{
+			"port=80&state=" + state,
+			"port=not-a-port&state=" + state,
+			"port=53682&state=short",
+			"port=53682&state=" + url.QueryEscape("<script>alert(1)</script>aaaaaaaa"),
+		} {
+			req := withUser(httptest.NewRequest(http.MethodGet, "/auth/cli?"+query, nil))
+			rec := httptest.NewRecorder()
+			h.HandleCLILogin(rec, req)
+
+			require.Equal(t, http.StatusBadRequest, rec.Code, "Expected %q to be rejected", query)
+		}
+	})
+}
+
+func TestLoginReturnsToPage(t *testing.T) {
+	db, cleanup := testutil.SetupTestDB(t)
+	defer cleanup()
+
+	sessionService := NewSessionService(db, nil)
+	userRepo := user.NewUserRepository(db)
+	m := NewAuthMiddleware(sessionService, nil, userRepo, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	// Hitting a protected page while logged out remembers it
+	rec := httptest.NewRecorder()
+	m.RequireAuth(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/auth/cli?port=53682", nil))
+	require.Equal(t, "/login", rec.Header().Get("Location"))
+
+	var returnTo *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == returnToCookie {
+			returnTo = c
+		}
+	}
+	require.NotNil(t, returnTo)
+	require.Equal(t, "/auth/cli?port=53682", returnTo.Value)
+
+	// Once logged in, the user is sent back to it
+	h := NewAuthHandler(db, nil, nil, sessionService, userRepo, &config.ServerConfig{}, nil)
+	h.providers["fake"] = &fakeProvider{user: &ProviderUser{ID: "abc-123", Username: "alice"}}
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/fake/callback?code=good-code&state=expected", nil)
+	req.SetPathValue("provider", "fake")
+	req.AddCookie(&http.Cookie{Name: "fake_oauth_state", Value: "expected"})
+	req.AddCookie(returnTo)
+	rec = httptest.NewRecorder()
+	h.HandleOAuthCallback(rec, req)
+
+	require.Equal(t, "/auth/cli?port=53682", rec.Header().Get("Location"))
+
+	// Only pages on this server are returned to
+	require.False(t, isLocalPath("//evil.example.com"))
+	require.False(t, isLocalPath("https://evil.example.com"))
+	require.True(t, isLocalPath("/dashboard"))
+}
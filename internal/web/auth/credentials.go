@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/db"
+	"github.com/jwtly10/go-tunol/internal/web/user"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// localProvider is the provider of users who sign in with an email and password
+const localProvider = "local"
+
+// minPasswordLength is the shortest password accepted when registering
+const minPasswordLength = 8
+
+// The errors Register returns for a bad registration, their messages are shown on the register page
+var (
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrEmailTaken         = errors.New("an account with this email already exists")
+	ErrInvalidEmail       = errors.New("invalid email address")
+	ErrWeakPassword       = fmt.Errorf("password must be at least %d characters", minPasswordLength)
+)
+
+// CredentialService manages local accounts, which sign in with an email and a bcrypt hashed password
+type CredentialService struct {
+	db             *db.Database
+	userRepository *user.Repository
+}
+
+func NewCredentialService(db *db.Database, userRepository *user.Repository) *CredentialService {
+	return &CredentialService{
+		db:             db,
+		userRepository: userRepository,
+	}
+}
+
+// Register creates a local account for the email, returning the new user
+func (s *CredentialService) Register(email, password string) (*user.User, error) {
+	email, err := normaliseEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	if len(password) < minPasswordLength {
+		return nil, ErrWeakPassword
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	// The user and its credentials are created together, a user without them could never sign in or
+	// register the email again
+	var u *user.User
+	err = s.db.Transaction(func(tx *db.Tx) error {
+		var exists bool
+		err := tx.QueryRow("SELECT 1 FROM credentials WHERE email = ?", email).Scan(&exists)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if exists {
+			return ErrEmailTaken
+		}
+
+		u, err = s.userRepository.CreateUserTx(tx, &user.User{
+			Provider:       localProvider,
+			ProviderUserID: email,
+			Username:       email,
+			Email:          email,
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+            INSERT INTO credentials (user_id, email, password_hash, created_at)
+            VALUES (?, ?, ?, ?)
+        `, u.ID, email, string(hash), time.Now())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// Authenticate returns the user with the email, if the password matches
+func (s *CredentialService) Authenticate(email, password string) (*user.User, error) {
+	email, err := normaliseEmail(email)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	var userID int64
+	var hash string
+	err = s.db.QueryRow("SELECT user_id, password_hash FROM credentials WHERE email = ?", email).Scan(&userID, &hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	u, err := s.userRepository.FindByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	// Updating the user records the login, as for users signing in with a provider
+	return s.userRepository.CreateOrUpdateUser(u)
+}
+
+// normaliseEmail validates the email, lower casing it so accounts can't be registered twice
+func normaliseEmail(email string) (string, error) {
+	addr, err := mail.ParseAddress(strings.TrimSpace(email))
+	if err != nil || addr.Name != "" {
+		return "", ErrInvalidEmail
+	}
+	return strings.ToLower(addr.Address), nil
+}
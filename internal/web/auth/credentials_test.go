@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"testing"
+
+	testutil "github.com/jwtly10/go-tunol/internal/testutils"
+	"github.com/jwtly10/go-tunol/internal/web/user"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentialService(t *testing.T) {
+	db, cleanup := testutil.SetupTestDB(t)
+	defer cleanup()
+
+	s := NewCredentialService(db, user.NewUserRepository(db))
+
+	u, err := s.Register("Alice@Example.com", "correct-horse")
+	require.NoError(t, err)
+	require.Equal(t, localProvider, u.Provider)
+	require.Equal(t, "alice@example.com", u.Username, "Expected the email to be lower cased")
+
+	t.Run("authenticates with the right password", func(t *testing.T) {
+		found, err := s.Authenticate("alice@example.com", "correct-horse")
+		require.NoError(t, err)
+		require.Equal(t, u.ID, found.ID)
+		require.NotNil(t, found.LastLogin, "Expected the login to be recorded")
+
+		found, err = s.Authenticate(" ALICE@example.com", "correct-horse")
+		require.NoError(t, err)
+		require.Equal(t, u.ID, found.ID)
+	})
+
+	t.Run("rejects the wrong password or an unknown email", func(t *testing.T) {
+		_, err := s.Authenticate("alice@example.com", "wrong-password")
+		require.ErrorIs(t, err, ErrInvalidCredentials)
+
+		_, err = s.Authenticate("bob@example.com", "correct-horse")
+		require.ErrorIs(t, err, ErrInvalidCredentials)
+	})
+
+	t.Run("rejects invalid registrations", func(t *testing.T) {
+		_, err := s.Register("alice@example.com", "another-password")
+		require.ErrorIs(t, err, ErrEmailTaken)
+
+		_, err = s.Register("not-an-email", "correct-horse")
+		require.ErrorIs(t, err, ErrInvalidEmail)
+
+		_, err = s.Register("bob@example.com", "short")
+		require.ErrorIs(t, err, ErrWeakPassword)
+		require.ErrorContains(t, err, "at least 8 characters")
+	})
+
+	t.Run("creates no user if the credentials cant be saved", func(t *testing.T) {
+		_, err := db.Exec(`CREATE TRIGGER fail_credentials BEFORE INSERT ON credentials BEGIN SELECT RAISE(ABORT, 'disk full'); END`)
+		require.NoError(t, err)
+
+		_, err = s.Register("carol@example.com", "correct-horse")
+		require.ErrorContains(t, err, "disk full")
+		found, err := user.NewUserRepository(db).FindByProviderID(localProvider, "carol@example.com")
+		require.NoError(t, err)
+		require.Nil(t, found, "Expected the user to be rolled back with the credentials")
+
+		// So the email can still be registered once the problem is fixed
+		_, err = db.Exec("DROP TRIGGER fail_credentials")
+		require.NoError(t, err)
+		_, err = s.Register("carol@example.com", "correct-horse")
+		require.NoError(t, err)
+	})
+}
@@ -1,28 +1,34 @@
 package auth
 
 import (
+	"github.com/jwtly10/go-tunol/internal/auth/token"
 	"github.com/jwtly10/go-tunol/internal/web/user"
 	"golang.org/x/net/context"
 	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 )
 
 const (
 	sessionCookie   = "tunol_session"
+	returnToCookie  = "tunol_return_to" // The page to go back to once the user has logged in
 	cookiePath      = "/"
-	sessionDuration = 30 * time.Minute
+	sessionDuration = 30 * time.Minute   // How long a session lasts without any requests
+	maxSessionAge   = 7 * 24 * time.Hour // How long a session can be refreshed for, before logging in again
 )
 
 type Middleware struct {
 	sessionService *SessionService
+	tokenService   *token.Service
 	userRepository *user.Repository
 	logger         *slog.Logger
 }
 
-func NewAuthMiddleware(sessionService *SessionService, userRepository *user.Repository, logger *slog.Logger) *Middleware {
+func NewAuthMiddleware(sessionService *SessionService, tokenService *token.Service, userRepository *user.Repository, logger *slog.Logger) *Middleware {
 	return &Middleware{
 		sessionService: sessionService,
+		tokenService:   tokenService,
 		userRepository: userRepository,
 		logger:         logger,
 	}
@@ -33,7 +39,7 @@ func (m *Middleware) RequireAuth(next http.Handler) http.Handler {
 		cookie, err := r.Cookie(sessionCookie)
 		if err != nil {
 			m.logger.Error("Failed to fetch session cookie", "error", err)
-			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+			redirectToLogin(w, r)
 			return
 		}
 
@@ -45,7 +51,7 @@ func (m *Middleware) RequireAuth(next http.Handler) http.Handler {
 		}
 
 		if session == nil {
-			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+			redirectToLogin(w, r)
 			return
 		}
 
@@ -57,7 +63,8 @@ func (m *Middleware) RequireAuth(next http.Handler) http.Handler {
 			return
 		}
 
-		m.logger.Info("User authenticated", "user", user.GithubUsername)
+		m.logger.Info("User authenticated", "user", user.Username)
+		session = m.refreshSession(w, session)
 
 		ctx := context.WithValue(r.Context(), "user", user)
 		ctx = context.WithValue(ctx, "session", session)
@@ -65,3 +72,103 @@ func (m *Middleware) RequireAuth(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// refreshSession extends the session as the user is active, updating the cookie to match. The session
+// is still valid if it can't be refreshed, so failures are only logged
+func (m *Middleware) refreshSession(w http.ResponseWriter, session *Session) *Session {
+	refreshed, err := m.sessionService.RefreshSession(session, sessionDuration, maxSessionAge)
+	if err != nil {
+		m.logger.Error("Failed to refresh session", "error", err)
+		return session
+	}
+
+	if refreshed.ExpiresAt.After(session.ExpiresAt) {
+		setSessionCookie(w, refreshed)
+	}
+	return refreshed
+}
+
+// setSessionCookie sets the http only session cookie, expiring with the session
+func setSessionCookie(w http.ResponseWriter, session *Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    session.Token,
+		Path:     cookiePath,
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// redirectToLogin sends the user to log in, remembering the page they were on so they can be sent
+// back to it, e.g. when authorising the CLI
+func redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		http.SetCookie(w, &http.Cookie{
+			Name:     returnToCookie,
+			Value:    r.URL.RequestURI(),
+			Path:     cookiePath,
+			MaxAge:   600, // Long enough to log in
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+}
+
+// RequireAPIAuth authenticates API requests with either a bearer token (as used by the CLI) or a
+// session cookie. Unlike RequireAuth, unauthenticated requests get a 401 rather than a redirect
+func (m *Middleware) RequireAPIAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var userID int64
+
+		if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+			plainToken := strings.TrimPrefix(authHeader, "Bearer ")
+			if valid, err := m.tokenService.ValidateToken(plainToken); !valid {
+				m.logger.Error("Failed to validate token", "error", err)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			t, err := m.tokenService.FindByPlainToken(plainToken)
+			if err != nil || t == nil {
+				m.logger.Error("Failed to find token owner", "error", err)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			userID = t.UserId
+		} else {
+			cookie, err := r.Cookie(sessionCookie)
+			if err != nil {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			session, err := m.sessionService.ValidateSession(cookie.Value)
+			if err != nil {
+				m.logger.Error("Failed to validate session", "error", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+
+			if session == nil {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			m.refreshSession(w, session)
+			userID = session.UserID
+		}
+
+		user, err := m.userRepository.FindByID(userID)
+		if err != nil {
+			m.logger.Error("Failed to fetch user", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "user", user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,241 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/jwtly10/go-tunol/internal/config"
+)
+
+// OAuthProvider is an OAuth service users can sign in to the dashboard with
+type OAuthProvider interface {
+	// Name identifies the provider in the login and callback routes, e.g. github
+	Name() string
+	// AuthURL is where users are sent to approve signing in, the state is passed back to the callback
+	AuthURL(state string) string
+	// Exchange swaps the code from the callback for an access token
+	Exchange(ctx context.Context, code string) (string, error)
+	// FetchUser fetches the profile of the user the access token belongs to
+	FetchUser(ctx context.Context, accessToken string) (*ProviderUser, error)
+}
+
+// ProviderUser is a user as returned by their OAuth provider
+type ProviderUser struct {
+	ID        string
+	Username  string
+	AvatarURL string
+	Email     string
+}
+
+// newProviders returns the providers configured for the server, keyed by name
+func newProviders(cfg *config.ServerConfig) map[string]OAuthProvider {
+	providers := make(map[string]OAuthProvider)
+	if cfg == nil {
+		return providers
+	}
+
+	providers["github"] = newGitHubProvider(cfg.Auth.GithubClientId, cfg.Auth.GithubClientSecret)
+	if cfg.Auth.GoogleClientId != "" {
+		redirectURL := cfg.HTTPURL() + "/auth/google/callback"
+		providers["google"] = newGoogleProvider(cfg.Auth.GoogleClientId, cfg.Auth.GoogleClientSecret, redirectURL)
+	}
+	return providers
+}
+
+// oauthEndpoints are the URLs of a provider, kept as fields so tests can point them at a fake server
+type oauthEndpoints struct {
+	authorizeURL string
+	tokenURL     string
+	userURL      string
+}
+
+// exchangeCode posts the form to the token endpoint, returning the access token from the JSON response
+func exchangeCode(ctx context.Context, tokenURL string, data url.Values) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", tokenURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		Scope       string `json:"scope"`
+		Error       string `json:"error"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+
+	// Providers can report a bad code with a 200, so the token has to be checked
+	if result.AccessToken == "" {
+		return "", fmt.Errorf("no access token in response (status %d, error %q)", resp.StatusCode, result.Error)
+	}
+
+	return result.AccessToken, nil
+}
+
+// fetchJSON fetches the user endpoint with the access token, decoding the response into v
+func fetchJSON(ctx context.Context, userURL, authorization string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", userURL, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status fetching user: %d", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// GitHub oAuth flow
+type gitHubProvider struct {
+	clientID     string
+	clientSecret string
+	endpoints    oauthEndpoints
+}
+
+func newGitHubProvider(clientID, clientSecret string) *gitHubProvider {
+	return &gitHubProvider{
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		endpoints: oauthEndpoints{
+			authorizeURL: "https://github.com/login/oauth/authorize",
+			tokenURL:     "https://github.com/login/oauth/access_token",
+			userURL:      "https://api.github.com/user",
+		},
+	}
+}
+
+func (p *gitHubProvider) Name() string {
+	return "github"
+}
+
+func (p *gitHubProvider) AuthURL(state string) string {
+	return p.endpoints.authorizeURL + "?" + url.Values{
+		"client_id": {p.clientID},
+		"state":     {state},
+		"scope":     {"user:email"},
+	}.Encode()
+}
+
+func (p *gitHubProvider) Exchange(ctx context.Context, code string) (string, error) {
+	return exchangeCode(ctx, p.endpoints.tokenURL, url.Values{
+		"client_id":     {p.clientID},
+		"client_secret": {p.clientSecret},
+		"code":          {code},
+	})
+}
+
+func (p *gitHubProvider) FetchUser(ctx context.Context, accessToken string) (*ProviderUser, error) {
+	var user struct {
+		ID        int64  `json:"id"`
+		Login     string `json:"login"`
+		AvatarURL string `json:"avatar_url"`
+		Email     string `json:"email"`
+	}
+	if err := fetchJSON(ctx, p.endpoints.userURL, "token "+accessToken, &user); err != nil {
+		return nil, err
+	}
+
+	return &ProviderUser{
+		ID:        strconv.FormatInt(user.ID, 10),
+		Username:  user.Login,
+		AvatarURL: user.AvatarURL,
+		Email:     user.Email,
+	}, nil
+}
+
+// Google oAuth flow, for self hosters using Google Workspace
+type googleProvider struct {
+	clientID     string
+	clientSecret string
+	redirectURL  string // Google requires the callback url to be passed, and to match the one registered
+	endpoints    oauthEndpoints
+}
+
+func newGoogleProvider(clientID, clientSecret, redirectURL string) *googleProvider {
+	return &googleProvider{
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		endpoints: oauthEndpoints{
+			authorizeURL: "https://accounts.google.com/o/oauth2/v2/auth",
+			tokenURL:     "https://oauth2.googleapis.com/token",
+			userURL:      "https://openidconnect.googleapis.com/v1/userinfo",
+		},
+	}
+}
+
+func (p *googleProvider) Name() string {
+	return "google"
+}
+
+func (p *googleProvider) AuthURL(state string) string {
+	return p.endpoints.authorizeURL + "?" + url.Values{
+		"client_id":     {p.clientID},
+		"redirect_uri":  {p.redirectURL},
+		"response_type": {"code"},
+		"scope":         {"openid email profile"},
+		"state":         {state},
+	}.Encode()
+}
+
+func (p *googleProvider) Exchange(ctx context.Context, code string) (string, error) {
+	return exchangeCode(ctx, p.endpoints.tokenURL, url.Values{
+		"client_id":     {p.clientID},
+		"client_secret": {p.clientSecret},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL},
+		"grant_type":    {"authorization_code"},
+	})
+}
+
+func (p *googleProvider) FetchUser(ctx context.Context, accessToken string) (*ProviderUser, error) {
+	var user struct {
+		Sub           string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Picture       string `json:"picture"`
+	}
+	if err := fetchJSON(ctx, p.endpoints.userURL, "Bearer "+accessToken, &user); err != nil {
+		return nil, err
+	}
+
+	// Google accounts don't have a username, so the email is used, which also makes them
+	// usable in the allowed users list
+	if !user.EmailVerified {
+		return nil, fmt.Errorf("google account email %q is not verified", user.Email)
+	}
+
+	return &ProviderUser{
+		ID:        user.Sub,
+		Username:  user.Email,
+		AvatarURL: user.Picture,
+		Email:     user.Email,
+	}, nil
+}
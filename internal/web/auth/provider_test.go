@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOAuthServer serves a token and user endpoint, checking the access token is passed back
+func fakeOAuthServer(t *testing.T, wantAuthorization string, user map[string]any) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		if r.Form.Get("code") != "good-code" {
+			json.NewEncoder(w).Encode(map[string]string{"error": "bad_verification_code"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "access-token"})
+	})
+	mux.HandleFunc("GET /user", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != wantAuthorization {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(user)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGitHubProvider(t *testing.T) {
+	server := fakeOAuthServer(t, "token access-token", map[string]any{
+		"id":         12345,
+		"login":      "testuser",
+		"avatar_url": "https://github.com/avatar.jpg",
+		"email":      "test@example.com",
+	})
+
+	p := newGitHubProvider("client-id", "client-secret")
+	p.endpoints.tokenURL = server.URL + "/token"
+	p.endpoints.userURL = server.URL + "/user"
+
+	authURL, err := url.Parse(p.AuthURL("the-state"))
+	require.NoError(t, err)
+	require.Equal(t, "client-id", authURL.Query().Get("client_id"))
+	require.Equal(t, "the-state", authURL.Query().Get("state"))
+
+	_, err = p.Exchange(context.Background(), "bad-code")
+	require.Error(t, err, "Expected an error when no access token is returned")
+
+	accessToken, err := p.Exchange(context.Background(), "good-code")
+	require.NoError(t, err)
+
+	user, err := p.FetchUser(context.Background(), accessToken)
+	require.NoError(t, err)
+	require.Equal(t, &ProviderUser{
+		ID:        "12345",
+		Username:  "testuser",
+		AvatarURL: "https://github.com/avatar.jpg",
+		Email:     "test@example.com",
+	}, user)
+}
+
+func TestGoogleProvider(t *testing.T) {
+	server := fakeOAuthServer(t, "Bearer access-token", map[string]any{
+		"sub":            "1029384756",
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"picture":        "https://example.com/alice.jpg",
+	})
+
+	p := newGoogleProvider("client-id", "client-secret", "https://tunol.dev/auth/google/callback")
+	p.endpoints.tokenURL = server.URL + "/token"
+	p.endpoints.userURL = server.URL + "/user"
+
+	authURL, err := url.Parse(p.AuthURL("the-state"))
+	require.NoError(t, err)
+	require.Equal(t, "https://tunol.dev/auth/google/callback", authURL.Query().Get("redirect_uri"))
+	require.Equal(t, "code", authURL.Query().Get("response_type"))
+
+	accessToken, err := p.Exchange(context.Background(), "good-code")
+	require.NoError(t, err)
+
+	user, err := p.FetchUser(context.Background(), accessToken)
+	require.NoError(t, err)
+	require.Equal(t, "1029384756", user.ID)
+	require.Equal(t, "alice@example.com", user.Username, "Expected the email to be used as the username")
+
+	_, err = p.FetchUser(context.Background(), "wrong-token")
+	require.Error(t, err)
+}
+
+func TestGoogleProviderRejectsUnverifiedEmail(t *testing.T) {
+	server := fakeOAuthServer(t, "Bearer access-token", map[string]any{
+		"sub":            "1029384756",
+		"email":          "alice@example.com",
+		"email_verified": false,
+	})
+
+	p := newGoogleProvider("client-id", "client-secret", "https://tunol.dev/auth/google/callback")
+	p.endpoints.userURL = server.URL + "/user"
+
+	_, err := p.FetchUser(context.Background(), "access-token")
+	require.Error(t, err)
+}
@@ -36,7 +36,7 @@ func (s *SessionService) CreateSession(userID int64, duration time.Duration) (*S
 		ExpiresAt: time.Now().Add(duration),
 	}
 
-	result, err := s.db.Exec(`
+	id, err := s.db.Insert(`
         INSERT INTO sessions (user_id, token, created_at, expires_at)
         VALUES (?, ?, ?, ?)
     `, session.UserID, session.Token, session.CreatedAt, session.ExpiresAt)
@@ -44,12 +44,6 @@ func (s *SessionService) CreateSession(userID int64, duration time.Duration) (*S
 	if err != nil {
 		return nil, err
 	}
-
-	// Get the auto-generated ID
-	id, err := result.LastInsertId()
-	if err != nil {
-		return nil, err
-	}
 	session.ID = id
 
 	return session, nil
@@ -79,7 +73,43 @@ func (s *SessionService) ValidateSession(token string) (*Session, error) {
 	return session, nil
 }
 
+// RefreshSession slides the session's expiry to duration from now, so active users stay logged in,
+// but never past maxLifetime after it was created. The session is returned with its new expiry
+func (s *SessionService) RefreshSession(session *Session, duration, maxLifetime time.Duration) (*Session, error) {
+	expiresAt := time.Now().Add(duration)
+	if limit := session.CreatedAt.Add(maxLifetime); expiresAt.After(limit) {
+		expiresAt = limit
+	}
+
+	if !expiresAt.After(session.ExpiresAt) {
+		return session, nil
+	}
+
+	if _, err := s.db.Exec(`UPDATE sessions SET expires_at = ? WHERE id = ?`, expiresAt, session.ID); err != nil {
+		return nil, err
+	}
+
+	refreshed := *session
+	refreshed.ExpiresAt = expiresAt
+	return &refreshed, nil
+}
+
 func (s *SessionService) DeleteSession(token string) error {
 	_, err := s.db.Exec("DELETE FROM sessions WHERE token = ?", token)
 	return err
 }
+
+// DeleteAllUserSessions deletes every session of the user, logging them out of all browsers
+func (s *SessionService) DeleteAllUserSessions(userID int64) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	return err
+}
+
+// PurgeExpired deletes the sessions that expired before now, returning how many were deleted
+func (s *SessionService) PurgeExpired(now time.Time) (int64, error) {
+	result, err := s.db.Exec("DELETE FROM sessions WHERE expires_at < ?", now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
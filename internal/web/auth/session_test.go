@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	testutil "github.com/jwtly10/go-tunol/internal/testutils"
+	"github.com/jwtly10/go-tunol/internal/web/user"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefreshSession(t *testing.T) {
+	db, cleanup := testutil.SetupTestDB(t)
+	defer cleanup()
+
+	sessionService := NewSessionService(db, nil)
+	userRepo := user.NewUserRepository(db)
+
+	u, err := userRepo.CreateUser(&user.User{Provider: "github", ProviderUserID: "12345", Username: "testuser"})
+	require.NoError(t, err)
+
+	session, err := sessionService.CreateSession(u.ID, time.Minute)
+	require.NoError(t, err)
+
+	t.Run("slides the expiry", func(t *testing.T) {
+		refreshed, err := sessionService.RefreshSession(session, time.Hour, 24*time.Hour)
+		require.NoError(t, err)
+		require.WithinDuration(t, time.Now().Add(time.Hour), refreshed.ExpiresAt, time.Second)
+
+		stored, err := sessionService.ValidateSession(session.Token)
+		require.NoError(t, err)
+		require.WithinDuration(t, refreshed.ExpiresAt, stored.ExpiresAt, time.Second)
+	})
+
+	t.Run("never past the max lifetime", func(t *testing.T) {
+		stored, err := sessionService.ValidateSession(session.Token)
+		require.NoError(t, err)
+
+		refreshed, err := sessionService.RefreshSession(stored, 48*time.Hour, 2*time.Hour)
+		require.NoError(t, err)
+		require.WithinDuration(t, stored.CreatedAt.Add(2*time.Hour), refreshed.ExpiresAt, time.Second)
+
+		// Once at the limit, refreshing doesn't extend it any further
+		again, err := sessionService.RefreshSession(refreshed, 48*time.Hour, 2*time.Hour)
+		require.NoError(t, err)
+		require.Equal(t, refreshed.ExpiresAt, again.ExpiresAt)
+	})
+}
+
+func TestRequireAuthRefreshesSession(t *testing.T) {
+	db, cleanup := testutil.SetupTestDB(t)
+	defer cleanup()
+
+	sessionService := NewSessionService(db, nil)
+	userRepo := user.NewUserRepository(db)
+	m := NewAuthMiddleware(sessionService, nil, userRepo, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	u, err := userRepo.CreateUser(&user.User{Provider: "github", ProviderUserID: "12345", Username: "testuser"})
+	require.NoError(t, err)
+
+	// A session about to expire, as if the user logged in a while ago
+	session, err := sessionService.CreateSession(u.ID, time.Minute)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/dashboard", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookie, Value: session.Token})
+	rec := httptest.NewRecorder()
+	m.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})).ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var cookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == sessionCookie {
+			cookie = c
+		}
+	}
+	require.NotNil(t, cookie, "Expected the session cookie to be refreshed")
+	require.Equal(t, session.Token, cookie.Value)
+	require.WithinDuration(t, time.Now().Add(sessionDuration), cookie.Expires, 2*time.Second)
+
+	stored, err := sessionService.ValidateSession(session.Token)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(sessionDuration), stored.ExpiresAt, 2*time.Second)
+}
+
+func TestLogoutEverywhere(t *testing.T) {
+	db, cleanup := testutil.SetupTestDB(t)
+	defer cleanup()
+
+	sessionService := NewSessionService(db, nil)
+	userRepo := user.NewUserRepository(db)
+	h := NewAuthHandler(db, nil, nil, sessionService, userRepo, nil, nil)
+
+	u, err := userRepo.CreateUser(&user.User{Provider: "github", ProviderUserID: "12345", Username: "testuser"})
+	require.NoError(t, err)
+	other, err := userRepo.CreateUser(&user.User{Provider: "github", ProviderUserID: "67890", Username: "other"})
+	require.NoError(t, err)
+
+	laptop, err := sessionService.CreateSession(u.ID, time.Hour)
+	require.NoError(t, err)
+	phone, err := sessionService.CreateSession(u.ID, time.Hour)
+	require.NoError(t, err)
+	otherSession, err := sessionService.CreateSession(other.ID, time.Hour)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/logout/all", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookie, Value: laptop.Token})
+	req = req.WithContext(context.WithValue(req.Context(), "user", u))
+	rec := httptest.NewRecorder()
+	h.HandleLogoutEverywhere(rec, req)
+
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.Equal(t, "/login", rec.Header().Get("Location"))
+
+	for _, s := range []*Session{laptop, phone} {
+		valid, err := sessionService.ValidateSession(s.Token)
+		require.NoError(t, err)
+		require.Nil(t, valid, "Expected every session of the user to be deleted")
+	}
+
+	valid, err := sessionService.ValidateSession(otherSession.Token)
+	require.NoError(t, err)
+	require.NotNil(t, valid, "Expected other users to stay logged in")
+}
@@ -2,24 +2,42 @@ package dashboard
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/jwtly10/go-tunol/internal/auth/token"
+	"github.com/jwtly10/go-tunol/internal/web/subdomain"
+	"github.com/jwtly10/go-tunol/internal/web/usage"
 	"github.com/jwtly10/go-tunol/internal/web/user"
 	"html/template"
 	"log/slog"
 	"net/http"
+	"strconv"
 	"time"
 )
 
 type Handler struct {
 	templates    *template.Template
 	tokenService *token.Service
+	subdomains   *subdomain.Repository
+	usage        *usage.Repository
 	logger       *slog.Logger
 }
 
-func NewDashboardHandler(templates *template.Template, tokenService *token.Service, logger *slog.Logger) *Handler {
+// usageHistoryDays is how far back the dashboard shows tunnel usage
+const usageHistoryDays = 7
+
+// Token validity, in days. Tokens can be created for any period up to the max
+const (
+	defaultTokenValidityDays = 30
+	maxTokenValidityDays     = 365
+)
+
+func NewDashboardHandler(templates *template.Template, tokenService *token.Service, subdomains *subdomain.Repository, usage *usage.Repository, logger *slog.Logger) *Handler {
 	return &Handler{
 		templates:    templates,
 		tokenService: tokenService,
+		subdomains:   subdomains,
+		usage:        usage,
 		logger:       logger,
 	}
 }
@@ -34,14 +52,44 @@ func (h *Handler) HandleDashboard(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	reservations, err := h.subdomains.ListUserReservations(u.ID)
+	if err != nil {
+		h.logger.Error("Failed to list reserved subdomains", "error", err)
+		http.Error(w, "Failed to load subdomains", http.StatusInternalServerError)
+		return
+	}
+
+	since := time.Now().AddDate(0, 0, -(usageHistoryDays - 1))
+	dailyUsage, err := h.usage.ListDaily(u.ID, since)
+	if err != nil {
+		h.logger.Error("Failed to list daily usage", "error", err)
+		http.Error(w, "Failed to load usage", http.StatusInternalServerError)
+		return
+	}
+
+	tunnelUsage, err := h.usage.ListByTunnel(u.ID, since)
+	if err != nil {
+		h.logger.Error("Failed to list tunnel usage", "error", err)
+		http.Error(w, "Failed to load usage", http.StatusInternalServerError)
+		return
+	}
+
 	data := map[string]interface{}{
-		"User":   u,
-		"Tokens": tokens,
+		"User":                  u,
+		"Tokens":                tokens,
+		"Subdomains":            reservations,
+		"MaxReservedSubdomains": subdomain.MaxReservationsPerUser,
+		"DailyUsage":            dailyUsage,
+		"TunnelUsage":           tunnelUsage,
+		"UsageHistoryDays":      usageHistoryDays,
+		"MaxTokenValidityDays":  maxTokenValidityDays,
 	}
 
 	h.logger.Info("Rendering dashboard",
 		"userID", u.ID,
-		"tokenCount", len(tokens))
+		"tokenCount", len(tokens),
+		"subdomainCount", len(reservations),
+		"tunnelUsageCount", len(tunnelUsage))
 
 	if err := h.templates.ExecuteTemplate(w, "layout.html", data); err != nil {
 		h.logger.Error("Failed to render template", "error", err)
@@ -64,7 +112,13 @@ func (h *Handler) HandleCreateToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	t, err := h.tokenService.CreateToken(u.ID, description, 30*24*time.Hour) // 30 days validity
+	validity, err := parseTokenValidity(r.FormValue("validity_days"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t, err := h.tokenService.CreateToken(u.ID, description, validity)
 	if err != nil {
 		h.logger.Error("Failed to create token", "error", err)
 		http.Error(w, "Failed to create token", http.StatusInternalServerError)
@@ -76,3 +130,112 @@ func (h *Handler) HandleCreateToken(w http.ResponseWriter, r *http.Request) {
 		"token": t.PlainToken,
 	})
 }
+
+// HandleRevokeToken revokes one of the users tokens
+func (h *Handler) HandleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	u := r.Context().Value("user").(*user.User)
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid token id", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.tokenService.RevokeToken(id, u.ID); err != nil {
+		if errors.Is(err, token.ErrTokenNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		h.logger.Error("Failed to revoke token", "error", err)
+		http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+		return
+	}
+
+	h.logger.Info("Revoked token", "userID", u.ID, "tokenID", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseTokenValidity parses the number of days a new token should be valid for, using the
+// default if not set
+func parseTokenValidity(value string) (time.Duration, error) {
+	days := defaultTokenValidityDays
+	if value != "" {
+		var err error
+		days, err = strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("validity must be a whole number of days")
+		}
+	}
+
+	if days < 1 || days > maxTokenValidityDays {
+		return 0, fmt.Errorf("validity must be between 1 and %d days", maxTokenValidityDays)
+	}
+
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// HandleReserveSubdomain claims a subdomain for the user, so their tunnels get a stable URL
+func (h *Handler) HandleReserveSubdomain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	u := r.Context().Value("user").(*user.User)
+	name := r.FormValue("subdomain")
+	if err := subdomain.Validate(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reservation, err := h.subdomains.Reserve(u.ID, name)
+	if err != nil {
+		if errors.Is(err, subdomain.ErrTaken) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, subdomain.ErrTooManyReserved) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.logger.Error("Failed to reserve subdomain", "error", err)
+		http.Error(w, "Failed to reserve subdomain", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"subdomain": reservation.Subdomain,
+	})
+}
+
+// HandleReleaseSubdomain releases a subdomain previously reserved by the user
+func (h *Handler) HandleReleaseSubdomain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	u := r.Context().Value("user").(*user.User)
+	name := r.FormValue("subdomain")
+	if name == "" {
+		http.Error(w, "Subdomain is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.subdomains.Release(u.ID, name); err != nil {
+		if errors.Is(err, subdomain.ErrNotReserved) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		h.logger.Error("Failed to release subdomain", "error", err)
+		http.Error(w, "Failed to release subdomain", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
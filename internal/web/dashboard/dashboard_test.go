@@ -0,0 +1,124 @@
+package dashboard
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/auth/token"
+	testutil "github.com/jwtly10/go-tunol/internal/testutils"
+	"github.com/jwtly10/go-tunol/internal/web/subdomain"
+	"github.com/jwtly10/go-tunol/internal/web/user"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTokenValidity(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "defaults when not set", value: "", want: 30 * 24 * time.Hour},
+		{name: "one day", value: "1", want: 24 * time.Hour},
+		{name: "max validity", value: "365", want: 365 * 24 * time.Hour},
+		{name: "zero days", value: "0", wantErr: true},
+		{name: "negative days", value: "-5", wantErr: true},
+		{name: "over the max", value: "366", wantErr: true},
+		{name: "not a number", value: "forever", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTokenValidity(tt.value)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestHandleRevokeToken(t *testing.T) {
+	db, cleanup := testutil.SetupTestDB(t)
+	defer cleanup()
+
+	tokenService := token.NewTokenService(db)
+	userRepo := user.NewUserRepository(db)
+	h := NewDashboardHandler(nil, tokenService, nil, nil, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+
+	owner, err := userRepo.CreateUser(&user.User{Provider: "github", ProviderUserID: "1", Username: "owner"})
+	require.NoError(t, err)
+	other, err := userRepo.CreateUser(&user.User{Provider: "github", ProviderUserID: "2", Username: "other"})
+	require.NoError(t, err)
+
+	tok, err := tokenService.CreateToken(owner.ID, "Laptop", 24*time.Hour)
+	require.NoError(t, err)
+
+	revoke := func(u *user.User, id string) int {
+		req := httptest.NewRequest(http.MethodPost, "/dashboard/tokens/revoke", strings.NewReader(url.Values{"id": {id}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithValue(req.Context(), "user", u))
+		rec := httptest.NewRecorder()
+		h.HandleRevokeToken(rec, req)
+		return rec.Code
+	}
+
+	id := strconv.FormatInt(tok.ID, 10)
+
+	require.Equal(t, http.StatusBadRequest, revoke(owner, "not-an-id"))
+
+	// Users can't revoke each others tokens
+	require.Equal(t, http.StatusNotFound, revoke(other, id))
+	valid, _ := tokenService.ValidateToken(tok.PlainToken)
+	require.True(t, valid)
+
+	require.Equal(t, http.StatusNoContent, revoke(owner, id))
+	valid, _ = tokenService.ValidateToken(tok.PlainToken)
+	require.False(t, valid)
+}
+
+func TestHandleReleaseSubdomain(t *testing.T) {
+	db, cleanup := testutil.SetupTestDB(t)
+	defer cleanup()
+
+	subdomains := subdomain.NewSubdomainRepository(db)
+	userRepo := user.NewUserRepository(db)
+	h := NewDashboardHandler(nil, nil, subdomains, nil, slog.New(slog.NewTextHandler(os.Stdout, nil)))
+
+	owner, err := userRepo.CreateUser(&user.User{Provider: "github", ProviderUserID: "1", Username: "owner"})
+	require.NoError(t, err)
+	other, err := userRepo.CreateUser(&user.User{Provider: "github", ProviderUserID: "2", Username: "other"})
+	require.NoError(t, err)
+
+	_, err = subdomains.Reserve(owner.ID, "myapp")
+	require.NoError(t, err)
+
+	release := func(u *user.User, name string) int {
+		req := httptest.NewRequest(http.MethodPost, "/dashboard/subdomains/release", strings.NewReader(url.Values{"subdomain": {name}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(context.WithValue(req.Context(), "user", u))
+		rec := httptest.NewRecorder()
+		h.HandleReleaseSubdomain(rec, req)
+		return rec.Code
+	}
+
+	// Users can't release each others subdomains
+	require.Equal(t, http.StatusNotFound, release(other, "myapp"))
+	require.Equal(t, http.StatusNoContent, release(owner, "myapp"))
+	require.Equal(t, http.StatusNotFound, release(owner, "myapp"))
+
+	// Database failures aren't mistaken for the subdomain not being reserved
+	_, err = db.Exec("DROP TABLE reserved_subdomains")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusInternalServerError, release(owner, "myapp"))
+}
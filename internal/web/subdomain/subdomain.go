@@ -0,0 +1,177 @@
+package subdomain
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/db"
+)
+
+const (
+	minLength = 3
+	maxLength = 32
+
+	// MaxReservationsPerUser is the number of subdomains a single user can hold at once
+	MaxReservationsPerUser = 3
+)
+
+var (
+	ErrTaken           = errors.New("subdomain is already reserved")
+	ErrTooManyReserved = fmt.Errorf("a maximum of %d subdomains can be reserved", MaxReservationsPerUser)
+	ErrNotReserved     = errors.New("subdomain is not reserved by this user")
+)
+
+// reserved cannot be requested as they are used by the server itself
+var reserved = map[string]bool{
+	"www":   true,
+	"api":   true,
+	"local": true,
+}
+
+type Reservation struct {
+	ID        int64
+	UserID    int64
+	Subdomain string
+	CreatedAt time.Time
+}
+
+type Repository struct {
+	db *db.Database
+}
+
+func NewSubdomainRepository(db *db.Database) *Repository {
+	return &Repository{db: db}
+}
+
+// Validate checks a subdomain is safe to use as a tunnel id
+func Validate(subdomain string) error {
+	if len(subdomain) < minLength || len(subdomain) > maxLength {
+		return fmt.Errorf("subdomain must be between %d and %d characters", minLength, maxLength)
+	}
+
+	for _, c := range subdomain {
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '-' {
+			return fmt.Errorf("subdomain may only contain lowercase letters, numbers and hyphens")
+		}
+	}
+
+	if strings.HasPrefix(subdomain, "-") || strings.HasSuffix(subdomain, "-") {
+		return fmt.Errorf("subdomain cannot start or end with a hyphen")
+	}
+
+	if reserved[subdomain] {
+		return fmt.Errorf("subdomain %s is reserved", subdomain)
+	}
+
+	return nil
+}
+
+// Reserve claims a subdomain for the user, so only they can tunnel through it
+func (r *Repository) Reserve(userID int64, subdomain string) (*Reservation, error) {
+	if err := Validate(subdomain); err != nil {
+		return nil, err
+	}
+
+	existing, err := r.FindBySubdomain(subdomain)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		if existing.UserID == userID {
+			return existing, nil
+		}
+		return nil, ErrTaken
+	}
+
+	reservations, err := r.ListUserReservations(userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(reservations) >= MaxReservationsPerUser {
+		return nil, ErrTooManyReserved
+	}
+
+	reservation := &Reservation{
+		UserID:    userID,
+		Subdomain: subdomain,
+		CreatedAt: time.Now(),
+	}
+
+	id, err := r.db.Insert(`
+        INSERT INTO reserved_subdomains (user_id, subdomain, created_at)
+        VALUES (?, ?, ?)
+    `, reservation.UserID, reservation.Subdomain, reservation.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	reservation.ID = id
+
+	return reservation, nil
+}
+
+// Release removes a users reservation of a subdomain
+func (r *Repository) Release(userID int64, subdomain string) error {
+	result, err := r.db.Exec(`DELETE FROM reserved_subdomains WHERE user_id = ? AND subdomain = ?`, userID, subdomain)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotReserved
+	}
+
+	return nil
+}
+
+// FindBySubdomain returns the reservation of a subdomain, or nil if it is not reserved
+func (r *Repository) FindBySubdomain(subdomain string) (*Reservation, error) {
+	reservation := &Reservation{}
+	err := r.db.QueryRow(`
+        SELECT id, user_id, subdomain, created_at
+        FROM reserved_subdomains
+        WHERE subdomain = ?
+    `, subdomain).Scan(
+		&reservation.ID,
+		&reservation.UserID,
+		&reservation.Subdomain,
+		&reservation.CreatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reservation, nil
+}
+
+// ListUserReservations returns all subdomains reserved by the user, oldest first
+func (r *Repository) ListUserReservations(userID int64) ([]Reservation, error) {
+	rows, err := r.db.Query(`
+        SELECT id, user_id, subdomain, created_at
+        FROM reserved_subdomains
+        WHERE user_id = ?
+        ORDER BY created_at ASC, id ASC
+    `, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reservations []Reservation
+	for rows.Next() {
+		var res Reservation
+		if err := rows.Scan(&res.ID, &res.UserID, &res.Subdomain, &res.CreatedAt); err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, res)
+	}
+	return reservations, rows.Err()
+}
@@ -0,0 +1,85 @@
+package subdomain
+
+import (
+	"testing"
+
+	testutil "github.com/jwtly10/go-tunol/internal/testutils"
+	"github.com/jwtly10/go-tunol/internal/web/user"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		subdomain string
+		wantErr   bool
+	}{
+		{name: "test valid subdomain", subdomain: "myapp", wantErr: false},
+		{name: "test valid subdomain with hyphen and numbers", subdomain: "my-app-2", wantErr: false},
+		{name: "test too short", subdomain: "ab", wantErr: true},
+		{name: "test too long", subdomain: "abcdefghijklmnopqrstuvwxyz1234567", wantErr: true},
+		{name: "test uppercase", subdomain: "MyApp", wantErr: true},
+		{name: "test invalid characters", subdomain: "my.app", wantErr: true},
+		{name: "test leading hyphen", subdomain: "-myapp", wantErr: true},
+		{name: "test trailing hyphen", subdomain: "myapp-", wantErr: true},
+		{name: "test reserved", subdomain: "www", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.subdomain)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate(%q) error = %v, wantErr %v", tt.subdomain, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSubdomainRepository(t *testing.T) {
+	db, cleanup := testutil.SetupTestDB(t)
+	defer cleanup()
+
+	userRepo := user.NewUserRepository(db)
+	repo := NewSubdomainRepository(db)
+
+	owner, err := userRepo.CreateUser(&user.User{Provider: "github", ProviderUserID: "1", Username: "owner"})
+	require.NoError(t, err)
+	other, err := userRepo.CreateUser(&user.User{Provider: "github", ProviderUserID: "2", Username: "other"})
+	require.NoError(t, err)
+
+	// Test reserve
+	reservation, err := repo.Reserve(owner.ID, "myapp")
+	require.NoError(t, err)
+	require.Equal(t, "myapp", reservation.Subdomain)
+
+	// Test reserving again is a no-op for the owner, but rejected for others
+	_, err = repo.Reserve(owner.ID, "myapp")
+	require.NoError(t, err)
+	_, err = repo.Reserve(other.ID, "myapp")
+	require.ErrorIs(t, err, ErrTaken)
+
+	// Test invalid names are rejected
+	_, err = repo.Reserve(owner.ID, "Bad Name")
+	require.Error(t, err)
+
+	// Test the reservation limit
+	_, err = repo.Reserve(owner.ID, "myapp-2")
+	require.NoError(t, err)
+	_, err = repo.Reserve(owner.ID, "myapp-3")
+	require.NoError(t, err)
+	_, err = repo.Reserve(owner.ID, "myapp-4")
+	require.ErrorIs(t, err, ErrTooManyReserved)
+
+	reservations, err := repo.ListUserReservations(owner.ID)
+	require.NoError(t, err)
+	require.Len(t, reservations, 3)
+	require.Equal(t, "myapp", reservations[0].Subdomain)
+
+	// Test release, only by the owner
+	require.ErrorIs(t, repo.Release(other.ID, "myapp"), ErrNotReserved)
+	require.NoError(t, repo.Release(owner.ID, "myapp"))
+
+	found, err := repo.FindBySubdomain("myapp")
+	require.NoError(t, err)
+	require.Nil(t, found)
+}
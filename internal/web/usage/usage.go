@@ -0,0 +1,94 @@
+package usage
+
+import (
+	"time"
+
+	"github.com/jwtly10/go-tunol/internal/db"
+)
+
+// dayFormat is how days are stored, so usage can be aggregated per day
+const dayFormat = "2006-01-02"
+
+// Summary is the aggregated usage of a day or a tunnel
+type Summary struct {
+	Key      string // The day or tunnel id the usage is grouped by
+	Requests int64
+	Errors   int64
+	BytesIn  int64
+	BytesOut int64
+}
+
+// ErrorRate returns the percentage of requests that failed
+func (s Summary) ErrorRate() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	return 100 * float64(s.Errors) / float64(s.Requests)
+}
+
+type Repository struct {
+	db *db.Database
+}
+
+func NewUsageRepository(db *db.Database) *Repository {
+	return &Repository{db: db}
+}
+
+// Record adds a single proxied request to the usage of the tunnel for today
+func (r *Repository) Record(userID int64, tunnelID string, bytesIn, bytesOut int, failed bool) error {
+	errorCount := 0
+	if failed {
+		errorCount = 1
+	}
+
+	_, err := r.db.Exec(`
+        INSERT INTO tunnel_usage (user_id, tunnel_id, day, request_count, error_count, bytes_in, bytes_out)
+        VALUES (?, ?, ?, 1, ?, ?, ?)
+        ON CONFLICT (user_id, tunnel_id, day) DO UPDATE SET
+            request_count = tunnel_usage.request_count + 1,
+            error_count = tunnel_usage.error_count + excluded.error_count,
+            bytes_in = tunnel_usage.bytes_in + excluded.bytes_in,
+            bytes_out = tunnel_usage.bytes_out + excluded.bytes_out
+    `, userID, tunnelID, time.Now().UTC().Format(dayFormat), errorCount, bytesIn, bytesOut)
+	return err
+}
+
+// ListDaily returns the users total usage for each day since the given time, newest first
+func (r *Repository) ListDaily(userID int64, since time.Time) ([]Summary, error) {
+	return r.list(`
+        SELECT day, SUM(request_count), SUM(error_count), SUM(bytes_in), SUM(bytes_out)
+        FROM tunnel_usage
+        WHERE user_id = ? AND day >= ?
+        GROUP BY day
+        ORDER BY day DESC
+    `, userID, since)
+}
+
+// ListByTunnel returns the users usage of each tunnel since the given time, busiest first
+func (r *Repository) ListByTunnel(userID int64, since time.Time) ([]Summary, error) {
+	return r.list(`
+        SELECT tunnel_id, SUM(request_count), SUM(error_count), SUM(bytes_in), SUM(bytes_out)
+        FROM tunnel_usage
+        WHERE user_id = ? AND day >= ?
+        GROUP BY tunnel_id
+        ORDER BY SUM(request_count) DESC, tunnel_id ASC
+    `, userID, since)
+}
+
+func (r *Repository) list(query string, userID int64, since time.Time) ([]Summary, error) {
+	rows, err := r.db.Query(query, userID, since.UTC().Format(dayFormat))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var summaries []Summary
+	for rows.Next() {
+		var s Summary
+		if err := rows.Scan(&s.Key, &s.Requests, &s.Errors, &s.BytesIn, &s.BytesOut); err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, s)
+	}
+	return summaries, rows.Err()
+}
@@ -0,0 +1,50 @@
+package usage
+
+import (
+	"testing"
+	"time"
+
+	testutil "github.com/jwtly10/go-tunol/internal/testutils"
+	"github.com/jwtly10/go-tunol/internal/web/user"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsageRepository(t *testing.T) {
+	db, cleanup := testutil.SetupTestDB(t)
+	defer cleanup()
+
+	userRepo := user.NewUserRepository(db)
+	repo := NewUsageRepository(db)
+
+	owner, err := userRepo.CreateUser(&user.User{Provider: "github", ProviderUserID: "1", Username: "owner"})
+	require.NoError(t, err)
+	other, err := userRepo.CreateUser(&user.User{Provider: "github", ProviderUserID: "2", Username: "other"})
+	require.NoError(t, err)
+
+	require.NoError(t, repo.Record(owner.ID, "myapp", 10, 100, false))
+	require.NoError(t, repo.Record(owner.ID, "myapp", 20, 200, true))
+	require.NoError(t, repo.Record(owner.ID, "other-app", 5, 50, false))
+	require.NoError(t, repo.Record(other.ID, "myapp", 1, 1, false))
+
+	weekAgo := time.Now().AddDate(0, 0, -7)
+
+	// Test usage is aggregated per tunnel
+	tunnels, err := repo.ListByTunnel(owner.ID, weekAgo)
+	require.NoError(t, err)
+	require.Len(t, tunnels, 2)
+	require.Equal(t, Summary{Key: "myapp", Requests: 2, Errors: 1, BytesIn: 30, BytesOut: 300}, tunnels[0])
+	require.Equal(t, 50.0, tunnels[0].ErrorRate())
+	require.Equal(t, "other-app", tunnels[1].Key)
+
+	// Test usage is aggregated per day, and only for the user
+	days, err := repo.ListDaily(owner.ID, weekAgo)
+	require.NoError(t, err)
+	require.Len(t, days, 1)
+	require.Equal(t, int64(3), days[0].Requests)
+	require.Equal(t, time.Now().UTC().Format(dayFormat), days[0].Key)
+
+	// Test usage before the since date is excluded
+	days, err = repo.ListDaily(owner.ID, time.Now().AddDate(0, 0, 1))
+	require.NoError(t, err)
+	require.Empty(t, days)
+}
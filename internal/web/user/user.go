@@ -8,13 +8,14 @@ import (
 )
 
 type User struct {
-	ID              int64
-	GithubID        int64
-	GithubUsername  string
-	GithubAvatarURL string
-	GithubEmail     string
-	CreatedAt       time.Time
-	LastLogin       *time.Time // May be nil if never logged in
+	ID             int64
+	Provider       string // The OAuth provider the user signs in with, e.g. github
+	ProviderUserID string // The id of the user with their provider
+	Username       string
+	AvatarURL      string
+	Email          string
+	CreatedAt      time.Time
+	LastLogin      *time.Time // May be nil if never logged in
 }
 
 type Repository struct {
@@ -25,46 +26,55 @@ func NewUserRepository(db *db.Database) *Repository {
 	return &Repository{db: db}
 }
 
-func (r *Repository) CreateUser(user *User) (*User, error) {
-	result, err := r.db.Exec(`
-        INSERT INTO users (github_id, github_username, github_avatar_url, github_email, created_at)
-        VALUES (?, ?, ?, ?, ?)
-    `, user.GithubID, user.GithubUsername, user.GithubAvatarURL, user.GithubEmail, time.Now())
+const userColumns = "id, provider, provider_user_id, username, avatar_url, email, created_at, last_login"
 
+func scanUser(row *sql.Row) (*User, error) {
+	user := &User{}
+	err := row.Scan(
+		&user.ID,
+		&user.Provider,
+		&user.ProviderUserID,
+		&user.Username,
+		&user.AvatarURL,
+		&user.Email,
+		&user.CreatedAt,
+		&user.LastLogin,
+	)
 	if err != nil {
 		return nil, err
 	}
+	return user, nil
+}
+
+func (r *Repository) CreateUser(user *User) (*User, error) {
+	return createUser(r.db, user)
+}
+
+// CreateUserTx creates the user in the transaction, for when other rows must be created with it
+func (r *Repository) CreateUserTx(tx *db.Tx, user *User) (*User, error) {
+	return createUser(tx, user)
+}
+
+func createUser(q db.Querier, user *User) (*User, error) {
+	id, err := q.Insert(`
+        INSERT INTO users (provider, provider_user_id, username, avatar_url, email, created_at)
+        VALUES (?, ?, ?, ?, ?, ?)
+    `, user.Provider, user.ProviderUserID, user.Username, user.AvatarURL, user.Email, time.Now())
 
-	id, err := result.LastInsertId()
 	if err != nil {
 		return nil, err
 	}
 
 	// Just query this insert worked so we are certain we have all the latest data when returning and checking sessions
-	var created User
-	err = r.db.QueryRow(`
-        SELECT id, github_id, github_username, github_avatar_url, github_email, created_at, last_login
+	return scanUser(q.QueryRow(`
+        SELECT `+userColumns+`
         FROM users 
         WHERE id = ?
-    `, id).Scan(
-		&created.ID,
-		&created.GithubID,
-		&created.GithubUsername,
-		&created.GithubAvatarURL,
-		&created.GithubEmail,
-		&created.CreatedAt,
-		&created.LastLogin,
-	)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return &created, nil
+    `, id))
 }
 
 func (r *Repository) CreateOrUpdateUser(user *User) (*User, error) {
-	existing, err := r.FindByGithubID(user.GithubID)
+	existing, err := r.FindByProviderID(user.Provider, user.ProviderUserID)
 	if err != nil {
 		return nil, err
 	}
@@ -75,52 +85,29 @@ func (r *Repository) CreateOrUpdateUser(user *User) (*User, error) {
 
 	_, err = r.db.Exec(`
 		UPDATE users
-		SET github_username = ?, github_avatar_url = ?, github_email = ?, last_login = ?
-		WHERE github_id = ?
-	`, user.GithubUsername, user.GithubAvatarURL, user.GithubEmail, time.Now(), user.GithubID)
+		SET username = ?, avatar_url = ?, email = ?, last_login = ?
+		WHERE provider = ? AND provider_user_id = ?
+	`, user.Username, user.AvatarURL, user.Email, time.Now(), user.Provider, user.ProviderUserID)
 
 	if err != nil {
 		return nil, err
 	}
 
 	// Just query this insert worked so we are certain we have all the latest data when returning and checking sessions
-	var updated User
-	err = r.db.QueryRow(`
-        SELECT id, github_id, github_username, github_avatar_url, github_email, created_at, last_login
+	return scanUser(r.db.QueryRow(`
+        SELECT `+userColumns+`
         FROM users 
-        WHERE github_id = ?
-    `, user.GithubID).Scan(
-		&updated.ID,
-		&updated.GithubID,
-		&updated.GithubUsername,
-		&updated.GithubAvatarURL,
-		&updated.GithubEmail,
-		&updated.CreatedAt,
-		&updated.LastLogin,
-	)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return &updated, nil
+        WHERE provider = ? AND provider_user_id = ?
+    `, user.Provider, user.ProviderUserID))
 }
 
-func (r *Repository) FindByGithubID(githubID int64) (*User, error) {
-	user := &User{}
-	err := r.db.QueryRow(`
-        SELECT id, github_id, github_username, github_avatar_url, github_email, created_at, last_login
+// FindByProviderID finds the user with the given id at their OAuth provider
+func (r *Repository) FindByProviderID(provider, providerUserID string) (*User, error) {
+	user, err := scanUser(r.db.QueryRow(`
+        SELECT `+userColumns+`
         FROM users
-        WHERE github_id = ?
-    `, githubID).Scan(
-		&user.ID,
-		&user.GithubID,
-		&user.GithubUsername,
-		&user.GithubAvatarURL,
-		&user.GithubEmail,
-		&user.CreatedAt,
-		&user.LastLogin,
-	)
+        WHERE provider = ? AND provider_user_id = ?
+    `, provider, providerUserID))
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	}
@@ -128,20 +115,11 @@ func (r *Repository) FindByGithubID(githubID int64) (*User, error) {
 }
 
 func (r *Repository) FindByID(userId int64) (*User, error) {
-	user := &User{}
-	err := r.db.QueryRow(`
-		SELECT id, github_id, github_username, github_avatar_url, github_email, created_at, last_login
+	user, err := scanUser(r.db.QueryRow(`
+		SELECT `+userColumns+`
 		FROM users
 		WHERE id = ?
-	`, userId).Scan(
-		&user.ID,
-		&user.GithubID,
-		&user.GithubUsername,
-		&user.GithubAvatarURL,
-		&user.GithubEmail,
-		&user.CreatedAt,
-		&user.LastLogin,
-	)
+	`, userId))
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	}
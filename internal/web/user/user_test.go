@@ -14,9 +14,10 @@ func TestUserRepository(t *testing.T) {
 	repo := NewUserRepository(db)
 
 	user := &User{
-		GithubID:       12345,
-		GithubUsername: "testuser",
-		GithubEmail:    "test@example.com",
+		Provider:       "github",
+		ProviderUserID: "12345",
+		Username:       "testuser",
+		Email:          "test@example.com",
 	}
 
 	// Test user create
@@ -25,14 +26,14 @@ func TestUserRepository(t *testing.T) {
 	// The id is auto-incremented, so we should set it to 1, since it's the first user in this test
 	require.Equal(t, int64(1), user.ID)
 
-	// Test finding user by GitHub ID
-	found, err := repo.FindByGithubID(user.GithubID)
+	// Test finding user by their GitHub ID
+	found, err := repo.FindByProviderID("github", user.ProviderUserID)
 	require.NoError(t, err)
 	require.NotNil(t, found)
-	require.Equal(t, user.GithubUsername, found.GithubUsername)
+	require.Equal(t, user.Username, found.Username)
 
 	// Test non-existent user
-	notFound, err := repo.FindByGithubID(99999)
+	notFound, err := repo.FindByProviderID("github", "99999")
 	require.NoError(t, err)
 	require.Nil(t, notFound)
 }